@@ -0,0 +1,209 @@
+// Package client is a Go client for jj-server.
+//
+//	c := client.New("127.0.0.1:9999", client.Options{})
+//	defer c.Close()
+//	err := c.DocSetValue(ctx, "user:1", user)
+//	name, err := c.Get(ctx, "user:1", "name")
+//
+// A Client is safe for concurrent use; every call borrows a connection from
+// the pool and gives it back once the reply is read.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"jj/resp"
+)
+
+var (
+	// ErrNil is returned when the key or the path doesn't exist
+	ErrNil = errors.New("jj: nil reply")
+	// ErrClosed is returned after Close
+	ErrClosed = errors.New("jj: client is closed")
+)
+
+// Error is an error reply of the server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+type Options struct {
+	PoolSize    int           // idle connections kept, 10 by default
+	DialTimeout time.Duration // 5s by default
+	// Timeout bounds every call that has no earlier context deadline, 0
+	// means no limit
+	Timeout time.Duration
+	// Username and Password authenticate every connection, none if the
+	// password is empty; no username is the default user
+	Username string
+	Password string
+	// TLSConfig dials the server with TLS, none if nil. Certificates set
+	// in it authenticate the client to servers that ask for one.
+	TLSConfig *tls.Config
+}
+
+type Client struct {
+	opts Options
+	pool *pool
+}
+
+func New(addr string, opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	c := &Client{
+		opts: opts,
+		pool: &pool{addr: addr, size: opts.PoolSize},
+	}
+	c.pool.dialer.Timeout = opts.DialTimeout
+	c.pool.tlsConfig = opts.TLSConfig
+	switch {
+	case opts.Password == "":
+	case opts.Username == "":
+		c.pool.auth = command("auth", opts.Password)
+	default:
+		c.pool.auth = command("auth", opts.Username, opts.Password)
+	}
+	return c
+}
+
+// Close closes the idle connections, calls in flight finish normally
+func (c *Client) Close() error {
+	c.pool.close()
+	return nil
+}
+
+// command builds a request, args are strings, byte slices, integers,
+// floats or bools
+func command(args ...interface{}) *resp.Resp {
+	r := &resp.Resp{Type: resp.MultiResp}
+	for _, a := range args {
+		var b []byte
+		switch v := a.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = []byte(strconv.Itoa(v))
+		case int64:
+			b = []byte(strconv.FormatInt(v, 10))
+		case uint64:
+			b = []byte(strconv.FormatUint(v, 10))
+		case float64:
+			b = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			b = []byte("0")
+			if v {
+				b = []byte("1")
+			}
+		default:
+			b = []byte(fmt.Sprint(v))
+		}
+		if b == nil {
+			b = []byte{}
+		}
+		r.Multi = append(r.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: b})
+	}
+	return r
+}
+
+// Do runs any command and returns the raw reply. Error replies are returned
+// as Error.
+func (c *Client) Do(ctx context.Context, args ...interface{}) (*resp.Resp, error) {
+	return c.do(ctx, c.opts.Timeout, command(args...))
+}
+
+func (c *Client) do(ctx context.Context, timeout time.Duration, req *resp.Resp) (*resp.Resp, error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.pool.put(cn)
+	replies, err := cn.roundTrip(ctx, timeout, req)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], replyErr(replies[0])
+}
+
+func replyErr(r *resp.Resp) error {
+	if r.Type == resp.ErrorResp {
+		return Error(r.Error)
+	}
+	return nil
+}
+
+func okReply(r *resp.Resp, err error) error {
+	if err != nil {
+		return err
+	}
+	if r.Type != resp.SimpleString {
+		return fmt.Errorf("jj: unexpected reply type %d", r.Type)
+	}
+	return nil
+}
+
+func bytesReply(r *resp.Resp, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case resp.BulkResp:
+		if r.Bulk == nil {
+			return nil, ErrNil
+		}
+		return r.Bulk, nil
+	case resp.SimpleString:
+		return []byte(r.Status), nil
+	}
+	return nil, fmt.Errorf("jj: unexpected reply type %d", r.Type)
+}
+
+func intReply(r *resp.Resp, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch r.Type {
+	case resp.IntegerResp:
+		return r.Integer, nil
+	case resp.BulkResp:
+		if r.Bulk == nil {
+			return 0, ErrNil
+		}
+		return strconv.ParseInt(string(r.Bulk), 10, 64)
+	}
+	return 0, fmt.Errorf("jj: unexpected reply type %d", r.Type)
+}
+
+func floatReply(r *resp.Resp, err error) (float64, error) {
+	b, err := bytesReply(r, err)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func stringsReply(r *resp.Resp, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	if r.Type != resp.MultiResp {
+		return nil, fmt.Errorf("jj: unexpected reply type %d", r.Type)
+	}
+	ret := make([]string, 0, len(r.Multi))
+	for _, m := range r.Multi {
+		ret = append(ret, string(m.Bulk))
+	}
+	return ret, nil
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"jj/server"
+)
+
+var (
+	srvOnce sync.Once
+	srvAddr string
+)
+
+func newClient(t *testing.T) *Client {
+	srvOnce.Do(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srvAddr = l.Addr().String()
+		l.Close()
+		go server.NewServer(srvAddr).Run()
+	})
+	c := New(srvAddr, Options{PoolSize: 2, Timeout: 2 * time.Second})
+	for i := 0; c.Ping(context.Background()) != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return c
+}
+
+type user struct {
+	Name string   `json:"name"`
+	Age  int      `json:"age"`
+	Tags []string `json:"tags"`
+}
+
+func TestCommands(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.DocSetValue(ctx, "cu:1", user{Name: "ann", Age: 30, Tags: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Incr(ctx, "cu:1", "age", 2); err != nil {
+		t.Error(err)
+	}
+	if err := c.PushValue(ctx, "cu:1", "tags", "a"); err != nil {
+		t.Error(err)
+	}
+	var u user
+	if err := c.DocGetValue(ctx, "cu:1", &u); err != nil || u.Age != 32 || len(u.Tags) != 1 {
+		t.Error("doc", u, err)
+	}
+	var name string
+	if err := c.GetValue(ctx, "cu:1", "name", &name); err != nil || name != "ann" {
+		t.Error("get", name, err)
+	}
+	if _, err := c.DocGet(ctx, "cu:missing"); err != ErrNil {
+		t.Error("missing doc", err)
+	}
+	if _, ok := c.Set(ctx, "cu:1", "age", []byte("{bad")).(Error); !ok {
+		t.Error("error reply")
+	}
+
+	c.DocSet(ctx, "cu:2", []byte(`{"name":"bob"}`))
+	vals, err := c.MGet(ctx, "name", "cu:1", "cu:3", "cu:2")
+	if err != nil || len(vals) != 3 || string(vals[0]) != `"ann"` || vals[1] != nil || string(vals[2]) != `"bob"` {
+		t.Error("mget", vals, err)
+	}
+
+	n := 0
+	for cursor := 0; ; {
+		next, keys, err := c.Scan(ctx, cursor, "cu:*", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(keys)
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Error("scan", n)
+	}
+
+	if err := c.IndexCreate(ctx, "cu-age", "sorted", "cu:", "age"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetValue(ctx, "cu:2", "age", 20)
+	if r, err := c.ZRangeWithScores(ctx, "cu-age", 0, -1); err != nil || len(r) != 2 || r[0].Key != "cu:2" || r[1].Score != 32 {
+		t.Error("zrange", r, err)
+	}
+	if r, err := c.ZRank(ctx, "cu-age", "cu:1"); err != nil || r != 1 {
+		t.Error("zrank", r, err)
+	}
+
+	if err := c.DocDel(ctx, "cu:2"); err != nil {
+		t.Error(err)
+	}
+	if _, err := c.Get(ctx, "cu:2", "name"); err != ErrNil {
+		t.Error("deleted", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx := context.Background()
+
+	p := c.Pipeline()
+	p.Do("jdocset", "pl:1", `{"n":1}`)
+	p.Do("jincr", "pl:1", "n", 41)
+	get := p.Do("jget", "pl:1", "n")
+	bad := p.Do("jget", "pl:1")
+	if err := p.Exec(ctx); err == nil {
+		t.Error("the error reply should be returned")
+	}
+	var n int
+	if err := get.Unmarshal(&n); err != nil || n != 42 {
+		t.Error("pipelined get", n, err)
+	}
+	if _, ok := bad.Err().(Error); !ok {
+		t.Error("bad command", bad.Err())
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, _, err := c.BPop(ctx, 0, "to:1", "list"); err != context.DeadlineExceeded {
+		t.Error("deadline", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("blocked too long")
+	}
+
+	if _, _, _, err := c.BPop(context.Background(), 50*time.Millisecond, "to:1", "list"); err != ErrNil {
+		t.Error("bjpop timeout", err)
+	}
+
+	// the pool still works after a cancelled call
+	c.DocSet(context.Background(), "to:1", []byte(`{"list":[]}`))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Push(context.Background(), "to:1", "list", []byte("7"))
+	}()
+	key, _, val, err := c.BPop(context.Background(), time.Second, "to:1", "list")
+	if err != nil || key != "to:1" || string(val) != "7" {
+		t.Error("bjpop", key, val, err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ps, err := c.Subscribe(ctx, "news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	if m, err := ps.Receive(ctx); err != nil || m.Kind != "subscribe" || m.Count != 1 {
+		t.Fatal("subscribe", m, err)
+	}
+	cs, err := c.WatchStream(ctx, "ws:", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	if n, err := c.Publish(ctx, "news", []byte("hi")); err != nil || n != 1 {
+		t.Error("publish", n, err)
+	}
+	if m, err := ps.Receive(ctx); err != nil || m.Kind != "message" || string(m.Payload) != "hi" {
+		t.Error("message", m, err)
+	}
+
+	c.DocSet(ctx, "ws:1", []byte(`{"a":1}`))
+	if ch, err := cs.Next(ctx); err != nil || ch.Key != "ws:1" || ch.Seq != cs.Seq {
+		t.Error("change", ch, err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	c := newClient(t)
+	defer c.Close()
+	ctx := context.Background()
+	if _, err := c.Do(ctx, "acl", "setuser", "app", "on", ">pw", "~app:*", "+@read", "+@write"); err != nil {
+		t.Fatal(err)
+	}
+
+	app := New(srvAddr, Options{Username: "app", Password: "pw"})
+	defer app.Close()
+	if err := app.DocSet(ctx, "app:1", []byte(`{}`)); err != nil {
+		t.Error(err)
+	}
+	if err := app.DocSet(ctx, "other", []byte(`{}`)); err == nil {
+		t.Error("key out of the user patterns")
+	}
+
+	bad := New(srvAddr, Options{Username: "app", Password: "nope"})
+	defer bad.Close()
+	if err := bad.Ping(ctx); err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Error("wrong password", err)
+	}
+}
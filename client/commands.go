@@ -0,0 +1,324 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"jj/resp"
+)
+
+func (c *Client) Ping(ctx context.Context) error {
+	return okReply(c.Do(ctx, "ping"))
+}
+
+// DocSet stores the JSON document doc at key
+func (c *Client) DocSet(ctx context.Context, key string, doc []byte) error {
+	return okReply(c.Do(ctx, "jdocset", key, doc))
+}
+
+// DocGet returns the document at key, or ErrNil
+func (c *Client) DocGet(ctx context.Context, key string) ([]byte, error) {
+	return bytesReply(c.Do(ctx, "jdocget", key))
+}
+
+func (c *Client) DocDel(ctx context.Context, key string) error {
+	return okReply(c.Do(ctx, "jdocdel", key))
+}
+
+// Set stores the JSON value val at path in the document at key
+func (c *Client) Set(ctx context.Context, key string, path string, val []byte) error {
+	return okReply(c.Do(ctx, "jset", key, path, val))
+}
+
+// Get returns the JSON value at path in the document at key, or ErrNil
+func (c *Client) Get(ctx context.Context, key string, path string) ([]byte, error) {
+	return bytesReply(c.Do(ctx, "jget", key, path))
+}
+
+// MGet returns the value at path for every key, nil where it is missing
+func (c *Client) MGet(ctx context.Context, path string, keys ...string) ([][]byte, error) {
+	args := []interface{}{"jmget", path}
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	r, err := c.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, 0, len(r.Multi))
+	for _, m := range r.Multi {
+		ret = append(ret, m.Bulk)
+	}
+	return ret, nil
+}
+
+func (c *Client) Incr(ctx context.Context, key string, path string, n int64) error {
+	return okReply(c.Do(ctx, "jincr", key, path, n))
+}
+
+// Push appends the JSON value val to the array at path
+func (c *Client) Push(ctx context.Context, key string, path string, val []byte) error {
+	return okReply(c.Do(ctx, "jpush", key, path, val))
+}
+
+// Pop removes and returns the first item of the array at path
+func (c *Client) Pop(ctx context.Context, key string, path string) ([]byte, error) {
+	return bytesReply(c.Do(ctx, "jpop", key, path))
+}
+
+// BPop pops from the first non empty array of keyPaths, given as key, path
+// pairs, waiting up to timeout for one, 0 waits forever. It returns ErrNil
+// on timeout.
+func (c *Client) BPop(ctx context.Context, timeout time.Duration, keyPaths ...string) (key string, path string, val []byte, err error) {
+	if len(keyPaths) == 0 || len(keyPaths)%2 != 0 {
+		return "", "", nil, errors.New("jj: BPop takes key, path pairs")
+	}
+	args := []interface{}{"bjpop"}
+	for _, kp := range keyPaths {
+		args = append(args, kp)
+	}
+	args = append(args, timeout.Seconds())
+
+	// the connection may stay quiet for the whole timeout
+	connTimeout := time.Duration(0)
+	if timeout > 0 && c.opts.Timeout > 0 {
+		connTimeout = timeout + c.opts.Timeout
+	}
+	r, err := c.do(ctx, connTimeout, command(args...))
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(r.Multi) != 3 {
+		return "", "", nil, ErrNil
+	}
+	return string(r.Multi[0].Bulk), string(r.Multi[1].Bulk), r.Multi[2].Bulk, nil
+}
+
+// Scan returns keys matching pattern from cursor on, and the cursor of the
+// next call, 0 once all keys were returned. An empty pattern matches all.
+func (c *Client) Scan(ctx context.Context, cursor int, pattern string, count int) (int, []string, error) {
+	args := []interface{}{"scan", cursor}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	r, err := c.Do(ctx, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(r.Multi) != 2 {
+		return 0, nil, errors.New("jj: invalid scan reply")
+	}
+	next, err := strconv.Atoi(string(r.Multi[0].Bulk))
+	if err != nil {
+		return 0, nil, err
+	}
+	keys, err := stringsReply(r.Multi[1], nil)
+	return next, keys, err
+}
+
+// Publish sends msg on channel and returns the number of receivers
+func (c *Client) Publish(ctx context.Context, channel string, msg []byte) (int64, error) {
+	return intReply(c.Do(ctx, "publish", channel, msg))
+}
+
+// IndexCreate creates an index on the documents whose key starts with
+// prefix, typ is sorted, geo or vector and args follow the prefix
+func (c *Client) IndexCreate(ctx context.Context, name string, typ string, prefix string, args ...string) error {
+	cmd := []interface{}{"jindex", "create", name, typ, prefix}
+	for _, a := range args {
+		cmd = append(cmd, a)
+	}
+	return okReply(c.Do(ctx, cmd...))
+}
+
+func (c *Client) IndexDrop(ctx context.Context, name string) error {
+	return okReply(c.Do(ctx, "jindex", "drop", name))
+}
+
+// IndexList returns the definition of every index
+func (c *Client) IndexList(ctx context.Context) ([][]string, error) {
+	r, err := c.Do(ctx, "jindex", "list")
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]string
+	for _, m := range r.Multi {
+		info, err := stringsReply(m, nil)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info)
+	}
+	return ret, nil
+}
+
+// ScoredKey is a key of a sorted or vector index with its score
+type ScoredKey struct {
+	Key   string
+	Score float64
+}
+
+func scoredKeysReply(r *resp.Resp, err error) ([]ScoredKey, error) {
+	if err != nil {
+		return nil, err
+	}
+	var ret []ScoredKey
+	for i := 0; i+1 < len(r.Multi); i += 2 {
+		score, err := strconv.ParseFloat(string(r.Multi[i+1].Bulk), 64)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ScoredKey{Key: string(r.Multi[i].Bulk), Score: score})
+	}
+	return ret, nil
+}
+
+// ZRange returns the keys of a sorted index from rank start to stop,
+// negative ranks count from the end
+func (c *Client) ZRange(ctx context.Context, index string, start int, stop int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "jzrange", index, start, stop))
+}
+
+func (c *Client) ZRevRange(ctx context.Context, index string, start int, stop int) ([]string, error) {
+	return stringsReply(c.Do(ctx, "jzrevrange", index, start, stop))
+}
+
+func (c *Client) ZRangeWithScores(ctx context.Context, index string, start int, stop int) ([]ScoredKey, error) {
+	return scoredKeysReply(c.Do(ctx, "jzrange", index, start, stop, "WITHSCORES"))
+}
+
+func (c *Client) ZRevRangeWithScores(ctx context.Context, index string, start int, stop int) ([]ScoredKey, error) {
+	return scoredKeysReply(c.Do(ctx, "jzrevrange", index, start, stop, "WITHSCORES"))
+}
+
+// ZRangeByScore returns the keys scored between min and max, given like
+// "1.5", "(1.5" for exclusive, "-inf" or "+inf". A negative count returns
+// all of them after offset.
+func (c *Client) ZRangeByScore(ctx context.Context, index string, min string, max string, offset int, count int) ([]ScoredKey, error) {
+	return scoredKeysReply(c.Do(ctx, "jzrangebyscore", index, min, max, "WITHSCORES", "LIMIT", offset, count))
+}
+
+func (c *Client) ZRevRangeByScore(ctx context.Context, index string, max string, min string, offset int, count int) ([]ScoredKey, error) {
+	return scoredKeysReply(c.Do(ctx, "jzrevrangebyscore", index, max, min, "WITHSCORES", "LIMIT", offset, count))
+}
+
+// ZRank returns the rank of key in a sorted index, or ErrNil
+func (c *Client) ZRank(ctx context.Context, index string, key string) (int64, error) {
+	return intReply(c.Do(ctx, "jzrank", index, key))
+}
+
+func (c *Client) ZRevRank(ctx context.Context, index string, key string) (int64, error) {
+	return intReply(c.Do(ctx, "jzrevrank", index, key))
+}
+
+func (c *Client) ZCard(ctx context.Context, index string) (int64, error) {
+	return intReply(c.Do(ctx, "jzcard", index))
+}
+
+// GeoResult is a key of a geo index with its distance, in the unit of the
+// query, and its position
+type GeoResult struct {
+	Key  string
+	Dist float64
+	Lat  float64
+	Lon  float64
+}
+
+func geoReply(r *resp.Resp, err error) ([]GeoResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	var ret []GeoResult
+	for _, m := range r.Multi {
+		if len(m.Multi) != 3 || len(m.Multi[2].Multi) != 2 {
+			return nil, errors.New("jj: invalid geo reply")
+		}
+		g := GeoResult{Key: string(m.Multi[0].Bulk)}
+		if g.Dist, err = strconv.ParseFloat(string(m.Multi[1].Bulk), 64); err != nil {
+			return nil, err
+		}
+		if g.Lat, err = strconv.ParseFloat(string(m.Multi[2].Multi[0].Bulk), 64); err != nil {
+			return nil, err
+		}
+		if g.Lon, err = strconv.ParseFloat(string(m.Multi[2].Multi[1].Bulk), 64); err != nil {
+			return nil, err
+		}
+		ret = append(ret, g)
+	}
+	return ret, nil
+}
+
+// GeoRadius returns up to count keys, nearest first, within radius of
+// lat, lon. unit is m, km, ft or mi; count 0 returns all.
+func (c *Client) GeoRadius(ctx context.Context, index string, lat float64, lon float64, radius float64, unit string, count int) ([]GeoResult, error) {
+	args := []interface{}{"jgeoradius", index, lat, lon, radius, unit, "WITHDIST", "WITHCOORD", "ASC"}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	return geoReply(c.Do(ctx, args...))
+}
+
+// GeoBox is GeoRadius for a box of width by height centered on lat, lon
+func (c *Client) GeoBox(ctx context.Context, index string, lat float64, lon float64, width float64, height float64, unit string, count int) ([]GeoResult, error) {
+	args := []interface{}{"jgeobox", index, lat, lon, width, height, unit, "WITHDIST", "WITHCOORD", "ASC"}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+	return geoReply(c.Do(ctx, args...))
+}
+
+// GeoDist returns the distance between two keys of a geo index, or ErrNil
+func (c *Client) GeoDist(ctx context.Context, index string, key1 string, key2 string, unit string) (float64, error) {
+	return floatReply(c.Do(ctx, "jgeodist", index, key1, key2, unit))
+}
+
+// Knn returns the k keys of a vector index nearest to vector, best first
+func (c *Client) Knn(ctx context.Context, index string, k int, vector []float64) ([]ScoredKey, error) {
+	b := []byte{'['}
+	for i, f := range vector {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendFloat(b, f, 'g', -1, 64)
+	}
+	b = append(b, ']')
+	return scoredKeysReply(c.Do(ctx, "jknn", index, k, b, "WITHSCORES"))
+}
+
+// SchemaSet makes every change to documents whose key starts with prefix
+// validate against the JSON schema
+func (c *Client) SchemaSet(ctx context.Context, prefix string, schema []byte) error {
+	return okReply(c.Do(ctx, "jschema", "set", prefix, schema))
+}
+
+func (c *Client) SchemaGet(ctx context.Context, prefix string) ([]byte, error) {
+	return bytesReply(c.Do(ctx, "jschema", "get", prefix))
+}
+
+func (c *Client) SchemaDel(ctx context.Context, prefix string) error {
+	return okReply(c.Do(ctx, "jschema", "del", prefix))
+}
+
+func (c *Client) SchemaList(ctx context.Context) ([]string, error) {
+	return stringsReply(c.Do(ctx, "jschema", "list"))
+}
+
+func (c *Client) ConfigGet(ctx context.Context, param string) (string, error) {
+	r, err := c.Do(ctx, "config", "get", param)
+	if err != nil {
+		return "", err
+	}
+	if len(r.Multi) != 2 {
+		return "", ErrNil
+	}
+	return string(r.Multi[1].Bulk), nil
+}
+
+func (c *Client) ConfigSet(ctx context.Context, param string, value string) error {
+	return okReply(c.Do(ctx, "config", "set", param, value))
+}
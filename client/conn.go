@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"jj/resp"
+
+	"github.com/juju/errors"
+)
+
+// conn is one connection to a jj-server
+type conn struct {
+	c   net.Conn
+	r   *bufio.Reader
+	err error // set once the connection is broken
+}
+
+// deadline is the earliest of the context deadline and now plus timeout
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout > 0 {
+		t = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		t = d
+	}
+	return t
+}
+
+// watch makes pending reads and writes fail when ctx is done. The returned
+// func must be called once the exchange is over.
+func (cn *conn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cn.c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// write sends the requests without waiting for the replies
+func (cn *conn) write(reqs ...*resp.Resp) error {
+	var buf []byte
+	for _, req := range reqs {
+		b, err := req.Bytes()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+	}
+	if _, err := cn.c.Write(buf); err != nil {
+		cn.err = err
+		return err
+	}
+	return nil
+}
+
+func (cn *conn) read() (*resp.Resp, error) {
+	r, err := resp.Parse(cn.r)
+	if err != nil {
+		cn.err = err
+		return nil, err
+	}
+	return r, nil
+}
+
+// roundTrip sends reqs in one write and reads as many replies
+func (cn *conn) roundTrip(ctx context.Context, timeout time.Duration, reqs ...*resp.Resp) ([]*resp.Resp, error) {
+	cn.c.SetDeadline(deadline(ctx, timeout))
+	stop := cn.watch(ctx)
+	defer stop()
+
+	if err := cn.write(reqs...); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	replies := make([]*resp.Resp, 0, len(reqs))
+	for range reqs {
+		r, err := cn.read()
+		if err != nil {
+			return nil, ctxErr(ctx, err)
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// ctxErr prefers the context error over the network error it caused. The
+// connection deadline may expire just before the context timer fires.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ne, ok := errors.Cause(err).(net.Error); ok && ne.Timeout() {
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
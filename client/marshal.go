@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// DocSetValue stores v, marshaled to JSON, as the document at key
+func (c *Client) DocSetValue(ctx context.Context, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.DocSet(ctx, key, b)
+}
+
+// DocGetValue unmarshals the document at key into v
+func (c *Client) DocGetValue(ctx context.Context, key string, v interface{}) error {
+	b, err := c.DocGet(ctx, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// SetValue stores v, marshaled to JSON, at path
+func (c *Client) SetValue(ctx context.Context, key string, path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Set(ctx, key, path, b)
+}
+
+// GetValue unmarshals the value at path into v
+func (c *Client) GetValue(ctx context.Context, key string, path string, v interface{}) error {
+	b, err := c.Get(ctx, key, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// PushValue appends v, marshaled to JSON, to the array at path
+func (c *Client) PushValue(ctx context.Context, key string, path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Push(ctx, key, path, b)
+}
+
+// PopValue removes the first item of the array at path and unmarshals it
+// into v
+func (c *Client) PopValue(ctx context.Context, key string, path string, v interface{}) error {
+	b, err := c.Pop(ctx, key, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"jj/resp"
+)
+
+// Cmd is a command queued in a Pipeline, its reply is set by Exec
+type Cmd struct {
+	req   *resp.Resp
+	reply *resp.Resp
+	err   error
+}
+
+func (cmd *Cmd) Reply() (*resp.Resp, error) {
+	return cmd.reply, cmd.err
+}
+
+func (cmd *Cmd) Err() error {
+	return cmd.err
+}
+
+func (cmd *Cmd) Bytes() ([]byte, error) {
+	return bytesReply(cmd.reply, cmd.err)
+}
+
+func (cmd *Cmd) Int() (int64, error) {
+	return intReply(cmd.reply, cmd.err)
+}
+
+func (cmd *Cmd) Strings() ([]string, error) {
+	return stringsReply(cmd.reply, cmd.err)
+}
+
+// Unmarshal decodes a JSON reply into v
+func (cmd *Cmd) Unmarshal(v interface{}) error {
+	b, err := cmd.Bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Pipeline sends queued commands in one write and reads all the replies
+// on the same connection.
+//
+//	p := c.Pipeline()
+//	a := p.Do("jget", "user:1", "name")
+//	b := p.Do("jget", "user:2", "name")
+//	err := p.Exec(ctx)
+type Pipeline struct {
+	c    *Client
+	cmds []*Cmd
+}
+
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Do queues a command
+func (p *Pipeline) Do(args ...interface{}) *Cmd {
+	cmd := &Cmd{req: command(args...)}
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+// Exec runs the queued commands and empties the pipeline. It returns the
+// first error, error replies included; each Cmd holds its own result.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	reqs := make([]*resp.Resp, 0, len(cmds))
+	for _, cmd := range cmds {
+		reqs = append(reqs, cmd.req)
+	}
+	replies, err := p.exec(ctx, reqs)
+	if err != nil {
+		for _, cmd := range cmds {
+			cmd.err = err
+		}
+		return err
+	}
+
+	var first error
+	for i, cmd := range cmds {
+		cmd.reply = replies[i]
+		cmd.err = replyErr(replies[i])
+		if first == nil {
+			first = cmd.err
+		}
+	}
+	return first
+}
+
+func (p *Pipeline) exec(ctx context.Context, reqs []*resp.Resp) ([]*resp.Resp, error) {
+	cn, err := p.c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.c.pool.put(cn)
+	return cn.roundTrip(ctx, p.c.opts.Timeout, reqs...)
+}
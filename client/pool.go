@@ -0,0 +1,90 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"jj/resp"
+)
+
+// pool keeps up to size idle connections to the server
+type pool struct {
+	addr   string
+	dialer net.Dialer
+	size   int
+	auth   *resp.Resp // sent on new connections, nil for none
+
+	tlsConfig *tls.Config
+
+	lock   sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		cn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return cn, nil
+	}
+	p.lock.Unlock()
+
+	c, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: c, r: bufio.NewReader(c)}
+	if p.auth != nil {
+		replies, err := cn.roundTrip(ctx, p.dialer.Timeout, p.auth)
+		if err == nil {
+			err = replyErr(replies[0])
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (p *pool) dial(ctx context.Context) (net.Conn, error) {
+	if p.tlsConfig == nil {
+		return p.dialer.DialContext(ctx, "tcp", p.addr)
+	}
+	d := tls.Dialer{NetDialer: &p.dialer, Config: p.tlsConfig}
+	return d.DialContext(ctx, "tcp", p.addr)
+}
+
+// put gives cn back, broken connections and those over size are closed
+func (p *pool) put(cn *conn) {
+	if cn.err != nil {
+		cn.c.Close()
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed || len(p.idle) >= p.size {
+		cn.c.Close()
+		return
+	}
+	p.idle = append(p.idle, cn)
+}
+
+func (p *pool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	for _, cn := range p.idle {
+		cn.c.Close()
+	}
+	p.idle = nil
+}
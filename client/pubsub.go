@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"jj/resp"
+)
+
+// Message is a push of a subscribed connection. Kind is message or pmessage
+// for published messages, and subscribe, psubscribe, unsubscribe or
+// punsubscribe with the subscription count in Count.
+type Message struct {
+	Kind    string
+	Pattern string // pmessage only
+	Channel string
+	Payload []byte
+	Count   int64
+}
+
+// PubSub is a connection in subscribe mode, it is not pooled
+type PubSub struct {
+	cn *conn
+}
+
+func (c *Client) subscribe(ctx context.Context, op string, names []string) (*PubSub, error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PubSub{cn: cn}
+	if err := ps.send(ctx, op, names); err != nil {
+		ps.Close()
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Subscribe opens a connection subscribed to channels
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "subscribe", channels)
+}
+
+// PSubscribe opens a connection subscribed to patterns
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*PubSub, error) {
+	return c.subscribe(ctx, "psubscribe", patterns)
+}
+
+func (ps *PubSub) send(ctx context.Context, op string, names []string) error {
+	args := []interface{}{op}
+	for _, n := range names {
+		args = append(args, n)
+	}
+	ps.cn.c.SetWriteDeadline(deadline(ctx, 0))
+	stop := ps.cn.watch(ctx)
+	defer stop()
+	return ctxErr(ctx, ps.cn.write(command(args...)))
+}
+
+func (ps *PubSub) Subscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "subscribe", channels)
+}
+
+func (ps *PubSub) PSubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "psubscribe", patterns)
+}
+
+func (ps *PubSub) Unsubscribe(ctx context.Context, channels ...string) error {
+	return ps.send(ctx, "unsubscribe", channels)
+}
+
+func (ps *PubSub) PUnsubscribe(ctx context.Context, patterns ...string) error {
+	return ps.send(ctx, "punsubscribe", patterns)
+}
+
+// Receive waits for the next push
+func (ps *PubSub) Receive(ctx context.Context) (*Message, error) {
+	r, err := receive(ctx, ps.cn)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Multi) < 3 {
+		return nil, errors.New("jj: invalid push message")
+	}
+	m := &Message{Kind: strings.ToLower(string(r.Multi[0].Bulk))}
+	switch {
+	case m.Kind == "message":
+		m.Channel, m.Payload = string(r.Multi[1].Bulk), r.Multi[2].Bulk
+	case m.Kind == "pmessage" && len(r.Multi) == 4:
+		m.Pattern, m.Channel, m.Payload = string(r.Multi[1].Bulk), string(r.Multi[2].Bulk), r.Multi[3].Bulk
+	default:
+		m.Channel, m.Count = string(r.Multi[1].Bulk), r.Multi[2].Integer
+	}
+	return m, nil
+}
+
+func (ps *PubSub) Close() error {
+	return ps.cn.c.Close()
+}
+
+// receive reads one push, waiting as long as ctx allows
+func receive(ctx context.Context, cn *conn) (*resp.Resp, error) {
+	cn.c.SetReadDeadline(deadline(ctx, 0))
+	stop := cn.watch(ctx)
+	defer stop()
+	r, err := cn.read()
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if err := replyErr(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Change is a mutation reported by a change stream
+type Change struct {
+	Seq   uint64
+	Key   string
+	Path  string
+	Op    string
+	Value []byte // new value, nil when deleted
+}
+
+// ChangeStream is a connection following jwatchstream, it is not pooled
+type ChangeStream struct {
+	cn  *conn
+	Seq uint64 // sequence the stream started from
+}
+
+// WatchStream follows the changes of the documents whose key starts with
+// prefix. A from of 0 starts with the next change, otherwise from the given
+// sequence if it is still retained.
+func (c *Client) WatchStream(ctx context.Context, prefix string, from uint64) (*ChangeStream, error) {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := []interface{}{"jwatchstream", prefix}
+	if from > 0 {
+		args = append(args, "FROM", from)
+	}
+	cs := &ChangeStream{cn: cn}
+	replies, err := cn.roundTrip(ctx, 0, command(args...))
+	if err == nil {
+		if err = replyErr(replies[0]); err == nil && len(replies[0].Multi) != 3 {
+			err = errors.New("jj: invalid jwatchstream reply")
+		}
+	}
+	if err != nil {
+		cs.Close()
+		return nil, err
+	}
+	cs.Seq = uint64(replies[0].Multi[2].Integer)
+	return cs, nil
+}
+
+// Next waits for the next change
+func (cs *ChangeStream) Next(ctx context.Context) (*Change, error) {
+	r, err := receive(ctx, cs.cn)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Multi) != 6 {
+		return nil, errors.New("jj: invalid change message")
+	}
+	return &Change{
+		Seq:   uint64(r.Multi[1].Integer),
+		Key:   string(r.Multi[2].Bulk),
+		Path:  string(r.Multi[3].Bulk),
+		Op:    string(r.Multi[4].Bulk),
+		Value: r.Multi[5].Bulk,
+	}, nil
+}
+
+func (cs *ChangeStream) Close() error {
+	return cs.cn.c.Close()
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/server"
+)
+
+// writeCert writes a certificate for name signed by ca, self-signed if ca
+// is nil, and returns it with its key
+func writeCert(t *testing.T, dir string, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		ca, caKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	file := func(name string) string { return filepath.Join(dir, name) }
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "app", ca, caKey)
+
+	s := server.NewServer("")
+	err := s.ListenTLS("127.0.0.1:0", server.TLSOptions{
+		CertFile:    file("server.crt"),
+		KeyFile:     file("server.key"),
+		CAFile:      file("ca.crt"),
+		AuthClients: "optional",
+		CertUser:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Run()
+	addr := s.TLSAddr().String()
+	ctx := context.Background()
+
+	conf, err := LoadTLSConfig(file("ca.crt"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := New(addr, Options{TLSConfig: conf, Timeout: 2 * time.Second})
+	defer admin.Close()
+	for _, args := range [][]interface{}{
+		{"acl", "setuser", "app", "on", "~app:*", "+@all"},
+		{"acl", "setuser", "default", "resetpass", ">admin"},
+	} {
+		if _, err := admin.Do(ctx, args...); err != nil {
+			t.Fatal(args, err)
+		}
+	}
+
+	conf, err = LoadTLSConfig(file("ca.crt"), file("app.crt"), file("app.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := New(addr, Options{TLSConfig: conf, Timeout: 2 * time.Second})
+	defer app.Close()
+	if r, err := app.Do(ctx, "acl", "whoami"); err != nil || string(r.Bulk) != "app" {
+		t.Error("certificate user", r, err)
+	}
+
+	anon := New(addr, Options{TLSConfig: &tls.Config{RootCAs: conf.RootCAs}, Timeout: 2 * time.Second})
+	defer anon.Close()
+	if err := anon.Ping(ctx); err == nil || !strings.HasPrefix(err.Error(), "NOAUTH") {
+		t.Error("no certificate", err)
+	}
+	untrusted := New(addr, Options{TLSConfig: &tls.Config{}, Timeout: 2 * time.Second})
+	defer untrusted.Close()
+	if err := untrusted.Ping(ctx); err == nil {
+		t.Error("unknown server certificate")
+	}
+	plain := New(addr, Options{Timeout: time.Second})
+	defer plain.Close()
+	if err := plain.Ping(ctx); err == nil {
+		t.Error("plain connection to the TLS listener")
+	}
+
+	// without a CA of its own, any public CA could name a user
+	err = server.NewServer("").ListenTLS("127.0.0.1:0", server.TLSOptions{
+		CertFile:    file("server.crt"),
+		KeyFile:     file("server.key"),
+		AuthClients: "yes",
+		CertUser:    true,
+	})
+	if err == nil {
+		t.Error("certificate users without a CA")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jj/client"
+)
+
+type config struct {
+	addr     string
+	clients  int
+	requests int
+	duration time.Duration
+	pipeline int
+	docSize  int
+	keys     int
+	mix      []weightedOp
+	preload  bool
+}
+
+// worker results, merged at the end
+type result struct {
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func main() {
+	cfg := config{}
+	var mix string
+	flag.StringVar(&cfg.addr, "addr", "127.0.0.1:9999", "server address")
+	flag.IntVar(&cfg.clients, "c", 50, "concurrent clients")
+	flag.IntVar(&cfg.requests, "n", 100000, "total requests")
+	flag.DurationVar(&cfg.duration, "duration", 0, "run for this long instead of -n requests")
+	flag.IntVar(&cfg.pipeline, "P", 1, "requests pipelined per round trip")
+	flag.IntVar(&cfg.docSize, "d", 100, "document size in bytes")
+	flag.IntVar(&cfg.keys, "r", 10000, "number of distinct keys")
+	flag.StringVar(&mix, "mix", "jget:50,jset:20,jincr:10,jpush:10,jpop:10", "op:weight list of "+strings.Join(opNames(), ", "))
+	flag.BoolVar(&cfg.preload, "preload", true, "store every key before the run")
+	flag.Parse()
+
+	var err error
+	if cfg.mix, err = parseMix(mix); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if cfg.clients <= 0 || cfg.pipeline <= 0 || cfg.keys <= 0 || cfg.docSize < 0 {
+		fmt.Fprintln(os.Stderr, "-c, -P and -r must be positive")
+		os.Exit(2)
+	}
+
+	c := client.New(cfg.addr, client.Options{PoolSize: cfg.clients, Timeout: 10 * time.Second})
+	defer c.Close()
+	if cfg.preload {
+		start := time.Now()
+		if err := preload(c, &cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "preload:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("preloaded %d keys in %v\n", cfg.keys, time.Since(start).Round(time.Millisecond))
+	}
+
+	start := time.Now()
+	results := run(c, &cfg)
+	report(os.Stdout, &cfg, results, time.Since(start))
+}
+
+// preload stores one document per key
+func preload(c *client.Client, cfg *config) error {
+	ctx := context.Background()
+	doc := makeDoc(cfg.docSize)
+	p := c.Pipeline()
+	for i := 0; i < cfg.keys; i++ {
+		p.Do("jdocset", keyName(i), doc)
+		if (i+1)%1000 == 0 || i == cfg.keys-1 {
+			if err := p.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run drives the clients until the requests are done or the time is over
+func run(c *client.Client, cfg *config) []*result {
+	var remaining int64 = int64(cfg.requests)
+	deadline := time.Time{}
+	if cfg.duration > 0 {
+		deadline = time.Now().Add(cfg.duration)
+	}
+
+	// take returns how many requests the next round trip sends
+	take := func() int {
+		if !deadline.IsZero() {
+			if time.Now().After(deadline) {
+				return 0
+			}
+			return cfg.pipeline
+		}
+		n := atomic.AddInt64(&remaining, -int64(cfg.pipeline))
+		if n < 0 {
+			return int(int64(cfg.pipeline) + n)
+		}
+		return cfg.pipeline
+	}
+
+	results := make([]*result, cfg.clients)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.clients; w++ {
+		res := &result{latencies: make(map[string][]time.Duration), errors: make(map[string]int)}
+		results[w] = res
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			worker(c, cfg, rand.New(rand.NewSource(seed)), take, res)
+		}(int64(w) + time.Now().UnixNano())
+	}
+	wg.Wait()
+	return results
+}
+
+func worker(c *client.Client, cfg *config, rnd *rand.Rand, take func() int, res *result) {
+	ctx := context.Background()
+	doc := makeDoc(cfg.docSize)
+	ops := make([]string, 0, cfg.pipeline)
+	cmds := make([]*client.Cmd, 0, cfg.pipeline)
+	for {
+		n := take()
+		if n <= 0 {
+			return
+		}
+		p := c.Pipeline()
+		ops, cmds = ops[:0], cmds[:0]
+		for i := 0; i < n; i++ {
+			op := pickOp(cfg.mix, rnd)
+			ops = append(ops, op.name)
+			cmds = append(cmds, p.Do(op.args(keyName(rnd.Intn(cfg.keys)), doc, rnd)...))
+		}
+		start := time.Now()
+		p.Exec(ctx)
+		elapsed := time.Since(start)
+		for i, cmd := range cmds {
+			// an empty list to pop from is not a failure
+			if err := cmd.Err(); err != nil && err != client.ErrNil {
+				res.errors[ops[i]]++
+				continue
+			}
+			res.latencies[ops[i]] = append(res.latencies[ops[i]], elapsed)
+		}
+	}
+}
+
+func keyName(i int) string {
+	return "bench:" + strconv.Itoa(i)
+}
+
+// makeDoc builds a document of about size bytes
+func makeDoc(size int) string {
+	doc := `{"n":0,"list":[],"pad":""}`
+	if pad := size - len(doc); pad > 0 {
+		doc = `{"n":0,"list":[],"pad":"` + strings.Repeat("x", pad) + `"}`
+	}
+	return doc
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func report(w io.Writer, cfg *config, results []*result, elapsed time.Duration) {
+	latencies := make(map[string][]time.Duration)
+	errors := make(map[string]int)
+	var all []time.Duration
+	for _, res := range results {
+		for op, l := range res.latencies {
+			latencies[op] = append(latencies[op], l...)
+			all = append(all, l...)
+		}
+		for op, n := range res.errors {
+			errors[op] += n
+		}
+	}
+
+	fmt.Fprintf(w, "%d clients, pipeline %d, %d byte documents, %d keys, %v\n\n",
+		cfg.clients, cfg.pipeline, cfg.docSize, cfg.keys, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-8s %10s %8s %12s %9s %9s %9s %9s %9s\n",
+		"op", "requests", "errors", "req/s", "p50 ms", "p90 ms", "p99 ms", "p99.9 ms", "max ms")
+
+	line := func(name string, l []time.Duration, errs int) {
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%-8s %10d %8d %12.0f %9.3f %9.3f %9.3f %9.3f %9.3f\n",
+			name, len(l), errs, float64(len(l))/elapsed.Seconds(),
+			ms(percentile(l, 50)), ms(percentile(l, 90)), ms(percentile(l, 99)), ms(percentile(l, 99.9)), ms(percentile(l, 100)))
+	}
+	total := 0
+	for _, op := range cfg.mix {
+		line(op.name, latencies[op.name], errors[op.name])
+		total += errors[op.name]
+	}
+	line("total", all, total)
+}
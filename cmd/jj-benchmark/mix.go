@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// benchOps build the arguments of each command for a key
+var benchOps = map[string]func(key string, doc string, rnd *rand.Rand) []interface{}{
+	"jdocset": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jdocset", key, doc}
+	},
+	"jdocget": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jdocget", key}
+	},
+	"jget": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jget", key, "n"}
+	},
+	"jset": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jset", key, "n", rnd.Intn(1000000)}
+	},
+	"jincr": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jincr", key, "n", 1}
+	},
+	"jpush": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jpush", key, "list", rnd.Intn(1000000)}
+	},
+	"jpop": func(key string, doc string, rnd *rand.Rand) []interface{} {
+		return []interface{}{"jpop", key, "list"}
+	},
+}
+
+func opNames() []string {
+	var names []string
+	for name := range benchOps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type weightedOp struct {
+	name   string
+	weight int
+	args   func(key string, doc string, rnd *rand.Rand) []interface{}
+}
+
+// parseMix reads a list like jget:50,jset:20,jincr
+func parseMix(s string) ([]weightedOp, error) {
+	var mix []weightedOp
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weight := part, 1
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			var err error
+			name = part[:i]
+			if weight, err = strconv.Atoi(part[i+1:]); err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight in %q", part)
+			}
+		}
+		args, ok := benchOps[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown op %q, use one of %s", name, strings.Join(opNames(), ", "))
+		}
+		if weight > 0 {
+			mix = append(mix, weightedOp{name: strings.ToLower(name), weight: weight, args: args})
+		}
+	}
+	if len(mix) == 0 {
+		return nil, fmt.Errorf("empty mix")
+	}
+	return mix, nil
+}
+
+func pickOp(mix []weightedOp, rnd *rand.Rand) *weightedOp {
+	total := 0
+	for _, op := range mix {
+		total += op.weight
+	}
+	n := rnd.Intn(total)
+	for i := range mix {
+		if n < mix[i].weight {
+			return &mix[i]
+		}
+		n -= mix[i].weight
+	}
+	return &mix[len(mix)-1]
+}
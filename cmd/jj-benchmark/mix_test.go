@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := parseMix("jget:3, jset ,jincr:0")
+	if err != nil || len(mix) != 2 || mix[0].weight != 3 || mix[1].name != "jset" || mix[1].weight != 1 {
+		t.Error(mix, err)
+	}
+	for _, s := range []string{"", "jget:x", "jfoo:1", "jget:0"} {
+		if _, err := parseMix(s); err == nil {
+			t.Error("should fail:", s)
+		}
+	}
+
+	counts := make(map[string]int)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		counts[pickOp(mix, rnd).name]++
+	}
+	if counts["jget"] < 2700 || counts["jget"] > 3300 {
+		t.Error("weights", counts)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var l []time.Duration
+	for i := 1; i <= 1000; i++ {
+		l = append(l, time.Duration(i))
+	}
+	if percentile(l, 50) != 500 || percentile(l, 99.9) != 999 || percentile(l, 100) != 1000 || percentile(nil, 50) != 0 {
+		t.Error(percentile(l, 50), percentile(l, 99.9), percentile(l, 100))
+	}
+}
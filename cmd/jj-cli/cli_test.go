@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"jj/resp"
+)
+
+func TestSplitLine(t *testing.T) {
+	for line, want := range map[string]string{
+		`jdocset a {"b": [1, "x y"], "c": "}"}`: `jdocset|a|{"b": [1, "x y"], "c": "}"}`,
+		`jset a b "x \"y\"\n"`:                  "jset|a|b|x \"y\"\n",
+		`jset a b 'it''s'`:                      "jset|a|b|it|s",
+		`  ping  `:                              "ping",
+		`jpush a b [1,[2]] tail`:                "jpush|a|b|[1,[2]]|tail",
+	} {
+		args, err := splitLine(line)
+		if err != nil || strings.Join(args, "|") != want {
+			t.Errorf("%s: %q %v", line, args, err)
+		}
+	}
+	for _, line := range []string{`jset a "b`, `jdocset a {"b": 1`, `ping 'x`} {
+		if _, err := splitLine(line); err == nil {
+			t.Error("should fail:", line)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	for _, c := range []struct {
+		line, want string
+	}{
+		{"jdocg", "jdocget "},
+		{"jz", "jz"},
+		{"jzrevrangeb", "jzrevrangebyscore "},
+		{"cluster sl", "cluster slots "},
+		{"jindex ", "jindex "},
+		{"JDOCG", "jdocget "},
+	} {
+		got, pos, ok := complete(c.line, len(c.line))
+		if c.line == c.want {
+			if ok && got != c.want {
+				t.Error(c.line, got)
+			}
+			continue
+		}
+		if !ok || got != c.want || pos != len(c.want) {
+			t.Errorf("%q: %q %d %v", c.line, got, pos, ok)
+		}
+	}
+	if _, _, ok := complete("jget a", 6); ok {
+		t.Error("arguments are not completed")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	f := &formatter{}
+	r := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{
+		{Type: resp.BulkResp, Bulk: []byte(`{"a":[1]}`)},
+		{Type: resp.BulkResp},
+		{Type: resp.IntegerResp, Integer: 3},
+		{Type: resp.BulkResp, Bulk: []byte("plain")},
+	}}
+	want := "1) {\n     \"a\": [\n       1\n     ]\n   }\n2) (nil)\n3) (integer) 3\n4) \"plain\""
+	if got := f.format(r); got != want {
+		t.Errorf("pretty:\n%s", got)
+	}
+
+	f.raw = true
+	if got := f.format(r); got != "{\"a\":[1]}\n\n3\nplain" {
+		t.Errorf("raw: %q", got)
+	}
+
+	f = &formatter{}
+	m := &resp.Resp{Type: resp.MapResp, Multi: []*resp.Resp{
+		{Type: resp.BulkResp, Bulk: []byte("proto")}, {Type: resp.IntegerResp, Integer: 3},
+		{Type: resp.BulkResp, Bulk: []byte("ok")}, {Type: resp.BooleanResp, Bool: true},
+		{Type: resp.BulkResp, Bulk: []byte("f")}, {Type: resp.DoubleResp, Double: 0.5},
+		{Type: resp.BulkResp, Bulk: []byte("z")}, {Type: resp.NullResp},
+	}}
+	want = "1# \"proto\" => (integer) 3\n2# \"ok\" => (true)\n3# \"f\" => (double) 0.5\n4# \"z\" => (nil)"
+	if got := f.format(m); got != want {
+		t.Errorf("map:\n%s", got)
+	}
+
+	f = &formatter{color: true}
+	if got := f.highlight([]byte(`{"k": "v", "n": -1.5}`)); !strings.Contains(got, colorKey+`"k"`) ||
+		!strings.Contains(got, colorString+`"v"`) || !strings.Contains(got, colorNumber+"-1.5") {
+		t.Errorf("highlight: %q", got)
+	}
+}
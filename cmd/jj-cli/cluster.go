@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxSlots = 1024
+
+type clusterNode struct {
+	id    string
+	addr  string
+	slots []int
+	conn  *conn
+}
+
+// clusterNodes reads the nodes and their slots from CLUSTER NODES
+func clusterNodes(seed string) ([]*clusterNode, error) {
+	c, err := dial(seed)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.do("cluster", "nodes")
+	c.close()
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*clusterNode
+	for _, line := range strings.Split(string(r.Bulk), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		n := &clusterNode{id: fields[0], addr: fields[1]}
+		for _, f := range fields[8:] {
+			if strings.HasPrefix(f, "[") {
+				return nil, fmt.Errorf("slot %s of %s is migrating, fix it first", f, n.addr)
+			}
+			bounds := strings.SplitN(f, "-", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, err
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, err
+				}
+			}
+			for i := start; i <= end; i++ {
+				n.slots = append(n.slots, i)
+			}
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// migrateSlot moves slot and its documents from src to dst while both keep
+// serving it: dst imports, src migrates and answers ASK for the keys that
+// left, then dst and src take the new owner.
+func migrateSlot(src *clusterNode, dst *clusterNode, slot int, batch int, timeout int) error {
+	s := strconv.Itoa(slot)
+	if _, err := dst.conn.do("cluster", "setslot", s, "importing", src.id); err != nil {
+		return err
+	}
+	if _, err := src.conn.do("cluster", "setslot", s, "migrating", dst.id); err != nil {
+		return err
+	}
+
+	host, port, _ := net.SplitHostPort(dst.addr)
+	for {
+		r, err := src.conn.do("cluster", "getkeysinslot", s, strconv.Itoa(batch))
+		if err != nil {
+			return err
+		}
+		if len(r.Multi) == 0 {
+			break
+		}
+		args := []string{"jmigrate", host, port, strconv.Itoa(timeout)}
+		for _, k := range r.Multi {
+			args = append(args, string(k.Bulk))
+		}
+		if _, err := src.conn.do(args...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := dst.conn.do("cluster", "setslot", s, "node", dst.id); err != nil {
+		return err
+	}
+	_, err := src.conn.do("cluster", "setslot", s, "node", dst.id)
+	return err
+}
+
+// rebalance moves slots so that every node owns the same number, give or
+// take one
+func rebalance(seed string, batch int, timeout int) error {
+	nodes, err := clusterNodes(seed)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("no nodes")
+	}
+	assigned := 0
+	for _, n := range nodes {
+		assigned += len(n.slots)
+		if n.conn, err = dial(n.addr); err != nil {
+			return err
+		}
+		defer n.conn.close()
+	}
+	if assigned < maxSlots {
+		fmt.Printf("%d slots are not assigned, they are left alone\n", maxSlots-assigned)
+	}
+
+	// the nodes with the most slots keep the remainder, to move less
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return len(nodes[i].slots) > len(nodes[j].slots)
+	})
+	want := make(map[*clusterNode]int)
+	for i, n := range nodes {
+		want[n] = assigned / len(nodes)
+		if i < assigned%len(nodes) {
+			want[n]++
+		}
+	}
+
+	var surplus []int
+	var from []*clusterNode
+	for _, n := range nodes {
+		for len(n.slots) > want[n] {
+			surplus = append(surplus, n.slots[len(n.slots)-1])
+			from = append(from, n)
+			n.slots = n.slots[:len(n.slots)-1]
+		}
+	}
+	moved := 0
+	for _, n := range nodes {
+		for len(n.slots) < want[n] {
+			slot, src := surplus[0], from[0]
+			surplus, from = surplus[1:], from[1:]
+			fmt.Printf("moving slot %d from %s to %s\n", slot, src.addr, n.addr)
+			if err := migrateSlot(src, n, slot, batch, timeout); err != nil {
+				return fmt.Errorf("slot %d: %v", slot, err)
+			}
+			n.slots = append(n.slots, slot)
+			moved++
+		}
+	}
+	fmt.Printf("moved %d slots\n", moved)
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type cmdHelp struct {
+	name string
+	args string
+	subs []string // subcommands completed after the name
+}
+
+var cmdHelps = []cmdHelp{
+	{name: "jdocset", args: "key doc"},
+	{name: "jdocget", args: "key"},
+	{name: "jdocdel", args: "key"},
+	{name: "jmget", args: "path key [key ...]"},
+	{name: "jset", args: "key path value"},
+	{name: "jget", args: "key path"},
+	{name: "jincr", args: "key path integer"},
+	{name: "jpush", args: "key path value"},
+	{name: "jpop", args: "key path"},
+	{name: "bjpop", args: "key path [key path ...] timeout"},
+	{name: "scan", args: "cursor [MATCH pattern] [COUNT count]"},
+	{name: "jindex", args: "create|drop|list ...", subs: []string{"create", "drop", "list"}},
+	{name: "jzrange", args: "index start stop [WITHSCORES]"},
+	{name: "jzrevrange", args: "index start stop [WITHSCORES]"},
+	{name: "jzrangebyscore", args: "index min max [WITHSCORES] [LIMIT offset count]"},
+	{name: "jzrevrangebyscore", args: "index max min [WITHSCORES] [LIMIT offset count]"},
+	{name: "jzrank", args: "index key"},
+	{name: "jzrevrank", args: "index key"},
+	{name: "jzcard", args: "index"},
+	{name: "jgeoradius", args: "index lat lon radius m|km|ft|mi [WITHDIST] [WITHCOORD] [COUNT n] [ASC|DESC]"},
+	{name: "jgeobox", args: "index lat lon width height m|km|ft|mi [WITHDIST] [WITHCOORD] [COUNT n] [ASC|DESC]"},
+	{name: "jgeodist", args: "index key1 key2 [m|km|ft|mi]"},
+	{name: "jknn", args: "index k vector [EF n] [WITHSCORES]"},
+	{name: "jschema", args: "set|get|del|list ...", subs: []string{"set", "get", "del", "list"}},
+	{name: "subscribe", args: "channel [channel ...]"},
+	{name: "psubscribe", args: "pattern [pattern ...]"},
+	{name: "publish", args: "channel message"},
+	{name: "jwatchstream", args: "prefix [FROM seq]"},
+	{name: "ping", args: "[message]"},
+	{name: "hello", args: "[2|3] [AUTH username password] [SETNAME name]"},
+	{name: "auth", args: "[username] password"},
+	{name: "acl", args: "setuser|getuser|deluser|list|users|whoami|load|save ...", subs: []string{
+		"deluser", "getuser", "list", "load", "save", "setuser", "users", "whoami",
+	}},
+	{name: "client", args: "id | getname | setname name | json [native|string]", subs: []string{"id", "getname", "setname", "json"}},
+	{name: "config", args: "get pattern | set param value | rewrite", subs: []string{"get", "rewrite", "set"}},
+	{name: "save"},
+	{name: "bgsave"},
+	{name: "lastsave"},
+	{name: "shutdown", args: "[SAVE|NOSAVE]", subs: []string{"nosave", "save"}},
+	{name: "replicaof", args: "host port | no one"},
+	{name: "role"},
+	{name: "cluster", args: "subcommand ...", subs: []string{
+		"addslots", "addslotsrange", "countkeysinslot", "delslots", "delslotsrange",
+		"getkeysinslot", "info", "keyslot", "meet", "myid", "nodes", "setslot", "slots",
+	}},
+	{name: "asking"},
+	{name: "jmigrate", args: "host port timeout-ms key [key ...]"},
+	{name: "jrestore", args: "key doc [REPLACE]"},
+	{name: "help", args: "[command]"},
+	{name: "quit"},
+}
+
+// streamCmds keep sending messages after their reply
+var streamCmds = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"jwatchstream": true,
+}
+
+func findHelp(name string) *cmdHelp {
+	for i := range cmdHelps {
+		if cmdHelps[i].name == strings.ToLower(name) {
+			return &cmdHelps[i]
+		}
+	}
+	return nil
+}
+
+// help lists the commands, or the syntax of one
+func help(args []string) string {
+	var lines []string
+	for _, h := range cmdHelps {
+		if len(args) > 0 && h.name != strings.ToLower(args[0]) {
+			continue
+		}
+		lines = append(lines, strings.TrimSpace(h.name+" "+h.args))
+	}
+	if len(lines) == 0 {
+		return "unknown command " + args[0]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// complete completes the word before pos, the command name or the
+// subcommand after it
+func complete(line string, pos int) (string, int, bool) {
+	head := line[:pos]
+	words := strings.Fields(head)
+	endsWord := len(head) > 0 && head[len(head)-1] != ' '
+
+	var candidates []string
+	var word string
+	switch {
+	case len(words) == 0 || (len(words) == 1 && endsWord):
+		if len(words) == 1 {
+			word = words[0]
+		}
+		for _, h := range cmdHelps {
+			candidates = append(candidates, h.name)
+		}
+	case len(words) == 1 || (len(words) == 2 && endsWord):
+		h := findHelp(words[0])
+		if h == nil {
+			return "", 0, false
+		}
+		if len(words) == 2 {
+			word = words[1]
+		}
+		candidates = h.subs
+	default:
+		return "", 0, false
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, strings.ToLower(word)) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+	completed := commonPrefix(matches)
+	if len(matches) == 1 {
+		completed += " "
+	}
+	newHead := head[:len(head)-len(word)] + completed
+	return newHead + line[pos:], len(newHead), true
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"jj/resp"
+)
+
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+// auth is the AUTH command sent on every connection, nil for none
+var auth []string
+
+// tlsConfig dials with TLS, nil for plain connections
+var tlsConfig *tls.Config
+
+func dial(addr string) (*conn, error) {
+	var c net.Conn
+	var err error
+	if tlsConfig != nil {
+		c, err = tls.Dial("tcp", addr, tlsConfig)
+	} else {
+		c, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: c, r: bufio.NewReader(c)}
+	if auth != nil {
+		if _, err := cn.do(auth...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// call sends a command and returns the reply, error replies included
+func (c *conn) call(args ...string) (*resp.Resp, error) {
+	r := &resp.Resp{Type: resp.MultiResp}
+	for _, a := range args {
+		r.Multi = append(r.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(a)})
+	}
+	b, _ := r.Bytes()
+	if _, err := c.c.Write(b); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read waits for the next reply or push message
+func (c *conn) read() (*resp.Resp, error) {
+	return resp.Parse(c.r)
+}
+
+// do is call with error replies returned as errors
+func (c *conn) do(args ...string) (*resp.Resp, error) {
+	ret, err := c.call(args...)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Type == resp.ErrorResp {
+		return nil, errors.New(ret.Error)
+	}
+	return ret, nil
+}
+
+func (c *conn) close() {
+	c.c.Close()
+}
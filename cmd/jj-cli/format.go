@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"jj/resp"
+)
+
+// ANSI colors of the JSON tokens
+const (
+	colorReset   = "\x1b[0m"
+	colorKey     = "\x1b[34;1m"
+	colorString  = "\x1b[32m"
+	colorNumber  = "\x1b[33m"
+	colorLiteral = "\x1b[35m"
+	colorError   = "\x1b[31m"
+)
+
+type formatter struct {
+	raw   bool // print values as they are, one per line
+	color bool
+}
+
+// format renders a reply like redis-cli does, with JSON values indented
+func (f *formatter) format(r *resp.Resp) string {
+	if f.raw {
+		return f.formatRaw(r)
+	}
+	return f.formatPretty(r, "")
+}
+
+func (f *formatter) formatRaw(r *resp.Resp) string {
+	switch r.Type {
+	case resp.ErrorResp:
+		return r.Error
+	case resp.SimpleString:
+		return r.Status
+	case resp.IntegerResp:
+		return strconv.FormatInt(r.Integer, 10)
+	case resp.BulkResp, resp.VerbatimResp:
+		return string(r.Bulk)
+	case resp.NullResp:
+		return ""
+	case resp.DoubleResp:
+		return strconv.FormatFloat(r.Double, 'g', -1, 64)
+	case resp.BooleanResp:
+		return strconv.FormatBool(r.Bool)
+	}
+	var lines []string
+	for _, m := range r.Multi {
+		lines = append(lines, f.formatRaw(m))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (f *formatter) formatPretty(r *resp.Resp, indent string) string {
+	switch r.Type {
+	case resp.ErrorResp:
+		return f.paint(colorError, "(error) "+r.Error)
+	case resp.SimpleString:
+		return r.Status
+	case resp.IntegerResp:
+		return "(integer) " + strconv.FormatInt(r.Integer, 10)
+	case resp.BulkResp:
+		if r.Bulk == nil {
+			return "(nil)"
+		}
+		return f.formatBulk(r.Bulk, indent)
+	case resp.NullResp:
+		return "(nil)"
+	case resp.DoubleResp:
+		return "(double) " + strconv.FormatFloat(r.Double, 'g', -1, 64)
+	case resp.BooleanResp:
+		return "(" + strconv.FormatBool(r.Bool) + ")"
+	case resp.VerbatimResp:
+		return string(r.Bulk)
+	case resp.MapResp:
+		return f.formatMap(r, indent)
+	}
+
+	if r.Multi == nil {
+		return "(nil)"
+	}
+	if len(r.Multi) == 0 {
+		return "(empty array)"
+	}
+	width := len(strconv.Itoa(len(r.Multi)))
+	var b strings.Builder
+	for i, m := range r.Multi {
+		prefix := fmt.Sprintf("%*d) ", width, i+1)
+		if i > 0 {
+			b.WriteString("\n" + indent)
+		}
+		b.WriteString(prefix)
+		b.WriteString(f.formatPretty(m, indent+strings.Repeat(" ", len(prefix))))
+	}
+	return b.String()
+}
+
+// formatMap prints the pairs of a RESP3 map as "1# key => value"
+func (f *formatter) formatMap(r *resp.Resp, indent string) string {
+	if len(r.Multi) == 0 {
+		return "(empty hash)"
+	}
+	n := len(r.Multi) / 2
+	width := len(strconv.Itoa(n))
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString("\n" + indent)
+		}
+		prefix := fmt.Sprintf("%*d# ", width, i+1)
+		key := f.formatPretty(r.Multi[2*i], indent+strings.Repeat(" ", len(prefix)))
+		b.WriteString(prefix + key + " => ")
+		b.WriteString(f.formatPretty(r.Multi[2*i+1], indent+strings.Repeat(" ", len(prefix)+4)))
+	}
+	return b.String()
+}
+
+// formatBulk indents JSON objects and arrays, other values are quoted
+func (f *formatter) formatBulk(b []byte, indent string) string {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		var buf bytes.Buffer
+		json.Indent(&buf, trimmed, indent, "  ")
+		return f.highlight(buf.Bytes())
+	}
+	if json.Valid(trimmed) {
+		return f.highlight(trimmed)
+	}
+	return strconv.Quote(string(b))
+}
+
+func (f *formatter) paint(color string, s string) string {
+	if !f.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// highlight colors the tokens of valid JSON
+func (f *formatter) highlight(b []byte) string {
+	if !f.color {
+		return string(b)
+	}
+	var out strings.Builder
+	for i := 0; i < len(b); {
+		c := b[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for j < len(b) && b[j] != '"' {
+				if b[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j++
+			if j > len(b) {
+				j = len(b)
+			}
+			color := colorString
+			if isKey(b[j:]) {
+				color = colorKey
+			}
+			out.WriteString(f.paint(color, string(b[i:j])))
+			i = j
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(b) && strings.IndexByte("0123456789.eE+-", b[j]) >= 0 {
+				j++
+			}
+			out.WriteString(f.paint(colorNumber, string(b[i:j])))
+			i = j
+		case c == 't' || c == 'f' || c == 'n':
+			j := i + 1
+			for j < len(b) && b[j] >= 'a' && b[j] <= 'z' {
+				j++
+			}
+			out.WriteString(f.paint(colorLiteral, string(b[i:j])))
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
+// isKey tells if the string before rest is an object key
+func isKey(rest []byte) bool {
+	rest = bytes.TrimLeft(rest, " \t\r\n")
+	return len(rest) > 0 && rest[0] == ':'
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"jj/client"
+
+	"golang.org/x/term"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage:
+  jj-cli [options]                        interactive shell
+  jj-cli [options] command [arg ...]      run one command
+  jj-cli [options] < commands.txt         run one command per line
+  jj-cli cluster rebalance [-batch n] [-timeout ms] <host:port>
+
+options:
+`)
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, `
+JSON arguments need no quoting: jdocset user:1 {"name": "ann"}
+Load a document from a file: jj-cli -x jdocset user:1 < user.json
+`)
+	os.Exit(2)
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9999", "server address")
+	follow := flag.Bool("c", false, "follow cluster redirections")
+	raw := flag.Bool("raw", false, "print replies as they are, the default when stdout is not a terminal")
+	pretty := flag.Bool("pretty", false, "indent JSON replies even when stdout is not a terminal")
+	noColor := flag.Bool("no-color", false, "don't highlight JSON replies")
+	stdinArg := flag.Bool("x", false, "read the last argument from stdin")
+	user := flag.String("user", "", "user to authenticate as")
+	pass := flag.String("pass", "", "password to authenticate with, none if empty")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caCert := flag.String("cacert", "", "CA certificate verifying the server, the system roots if empty")
+	cert := flag.String("cert", "", "client certificate, for servers that ask for one")
+	key := flag.String("key", "", "private key of the client certificate")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+
+	switch {
+	case *pass == "":
+	case *user == "":
+		auth = []string{"auth", *pass}
+	default:
+		auth = []string{"auth", *user, *pass}
+	}
+	if *useTLS {
+		conf, err := client.LoadTLSConfig(*caCert, *cert, *key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		tlsConfig = conf
+	}
+
+	if len(args) >= 2 && args[0] == "cluster" && args[1] == "rebalance" {
+		clusterRebalance(args[2:])
+		return
+	}
+
+	outTerm := term.IsTerminal(int(os.Stdout.Fd()))
+	s := &session{
+		addr:   *addr,
+		follow: *follow,
+		fmt: &formatter{
+			raw:   *raw || (!outTerm && !*pretty),
+			color: outTerm && !*noColor,
+		},
+		out: os.Stdout,
+	}
+
+	if *stdinArg {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		args = append(args, strings.TrimSuffix(string(b), "\n"))
+	}
+
+	switch {
+	case len(args) > 0:
+		if !s.exec(args) {
+			os.Exit(1)
+		}
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		if err := s.repl(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		if s.script(os.Stdin) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+func clusterRebalance(args []string) {
+	fs := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	batch := fs.Int("batch", 100, "keys moved per jmigrate")
+	timeout := fs.Int("timeout", 5000, "jmigrate timeout in milliseconds")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	if err := rebalance(fs.Arg(0), *batch, *timeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"jj/resp"
+
+	"golang.org/x/term"
+)
+
+// session runs commands on one server, following cluster redirections if
+// asked to
+type session struct {
+	addr   string
+	c      *conn
+	follow bool
+	fmt    *formatter
+	out    io.Writer
+
+	// interrupt, if set, returns a channel closed when the user wants a
+	// stream to stop
+	interrupt func() <-chan struct{}
+}
+
+func (s *session) connect() error {
+	if s.c != nil {
+		s.c.close()
+		s.c = nil
+	}
+	c, err := dial(s.addr)
+	if err != nil {
+		return err
+	}
+	s.c = c
+	return nil
+}
+
+func (s *session) printf(format string, args ...interface{}) {
+	fmt.Fprintf(s.out, format, args...)
+}
+
+// run sends a command and returns its reply, reconnecting once if the
+// connection was lost
+func (s *session) run(args []string) (*resp.Resp, error) {
+	if s.c == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	r, err := s.c.call(args...)
+	if err != nil {
+		if err = s.connect(); err != nil {
+			return nil, err
+		}
+		if r, err = s.c.call(args...); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; s.follow && i < 5 && r.Type == resp.ErrorResp; i++ {
+		fields := strings.Fields(r.Error)
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			break
+		}
+		s.printf("-> Redirected to slot [%s] located at %s\n", fields[1], fields[2])
+		if fields[0] == "ASK" {
+			// only this command goes to the importing node
+			if r, err = ask(fields[2], args); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s.addr = fields[2]
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+		if r, err = s.c.call(args...); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func ask(addr string, args []string) (*resp.Resp, error) {
+	c, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	if _, err := c.call("asking"); err != nil {
+		return nil, err
+	}
+	return c.call(args...)
+}
+
+// exec runs one line, local commands included. It returns false on an
+// error reply.
+func (s *session) exec(args []string) bool {
+	switch strings.ToLower(args[0]) {
+	case "help":
+		s.printf("%s\n", help(args[1:]))
+		return true
+	case "shutdown":
+		return s.shutdown(args)
+	}
+
+	r, err := s.run(args)
+	if err != nil {
+		s.printf("%s\n", s.fmt.paint(colorError, err.Error()))
+		s.c = nil
+		return false
+	}
+	s.printf("%s\n", s.fmt.format(r))
+	if r.Type == resp.ErrorResp {
+		return false
+	}
+	if streamCmds[strings.ToLower(args[0])] {
+		s.stream()
+	}
+	return true
+}
+
+// shutdown sends SHUTDOWN once, never again on a new connection, and
+// takes the connection closing without a reply for success
+func (s *session) shutdown(args []string) bool {
+	if s.c == nil {
+		if err := s.connect(); err != nil {
+			s.printf("%s\n", s.fmt.paint(colorError, err.Error()))
+			return false
+		}
+	}
+	r, err := s.c.call(args...)
+	if err != nil {
+		s.c = nil
+		if oe, ok := err.(*net.OpError); ok && oe.Op == "write" {
+			s.printf("%s\n", s.fmt.paint(colorError, err.Error()))
+			return false
+		}
+		return true
+	}
+	s.printf("%s\n", s.fmt.format(r))
+	return r.Type != resp.ErrorResp
+}
+
+// stream prints the messages pushed on the connection until it closes or
+// the user interrupts it. The connection is dropped afterwards.
+func (s *session) stream() {
+	var stop <-chan struct{}
+	if s.interrupt != nil {
+		stop = s.interrupt()
+	}
+	c := s.c
+	s.c = nil
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			r, err := c.read()
+			if err != nil {
+				return
+			}
+			s.printf("%s\n", s.fmt.format(r))
+		}
+	}()
+	select {
+	case <-done:
+		if stop != nil {
+			// stdin is read until Ctrl-C, the terminal can't have it before
+			s.printf("(connection closed, press Ctrl-C)\n")
+			<-stop
+		}
+	case <-stop:
+		c.close()
+		<-done
+	}
+}
+
+// repl reads commands from the terminal with history and completion
+func (s *session) repl() error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	if w, h, err := term.GetSize(fd); err == nil && w > 0 {
+		t.SetSize(w, h)
+	}
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return complete(line, pos)
+	}
+	s.out = t
+	s.interrupt = interrupted
+
+	for {
+		t.SetPrompt(s.addr + "> ")
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		args, err := splitLine(line)
+		if err != nil {
+			s.printf("%s\n", s.fmt.paint(colorError, err.Error()))
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if cmd := strings.ToLower(args[0]); cmd == "quit" || cmd == "exit" {
+			return nil
+		}
+		if streamCmds[strings.ToLower(args[0])] {
+			s.printf("(press Ctrl-C to stop)\n")
+		}
+		s.exec(args)
+	}
+}
+
+// interrupted returns a channel closed once Ctrl-C is typed. The terminal is
+// in raw mode, so the keys are read by hand, only while a stream runs.
+func interrupted() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		b := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(b)
+			if err != nil || strings.ContainsAny(string(b[:n]), "\x03\x04") {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// script runs one command per line of r and returns the number of
+// commands that failed
+func (s *session) script(r io.Reader) int {
+	failed := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		args, err := splitLine(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !s.exec(args) {
+			failed++
+		}
+	}
+	return failed
+}
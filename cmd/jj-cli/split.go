@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	errUnbalancedQuotes   = errors.New("unbalanced quotes")
+	errUnbalancedBrackets = errors.New("unbalanced brackets")
+)
+
+// splitLine splits a command line into arguments. Double quotes take
+// backslash escapes, single quotes are literal, and an argument starting
+// with { or [ runs to the matching bracket, so JSON needs no quoting.
+func splitLine(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"':
+			arg, n, err := doubleQuoted(line[i:])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			i += n
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnbalancedQuotes
+			}
+			args = append(args, line[i+1:i+1+end])
+			i += end + 2
+		case c == '{' || c == '[':
+			n, err := bracketed(line[i:])
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, line[i:i+n])
+			i += n
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t\r\n", rune(line[j])) {
+				j++
+			}
+			args = append(args, line[i:j])
+			i = j
+		}
+	}
+	return args, nil
+}
+
+// doubleQuoted reads a "..." argument and returns it unescaped with the
+// number of bytes read
+func doubleQuoted(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", 0, errUnbalancedQuotes
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, errUnbalancedQuotes
+}
+
+// bracketed returns the length of the JSON object or array s starts with
+func bracketed(s string) (int, error) {
+	depth := 0
+	inString := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, errUnbalancedBrackets
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"jj/proxy"
+)
+
+func main() {
+	cfg := proxy.Config{}
+	var nodes string
+	flag.StringVar(&cfg.Addr, "addr", ":19000", "address to listen on")
+	flag.StringVar(&nodes, "nodes", "127.0.0.1:9999", "comma separated cluster nodes to load the slot map from")
+	flag.IntVar(&cfg.PoolSize, "pool", 16, "idle connections kept per node")
+	flag.DurationVar(&cfg.DialTimeout, "dial-timeout", time.Second, "timeout to connect to a node")
+	flag.DurationVar(&cfg.RefreshPeriod, "refresh", 10*time.Second, "how often the slot map is reloaded")
+	flag.StringVar(&cfg.User, "user", "", "user the slot map is loaded as, clients AUTH as themselves")
+	flag.StringVar(&cfg.Password, "pass", "", "password of -user, none if empty")
+	flag.Parse()
+
+	cfg.Nodes = strings.Split(nodes, ",")
+	proxy.New(cfg).Run()
+}
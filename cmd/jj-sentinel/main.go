@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"jj/sentinel"
+)
+
+func main() {
+	cfg := sentinel.Config{}
+	var peers string
+	flag.StringVar(&cfg.Addr, "addr", ":26379", "address to listen on")
+	flag.StringVar(&cfg.Name, "name", "mymaster", "name of the monitored primary")
+	flag.StringVar(&cfg.Master, "master", "127.0.0.1:9999", "initial primary, host:port")
+	flag.IntVar(&cfg.Quorum, "quorum", 2, "sentinels that must agree the primary is down")
+	flag.StringVar(&peers, "peers", "", "comma separated addresses of the other sentinels")
+	flag.DurationVar(&cfg.DownAfter, "down-after", 5*time.Second, "time after which an unreachable primary is down")
+	flag.DurationVar(&cfg.FailoverTimeout, "failover-timeout", 30*time.Second, "time allowed for a failover")
+	flag.DurationVar(&cfg.Period, "period", time.Second, "how often nodes are checked")
+	flag.StringVar(&cfg.User, "user", "", "user to authenticate to the nodes as")
+	flag.StringVar(&cfg.Password, "pass", "", "password to authenticate to the nodes with, none if empty")
+	flag.Parse()
+
+	if peers != "" {
+		cfg.Peers = strings.Split(peers, ",")
+	}
+	sentinel.New(cfg).Run()
+}
@@ -1,10 +1,64 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
 	"jj/server"
+
+	log "github.com/ngaut/logging"
 )
 
 func main() {
 	s := server.NewServer(":9999")
+
+	// every parameter is a flag too, set ones override the config file
+	configFile := flag.String("config", "", "config file of \"parameter value\" lines, none if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "time given to the sessions to finish on SIGTERM or SIGINT")
+	usage := server.ConfigUsage()
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vals := make(map[string]*string, len(names))
+	for _, name := range names {
+		def, _ := s.GetConfig(name)
+		vals[name] = flag.String(name, def, usage[name])
+	}
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := s.LoadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if v, ok := vals[f.Name]; ok && err == nil {
+			err = s.SetConfig(f.Name, *v)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// SIGTERM and SIGINT shut down gracefully, Run returns once it is over
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Info("received", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Warning("shutdown,", err)
+		}
+	}()
 	s.Run()
 }
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"jj/resp"
+)
+
+// backendConn is a connection to a jj-server node, authenticated with auth
+type backendConn struct {
+	addr string
+	auth string // the AUTH command sent on connect, empty for none
+	c    net.Conn
+	r    *bufio.Reader
+	err  error // set once the connection is broken
+}
+
+// do sends req and reads one reply
+func (bc *backendConn) do(req *resp.Resp) (*resp.Resp, error) {
+	b, err := req.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bc.c.Write(b); err != nil {
+		bc.err = err
+		return nil, err
+	}
+	ret, err := resp.Parse(bc.r)
+	if err != nil {
+		bc.err = err
+		return nil, err
+	}
+	return ret, nil
+}
+
+type poolKey struct {
+	addr string
+	auth string
+}
+
+// pool keeps up to size idle connections to every node for every set of
+// credentials, so that the nodes check the commands of each client against
+// its own user
+type pool struct {
+	lock        sync.Mutex
+	size        int
+	dialTimeout time.Duration
+	idle        map[poolKey][]*backendConn
+}
+
+func newPool(cfg Config) *pool {
+	return &pool{
+		size:        cfg.PoolSize,
+		dialTimeout: cfg.DialTimeout,
+		idle:        make(map[poolKey][]*backendConn),
+	}
+}
+
+// authCommand returns the AUTH command for user and password, nil if
+// password is empty
+func authCommand(user string, password string) *resp.Resp {
+	switch {
+	case password == "":
+		return nil
+	case user == "":
+		return command("auth", password)
+	default:
+		return command("auth", user, password)
+	}
+}
+
+func authKey(auth *resp.Resp) string {
+	if auth == nil {
+		return ""
+	}
+	b, _ := auth.Bytes()
+	return string(b)
+}
+
+func (p *pool) get(addr string, auth *resp.Resp) (*backendConn, error) {
+	key := poolKey{addr, authKey(auth)}
+	p.lock.Lock()
+	if conns := p.idle[key]; len(conns) > 0 {
+		bc := conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.lock.Unlock()
+		return bc, nil
+	}
+	p.lock.Unlock()
+	return p.dial(addr, auth)
+}
+
+// dial opens a connection to addr and authenticates it, an error reply to
+// AUTH is returned as the error
+func (p *pool) dial(addr string, auth *resp.Resp) (*backendConn, error) {
+	c, err := net.DialTimeout("tcp", addr, p.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	bc := &backendConn{addr: addr, auth: authKey(auth), c: c, r: bufio.NewReader(c)}
+	if auth != nil {
+		ret, err := bc.do(auth)
+		if err == nil && ret.Type == resp.ErrorResp {
+			err = errors.New(ret.Error)
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// put gives bc back, broken connections and those over size are closed
+func (p *pool) put(bc *backendConn) {
+	if bc.err != nil {
+		bc.c.Close()
+		return
+	}
+	key := poolKey{bc.addr, bc.auth}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.idle[key]) >= p.size {
+		bc.c.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], bc)
+}
+
+// do runs req on a pooled connection to addr authenticated with auth, after
+// ASKING if asking
+func (p *pool) do(addr string, auth *resp.Resp, req *resp.Resp, asking bool) (*resp.Resp, error) {
+	bc, err := p.get(addr, auth)
+	if err != nil {
+		return nil, err
+	}
+	defer p.put(bc)
+	if asking {
+		if _, err := bc.do(command("asking")); err != nil {
+			return nil, err
+		}
+	}
+	return bc.do(req)
+}
@@ -0,0 +1,425 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jj/resp"
+	"jj/server"
+
+	log "github.com/ngaut/logging"
+)
+
+const maxRedirects = 5
+
+var (
+	ErrCrossSlot    = errors.New("CROSSSLOT keys in request don't hash to the same slot")
+	ErrClusterDown  = errors.New("CLUSTERDOWN hash slot not served")
+	ErrRedirects    = errors.New("too many cluster redirections")
+	ErrNoNodes      = errors.New("no node is reachable")
+	ErrUnsupported  = errors.New("command not supported by the proxy")
+	ErrInvalidParam = errors.New("invalid parameter")
+)
+
+// commands that keep a connection to themselves or change its state, and
+// those moving documents between the nodes
+var unsupportedCmds = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"jwatchstream": true,
+	"psync":        true,
+	"replconf":     true,
+	"asking":       true,
+	"hello":        true,
+	"client":       true,
+	"acl":          true,
+	"jmigrate":     true,
+	"jrestore":     true,
+}
+
+// the commands without keys that go to the first node, the others are not
+// data commands and are refused
+var keylessCmds = map[string]bool{
+	"jzrange":           true,
+	"jzrevrange":        true,
+	"jzrangebyscore":    true,
+	"jzrevrangebyscore": true,
+	"jzrank":            true,
+	"jzrevrank":         true,
+	"jzcard":            true,
+	"jgeoradius":        true,
+	"jgeobox":           true,
+	"jgeodist":          true,
+	"jknn":              true,
+	"publish":           true,
+}
+
+type Config struct {
+	Addr          string   // address the proxy listens on
+	Nodes         []string // nodes asked for the slot map
+	PoolSize      int      // idle connections kept per node
+	DialTimeout   time.Duration
+	RefreshPeriod time.Duration // how often the slot map is reloaded
+	User          string        // user the slot map is loaded as
+	Password      string        // no authentication if empty
+}
+
+// Proxy lets clients that don't follow redirections use a cluster. Every
+// command goes to the node owning the slot of its keys; jmget and scan are
+// split over the nodes. Clients AUTH to the proxy, which checks their
+// credentials on a node and uses them for all their commands.
+type Proxy struct {
+	cfg       Config
+	pool      *pool
+	auth      *resp.Resp // AUTH of the slot map loads, nil for none
+	refreshCh chan struct{}
+
+	lock  sync.RWMutex
+	slots [server.MaxSlotSize]string
+}
+
+func New(cfg Config) *Proxy {
+	return &Proxy{
+		cfg:       cfg,
+		pool:      newPool(cfg),
+		auth:      authCommand(cfg.User, cfg.Password),
+		refreshCh: make(chan struct{}, 1),
+	}
+}
+
+func command(args ...string) *resp.Resp {
+	r := &resp.Resp{Type: resp.MultiResp}
+	for _, a := range args {
+		r.Multi = append(r.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(a)})
+	}
+	return r
+}
+
+func respErr(err error) *resp.Resp {
+	return &resp.Resp{Type: resp.ErrorResp, Error: err.Error()}
+}
+
+func (p *Proxy) Run() {
+	if err := p.refresh(); err != nil {
+		log.Warning(err)
+	}
+	go p.refreshLoop()
+
+	log.Info("proxy listening on", p.cfg.Addr)
+	listener, err := net.Listen("tcp", p.cfg.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		go p.handleConn(conn)
+	}
+}
+
+func (p *Proxy) refreshLoop() {
+	ticker := time.NewTicker(p.cfg.RefreshPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.refreshCh:
+		}
+		if err := p.refresh(); err != nil {
+			log.Warning(err)
+		}
+	}
+}
+
+// triggerRefresh asks for a reload of the slot map without waiting for it
+func (p *Proxy) triggerRefresh() {
+	select {
+	case p.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+// nodes returns the known nodes, those of the slot map first
+func (p *Proxy) nodes() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addr := range p.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	for _, addr := range p.cfg.Nodes {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// refresh reloads the slot map from the first node that answers. A node
+// without cluster mode gets all the slots.
+func (p *Proxy) refresh() error {
+	for _, addr := range p.nodes() {
+		r, err := p.pool.do(addr, p.auth, command("cluster", "slots"), false)
+		if err != nil {
+			continue
+		}
+
+		var slots [server.MaxSlotSize]string
+		if r.Type == resp.ErrorResp {
+			if r.Error != server.ErrClusterDisabled.Error() {
+				continue
+			}
+			for i := range slots {
+				slots[i] = addr
+			}
+		}
+		for _, rng := range r.Multi {
+			if len(rng.Multi) < 3 || len(rng.Multi[2].Multi) < 2 {
+				continue
+			}
+			node := rng.Multi[2].Multi
+			owner := net.JoinHostPort(string(node[0].Bulk), strconv.FormatInt(node[1].Integer, 10))
+			for i := rng.Multi[0].Integer; i <= rng.Multi[1].Integer && i < server.MaxSlotSize; i++ {
+				slots[i] = owner
+			}
+		}
+
+		p.lock.Lock()
+		p.slots = slots
+		p.lock.Unlock()
+		return nil
+	}
+	return ErrNoNodes
+}
+
+func (p *Proxy) owner(slot int) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.slots[slot]
+}
+
+// session is a client of the proxy
+type session struct {
+	auth *resp.Resp // AUTH its backend connections send, nil for none
+}
+
+func (p *Proxy) handleConn(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	sess := &session{}
+	for {
+		req, err := resp.ParseWithLimits(r, resp.DefaultLimits)
+		if err != nil {
+			if pe := resp.AsProtocolError(err); pe != nil {
+				b, _ := respErr(pe).Bytes()
+				c.Write(b)
+			}
+			return
+		}
+		b, _ := p.dispatch(sess, req).Bytes()
+		if _, err := c.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (p *Proxy) dispatch(sess *session, req *resp.Resp) *resp.Resp {
+	op, err := req.Op()
+	if err != nil {
+		return respErr(err)
+	}
+	strOp := strings.ToLower(string(op))
+	switch {
+	case strOp == "ping":
+		return &resp.Resp{Type: resp.SimpleString, Status: "PONG"}
+	case strOp == "auth":
+		return p.authenticate(sess, req)
+	case strOp == "jmget":
+		return p.jmget(sess, req)
+	case strOp == "scan":
+		return p.scan(sess, req)
+	case unsupportedCmds[strOp]:
+		return respErr(ErrUnsupported)
+	}
+
+	keys, _ := req.Keys()
+	if len(keys) == 0 {
+		if !keylessCmds[strOp] {
+			return respErr(ErrUnsupported)
+		}
+		nodes := p.nodes()
+		if len(nodes) == 0 {
+			return respErr(ErrNoNodes)
+		}
+		ret, err := p.pool.do(nodes[0], sess.auth, req, false)
+		if err != nil {
+			return respErr(err)
+		}
+		return ret
+	}
+	slot := server.GetSlotIdFromKey(string(keys[0]))
+	for _, k := range keys[1:] {
+		if server.GetSlotIdFromKey(string(k)) != slot {
+			return respErr(ErrCrossSlot)
+		}
+	}
+	return p.forward(sess, slot, req)
+}
+
+// auth [username] password checks the credentials on a node, they are sent
+// on the backend connections of the session from then on
+func (p *Proxy) authenticate(sess *session, req *resp.Resp) *resp.Resp {
+	if len(req.Multi) != 2 && len(req.Multi) != 3 {
+		return respErr(ErrInvalidParam)
+	}
+	nodes := p.nodes()
+	if len(nodes) == 0 {
+		return respErr(ErrNoNodes)
+	}
+	auth := command("auth")
+	auth.Multi = append(auth.Multi, req.Multi[1:]...)
+	bc, err := p.pool.dial(nodes[0], auth)
+	if err != nil {
+		return respErr(err)
+	}
+	p.pool.put(bc)
+	sess.auth = auth
+	return &resp.Resp{Type: resp.SimpleString, Status: "OK"}
+}
+
+// forward runs req on the owner of slot, following MOVED and ASK
+func (p *Proxy) forward(sess *session, slot int, req *resp.Resp) *resp.Resp {
+	addr := p.owner(slot)
+	asking := false
+	for i := 0; i < maxRedirects; i++ {
+		if addr == "" {
+			p.triggerRefresh()
+			return respErr(ErrClusterDown)
+		}
+		ret, err := p.pool.do(addr, sess.auth, req, asking)
+		if err != nil {
+			p.triggerRefresh()
+			return respErr(err)
+		}
+		if ret.Type != resp.ErrorResp {
+			return ret
+		}
+
+		fields := strings.Fields(ret.Error)
+		switch {
+		case len(fields) == 3 && fields[0] == "MOVED":
+			addr, asking = fields[2], false
+			p.lock.Lock()
+			p.slots[slot] = addr
+			p.lock.Unlock()
+			p.triggerRefresh()
+		case len(fields) == 3 && fields[0] == "ASK":
+			addr, asking = fields[2], true
+		case len(fields) > 0 && fields[0] == "TRYAGAIN":
+			time.Sleep(10 * time.Millisecond)
+		default:
+			return ret
+		}
+	}
+	return respErr(ErrRedirects)
+}
+
+// jmget <path> <key> [key ...] sends one jmget per slot
+func (p *Proxy) jmget(sess *session, req *resp.Resp) *resp.Resp {
+	if len(req.Multi) < 3 {
+		return respErr(ErrInvalidParam)
+	}
+	groups := make(map[int][]int) // slot -> index of the keys
+	for i, k := range req.Multi[2:] {
+		slot := server.GetSlotIdFromKey(string(k.Bulk))
+		groups[slot] = append(groups[slot], i)
+	}
+
+	ret := &resp.Resp{Type: resp.MultiResp, Multi: make([]*resp.Resp, len(req.Multi)-2)}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var failed *resp.Resp
+	for slot, idx := range groups {
+		sub := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{req.Multi[0], req.Multi[1]}}
+		for _, i := range idx {
+			sub.Multi = append(sub.Multi, req.Multi[i+2])
+		}
+		wg.Add(1)
+		go func(slot int, idx []int) {
+			defer wg.Done()
+			r := p.forward(sess, slot, sub)
+			lock.Lock()
+			defer lock.Unlock()
+			if r.Type == resp.ErrorResp || len(r.Multi) != len(idx) {
+				failed = r
+				return
+			}
+			for j, i := range idx {
+				ret.Multi[i] = r.Multi[j]
+			}
+		}(slot, idx)
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	return ret
+}
+
+// scan <cursor> [MATCH pattern] [COUNT count] walks the nodes one after the
+// other. The proxy cursor is the node index times the number of slots plus
+// the cursor of the node.
+func (p *Proxy) scan(sess *session, req *resp.Resp) *resp.Resp {
+	if len(req.Multi) < 2 {
+		return respErr(ErrInvalidParam)
+	}
+	cursor, err := strconv.Atoi(string(req.Multi[1].Bulk))
+	if err != nil || cursor < 0 {
+		return respErr(errors.New("invalid cursor"))
+	}
+	nodes := p.nodes()
+	idx := cursor / server.MaxSlotSize
+	if idx >= len(nodes) {
+		return respErr(errors.New("invalid cursor"))
+	}
+
+	sub := &resp.Resp{Type: resp.MultiResp, Multi: append([]*resp.Resp{}, req.Multi...)}
+	sub.Multi[1] = &resp.Resp{Type: resp.BulkResp, Bulk: []byte(strconv.Itoa(cursor % server.MaxSlotSize))}
+	ret, err := p.pool.do(nodes[idx], sess.auth, sub, false)
+	if err != nil {
+		return respErr(err)
+	}
+	if ret.Type != resp.MultiResp || len(ret.Multi) != 2 {
+		return ret
+	}
+
+	next, err := strconv.Atoi(string(ret.Multi[0].Bulk))
+	if err != nil {
+		return respErr(fmt.Errorf("invalid scan reply from %s", nodes[idx]))
+	}
+	if next != 0 {
+		next += idx * server.MaxSlotSize
+	} else if idx+1 < len(nodes) {
+		next = (idx + 1) * server.MaxSlotSize
+	}
+	ret.Multi[0] = &resp.Resp{Type: resp.BulkResp, Bulk: []byte(strconv.Itoa(next))}
+	return ret
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+	"jj/server"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type testConn struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	var c net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			return &testConn{t: t, c: c, r: bufio.NewReader(c)}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+func (tc *testConn) do(args ...string) *resp.Resp {
+	b, _ := command(args...).Bytes()
+	if _, err := tc.c.Write(b); err != nil {
+		tc.t.Fatal(err)
+	}
+	r, err := resp.Parse(tc.r)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return r
+}
+
+func keyInSlot(slot int) string {
+	for i := 0; ; i++ {
+		if k := fmt.Sprint("k", i); server.GetSlotIdFromKey(k) == slot {
+			return k
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	var nodes []*testConn
+	for i, addr := range addrs {
+		go server.NewServer(addr).Run()
+		n := dial(t, addr)
+		defer n.c.Close()
+		n.do("config", "set", "cluster-enabled", "yes")
+		n.do("cluster", "addslotsrange", fmt.Sprint(i*512), fmt.Sprint(i*512+511))
+		nodes = append(nodes, n)
+	}
+	host, port, _ := net.SplitHostPort(addrs[1])
+	nodes[0].do("cluster", "meet", host, port)
+	for _, n := range nodes {
+		for i := 0; !strings.Contains(string(n.do("cluster", "info").Bulk), "cluster_state:ok"); i++ {
+			if i > 200 {
+				t.Fatal("cluster not ready")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	paddr := freeAddr(t)
+	go New(Config{
+		Addr:          paddr,
+		Nodes:         addrs[:1],
+		PoolSize:      4,
+		DialTimeout:   time.Second,
+		RefreshPeriod: time.Minute,
+	}).Run()
+	c := dial(t, paddr)
+	defer c.c.Close()
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprint("doc:", i)
+		keys = append(keys, k)
+		if r := c.do("jdocset", k, fmt.Sprintf(`{"n":%d}`, i)); r.Status != "OK" {
+			t.Fatal("jdocset", k, r)
+		}
+	}
+	if r := c.do("jincr", "doc:7", "n", "1"); r.Status != "OK" {
+		t.Error("jincr", r)
+	}
+
+	r := c.do("jmget", "n", "doc:3", "doc:7", "missing", "doc:42")
+	if len(r.Multi) != 4 || string(r.Multi[0].Bulk) != "3" || string(r.Multi[1].Bulk) != "8" ||
+		r.Multi[2].Bulk != nil || string(r.Multi[3].Bulk) != "42" {
+		t.Error("jmget", r)
+	}
+
+	var scanned []string
+	cursor := "0"
+	for {
+		r := c.do("scan", cursor, "MATCH", "doc:*", "COUNT", "7")
+		for _, k := range r.Multi[1].Multi {
+			scanned = append(scanned, string(k.Bulk))
+		}
+		cursor = string(r.Multi[0].Bulk)
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	sort.Strings(scanned)
+	if strings.Join(keys, ",") != strings.Join(scanned, ",") {
+		t.Error("scan", scanned)
+	}
+
+	// slot 0 moves to the second node, the proxy follows MOVED
+	bid := string(nodes[1].do("cluster", "myid").Bulk)
+	nodes[1].do("cluster", "setslot", "0", "node", bid)
+	nodes[0].do("cluster", "setslot", "0", "node", bid)
+	k := keyInSlot(0)
+	if r := c.do("jdocset", k, "1"); r.Status != "OK" {
+		t.Error("moved", r)
+	}
+	if r := nodes[1].do("jdocget", k); string(r.Bulk) != "1" {
+		t.Error("owner", r)
+	}
+
+	// admin commands are not forwarded, clients run as the user they AUTH as
+	for _, args := range [][]string{{"config", "set", "maxmemory", "1"}, {"shutdown"}, {"cluster", "nodes"}} {
+		if r := c.do(args...); r.Error != ErrUnsupported.Error() {
+			t.Error(args[0], r)
+		}
+	}
+	for _, n := range nodes {
+		n.do("acl", "setuser", "ro", "on", ">pw", "~doc:*", "+@read")
+	}
+	ro := dial(t, paddr)
+	defer ro.c.Close()
+	if r := ro.do("auth", "ro", "nope"); r.Error != server.ErrWrongPass.Error() {
+		t.Error("wrong password", r)
+	}
+	if r := ro.do("auth", "ro", "pw"); r.Status != "OK" {
+		t.Fatal("auth", r)
+	}
+	if r := ro.do("jget", "doc:3", "n"); string(r.Bulk) != "3" {
+		t.Error("read as ro", r)
+	}
+	if r := ro.do("jdocset", "doc:3", "1"); !strings.HasPrefix(r.Error, "NOPERM") {
+		t.Error("write as ro", r)
+	}
+}
@@ -0,0 +1,153 @@
+package resp
+
+// SplitArgs splits an inline command the way redis-cli and redis do:
+// arguments are separated by spaces, "..." takes the escapes \n \r \t \b \a
+// and \xHH, '...' only \', and a closing quote must end the argument. An
+// unquoted argument starting with { or [ runs to the matching bracket if
+// the argument ends there, so JSON needs no quoting: jset a b {"x": [1, 2]}.
+// Otherwise it is split as usual, like the key {user1}.profile or the
+// pattern [ab]*.
+func SplitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		if line[i] == '{' || line[i] == '[' {
+			if n, ok := bracketLen(line[i:]); ok && (i+n == len(line) || isSpace(line[i+n])) {
+				args = append(args, append([]byte{}, line[i:i+n]...))
+				i += n
+				continue
+			}
+		}
+
+		arg := []byte{}
+		inq, insq := false, false
+	arg:
+		for {
+			switch {
+			case inq:
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 4
+				case c == '\\' && i+1 < len(line):
+					switch e := line[i+1]; e {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					default:
+						arg = append(arg, e)
+					}
+					i += 2
+				case c == '"':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("closing quote must be followed by a space")
+					}
+					i++
+					break arg
+				default:
+					arg = append(arg, c)
+					i++
+				}
+			case insq:
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg = append(arg, '\'')
+					i += 2
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("closing quote must be followed by a space")
+					}
+					i++
+					break arg
+				default:
+					arg = append(arg, c)
+					i++
+				}
+			default:
+				if i == len(line) || isSpace(line[i]) {
+					break arg
+				}
+				switch line[i] {
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					arg = append(arg, line[i])
+				}
+				i++
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+// bracketLen returns the length of the JSON object or array b starts with,
+// false if its brackets are unbalanced
+func bracketLen(b []byte) (int, bool) {
+	depth := 0
+	inString := false
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				return i + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f' || c == 0
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
@@ -0,0 +1,49 @@
+package resp
+
+// keysAt returns the arguments from first to last, every step. A negative
+// last counts from the end, -1 being the last argument.
+func keysAt(first int, last int, step int) funGetKeys {
+	return func(r *Resp) ([][]byte, error) {
+		end := last
+		if end < 0 {
+			end = len(r.Multi) + end
+		}
+		var keys [][]byte
+		for i := first; i <= end && i < len(r.Multi); i += step {
+			keys = append(keys, r.Multi[i].Bulk)
+		}
+		return keys, nil
+	}
+}
+
+func noKeys(r *Resp) ([][]byte, error) {
+	return nil, nil
+}
+
+// key positions of the jj commands
+func init() {
+	for _, op := range []string{
+		"jdocset", "jdocget", "jdocdel",
+		"jget", "jset", "jincr", "jpush", "jpop",
+		"jrestore",
+	} {
+		keyFun[op] = keysAt(1, 1, 1)
+	}
+	keyFun["jmget"] = keysAt(2, -1, 1)
+	keyFun["bjpop"] = keysAt(1, -2, 2)
+	keyFun["jmigrate"] = keysAt(4, -1, 1)
+
+	// indexes, streams and channels are local to a node and not keys
+	for _, op := range []string{
+		"ping", "config", "save", "bgsave", "lastsave", "shutdown", "role", "cluster", "asking", "scan",
+		"hello", "client", "auth", "acl",
+		"replicaof", "psync", "replconf",
+		"jindex", "jschema", "jknn", "jwatchstream",
+		"jzrange", "jzrevrange", "jzrangebyscore", "jzrevrangebyscore",
+		"jzrank", "jzrevrank", "jzcard",
+		"jgeoradius", "jgeobox", "jgeodist",
+		"subscribe", "psubscribe", "unsubscribe", "punsubscribe", "publish",
+	} {
+		keyFun[op] = noKeys
+	}
+}
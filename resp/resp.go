@@ -2,7 +2,10 @@ package resp
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 
@@ -21,6 +24,15 @@ const (
 	BulkResp
 	MultiResp
 	NoKey
+
+	// RESP3 types
+	NullResp
+	DoubleResp
+	BooleanResp
+	MapResp // Multi holds the keys and values in turn
+	SetResp
+	VerbatimResp // Format holds the 3 letter format, Bulk the text
+	PushResp
 )
 
 type funGetKeys func(r *Resp) ([][]byte, error)
@@ -46,21 +58,72 @@ type Resp struct {
 	Integer int64  // Support Redis 64bit integer
 	Bulk    []byte // Support Redis Null Bulk Resp
 	Multi   []*Resp
+	Double  float64
+	Bool    bool
+	Format  string
 }
 
-func readLine(r *bufio.Reader) ([]byte, error) {
-	line, err := r.ReadBytes('\n')
-	if err != nil {
-		return nil, errors.Trace(err)
+// Limits bound what a peer may send, 0 meaning no limit. Sizes are checked
+// before anything is allocated.
+type Limits struct {
+	MaxBulkLen   int // bytes of a bulk string
+	MaxMultiLen  int // elements of an array, or arguments of an inline command
+	MaxDepth     int // arrays nested in arrays
+	MaxInlineLen int // bytes of a line, inline commands included
+}
+
+// DefaultLimits are the request limits of redis
+var DefaultLimits = Limits{
+	MaxBulkLen:   512 << 20,
+	MaxMultiLen:  1024 * 1024,
+	MaxDepth:     8,
+	MaxInlineLen: 64 << 10,
+}
+
+// ProtocolError is a malformed message. A server replies it and closes the
+// connection, since it can't tell where the next request starts.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Reason
+}
+
+func protocolError(format string, args ...interface{}) error {
+	return &ProtocolError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// AsProtocolError returns the protocol error behind err, nil if there is none
+func AsProtocolError(err error) *ProtocolError {
+	pe, _ := errors.Cause(err).(*ProtocolError)
+	return pe
+}
+
+// readLine reads up to \r\n, or \n alone as redis accepts for inline
+// commands, and strips it
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, errors.Trace(err)
+		}
+		if max > 0 && len(line)+len(chunk) > max+2 {
+			return nil, protocolError("too big request line")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
 	}
-	if len(line) < 2 || line[len(line)-2] != '\r' { // \r\n
-		return nil, errors.Errorf("invalid redis packet %v, err:%v", line, err)
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
 	}
-	if len(line) == 2 {
+	if len(line) == 0 {
 		return EMPTY_LINE, nil
 	}
-
-	line = line[:len(line)-2] //strip \r\n
 	return line, nil
 }
 
@@ -76,31 +139,32 @@ func Itoa(i int) []byte {
 	return []byte(strconv.Itoa(i))
 }
 
-//todo: overflow
+const maxInt = int(^uint(0) >> 1)
+
+// Btoi parses a decimal integer, failing rather than overflowing
 func Btoi(b []byte) (int, error) {
+	digits := b
+	if len(b) > 0 && b[0] == '-' {
+		digits = b[1:]
+	}
+	if len(digits) == 0 {
+		return 0, errors.Errorf("Invalid number %s", string(b))
+	}
 	n := 0
-	sign := 1
-	for i := uint8(0); i < uint8(len(b)); i++ {
-		if i == 0 && b[i] == '-' {
-			if len(b) == 1 {
-				return 0, errors.Errorf("Invalid number %s", string(b))
-			}
-			sign = -1
-			continue
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, errors.Errorf("Invalid number %s", string(b))
 		}
-
-		if b[i] >= 0 && b[i] <= '9' {
-			if i > 0 {
-				n *= 10
-			}
-			n += int(b[i]) - '0'
-			continue
+		d := int(c - '0')
+		if n > (maxInt-d)/10 {
+			return 0, errors.Errorf("Number out of range %s", string(b))
 		}
-
-		return 0, errors.Errorf("Invalid number %s", string(b))
+		n = n*10 + d
 	}
-
-	return sign * n, nil
+	if len(digits) < len(b) {
+		return -n, nil
+	}
+	return n, nil
 }
 
 func IsLetter(c byte) bool {
@@ -115,38 +179,73 @@ func IsLetter(c byte) bool {
 	return false
 }
 
+// bulks up to bulkPrealloc bytes are allocated at once, bigger ones grow
+// with the data received, so that a peer can't make us allocate what it
+// only announces
+const bulkPrealloc = 64 << 10
+
 func ReadBulk(r *bufio.Reader, size int) ([]byte, error) {
 	if size < 0 {
 		return nil, nil
 	}
 
-	buf := make([]byte, size)
-	if _, err := io.ReadFull(r, buf); err != nil {
-		return nil, err
+	var buf []byte
+	if size <= bulkPrealloc {
+		buf = make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else {
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, r, int64(size)); err != nil {
+			return nil, errors.Trace(err)
+		}
+		buf = b.Bytes()
 	}
 
-	line, err := readLine(r)
-	if err != nil {
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	if len(line) != 0 {
-		return nil, errors.New("should be just 0 " + string(line))
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return nil, protocolError("bulk string not followed by CRLF")
 	}
 
 	return buf, nil
 }
 
+// Parse reads a message without limits, for the replies of a trusted peer
 func Parse(r *bufio.Reader) (*Resp, error) {
-	line, err := readLine(r)
-	if err != nil {
-		return nil, errors.Trace(err)
-	}
+	return parse(r, &Limits{}, 0)
+}
 
-	if len(line) == 0 {
-		return nil, errors.New("empty NEW_LINE")
+// ParseWithLimits reads a request, failing with a ProtocolError if it goes
+// past l
+func ParseWithLimits(r *bufio.Reader, l Limits) (*Resp, error) {
+	return parse(r, &l, 0)
+}
+
+func parse(r *bufio.Reader, l *Limits, depth int) (*Resp, error) {
+	for {
+		line, err := readLine(r, l.MaxInlineLen)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(line) == 0 && depth > 0 {
+			return nil, protocolError("empty line")
+		}
+		// blank lines between requests are skipped, as redis does
+		if len(line) > 0 {
+			if rp, err := parseLine(r, l, depth, line); rp != nil || err != nil {
+				return rp, err
+			}
+		}
 	}
+}
 
+// parseLine parses the message starting with line, nil if it is an inline
+// command without arguments
+func parseLine(r *bufio.Reader, l *Limits, depth int, line []byte) (*Resp, error) {
 	switch line[0] {
 	case '-':
 		return &Resp{
@@ -161,16 +260,16 @@ func Parse(r *bufio.Reader) (*Resp, error) {
 	case ':':
 		i, err := Btoi(line[1:])
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, protocolError("invalid integer")
 		}
 		return &Resp{
 			Type:    IntegerResp,
 			Integer: int64(i),
 		}, nil
 	case '$':
-		size, err := Btoi(line[1:])
+		size, err := bulkLen(line[1:], l)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, err
 		}
 		bulk, err := ReadBulk(r, size)
 		if err != nil {
@@ -181,37 +280,129 @@ func Parse(r *bufio.Reader) (*Resp, error) {
 			Bulk: bulk,
 		}, nil
 	case '*':
-		i, err := Btoi(line[1:])
+		return parseAggregate(r, l, depth, MultiResp, line[1:], 1)
+	case '%':
+		return parseAggregate(r, l, depth, MapResp, line[1:], 2)
+	case '~':
+		return parseAggregate(r, l, depth, SetResp, line[1:], 1)
+	case '>':
+		return parseAggregate(r, l, depth, PushResp, line[1:], 1)
+	case '_':
+		if len(line) != 1 {
+			return nil, protocolError("invalid null")
+		}
+		return &Resp{Type: NullResp}, nil
+	case ',':
+		f, err := parseDouble(string(line[1:]))
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		rp := &Resp{Type: MultiResp}
-		if i >= 0 {
-			multi := make([]*Resp, i)
-			for j := 0; j < i; j++ {
-				rp, err := Parse(r)
-				if err != nil {
-					return nil, errors.Trace(err)
-				}
-				multi[j] = rp
-			}
-			rp.Multi = multi
+		return &Resp{Type: DoubleResp, Double: f}, nil
+	case '#':
+		if len(line) != 2 || (line[1] != 't' && line[1] != 'f') {
+			return nil, protocolError("invalid boolean")
 		}
-		return rp, nil
-	default:
-		if !IsLetter(line[0]) {
-			return nil, errors.New("redis protocol error, " + string(line))
-		}
-		rp := &Resp{Type: MultiResp}
-		for _, s := range strings.Split(string(line), " ") {
-			if str := strings.TrimSpace(s); len(str) > 0 {
-				rp.Multi = append(rp.Multi, &Resp{Type: BulkResp, Bulk: []byte(s)})
-			}
+		return &Resp{Type: BooleanResp, Bool: line[1] == 't'}, nil
+	case '=':
+		size, err := bulkLen(line[1:], l)
+		if err != nil {
+			return nil, err
+		}
+		text, err := ReadBulk(r, size)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(text) < 4 || text[3] != ':' {
+			return nil, protocolError("invalid verbatim string")
 		}
+		return &Resp{Type: VerbatimResp, Format: string(text[:3]), Bulk: text[4:]}, nil
+	}
+
+	if depth > 0 {
+		return nil, protocolError("expected a bulk string, got '%c'", line[0])
+	}
+	args, err := SplitArgs(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if l.MaxMultiLen > 0 && len(args) > l.MaxMultiLen {
+		return nil, protocolError("too many arguments")
+	}
+	rp := &Resp{Type: MultiResp, Multi: make([]*Resp, len(args))}
+	for i, arg := range args {
+		rp.Multi[i] = &Resp{Type: BulkResp, Bulk: arg}
+	}
+	return rp, nil
+}
+
+func bulkLen(b []byte, l *Limits) (int, error) {
+	size, err := Btoi(b)
+	if err != nil || size < -1 || (l.MaxBulkLen > 0 && size > l.MaxBulkLen) {
+		return 0, protocolError("invalid bulk length")
+	}
+	return size, nil
+}
+
+// parseAggregate reads the n elements of an array, set or push, or the n
+// pairs of a map
+func parseAggregate(r *bufio.Reader, l *Limits, depth int, typ int, size []byte, per int) (*Resp, error) {
+	n, err := Btoi(size)
+	if err != nil || n < -1 || (n == -1 && typ != MultiResp) ||
+		(l.MaxMultiLen > 0 && n*per > l.MaxMultiLen) || n > maxInt/2 {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if l.MaxDepth > 0 && depth >= l.MaxDepth {
+		return nil, protocolError("too deeply nested")
+	}
+	rp := &Resp{Type: typ}
+	if n < 0 {
 		return rp, nil
 	}
+	// grow with the elements received, like bulks
+	prealloc := n * per
+	if prealloc > 1024 {
+		prealloc = 1024
+	}
+	rp.Multi = make([]*Resp, 0, prealloc)
+	for j := 0; j < n*per; j++ {
+		item, err := parse(r, l, depth+1)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rp.Multi = append(rp.Multi, item)
+	}
+	return rp, nil
+}
 
-	return nil, errors.New("redis protocol error, " + string(line))
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Errorf("Invalid double %s", s)
+	}
+	return f, nil
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
 }
 
 func (r *Resp) Op() ([]byte, error) {
@@ -228,7 +419,7 @@ func (r *Resp) Keys() ([][]byte, error) {
 		return nil, err
 	}
 
-	f, ok := keyFun[string(key)]
+	f, ok := keyFun[strings.ToLower(string(key))]
 	if !ok {
 		return defaultGetKeys(r)
 	}
@@ -307,21 +498,123 @@ func (r *Resp) Bytes() ([]byte, error) {
 		if r.Multi == nil {
 			length = -1
 		}
-
-		buf = append(buf, '*')
-		buf = append(buf, Itoa(length)...)
+		return r.appendAggregate(buf, '*', length)
+	case MapResp:
+		return r.appendAggregate(buf, '%', len(r.Multi)/2)
+	case SetResp:
+		return r.appendAggregate(buf, '~', len(r.Multi))
+	case PushResp:
+		return r.appendAggregate(buf, '>', len(r.Multi))
+	case NullResp:
+		buf = append(buf, '_')
 		buf = append(buf, NEW_LINE...)
-
-		if len(r.Multi) > 0 {
-			for _, resp := range r.Multi {
-				slice, err := resp.Bytes()
-				if err != nil {
-					return nil, errors.Trace(err)
-				}
-				buf = append(buf, slice...)
-			}
+	case DoubleResp:
+		buf = append(buf, ',')
+		buf = append(buf, formatDouble(r.Double)...)
+		buf = append(buf, NEW_LINE...)
+	case BooleanResp:
+		b := byte('f')
+		if r.Bool {
+			b = 't'
+		}
+		buf = append(buf, '#', b)
+		buf = append(buf, NEW_LINE...)
+	case VerbatimResp:
+		if len(r.Format) != 3 {
+			return nil, errors.Errorf("invalid verbatim format %q", r.Format)
 		}
+		buf = append(buf, '=')
+		buf = append(buf, Itoa(len(r.Bulk)+4)...)
+		buf = append(buf, NEW_LINE...)
+		buf = append(buf, r.Format...)
+		buf = append(buf, ':')
+		buf = append(buf, r.Bulk...)
+		buf = append(buf, NEW_LINE...)
 	}
 
 	return buf, nil
 }
+
+func (r *Resp) appendAggregate(buf []byte, prefix byte, length int) ([]byte, error) {
+	buf = append(buf, prefix)
+	buf = append(buf, Itoa(length)...)
+	buf = append(buf, NEW_LINE...)
+	for _, resp := range r.Multi {
+		slice, err := resp.Bytes()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		buf = append(buf, slice...)
+	}
+	return buf, nil
+}
+
+// Resp2 returns r with the RESP3 types turned into their RESP2 form, the way
+// redis answers clients that did not send HELLO 3: null is a null bulk
+// string, a double a bulk string, a boolean 1 or 0 and a map a flat array.
+// r itself is returned if there is nothing to convert.
+func (r *Resp) Resp2() *Resp {
+	switch r.Type {
+	case NullResp:
+		return &Resp{Type: BulkResp}
+	case DoubleResp:
+		return &Resp{Type: BulkResp, Bulk: []byte(formatDouble(r.Double))}
+	case BooleanResp:
+		if r.Bool {
+			return &Resp{Type: IntegerResp, Integer: 1}
+		}
+		return &Resp{Type: IntegerResp, Integer: 0}
+	case VerbatimResp:
+		return &Resp{Type: BulkResp, Bulk: r.Bulk}
+	case MapResp, SetResp, PushResp:
+		multi, _ := convertItems(r.Multi, (*Resp).Resp2)
+		if multi == nil {
+			multi = []*Resp{}
+		}
+		return &Resp{Type: MultiResp, Multi: multi}
+	case MultiResp:
+		if multi, changed := convertItems(r.Multi, (*Resp).Resp2); changed {
+			return &Resp{Type: MultiResp, Multi: multi}
+		}
+	}
+	return r
+}
+
+// Resp3 returns r with the RESP2 null bulk string and null array turned into
+// the RESP3 null. r itself is returned if there is nothing to convert.
+func (r *Resp) Resp3() *Resp {
+	switch r.Type {
+	case BulkResp:
+		if r.Bulk == nil {
+			return &Resp{Type: NullResp}
+		}
+	case MultiResp, MapResp, SetResp, PushResp:
+		if r.Multi == nil && r.Type == MultiResp {
+			return &Resp{Type: NullResp}
+		}
+		if multi, changed := convertItems(r.Multi, (*Resp).Resp3); changed {
+			return &Resp{Type: r.Type, Multi: multi}
+		}
+	}
+	return r
+}
+
+// convertItems applies fn to every item, copying the slice only if an item
+// changed
+func convertItems(items []*Resp, fn func(*Resp) *Resp) ([]*Resp, bool) {
+	var out []*Resp
+	for i, item := range items {
+		c := fn(item)
+		if c != item && out == nil {
+			out = make([]*Resp, len(items))
+			copy(out, items[:i])
+		}
+		if out != nil {
+			out[i] = c
+		}
+	}
+	if out == nil {
+		return items, false
+	}
+	return out, true
+}
@@ -1 +1,147 @@
 package resp
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestResp3(t *testing.T) {
+	for _, s := range []string{
+		"_\r\n",
+		",1.5\r\n",
+		",-inf\r\n",
+		"#t\r\n",
+		"#f\r\n",
+		"%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n_\r\n",
+		"~2\r\n+x\r\n,2\r\n",
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n",
+		"=8\r\ntxt:abcd\r\n",
+		"*-1\r\n",
+		"*2\r\n%0\r\n~0\r\n",
+	} {
+		r, err := Parse(bufio.NewReader(bytes.NewBufferString(s)))
+		if err != nil {
+			t.Error(s, err)
+			continue
+		}
+		if b, err := r.Bytes(); err != nil || string(b) != s {
+			t.Errorf("%q: %q %v", s, b, err)
+		}
+	}
+
+	r, _ := Parse(bufio.NewReader(bytes.NewBufferString(",nan\r\n")))
+	if r.Type != DoubleResp || !math.IsNaN(r.Double) {
+		t.Error("nan", r)
+	}
+	for _, s := range []string{"_x\r\n", "#x\r\n", ",one\r\n", "=2\r\nab\r\n", "%-1\r\n"} {
+		if _, err := Parse(bufio.NewReader(bytes.NewBufferString(s))); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestResp2Conversion(t *testing.T) {
+	r := &Resp{Type: MapResp, Multi: []*Resp{
+		{Type: BulkResp, Bulk: []byte("a")}, {Type: DoubleResp, Double: 0.5},
+		{Type: BulkResp, Bulk: []byte("b")}, {Type: SetResp, Multi: []*Resp{{Type: BooleanResp, Bool: true}, {Type: NullResp}}},
+	}}
+	b, _ := r.Resp2().Bytes()
+	if string(b) != "*4\r\n$1\r\na\r\n$3\r\n0.5\r\n$1\r\nb\r\n*2\r\n:1\r\n$-1\r\n" {
+		t.Errorf("%q", b)
+	}
+
+	plain := &Resp{Type: MultiResp, Multi: []*Resp{{Type: BulkResp, Bulk: []byte("x")}}}
+	if plain.Resp2() != plain || plain.Resp3() != plain {
+		t.Error("copied a reply without RESP3 types")
+	}
+
+	r = &Resp{Type: MultiResp, Multi: []*Resp{{Type: BulkResp}, {Type: MultiResp}, {Type: IntegerResp, Integer: 1}}}
+	b, _ = r.Resp3().Bytes()
+	if string(b) != "*3\r\n_\r\n_\r\n:1\r\n" {
+		t.Errorf("%q", b)
+	}
+	if b, _ := (&Resp{Type: MultiResp}).Resp3().Bytes(); string(b) != "_\r\n" {
+		t.Errorf("%q", b)
+	}
+}
+
+func TestBtoi(t *testing.T) {
+	for s, want := range map[string]int{"0": 0, "-12": -12, "9223372036854775807": 9223372036854775807} {
+		if n, err := Btoi([]byte(s)); err != nil || n != want {
+			t.Error(s, n, err)
+		}
+	}
+	for _, s := range []string{"", "-", "1a", "9223372036854775808", "99999999999999999999", "1/"} {
+		if n, err := Btoi([]byte(s)); err == nil {
+			t.Error(s, n)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for line, want := range map[string]string{
+		`jset a b {"x": 1}`:             `jset|a|b|{"x": 1}`,
+		`jdocset a [1, {"b": "]"}]  `:   `jdocset|a|[1, {"b": "]"}]`,
+		`set "a b" 'c d' "\x41\n\"" ''`: "set|a b|c d|A\n\"|",
+		`  get   'it\'s'`:               `get|it's`,
+		`set k"ey" v`:                   "set|key|v",
+		"ping\t x":                      "ping|x",
+		`jdocget {user1}.profile`:       "jdocget|{user1}.profile",
+		`scan 0 MATCH [ab]*`:            "scan|0|MATCH|[ab]*",
+		`scan 0 MATCH [ab`:              "scan|0|MATCH|[ab",
+	} {
+		args, err := SplitArgs([]byte(line))
+		var got []string
+		for _, a := range args {
+			got = append(got, string(a))
+		}
+		if err != nil || strings.Join(got, "|") != want {
+			t.Errorf("%s: %q %v", line, got, err)
+		}
+	}
+	for _, line := range []string{`get "a`, `get 'a`, `get "a"b`, `get 'a'b`, `jset a b {"x": 1`} {
+		if _, err := SplitArgs([]byte(line)); AsProtocolError(err) == nil {
+			t.Error("should fail:", line, err)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	l := Limits{MaxBulkLen: 10, MaxMultiLen: 3, MaxDepth: 1, MaxInlineLen: 16}
+	for _, s := range []string{
+		"*1\r\n$11\r\nhello world\r\n",
+		"*4\r\n",
+		"*1\r\n*1\r\n$1\r\na\r\n",
+		"get aaaaaaaaaaaaaaaaaaaaaaaaaaaaa\r\n",
+		"a b c d\r\n",
+		"*1\r\n$-2\r\n",
+		"*1\r\n$99999999999999999999\r\n",
+		"*1\r\n$3\r\nabcd\r\n",
+		"*1\r\nget\r\n",
+	} {
+		_, err := ParseWithLimits(bufio.NewReader(bytes.NewBufferString(s)), l)
+		if AsProtocolError(err) == nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+
+	// blank lines are skipped and inline commands split with quotes
+	r, err := ParseWithLimits(bufio.NewReader(bytes.NewBufferString("\r\n\n  \r\nset 'a b' c\n")), l)
+	if err != nil || len(r.Multi) != 3 || string(r.Multi[1].Bulk) != "a b" {
+		t.Error(r, err)
+	}
+
+	// a big bulk is read as it arrives, not allocated as announced
+	_, err = Parse(bufio.NewReader(bytes.NewBufferString("$1000000000\r\nabc")))
+	if err == nil || AsProtocolError(err) != nil {
+		t.Error("short bulk", err)
+	}
+	big := strings.Repeat("x", 200000)
+	r, err = Parse(bufio.NewReader(bytes.NewBufferString("$200000\r\n" + big + "\r\n")))
+	if err != nil || string(r.Bulk) != big {
+		t.Error("big bulk", err)
+	}
+}
@@ -0,0 +1,174 @@
+package sentinel
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var (
+	ErrNoSuchMaster = errors.New("no such master with that name")
+	ErrNoReplica    = errors.New("no replica to promote")
+)
+
+var (
+	respInvalidParam = &resp.Resp{Type: resp.ErrorResp, Error: "invalid parameter"}
+	respNoSuchCmd    = &resp.Resp{Type: resp.ErrorResp, Error: "unknown command"}
+)
+
+func bulk(s string) *resp.Resp {
+	return &resp.Resp{Type: resp.BulkResp, Bulk: []byte(s)}
+}
+
+func integer(n int64) *resp.Resp {
+	return &resp.Resp{Type: resp.IntegerResp, Integer: n}
+}
+
+func respErr(err error) *resp.Resp {
+	return &resp.Resp{Type: resp.ErrorResp, Error: err.Error()}
+}
+
+func (s *Sentinel) handleConn(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		req, err := resp.ParseWithLimits(r, resp.DefaultLimits)
+		if err != nil {
+			if pe := resp.AsProtocolError(err); pe != nil {
+				b, _ := respErr(pe).Bytes()
+				c.Write(b)
+			}
+			return
+		}
+		op, err := req.Op()
+		if err != nil {
+			log.Warning(err)
+			return
+		}
+
+		var ret *resp.Resp
+		switch strings.ToLower(string(op)) {
+		case "ping":
+			ret = &resp.Resp{Type: resp.SimpleString, Status: "PONG"}
+		case "sentinel":
+			ret = s.cmdSentinel(req)
+		default:
+			ret = respNoSuchCmd
+		}
+		b, _ := ret.Bytes()
+		if _, err := c.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Sentinel) nodeFlags(n *node, master bool) string {
+	flags := "slave"
+	if master {
+		flags = "master"
+	}
+	if time.Since(n.lastOk) > s.cfg.DownAfter {
+		flags += ",s_down"
+	}
+	return flags
+}
+
+// sentinel get-master-addr-by-name <name>
+// sentinel master <name>
+// sentinel replicas <name>
+// sentinel is-master-down-by-addr <ip> <port> <epoch> <runid|*>
+// sentinel failover <name>
+func (s *Sentinel) cmdSentinel(r *resp.Resp) *resp.Resp {
+	if len(r.Multi) < 3 {
+		return respInvalidParam
+	}
+	sub := strings.ToLower(string(r.Multi[1].Bulk))
+
+	if sub == "is-master-down-by-addr" {
+		if len(r.Multi) != 6 {
+			return respInvalidParam
+		}
+		epoch, err := strconv.ParseUint(string(r.Multi[4].Bulk), 10, 64)
+		if err != nil {
+			return respInvalidParam
+		}
+		addr := net.JoinHostPort(string(r.Multi[2].Bulk), string(r.Multi[3].Bulk))
+		down, leader, leaderEpoch := s.vote(addr, epoch, string(r.Multi[5].Bulk))
+		d := int64(0)
+		if down {
+			d = 1
+		}
+		return &resp.Resp{
+			Type:  resp.MultiResp,
+			Multi: []*resp.Resp{integer(d), bulk(leader), integer(int64(leaderEpoch))},
+		}
+	}
+
+	if len(r.Multi) != 3 {
+		return respInvalidParam
+	}
+	if string(r.Multi[2].Bulk) != s.cfg.Name {
+		if sub == "get-master-addr-by-name" {
+			return &resp.Resp{Type: resp.MultiResp}
+		}
+		return respErr(ErrNoSuchMaster)
+	}
+
+	switch sub {
+	case "get-master-addr-by-name":
+		host, port, _ := net.SplitHostPort(s.MasterAddr())
+		return &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{bulk(host), bulk(port)}}
+	case "master":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		host, port, _ := net.SplitHostPort(s.master.addr)
+		return &resp.Resp{
+			Type: resp.MultiResp,
+			Multi: []*resp.Resp{
+				bulk("name"), bulk(s.cfg.Name),
+				bulk("ip"), bulk(host),
+				bulk("port"), bulk(port),
+				bulk("flags"), bulk(s.nodeFlags(s.master, true)),
+				bulk("config-epoch"), bulk(strconv.FormatUint(s.configEpoch, 10)),
+				bulk("num-slaves"), bulk(strconv.Itoa(len(s.replicas))),
+				bulk("quorum"), bulk(strconv.Itoa(s.cfg.Quorum)),
+			},
+		}
+	case "replicas", "slaves":
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		ret := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{}}
+		for _, n := range s.replicas {
+			host, port, _ := net.SplitHostPort(n.addr)
+			ret.Multi = append(ret.Multi, &resp.Resp{
+				Type: resp.MultiResp,
+				Multi: []*resp.Resp{
+					bulk("ip"), bulk(host),
+					bulk("port"), bulk(port),
+					bulk("flags"), bulk(s.nodeFlags(n, false)),
+					bulk("master-link-status"), bulk(n.linkState),
+					bulk("slave-repl-offset"), bulk(strconv.FormatInt(n.offset, 10)),
+				},
+			})
+		}
+		return ret
+	case "failover":
+		// forced, without asking the other sentinels
+		s.lock.Lock()
+		s.currentEpoch++
+		epoch := s.currentEpoch
+		s.lock.Unlock()
+		if err := s.failover(epoch); err != nil {
+			return respErr(err)
+		}
+		return &resp.Resp{Type: resp.SimpleString, Status: "OK"}
+	}
+	return respInvalidParam
+}
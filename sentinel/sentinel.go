@@ -0,0 +1,461 @@
+package sentinel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const callTimeout = 500 * time.Millisecond
+
+type Config struct {
+	Addr            string        // address the sentinel listens on
+	Name            string        // name of the monitored primary
+	Master          string        // initial primary, host:port
+	Quorum          int           // sentinels that must agree the primary is down
+	Peers           []string      // addresses of the other sentinels
+	DownAfter       time.Duration // a primary that doesn't answer this long is down
+	FailoverTimeout time.Duration
+	Period          time.Duration // how often nodes and peers are checked
+	User            string        // user the sentinel authenticates to the nodes as
+	Password        string        // no authentication if empty
+}
+
+// node is a jj-server as last seen by the sentinel
+type node struct {
+	addr       string
+	lastOk     time.Time
+	role       string
+	offset     int64
+	masterAddr string // primary a replica follows
+	linkState  string
+}
+
+// Sentinel watches a primary and its replicas. When enough sentinels agree
+// that the primary is down, they elect one of them in a new epoch, which
+// promotes the most up to date replica. The others learn the new primary
+// from the configuration epoch of their peers.
+type Sentinel struct {
+	cfg   Config
+	runid string
+
+	lock         sync.Mutex
+	master       *node
+	replicas     map[string]*node
+	configEpoch  uint64
+	currentEpoch uint64
+	leader       string // sentinel voted for in leaderEpoch
+	leaderEpoch  uint64
+	nextFailover time.Time
+}
+
+func New(cfg Config) *Sentinel {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return &Sentinel{
+		cfg:      cfg,
+		runid:    hex.EncodeToString(b),
+		master:   &node{addr: cfg.Master, role: "master", lastOk: time.Now()},
+		replicas: make(map[string]*node),
+	}
+}
+
+// MasterAddr returns the address of the current primary
+func (s *Sentinel) MasterAddr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.master.addr
+}
+
+func (s *Sentinel) Run() {
+	log.Info("sentinel listening on", s.cfg.Addr)
+	listener, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		for range time.Tick(s.cfg.Period) {
+			s.tick()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// nodeAuth is the AUTH command for the jj-server nodes, nil if there is no
+// password
+func (s *Sentinel) nodeAuth() []string {
+	switch {
+	case s.cfg.Password == "":
+		return nil
+	case s.cfg.User == "":
+		return []string{"auth", s.cfg.Password}
+	}
+	return []string{"auth", s.cfg.User, s.cfg.Password}
+}
+
+// call sends one command to addr and reads the reply, after the AUTH
+// command auth if there is one
+func call(auth []string, addr string, args ...string) (*resp.Resp, error) {
+	conn, err := net.DialTimeout("tcp", addr, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(callTimeout))
+	br := bufio.NewReader(conn)
+
+	if auth != nil {
+		if _, err := roundTrip(conn, br, auth); err != nil {
+			return nil, err
+		}
+	}
+	return roundTrip(conn, br, args)
+}
+
+func roundTrip(conn net.Conn, br *bufio.Reader, args []string) (*resp.Resp, error) {
+	r := &resp.Resp{Type: resp.MultiResp}
+	for _, a := range args {
+		r.Multi = append(r.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(a)})
+	}
+	b, _ := r.Bytes()
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	ret, err := resp.Parse(br)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Type == resp.ErrorResp {
+		return nil, errors.New(ret.Error)
+	}
+	return ret, nil
+}
+
+type roleInfo struct {
+	role       string
+	offset     int64
+	masterAddr string
+	linkState  string
+	replicas   []string
+}
+
+func queryRole(auth []string, addr string) (*roleInfo, error) {
+	r, err := call(auth, addr, "role")
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Multi) == 3 && string(r.Multi[0].Bulk) == "master" {
+		info := &roleInfo{role: "master", offset: r.Multi[1].Integer}
+		for _, rp := range r.Multi[2].Multi {
+			if len(rp.Multi) == 3 {
+				info.replicas = append(info.replicas, net.JoinHostPort(string(rp.Multi[0].Bulk), string(rp.Multi[1].Bulk)))
+			}
+		}
+		return info, nil
+	}
+	if len(r.Multi) == 5 && string(r.Multi[0].Bulk) == "slave" {
+		return &roleInfo{
+			role:       "slave",
+			masterAddr: net.JoinHostPort(string(r.Multi[1].Bulk), string(r.Multi[2].Bulk)),
+			linkState:  string(r.Multi[3].Bulk),
+			offset:     r.Multi[4].Integer,
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected role reply %+v", r)
+}
+
+func (s *Sentinel) tick() {
+	s.syncPeers()
+	s.checkNodes()
+
+	s.lock.Lock()
+	down := s.masterDown()
+	s.lock.Unlock()
+	if !down {
+		return
+	}
+	if n := s.agreeDown(); n < s.cfg.Quorum {
+		return
+	}
+	s.tryFailover()
+}
+
+// masterDown must be called with the lock held
+func (s *Sentinel) masterDown() bool {
+	return time.Since(s.master.lastOk) > s.cfg.DownAfter
+}
+
+// syncPeers adopts the primary of a peer with a newer configuration
+func (s *Sentinel) syncPeers() {
+	for _, peer := range s.cfg.Peers {
+		r, err := call(nil, peer, "sentinel", "master", s.cfg.Name)
+		if err != nil {
+			continue
+		}
+		fields := make(map[string]string)
+		for i := 0; i+1 < len(r.Multi); i += 2 {
+			fields[string(r.Multi[i].Bulk)] = string(r.Multi[i+1].Bulk)
+		}
+		epoch, err := strconv.ParseUint(fields["config-epoch"], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.lock.Lock()
+		if epoch > s.configEpoch {
+			s.switchMaster(net.JoinHostPort(fields["ip"], fields["port"]), epoch)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// switchMaster must be called with the lock held
+func (s *Sentinel) switchMaster(addr string, epoch uint64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	s.configEpoch = epoch
+	if addr == s.master.addr {
+		return
+	}
+	log.Infof("switch master %s %s -> %s (epoch %d)", s.cfg.Name, s.master.addr, addr, epoch)
+	old := s.master
+	n, ok := s.replicas[addr]
+	if !ok {
+		n = &node{addr: addr}
+	}
+	delete(s.replicas, addr)
+	n.lastOk = time.Now()
+	s.master = n
+	s.replicas[old.addr] = old
+}
+
+// checkNodes refreshes the state of all nodes, and points replicas that
+// follow someone else, or a former primary that came back, to the primary
+func (s *Sentinel) checkNodes() {
+	s.lock.Lock()
+	addrs := []string{s.master.addr}
+	for addr := range s.replicas {
+		addrs = append(addrs, addr)
+	}
+	s.lock.Unlock()
+
+	for _, addr := range addrs {
+		info, err := queryRole(s.nodeAuth(), addr)
+		if err != nil {
+			continue
+		}
+		s.lock.Lock()
+		n := s.replicas[addr]
+		if addr == s.master.addr {
+			n = s.master
+			for _, r := range info.replicas {
+				if _, ok := s.replicas[r]; !ok && r != s.master.addr {
+					s.replicas[r] = &node{addr: r}
+				}
+			}
+		}
+		if n != nil {
+			n.lastOk = time.Now()
+			n.role = info.role
+			n.offset = info.offset
+			n.masterAddr = info.masterAddr
+			n.linkState = info.linkState
+		}
+		s.lock.Unlock()
+	}
+
+	s.lock.Lock()
+	if s.masterDown() || s.master.role != "master" {
+		s.lock.Unlock()
+		return
+	}
+	master := s.master.addr
+	var stray []string
+	for _, n := range s.replicas {
+		if time.Since(n.lastOk) <= s.cfg.DownAfter && (n.role == "master" || n.masterAddr != master) {
+			stray = append(stray, n.addr)
+		}
+	}
+	s.lock.Unlock()
+
+	host, port, _ := net.SplitHostPort(master)
+	for _, addr := range stray {
+		log.Infof("pointing %s to master %s", addr, master)
+		if _, err := call(s.nodeAuth(), addr, "replicaof", host, port); err != nil {
+			log.Warning(err)
+		}
+	}
+}
+
+// agreeDown counts the sentinels, this one included, that see the primary down
+func (s *Sentinel) agreeDown() int {
+	s.lock.Lock()
+	host, port, _ := net.SplitHostPort(s.master.addr)
+	epoch := s.currentEpoch
+	s.lock.Unlock()
+
+	n := 1
+	for _, peer := range s.cfg.Peers {
+		r, err := call(nil, peer, "sentinel", "is-master-down-by-addr", host, port, strconv.FormatUint(epoch, 10), "*")
+		if err == nil && len(r.Multi) == 3 && r.Multi[0].Integer == 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// tryFailover asks the peers to elect this sentinel in a new epoch, and
+// fails over if a majority of the sentinels, and at least quorum, voted for it
+func (s *Sentinel) tryFailover() {
+	s.lock.Lock()
+	if time.Now().Before(s.nextFailover) {
+		s.lock.Unlock()
+		return
+	}
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	s.leader, s.leaderEpoch = s.runid, epoch
+	s.nextFailover = time.Now().Add(s.failoverDelay())
+	host, port, _ := net.SplitHostPort(s.master.addr)
+	s.lock.Unlock()
+
+	votes := 1
+	for _, peer := range s.cfg.Peers {
+		r, err := call(nil, peer, "sentinel", "is-master-down-by-addr", host, port, strconv.FormatUint(epoch, 10), s.runid)
+		if err == nil && len(r.Multi) == 3 && string(r.Multi[1].Bulk) == s.runid && uint64(r.Multi[2].Integer) == epoch {
+			votes++
+		}
+	}
+	needed := (len(s.cfg.Peers)+1)/2 + 1
+	if s.cfg.Quorum > needed {
+		needed = s.cfg.Quorum
+	}
+	if votes < needed {
+		log.Infof("not elected for failover of %s in epoch %d, %d/%d votes", s.cfg.Name, epoch, votes, needed)
+		return
+	}
+	if err := s.failover(epoch); err != nil {
+		log.Warningf("failover of %s failed, %v", s.cfg.Name, err)
+	}
+}
+
+// failoverDelay is the failover timeout plus some jitter, so that sentinels
+// that split the votes don't try again at the same time
+func (s *Sentinel) failoverDelay() time.Duration {
+	d := s.cfg.FailoverTimeout
+	if n, err := rand.Int(rand.Reader, big.NewInt(int64(d/2)+1)); err == nil {
+		d += time.Duration(n.Int64())
+	}
+	return d
+}
+
+// pickReplica returns the replica that got furthest in the replication
+// stream among those seen in the last maxAge
+func pickReplica(nodes []*node, maxAge time.Duration) *node {
+	var candidates []*node
+	for _, n := range nodes {
+		if n.role == "slave" && time.Since(n.lastOk) <= maxAge {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].offset != candidates[j].offset {
+			return candidates[i].offset > candidates[j].offset
+		}
+		return candidates[i].addr < candidates[j].addr
+	})
+	return candidates[0]
+}
+
+func (s *Sentinel) failover(epoch uint64) error {
+	s.lock.Lock()
+	var nodes []*node
+	for _, n := range s.replicas {
+		nodes = append(nodes, n)
+	}
+	candidate := pickReplica(nodes, s.cfg.DownAfter)
+	s.lock.Unlock()
+	if candidate == nil {
+		return ErrNoReplica
+	}
+
+	log.Infof("promoting %s for %s in epoch %d", candidate.addr, s.cfg.Name, epoch)
+	if _, err := call(s.nodeAuth(), candidate.addr, "replicaof", "no", "one"); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.cfg.FailoverTimeout)
+	for {
+		info, err := queryRole(s.nodeAuth(), candidate.addr)
+		if err == nil && info.role == "master" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not promoted in time", candidate.addr)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	s.lock.Lock()
+	if epoch < s.configEpoch {
+		s.lock.Unlock()
+		return fmt.Errorf("a newer failover happened in epoch %d", s.configEpoch)
+	}
+	s.switchMaster(candidate.addr, epoch)
+	var others []string
+	for addr := range s.replicas {
+		others = append(others, addr)
+	}
+	s.lock.Unlock()
+
+	host, port, _ := net.SplitHostPort(candidate.addr)
+	for _, addr := range others {
+		call(s.nodeAuth(), addr, "replicaof", host, port)
+	}
+	return nil
+}
+
+// vote answers is-master-down-by-addr. A sentinel votes for the first
+// sentinel that asks in an epoch, and then waits before trying itself.
+func (s *Sentinel) vote(addr string, epoch uint64, runid string) (bool, string, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	down := addr == s.master.addr && s.masterDown()
+	if runid == "*" {
+		return down, "*", 0
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if epoch > s.leaderEpoch {
+		s.leader, s.leaderEpoch = runid, epoch
+		if runid != s.runid {
+			s.nextFailover = time.Now().Add(s.failoverDelay())
+		}
+	}
+	return down, s.leader, s.leaderEpoch
+}
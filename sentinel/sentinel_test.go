@@ -0,0 +1,195 @@
+package sentinel
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"jj/server"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+func startServer(t *testing.T) string {
+	addr := freeAddr(t)
+	go server.NewServer(addr).Run()
+	waitFor(t, "server", func() bool {
+		_, err := call(nil, addr, "ping")
+		return err == nil
+	})
+	return addr
+}
+
+// proxy forwards to a server until it is closed, which makes the server
+// look down
+type proxy struct {
+	l     net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &proxy{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, err := net.Dial("tcp", target)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			p.lock.Lock()
+			p.conns = append(p.conns, c, b)
+			p.lock.Unlock()
+			go io.Copy(b, c)
+			go io.Copy(c, b)
+		}
+	}()
+	return p
+}
+
+func (p *proxy) Close() {
+	p.l.Close()
+	p.lock.Lock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.lock.Unlock()
+}
+
+func TestPickReplica(t *testing.T) {
+	now := time.Now()
+	nodes := []*node{
+		{addr: "b:1", role: "slave", offset: 10, lastOk: now},
+		{addr: "a:1", role: "slave", offset: 10, lastOk: now},
+		{addr: "c:1", role: "slave", offset: 20, lastOk: now.Add(-time.Minute)},
+		{addr: "d:1", role: "master", offset: 30, lastOk: now},
+	}
+	if n := pickReplica(nodes, time.Second); n.addr != "a:1" {
+		t.Error("pick", n.addr)
+	}
+	if n := pickReplica(nodes[2:], time.Second); n != nil {
+		t.Error("pick", n.addr)
+	}
+}
+
+func TestVote(t *testing.T) {
+	s := New(Config{Master: "m:1", DownAfter: time.Second, FailoverTimeout: time.Second})
+	if _, leader, epoch := s.vote("m:1", 1, "x"); leader != "x" || epoch != 1 {
+		t.Error("vote", leader, epoch)
+	}
+	// one vote per epoch
+	if _, leader, _ := s.vote("m:1", 1, "y"); leader != "x" {
+		t.Error("vote", leader)
+	}
+	if _, leader, epoch := s.vote("m:1", 2, "y"); leader != "y" || epoch != 2 {
+		t.Error("vote", leader, epoch)
+	}
+	if down, _, _ := s.vote("m:1", 2, "*"); down {
+		t.Error("master is up")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary := startServer(t)
+	p := newProxy(t, primary)
+	replicas := []string{startServer(t), startServer(t)}
+	host, port, _ := net.SplitHostPort(p.l.Addr().String())
+	for _, r := range replicas {
+		if _, err := call(nil, r, "replicaof", host, port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := call(nil, p.l.Addr().String(), "jdocset", "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	var sentinels []*Sentinel
+	for i, addr := range addrs {
+		var peers []string
+		for j, peer := range addrs {
+			if j != i {
+				peers = append(peers, peer)
+			}
+		}
+		s := New(Config{
+			Addr:            addr,
+			Name:            "mymaster",
+			Master:          p.l.Addr().String(),
+			Quorum:          2,
+			Peers:           peers,
+			DownAfter:       300 * time.Millisecond,
+			FailoverTimeout: time.Second,
+			Period:          50 * time.Millisecond,
+		})
+		go s.Run()
+		sentinels = append(sentinels, s)
+	}
+
+	waitFor(t, "replicas", func() bool {
+		r, err := call(nil, addrs[0], "sentinel", "replicas", "mymaster")
+		return err == nil && len(r.Multi) == 2
+	})
+	p.Close()
+
+	var promoted string
+	waitFor(t, "failover", func() bool {
+		r, err := call(nil, addrs[0], "sentinel", "get-master-addr-by-name", "mymaster")
+		if err != nil || len(r.Multi) != 2 {
+			return false
+		}
+		promoted = net.JoinHostPort(string(r.Multi[0].Bulk), string(r.Multi[1].Bulk))
+		return promoted == replicas[0] || promoted == replicas[1]
+	})
+	for _, s := range sentinels {
+		waitFor(t, "all sentinels agree", func() bool {
+			return s.MasterAddr() == promoted
+		})
+	}
+
+	other := replicas[0]
+	if other == promoted {
+		other = replicas[1]
+	}
+	if _, err := call(nil, promoted, "jdocset", "b", "2"); err != nil {
+		t.Fatal("promoted replica is writable", err)
+	}
+	waitFor(t, "other replica follows", func() bool {
+		r, err := call(nil, other, "jdocget", "b")
+		return err == nil && string(r.Bulk) == "2"
+	})
+	if r, _ := call(nil, other, "jdocget", "a"); string(r.Bulk) != "1" {
+		t.Error("data before failover", r)
+	}
+	if _, err := call(nil, other, "jdocset", "c", "3"); err == nil || !strings.HasPrefix(err.Error(), "READONLY") {
+		t.Error("other replica is read only", err)
+	}
+}
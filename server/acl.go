@@ -0,0 +1,797 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"jj/resp"
+	"jj/utils"
+
+	log "github.com/ngaut/logging"
+)
+
+const (
+	defaultUser   = "default"
+	aclCategories = flagRead | flagWrite | flagAdmin
+)
+
+var aclCategoryNames = []struct {
+	name string
+	flag int
+}{
+	{"read", flagRead},
+	{"write", flagWrite},
+	{"admin", flagAdmin},
+}
+
+var (
+	ErrNoAuth       = errors.New("NOAUTH Authentication required.")
+	ErrWrongPass    = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	ErrNoPermKey    = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+	ErrDelDefault   = errors.New("the 'default' user cannot be removed")
+	ErrNoACLFile    = errors.New("this server is not configured to use an ACL file")
+	ErrHelloNoAuth  = errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH option can be used")
+	ErrInvalidRule  = errors.New("invalid ACL rule")
+	ErrInvalidUser  = errors.New("invalid ACL user name")
+	ErrInvalidEntry = errors.New("invalid ACL file entry")
+)
+
+// aclUser is what a user may run: the commands of its categories, minus or
+// plus single commands, on the keys matching its patterns, without the
+// paths its path rules hide
+type aclUser struct {
+	name       string
+	enabled    bool
+	nopass     bool
+	passwords  map[string]bool // sha256 of the passwords, in hex
+	categories int
+	commands   map[string]bool // commands allowed or denied beyond the categories
+	allKeys    bool
+	keys       []string
+	paths      []pathRule
+	deleted    bool
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		passwords: make(map[string]bool),
+		commands:  make(map[string]bool),
+	}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = make(map[string]bool, len(u.passwords))
+	for h := range u.passwords {
+		c.passwords[h] = true
+	}
+	c.commands = make(map[string]bool, len(u.commands))
+	for op, ok := range u.commands {
+		c.commands[op] = ok
+	}
+	c.keys = append([]string(nil), u.keys...)
+	c.paths = append([]pathRule(nil), u.paths...)
+	return &c
+}
+
+func hashPassword(pass string) string {
+	h := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(h[:])
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// setRule applies a rule of ACL SETUSER:
+//
+//	on off nopass resetpass >pass <pass #hash !hash
+//	~pattern allkeys resetkeys
+//	+@category -@category allcommands nocommands +command -command
+//	denypath:path redactpath:path resetpaths
+//	reset
+func (u *aclUser) setRule(rule string) error {
+	if rule == "" {
+		return ErrInvalidRule
+	}
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]bool)
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]bool)
+		return nil
+	case "allkeys":
+		u.allKeys, u.keys = true, nil
+		return nil
+	case "resetkeys":
+		u.allKeys, u.keys = false, nil
+		return nil
+	case "resetpaths":
+		u.paths = nil
+		return nil
+	case "allcommands":
+		return u.setCategory(aclCategories, true)
+	case "nocommands":
+		return u.setCategory(aclCategories, false)
+	case "reset":
+		*u = *newACLUser(u.name)
+		return nil
+	}
+
+	if i := strings.IndexByte(rule, ':'); i > 0 {
+		kind := strings.ToLower(rule[:i])
+		if kind == "denypath" || kind == "redactpath" {
+			r, err := newPathRule(rule[i+1:], kind == "redactpath")
+			if err != nil {
+				return err
+			}
+			u.paths = append(u.paths, r)
+			return nil
+		}
+	}
+
+	arg := rule[1:]
+	switch rule[0] {
+	case '>':
+		u.passwords[hashPassword(arg)] = true
+		u.nopass = false
+	case '<':
+		delete(u.passwords, hashPassword(arg))
+	case '#':
+		if !isPasswordHash(arg) {
+			return fmt.Errorf("%v: '%s' is not a sha256 hash", ErrInvalidRule, rule)
+		}
+		u.passwords[arg] = true
+		u.nopass = false
+	case '!':
+		delete(u.passwords, arg)
+	case '~':
+		if arg == "*" {
+			u.allKeys, u.keys = true, nil
+		} else if !u.allKeys {
+			u.keys = append(u.keys, arg)
+		}
+	case '+', '-':
+		allow := rule[0] == '+'
+		if strings.HasPrefix(arg, "@") {
+			cat := strings.ToLower(arg[1:])
+			if cat == "all" {
+				return u.setCategory(aclCategories, allow)
+			}
+			for _, c := range aclCategoryNames {
+				if c.name == cat {
+					return u.setCategory(c.flag, allow)
+				}
+			}
+			return fmt.Errorf("%v: unknown category '%s'", ErrInvalidRule, arg)
+		}
+		op := strings.ToLower(arg)
+		if _, ok := commands[op]; !ok {
+			return fmt.Errorf("%v: unknown command '%s'", ErrInvalidRule, arg)
+		}
+		u.commands[op] = allow
+	default:
+		return fmt.Errorf("%v: '%s'", ErrInvalidRule, rule)
+	}
+	return nil
+}
+
+// setCategory allows or denies the categories, which overrides the rules
+// given before for their commands
+func (u *aclUser) setCategory(flags int, allow bool) error {
+	if allow {
+		u.categories |= flags
+	} else {
+		u.categories &^= flags
+	}
+	for op := range u.commands {
+		if commands[op].flags&flags != 0 {
+			delete(u.commands, op)
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) canRun(op string, cmd *command) bool {
+	if allow, ok := u.commands[op]; ok {
+		return allow
+	}
+	cats := cmd.flags & aclCategories
+	return cats != 0 && cats&^u.categories == 0
+}
+
+func (u *aclUser) canAccess(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, p := range u.keys {
+		if utils.GlobMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) checkPassword(pass string) bool {
+	if u.nopass {
+		return true
+	}
+	h := hashPassword(pass)
+	ok := false
+	for p := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(h)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// flagNames are the flags of ACL GETUSER
+func (u *aclUser) flagNames() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	if u.categories == aclCategories && len(u.commands) == 0 {
+		flags = append(flags, "allcommands")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) commandRules() string {
+	var rules []string
+	if u.categories == aclCategories {
+		rules = append(rules, "+@all")
+	} else {
+		rules = append(rules, "-@all")
+		for _, c := range aclCategoryNames {
+			if u.categories&c.flag != 0 {
+				rules = append(rules, "+@"+c.name)
+			}
+		}
+	}
+	ops := make([]string, 0, len(u.commands))
+	for op := range u.commands {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		if u.commands[op] {
+			rules = append(rules, "+"+op)
+		} else {
+			rules = append(rules, "-"+op)
+		}
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) keyRules() string {
+	if u.allKeys {
+		return "~*"
+	}
+	rules := make([]string, len(u.keys))
+	for i, p := range u.keys {
+		rules[i] = "~" + p
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) pathRules() []string {
+	rules := make([]string, len(u.paths))
+	for i, r := range u.paths {
+		rules[i] = r.String()
+	}
+	return rules
+}
+
+func (u *aclUser) sortedPasswords() []string {
+	hashes := make([]string, 0, len(u.passwords))
+	for h := range u.passwords {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// String describes the user with the rules that create it, as in ACL LIST
+// and the ACL file
+func (u *aclUser) String() string {
+	rules := []string{"user", u.name, u.flagNames()[0]}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, h := range u.sortedPasswords() {
+		rules = append(rules, "#"+h)
+	}
+	if k := u.keyRules(); k != "" {
+		rules = append(rules, k)
+	} else {
+		rules = append(rules, "resetkeys")
+	}
+	rules = append(rules, u.commandRules())
+	rules = append(rules, u.pathRules()...)
+	return strings.Join(rules, " ")
+}
+
+// acl holds the users. Sessions keep a pointer to their user, so changes
+// apply to the authenticated sessions at their next command.
+type acl struct {
+	lock  sync.RWMutex
+	users map[string]*aclUser
+	file  string
+
+	// credentials sent to the other nodes
+	masterUser string
+	masterAuth string
+
+	// password of the default user set by requirepass
+	requirePass string
+}
+
+// newDefaultUser is the user of the sessions that don't authenticate: it
+// may run everything until it is given a password or restricted
+func newDefaultUser() *aclUser {
+	u := newACLUser(defaultUser)
+	u.enabled, u.nopass, u.allKeys = true, true, true
+	u.categories = aclCategories
+	return u
+}
+
+func newACL() *acl {
+	return &acl{users: map[string]*aclUser{defaultUser: newDefaultUser()}}
+}
+
+// sessionUser is the user of a new session, nil if it has to authenticate
+func (a *acl) sessionUser() *aclUser {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u := a.users[defaultUser]
+	if u.enabled && u.nopass {
+		return u
+	}
+	return nil
+}
+
+func (a *acl) authenticate(name string, pass string) (*aclUser, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.users[name]
+	if !ok || !u.enabled || !u.checkPassword(pass) {
+		return nil, ErrWrongPass
+	}
+	return u, nil
+}
+
+func (a *acl) fileName() string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.file
+}
+
+// certUser is the enabled user name, which a client certificate names
+func (a *acl) certUser(name string) *aclUser {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if u, ok := a.users[name]; ok && u.enabled {
+		return u
+	}
+	return nil
+}
+
+// authenticated tells if u is still a user, sessions of a deleted user have
+// to authenticate again
+func (a *acl) authenticated(u *aclUser) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return u != nil && !u.deleted
+}
+
+// check tells if the user may run the command on its keys
+func (a *acl) check(u *aclUser, op string, cmd *command, r *resp.Resp) error {
+	if cmd.flags&flagNoAuth != 0 {
+		return nil
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if u == nil || u.deleted {
+		return ErrNoAuth
+	}
+	// every user may ask who it is
+	if op == "acl" && len(r.Multi) == 2 && strings.EqualFold(string(r.Multi[1].Bulk), "whoami") {
+		return nil
+	}
+	if !u.canRun(op, cmd) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", op)
+	}
+	if u.allKeys {
+		return nil
+	}
+	keys, _ := r.Keys()
+	for _, k := range keys {
+		if !u.canAccess(string(k)) {
+			return ErrNoPermKey
+		}
+	}
+	return nil
+}
+
+// checkKey tells if the user may run op on key, or run op at all if key
+// is nil
+func (a *acl) checkKey(u *aclUser, op string, key *string) error {
+	r := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{bulk(op)}}
+	if key != nil {
+		r.Multi = append(r.Multi, bulk(*key))
+	}
+	return a.check(u, op, commands[op], r)
+}
+
+func (a *acl) canAccess(u *aclUser, key string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return u != nil && !u.deleted && u.canAccess(key)
+}
+
+// keyFilter tells which keys u may access, it is nil if u may access all of
+// them. Commands naming index entries rather than keys filter through it.
+func (a *acl) keyFilter(u *aclUser) func(key string) bool {
+	a.lock.RLock()
+	all := u != nil && !u.deleted && u.allKeys
+	a.lock.RUnlock()
+	if all {
+		return nil
+	}
+	return func(key string) bool {
+		return a.canAccess(u, key)
+	}
+}
+
+// checkKeys refuses the keys u may not access, for the index commands whose
+// key arguments check leaves out
+func (a *acl) checkKeys(u *aclUser, keys ...string) error {
+	for _, k := range keys {
+		if !a.canAccess(u, k) {
+			return ErrNoPermKey
+		}
+	}
+	return nil
+}
+
+// pathFilter returns the path rules of the user, nil if it has none
+func (a *acl) pathFilter(u *aclUser) *pathFilter {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if u == nil || len(u.paths) == 0 {
+		return nil
+	}
+	return &pathFilter{rules: u.paths}
+}
+
+func validUserName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n")
+}
+
+// setUser applies the rules to the user, created if needed, or leaves it
+// as it was if a rule is invalid
+func (a *acl) setUser(name string, rules []string) error {
+	if !validUserName(name) {
+		return ErrInvalidUser
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	u, ok := a.users[name]
+	var c *aclUser
+	if ok {
+		c = u.clone()
+	} else {
+		c = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := c.setRule(rule); err != nil {
+			return err
+		}
+	}
+	if ok {
+		*u = *c
+	} else {
+		a.users[name] = c
+	}
+	return nil
+}
+
+func (a *acl) getUser(name string) (*aclUser, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.users[name]
+	if !ok {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// delUsers removes the users, whose sessions have to authenticate again
+func (a *acl) delUsers(names []string) (int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	n := 0
+	for _, name := range names {
+		if name == defaultUser {
+			return n, ErrDelDefault
+		}
+		if u, ok := a.users[name]; ok {
+			u.deleted = true
+			delete(a.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (a *acl) userNames() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (a *acl) list() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	lines := make([]string, 0, len(a.users))
+	for _, u := range a.users {
+		lines = append(lines, u.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// parseACLFile reads the lines of ACL LIST, one user per line. The default
+// user is added if the file doesn't define it.
+func parseACLFile(path string) (map[string]*aclUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" || !validUserName(fields[1]) {
+			return nil, fmt.Errorf("%v at %s:%d", ErrInvalidEntry, path, n)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return nil, fmt.Errorf("%v at %s:%d: duplicate user '%s'", ErrInvalidEntry, path, n, fields[1])
+		}
+		u := newACLUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.setRule(rule); err != nil {
+				return nil, fmt.Errorf("%v at %s:%d", err, path, n)
+			}
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, ok := users[defaultUser]; !ok {
+		users[defaultUser] = newDefaultUser()
+	}
+	return users, nil
+}
+
+// load replaces the users with those of the ACL file. Users that are kept
+// are updated in place, the sessions of the others have to authenticate
+// again. Nothing changes if the file is invalid.
+func (a *acl) load() error {
+	a.lock.RLock()
+	path := a.file
+	a.lock.RUnlock()
+	if path == "" {
+		return ErrNoACLFile
+	}
+	users, err := parseACLFile(path)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for name, u := range a.users {
+		if nu, ok := users[name]; ok {
+			*u = *nu
+			users[name] = u
+		} else {
+			u.deleted = true
+		}
+	}
+	a.users = users
+	return nil
+}
+
+// save writes the users to the ACL file, through a temporary file so it is
+// never left half written
+func (a *acl) save() error {
+	a.lock.RLock()
+	path := a.file
+	a.lock.RUnlock()
+	if path == "" {
+		return ErrNoACLFile
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(a.list(), "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// nodeAuth is the AUTH command for the other nodes of a replication or a
+// cluster, nil if masterauth is not set
+func (a *acl) nodeAuth() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	switch {
+	case a.masterAuth == "":
+		return nil
+	case a.masterUser == "":
+		return []string{"auth", a.masterAuth}
+	}
+	return []string{"auth", a.masterUser, a.masterAuth}
+}
+
+// LoadACL sets the ACL file and loads its users. A missing file is created
+// by ACL SAVE.
+func (s *Server) LoadACL(path string) error {
+	s.acl.lock.Lock()
+	s.acl.file = path
+	s.acl.lock.Unlock()
+	err := s.acl.load()
+	if os.IsNotExist(err) {
+		log.Warningf("acl file %s not found, it will be created by ACL SAVE", path)
+		return nil
+	}
+	return err
+}
+
+// auth [username] password
+func cmdAuth(r *resp.Resp, client *session) *resp.Resp {
+	var name, pass string
+	switch len(r.Multi) {
+	case 2:
+		name, pass = defaultUser, string(r.Multi[1].Bulk)
+	case 3:
+		name, pass = string(r.Multi[1].Bulk), string(r.Multi[2].Bulk)
+	default:
+		return RespInvalidParam
+	}
+	u, err := client.srv.acl.authenticate(name, pass)
+	if err != nil {
+		log.Warningf("failed authentication of %s from %v", name, client.RemoteAddr())
+		return RespErr(err)
+	}
+	client.user = u
+	return RespOk
+}
+
+// acl is added here as its rules look the commands up
+func init() {
+	commands["acl"] = &command{cmdACL, flagAdmin}
+}
+
+// acl setuser <username> [rule ...]
+// acl getuser <username>
+// acl deluser <username> [username ...]
+// acl list
+// acl users
+// acl whoami
+// acl load
+// acl save
+func cmdACL(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+
+	a := client.srv.acl
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "setuser":
+		if len(r.Multi) < 3 {
+			return RespInvalidParam
+		}
+		rules := make([]string, 0, len(r.Multi)-3)
+		for _, arg := range r.Multi[3:] {
+			rules = append(rules, string(arg.Bulk))
+		}
+		if err := a.setUser(string(r.Multi[2].Bulk), rules); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	case "getuser":
+		if len(r.Multi) != 3 {
+			return RespInvalidParam
+		}
+		u, ok := a.getUser(string(r.Multi[2].Bulk))
+		if !ok {
+			return RespNil
+		}
+		return &resp.Resp{
+			Type: resp.MapResp,
+			Multi: []*resp.Resp{
+				bulk("flags"), bulkStrings(u.flagNames()),
+				bulk("passwords"), bulkStrings(u.sortedPasswords()),
+				bulk("commands"), bulk(u.commandRules()),
+				bulk("keys"), bulk(u.keyRules()),
+				bulk("paths"), bulkStrings(u.pathRules()),
+			},
+		}
+	case "deluser":
+		if len(r.Multi) < 3 {
+			return RespInvalidParam
+		}
+		names := make([]string, 0, len(r.Multi)-2)
+		for _, arg := range r.Multi[2:] {
+			names = append(names, string(arg.Bulk))
+		}
+		n, err := a.delUsers(names)
+		if err != nil {
+			return RespErr(err)
+		}
+		return &resp.Resp{Type: resp.IntegerResp, Integer: int64(n)}
+	case "list":
+		return bulkStrings(a.list())
+	case "users":
+		return bulkStrings(a.userNames())
+	case "whoami":
+		if client.user == nil {
+			return RespErr(ErrNoAuth)
+		}
+		return bulk(client.user.name)
+	case "load":
+		if err := a.load(); err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		return RespOk
+	case "save":
+		if err := a.save(); err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		return RespOk
+	}
+	return RespInvalidParam
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"jj/resp"
+)
+
+func TestACL(t *testing.T) {
+	s := NewServer("")
+	admin := newTestClient(t, s)
+	defer admin.close()
+
+	admin.do("jdocset", "cache:1", `{"a": 1}`)
+	admin.do("jdocset", "user:1", `{"a": 1}`)
+	for _, args := range [][]string{
+		{"acl", "setuser", "alice", "on", ">secret", "~cache:*", "+@read", "+jset"},
+		{"acl", "setuser", "default", "resetpass", ">admin"},
+	} {
+		if r := admin.do(args...); r.Type != resp.SimpleString {
+			t.Fatal(args, r)
+		}
+	}
+	// the session authenticated before keeps its rights
+	if r := admin.do("acl", "whoami"); string(r.Bulk) != "default" {
+		t.Error("whoami", r)
+	}
+
+	c := newTestClient(t, s)
+	defer c.close()
+	if r := c.do("jget", "cache:1", "a"); r.Error != ErrNoAuth.Error() {
+		t.Error("noauth", r)
+	}
+	if r := c.do("hello", "3"); r.Error != ErrHelloNoAuth.Error() {
+		t.Error("hello noauth", r)
+	}
+	if r := c.do("auth", "alice", "nope"); r.Error != ErrWrongPass.Error() {
+		t.Error("wrongpass", r)
+	}
+	if r := c.do("auth", "alice", "secret"); r.Type != resp.SimpleString {
+		t.Fatal("auth", r)
+	}
+	if r := c.do("jget", "cache:1", "a"); string(r.Bulk) != "1" {
+		t.Error("read", r)
+	}
+	if r := c.do("jset", "cache:1", "a", "2"); r.Type != resp.SimpleString {
+		t.Error("jset", r)
+	}
+	if r := c.do("jget", "user:1", "a"); r.Error != ErrNoPermKey.Error() {
+		t.Error("key", r)
+	}
+	if r := c.do("jmget", "a", "cache:1", "user:1"); r.Error != ErrNoPermKey.Error() {
+		t.Error("jmget keys", r)
+	}
+	for _, op := range []string{"jdocdel", "acl", "config"} {
+		if r := c.do(op, "cache:1", "x"); !strings.HasPrefix(r.Error, "NOPERM") || !strings.Contains(r.Error, op) {
+			t.Error(op, r)
+		}
+	}
+
+	// a bad rule leaves the user as it was
+	if r := admin.do("acl", "setuser", "alice", "+@write", "+nope"); r.Type != resp.ErrorResp {
+		t.Error("bad rule", r)
+	}
+	r := admin.do("acl", "getuser", "alice")
+	if len(r.Multi) != 10 || string(r.Multi[5].Bulk) != "-@all +@read +jset" || string(r.Multi[7].Bulk) != "~cache:*" {
+		t.Error("getuser", r)
+	}
+	if r := admin.do("acl", "setuser", "alice", "+@write", "-jdocdel"); r.Type != resp.SimpleString {
+		t.Fatal(r)
+	}
+	if r := c.do("jdocset", "cache:2", "{}"); r.Type != resp.SimpleString {
+		t.Error("granted write", r)
+	}
+	if r := c.do("jdocdel", "cache:2"); !strings.HasPrefix(r.Error, "NOPERM") {
+		t.Error("denied command", r)
+	}
+	r = admin.do("acl", "list")
+	want := "user alice on #" + hashPassword("secret") + " ~cache:* -@all +@read +@write -jdocdel"
+	if len(r.Multi) != 2 || string(r.Multi[0].Bulk) != want {
+		t.Error("list", r)
+	}
+
+	// the sessions of a deleted user have to authenticate again
+	if r := admin.do("acl", "deluser", "alice", "bob"); r.Integer != 1 {
+		t.Error("deluser", r)
+	}
+	if r := admin.do("acl", "deluser", "default"); r.Type != resp.ErrorResp {
+		t.Error("deluser default", r)
+	}
+	if r := c.do("jget", "cache:1", "a"); r.Error != ErrNoAuth.Error() {
+		t.Error("deleted user", r)
+	}
+	if r := c.do("hello", "3", "auth", "default", "admin"); r.Type != resp.MapResp {
+		t.Error("hello auth", r)
+	}
+	if r := c.do("acl", "whoami"); string(r.Bulk) != "default" {
+		t.Error("whoami", r)
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	s := NewServer("")
+	if err := s.LoadACL(path); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s)
+	defer c.close()
+	c.do("acl", "setuser", "bob", "on", "nopass", "allkeys", "+@all", "-jdocdel")
+	c.do("acl", "setuser", "carol", "off", "#"+hashPassword("x"), "~a*", "~b*", "+jget")
+	if r := c.do("acl", "save"); r.Type != resp.SimpleString {
+		t.Fatal("save", r)
+	}
+	saved := c.do("acl", "list")
+
+	s2 := NewServer("")
+	if err := s2.LoadACL(path); err != nil {
+		t.Fatal(err)
+	}
+	c2 := newTestClient(t, s2)
+	defer c2.close()
+	b1, _ := saved.Bytes()
+	b2, _ := c2.do("acl", "list").Bytes()
+	if len(saved.Multi) != 3 || string(b1) != string(b2) {
+		t.Errorf("reloaded %q, saved %q", b2, b1)
+	}
+
+	// an invalid file changes nothing
+	os.WriteFile(path, []byte("user dave on +nope\n"), 0600)
+	if r := c2.do("acl", "load"); r.Type != resp.ErrorResp {
+		t.Error("invalid file", r)
+	}
+	if r := c2.do("acl", "users"); len(r.Multi) != 3 {
+		t.Error("users", r)
+	}
+	if r := NewServer("").LoadACL(path); r == nil {
+		t.Error("invalid file at start")
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("default", []string{"resetpass", ">admin"})
+	s.acl.setUser("reader", []string{"on", ">r", "~pub:*", "+@read"})
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+
+	do := func(method string, path string, user string, pass string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(`{"a": 1}`))
+		if pass != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for _, tc := range []struct {
+		method, path, user, pass string
+		status                   int
+	}{
+		{"PUT", "/docs/pub:1", "", "", http.StatusUnauthorized},
+		{"PUT", "/docs/pub:1", "", "nope", http.StatusUnauthorized},
+		{"PUT", "/docs/pub:1", "", "admin", http.StatusCreated},
+		{"PUT", "/docs/sec:1", "default", "admin", http.StatusCreated},
+		{"GET", "/docs/pub:1", "reader", "r", http.StatusOK},
+		{"GET", "/docs/sec:1", "reader", "r", http.StatusForbidden},
+		{"PUT", "/docs/pub:1", "reader", "r", http.StatusForbidden},
+		{"GET", "/ws", "", "", http.StatusUnauthorized},
+	} {
+		if status := do(tc.method, tc.path, tc.user, tc.pass); status != tc.status {
+			t.Error(tc, status)
+		}
+	}
+}
+
+func TestACLWatchStream(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("reader", []string{"on", "nopass", "~pub:*", "+@read"})
+	c := newTestClient(t, s)
+	defer c.close()
+	w := newTestClient(t, s)
+	defer w.close()
+
+	c.do("jdocset", "sec:1", "1")
+	w.do("auth", "reader", "x")
+	if r := w.do("jwatchstream", "*", "FROM", strconv.FormatUint(s.changelog.epoch, 10)); r.Type != resp.MultiResp {
+		t.Fatal(r)
+	}
+	c.do("jdocset", "sec:2", "2")
+	c.do("jdocset", "pub:1", "3")
+	if r := w.read(); string(r.Multi[2].Bulk) != "pub:1" {
+		t.Error("watched", r)
+	}
+}
+
+func TestACLKeylessCommands(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("reader", []string{"on", "nopass", "~pub:*", "+@read"})
+	admin := newTestClient(t, s)
+	defer admin.close()
+	c := newTestClient(t, s)
+	defer c.close()
+
+	admin.do("config", "set", "notify-keyspace-events", "KEd")
+	admin.do("jindex", "create", "byn", "sorted", "", "n")
+	admin.do("jindex", "create", "pos", "geo", "", "lat", "lon")
+	admin.do("jindex", "create", "vec", "vector", "", "v", "2", "l2")
+	for _, key := range []string{"pub:1", "sec:1", "pub:2"} {
+		admin.do("jdocset", key, `{"n": 1, "lat": 1, "lon": 1, "v": [1, 1]}`)
+	}
+	c.do("auth", "reader", "x")
+	if r := c.do("acl", "whoami"); string(r.Bulk) != "reader" {
+		t.Error("whoami", r)
+	}
+
+	for _, args := range [][]string{
+		{"jzrangebyscore", "byn", "-inf", "+inf", "WITHSCORES", "LIMIT", "1", "5"},
+		{"jzrange", "byn", "0", "-1"},
+		{"jgeoradius", "pos", "1", "1", "10", "km", "COUNT", "2"},
+		{"jknn", "vec", "3", "[1, 1]"},
+	} {
+		r := c.do(args...)
+		for _, item := range r.Multi {
+			if item.Type == resp.MultiResp {
+				item = item.Multi[0]
+			}
+			if strings.HasPrefix(string(item.Bulk), "sec:") {
+				t.Error(args[0], "denied key", r)
+			}
+		}
+	}
+	if r := c.do("jzrangebyscore", "byn", "-inf", "+inf", "LIMIT", "1", "5"); len(r.Multi) != 1 || string(r.Multi[0].Bulk) != "pub:2" {
+		t.Error("limit", r)
+	}
+	if r := c.do("jgeoradius", "pos", "1", "1", "10", "km", "COUNT", "2"); len(r.Multi) != 2 {
+		t.Error("count", r)
+	}
+	if r := c.do("scan", "0", "COUNT", "10000"); len(r.Multi[1].Multi) != 2 {
+		t.Error("scan", r)
+	}
+	// counts and positions only take the accessible keys in
+	if r := c.do("jzcard", "byn"); r.Integer != 2 {
+		t.Error("jzcard", r)
+	}
+	if r := c.do("jzrevrank", "byn", "pub:1"); r.Integer != 1 {
+		t.Error("jzrevrank", r)
+	}
+	if r := c.do("jzrevrange", "byn", "0", "1"); len(r.Multi) != 2 || string(r.Multi[1].Bulk) != "pub:1" {
+		t.Error("jzrevrange page", r)
+	}
+	for _, args := range [][]string{
+		{"jzrank", "byn", "sec:1"},
+		{"jzrevrank", "byn", "sec:1"},
+		{"jgeodist", "pos", "pub:1", "sec:1"},
+	} {
+		if r := c.do(args...); r.Error != ErrNoPermKey.Error() {
+			t.Error(args[0], r)
+		}
+	}
+
+	if r := c.do("psubscribe", "__key*"); r.Type != resp.MultiResp {
+		t.Fatal(r)
+	}
+	admin.do("jdocset", "sec:2", "1")
+	admin.do("jdocset", "pub:3", "1")
+	for _, channel := range []string{"__keyspace__:pub:3", "__keyevent__:" + OpDocSet} {
+		if r := c.read(); string(r.Multi[2].Bulk) != channel {
+			t.Error("notification", r)
+		}
+	}
+}
+
+func TestPathACL(t *testing.T) {
+	s := NewServer("")
+	admin := newTestClient(t, s)
+	defer admin.close()
+	admin.do("jdocset", "user:1", `{"name": "ann", "billing": {"card": "4111", "zip": "75001"}, "phones": ["1", "2"]}`)
+	admin.do("jdocset", "user:2", `{"name": "bob"}`)
+	if r := admin.do("acl", "setuser", "support", "on", "nopass", "allkeys", "+@all",
+		"denypath:billing.card", "redactpath:phones[1]"); r.Type != resp.SimpleString {
+		t.Fatal(r)
+	}
+	if r := admin.do("acl", "setuser", "x", "denypath:a..[x]"); r.Type != resp.ErrorResp {
+		t.Error("invalid path", r)
+	}
+	if r := admin.do("acl", "getuser", "support"); len(r.Multi) != 10 || len(r.Multi[9].Multi) != 2 {
+		t.Error("getuser", r)
+	}
+
+	c := newTestClient(t, s)
+	defer c.close()
+	c.do("auth", "support", "x")
+	if r := c.do("jdocget", "user:1"); string(r.Bulk) != `{"billing":{"zip":"75001"},"name":"ann","phones":["1","[redacted]"]}` {
+		t.Error("jdocget", r)
+	}
+	for path, want := range map[string]string{"billing.card": "", "billing.zip": `"75001"`, "phones[1]": `"[redacted]"`} {
+		if r := c.do("jget", "user:1", path); string(r.Bulk) != want {
+			t.Error("jget", path, r)
+		}
+	}
+	if r := c.do("jmget", "billing", "user:1"); string(r.Multi[0].Bulk) != `{"zip":"75001"}` {
+		t.Error("jmget", r)
+	}
+
+	for _, args := range [][]string{
+		{"jset", "user:1", "billing.card", `"x"`},
+		{"jset", "user:1", "billing", `{}`},
+		{"jset", "user:2", "billing.card", `"x"`},
+		{"jdocset", "user:1", `{"name": "ann"}`},
+		{"jdocdel", "user:1"},
+		{"jpop", "user:1", "phones"},
+	} {
+		if r := c.do(args...); r.Error != ErrNoPermPath.Error() {
+			t.Error(args, r)
+		}
+	}
+	for _, args := range [][]string{
+		{"jset", "user:1", "billing.zip", `"75002"`},
+		{"jset", "user:1", "name", `"ann b"`},
+		{"jdocset", "user:2", `{"name": "bob", "phones": []}`},
+	} {
+		if r := c.do(args...); r.Type != resp.SimpleString {
+			t.Error(args, r)
+		}
+	}
+	if r := admin.do("jget", "user:1", "billing"); string(r.Bulk) != `{"card":"4111","zip":"75002"}` {
+		t.Error("unchanged", r)
+	}
+	if r := admin.do("acl", "list"); !strings.Contains(string(r.Multi[1].Bulk), "+@all denypath:billing.card redactpath:phones[1]") {
+		t.Error("list", r)
+	}
+
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL+"/docs/user:1", nil)
+	req.SetBasicAuth("support", "x")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 256)
+	n, _ := res.Body.Read(b)
+	res.Body.Close()
+	if strings.Contains(string(b[:n]), "4111") || !strings.Contains(string(b[:n]), "75002") {
+		t.Errorf("http get %s", b[:n])
+	}
+}
+
+func TestPathACLWatchStream(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("reader", []string{"on", "nopass", "allkeys", "+@read", "denypath:secret"})
+	c := newTestClient(t, s)
+	defer c.close()
+	w := newTestClient(t, s)
+	defer w.close()
+
+	w.do("auth", "reader", "x")
+	if r := w.do("jwatchstream", "*"); r.Type != resp.MultiResp {
+		t.Fatal(r)
+	}
+	c.do("jdocset", "a", `{"secret": 1, "n": 1}`)
+	c.do("jset", "a", "secret", "2")
+	c.do("jset", "a", "n", "2")
+	if r := w.read(); string(r.Multi[5].Bulk) != `{"n":1}` {
+		t.Error("filtered", r)
+	}
+	if r := w.read(); string(r.Multi[3].Bulk) != "n" {
+		t.Error("denied change sent", r)
+	}
+}
+
+func TestPathACLIndexes(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("reader", []string{"on", "nopass", "allkeys", "+@read", "denypath:salary", "redactpath:home.lat"})
+	admin := newTestClient(t, s)
+	defer admin.close()
+	c := newTestClient(t, s)
+	defer c.close()
+
+	admin.do("jindex", "create", "bysalary", "sorted", "", "salary")
+	admin.do("jindex", "create", "byage", "sorted", "", "age")
+	admin.do("jindex", "create", "home", "geo", "", "home.lat", "home.lon")
+	admin.do("jindex", "create", "vec", "vector", "", "salary", "1", "l2")
+	admin.do("jdocset", "a", `{"salary": 100, "age": 30, "home": {"lat": 1, "lon": 1}}`)
+	admin.do("jdocset", "b", `{"salary": 200, "age": 40, "home": {"lat": 2, "lon": 2}}`)
+	c.do("auth", "reader", "x")
+
+	for _, args := range [][]string{
+		{"jzrangebyscore", "bysalary", "-inf", "+inf", "WITHSCORES"},
+		{"jzrange", "bysalary", "0", "-1"},
+		{"jzrank", "bysalary", "a"},
+		{"jzcard", "bysalary"},
+		{"jgeoradius", "home", "1", "1", "500", "km", "WITHCOORD"},
+		{"jgeodist", "home", "a", "b"},
+		{"jknn", "vec", "1", "[150]"},
+	} {
+		if r := c.do(args...); r.Error != ErrNoPermIndex.Error() {
+			t.Error(args[0], args[1], r)
+		}
+	}
+	if r := c.do("jzrangebyscore", "byage", "-inf", "+inf", "WITHSCORES"); len(r.Multi) != 4 {
+		t.Error("allowed index", r)
+	}
+	if r := admin.do("jzrank", "bysalary", "b"); r.Integer != 1 {
+		t.Error("admin", r)
+	}
+}
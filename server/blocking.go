@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"jj/resp"
+)
+
+var ErrInvalidTimeout = errors.New("timeout is not a float or out of range")
+
+// popWaiter is a session blocked in bjpop on one or more key/path pairs
+type popWaiter struct {
+	keys  []string
+	paths []string
+	wake  chan struct{}
+}
+
+// blockingPops queues the waiters of every key/path in arrival order. When
+// a mutation leaves n items in a watched array, the first n waiters are
+// woken; a waiter that finds nothing left gets back in at the front.
+type blockingPops struct {
+	lock    sync.Mutex
+	waiting map[string]map[string][]*popWaiter // key -> path -> waiters
+	quit    <-chan struct{}                    // closed on shutdown
+}
+
+func newBlockingPops(quit <-chan struct{}) *blockingPops {
+	return &blockingPops{
+		waiting: make(map[string]map[string][]*popWaiter),
+		quit:    quit,
+	}
+}
+
+func (bp *blockingPops) register(w *popWaiter, front bool) {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	for i, key := range w.keys {
+		paths, ok := bp.waiting[key]
+		if !ok {
+			paths = make(map[string][]*popWaiter)
+			bp.waiting[key] = paths
+		}
+		if front {
+			paths[w.paths[i]] = append([]*popWaiter{w}, paths[w.paths[i]]...)
+		} else {
+			paths[w.paths[i]] = append(paths[w.paths[i]], w)
+		}
+	}
+}
+
+func (bp *blockingPops) unregister(w *popWaiter) {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	for i, key := range w.keys {
+		paths := bp.waiting[key]
+		queue := paths[w.paths[i]]
+		for j, x := range queue {
+			if x == w {
+				queue = append(queue[:j], queue[j+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(paths, w.paths[i])
+		} else {
+			paths[w.paths[i]] = queue
+		}
+		if len(paths) == 0 {
+			delete(bp.waiting, key)
+		}
+	}
+}
+
+func (bp *blockingPops) onMutation(key string, path string, op string, doc interface{}) {
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	paths, ok := bp.waiting[key]
+	if !ok || doc == nil {
+		return
+	}
+	for p, queue := range paths {
+		n, err := jsonPathArrayLen(doc, p)
+		if err != nil {
+			continue
+		}
+		for ; n > 0 && len(queue) > 0; n-- {
+			select {
+			case queue[0].wake <- struct{}{}:
+			default:
+			}
+			queue = queue[1:]
+		}
+		if len(queue) == 0 {
+			delete(paths, p)
+		} else {
+			paths[p] = queue
+		}
+	}
+	if len(paths) == 0 {
+		delete(bp.waiting, key)
+	}
+}
+
+// tryPop pops from the first non-empty array of w, i is -1 if all are empty
+func tryPop(db Db, w *popWaiter) (int, interface{}, error) {
+	for i, key := range w.keys {
+		v, err := db.PopPath(key, w.paths[i])
+		if err == ErrNoSuchKey || err == ErrEmptyArray {
+			continue
+		}
+		if err != nil {
+			return -1, nil, err
+		}
+		return i, v, nil
+	}
+	return -1, nil, nil
+}
+
+// Pop blocks until one of the arrays of w has an item, the timeout fires
+// (0 waits forever), closed is closed or the server shuts down
+func (bp *blockingPops) Pop(db Db, w *popWaiter, timeout time.Duration, closed <-chan struct{}) (int, interface{}, error) {
+	var expire <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expire = timer.C
+	}
+
+	front := false
+	for {
+		// register before trying, so a push in between is not missed
+		bp.register(w, front)
+		i, v, err := tryPop(db, w)
+		if err != nil || i >= 0 {
+			bp.unregister(w)
+			return i, v, err
+		}
+
+		select {
+		case <-w.wake:
+			bp.unregister(w)
+			front = true
+		case <-expire:
+			bp.unregister(w)
+			return -1, nil, nil
+		case <-closed:
+			bp.unregister(w)
+			return -1, nil, nil
+		case <-bp.quit:
+			bp.unregister(w)
+			return -1, nil, nil
+		}
+	}
+}
+
+// bjpop <key> <path> [key path ...] <timeout>
+func cmdBJPop(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 4 || len(r.Multi)%2 != 0 {
+		return RespInvalidParam
+	}
+
+	secs, err := strconv.ParseFloat(string(r.Multi[len(r.Multi)-1].Bulk), 64)
+	// NaN fails every comparison, and a Duration holds under 300 years
+	if err != nil || !(secs >= 0 && secs < math.MaxInt64/float64(time.Second)) {
+		return RespErr(ErrInvalidTimeout)
+	}
+
+	w := &popWaiter{wake: make(chan struct{}, 1)}
+	for i := 1; i < len(r.Multi)-1; i += 2 {
+		w.keys = append(w.keys, string(r.Multi[i].Bulk))
+		w.paths = append(w.paths, string(r.Multi[i+1].Bulk))
+	}
+
+	closed, stop := client.watchDisconnect()
+	i, v, err := client.srv.blocking.Pop(client.db(), w, time.Duration(secs*float64(time.Second)), closed)
+	stop()
+	if err != nil {
+		return RespErr(err)
+	}
+	if i < 0 {
+		return &resp.Resp{Type: resp.MultiResp}
+	}
+
+	val := client.jsonReply(v)
+	if val.Type == resp.ErrorResp {
+		return val
+	}
+	return &resp.Resp{
+		Type:  resp.MultiResp,
+		Multi: []*resp.Resp{bulk(w.keys[i]), bulk(w.paths[i]), val},
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBJPop(t *testing.T) {
+	s := NewServer("")
+	c := newTestClient(t, s)
+	defer c.close()
+	a := newTestClient(t, s)
+	defer a.close()
+	b := newTestClient(t, s)
+	defer b.close()
+
+	if r := c.do("bjpop", "q", "items", "0.05"); r.Multi != nil {
+		t.Error("should time out", r)
+	}
+
+	a.send("bjpop", "q", "items", "0")
+	time.Sleep(50 * time.Millisecond)
+	b.send("bjpop", "other", "items", "q", "items", "0")
+	time.Sleep(50 * time.Millisecond)
+
+	// the first waiter is served first
+	c.do("jdocset", "q", `{"items":[]}`)
+	c.do("jpush", "q", "items", `"job1"`)
+	if r := a.read(); string(r.Multi[0].Bulk) != "q" || string(r.Multi[2].Bulk) != `"job1"` {
+		t.Error("a", r)
+	}
+	c.do("jpush", "q", "items", `"job2"`)
+	if r := b.read(); string(r.Multi[0].Bulk) != "q" || string(r.Multi[2].Bulk) != `"job2"` {
+		t.Error("b", r)
+	}
+
+	// items already there are popped right away
+	c.do("jpush", "q", "items", `"job3"`)
+	if r := a.do("bjpop", "q", "items", "1"); string(r.Multi[2].Bulk) != `"job3"` {
+		t.Error("a", r)
+	}
+	if r := c.do("jpop", "q", "items"); r.Bulk != nil {
+		t.Error("empty pop", r)
+	}
+
+	for _, timeout := range []string{"-1", "nan", "inf", "1e10", "x"} {
+		if r := c.do("bjpop", "q", "items", timeout); r.Error != ErrInvalidTimeout.Error() {
+			t.Error("timeout", timeout, r)
+		}
+	}
+}
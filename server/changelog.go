@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const defaultChangelogRetention = 10000
+
+type changeEntry struct {
+	seq  uint64
+	key  string
+	path string
+	op   string
+	val  []byte
+	msg  []byte // the RESP message sent to watchers
+}
+
+// changeWatcher is a jwatchstream session. Until it caught up with the log
+// the live changes wait in pending, behind the replayed ones.
+type changeWatcher struct {
+	client    *session
+	prefix    string
+	replaying bool     // guarded by the changelog lock
+	pending   [][]byte // guarded by the changelog lock
+	dropped   bool     // guarded by the changelog lock
+}
+
+// match tells if the watcher gets the changes of key, which must be under
+// its prefix and readable by its user
+func (w *changeWatcher) match(key string) bool {
+	return strings.HasPrefix(key, w.prefix) && w.client.srv.acl.canAccess(w.client.user, key)
+}
+
+// message returns the entry as the watcher gets it, without the paths its
+// user may not read: a change inside a denied path is not sent at all
+func (w *changeWatcher) message(e *changeEntry) []byte {
+	f := w.client.srv.acl.pathFilter(w.client.user)
+	if f == nil || e.val == nil {
+		return e.msg
+	}
+	steps, err := parsePath(e.path)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(e.val, &v); err != nil {
+		return nil
+	}
+	v, ok := f.filterAt(steps, v)
+	if !ok {
+		return nil
+	}
+	val, _ := json.Marshal(v)
+	return changeMessage(e.seq, e.key, e.path, e.op, val)
+}
+
+// send pushes the entry to the watcher, or queues it behind the replay. A
+// replay falling more than the retention and a push queue behind the log
+// is disconnected. Must hold the changelog lock.
+func (w *changeWatcher) send(e *changeEntry, retention int) {
+	b := w.message(e)
+	if b == nil || w.dropped {
+		return
+	}
+	if !w.replaying {
+		w.client.sendPush(b)
+		return
+	}
+	if len(w.pending) >= retention+pushQueueSize {
+		log.Warningf("jwatchstream of %v fell behind the change log, closing connection", w.client.RemoteAddr())
+		w.dropped, w.pending = true, nil
+		w.client.Conn.Close()
+		return
+	}
+	w.pending = append(w.pending, b)
+}
+
+// changelog keeps the last retention mutations, numbered by an increasing
+// sequence. A watcher that lost its connection resumes from the last
+// sequence it saw, as long as that entry is still retained. The log is in
+// memory, so a run starts its sequence at its start time in nanoseconds:
+// the sequences of an earlier run are below and refused.
+type changelog struct {
+	lock      sync.Mutex
+	entries   []changeEntry // ring buffer
+	head      int
+	count     int
+	epoch     uint64 // first sequence of this run
+	nextSeq   uint64
+	retention int
+	watchers  map[*changeWatcher]bool
+}
+
+func newChangelog(retention int) *changelog {
+	epoch := uint64(time.Now().UnixNano())
+	return &changelog{
+		entries:   make([]changeEntry, retention),
+		epoch:     epoch,
+		nextSeq:   epoch,
+		retention: retention,
+		watchers:  make(map[*changeWatcher]bool),
+	}
+}
+
+func changeMessage(seq uint64, key string, path string, op string, val []byte) []byte {
+	return pushMessage(
+		bulk("change"),
+		&resp.Resp{Type: resp.IntegerResp, Integer: int64(seq)},
+		bulk(key),
+		bulk(path),
+		bulk(op),
+		&resp.Resp{Type: resp.BulkResp, Bulk: val},
+	)
+}
+
+// onMutation records the new value at path, or the whole document for
+// document level operations. It runs with the slot lock held, so the value
+// is serialized before anyone can change it again.
+func (cl *changelog) onMutation(key string, path string, op string, doc interface{}) {
+	var val []byte
+	if doc != nil {
+		v := doc
+		if path != "" {
+			v = nil
+			jsonPathQuery(doc, path, &v)
+		}
+		val, _ = json.Marshal(v)
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	seq := cl.nextSeq
+	cl.nextSeq++
+	e := changeEntry{
+		seq:  seq,
+		key:  key,
+		path: path,
+		op:   op,
+		val:  val,
+		msg:  changeMessage(seq, key, path, op, val),
+	}
+	if cl.retention > 0 {
+		if cl.count == cl.retention {
+			cl.head = (cl.head + 1) % cl.retention
+			cl.count--
+		}
+		cl.entries[(cl.head+cl.count)%cl.retention] = e
+		cl.count++
+	}
+	for w := range cl.watchers {
+		if w.match(key) {
+			w.send(&e, cl.retention)
+		}
+	}
+}
+
+// oldest returns the first sequence still retained, must hold lock
+func (cl *changelog) oldest() uint64 {
+	if cl.count == 0 {
+		return cl.nextSeq
+	}
+	return cl.entries[cl.head].seq
+}
+
+// watch takes the retained entries from seq on and registers the watcher
+// for the following ones, both under the lock so nothing is missed or sent
+// twice, then replays them. seq 0 means only new entries.
+func (cl *changelog) watch(client *session, prefix string, seq uint64) (*changeWatcher, error) {
+	cl.lock.Lock()
+	if seq == 0 {
+		seq = cl.nextSeq
+	}
+	if err := cl.checkSeq(seq); err != nil {
+		cl.lock.Unlock()
+		return nil, err
+	}
+
+	w := &changeWatcher{client: client, prefix: prefix, replaying: true}
+	msgs := [][]byte{pushMessage(bulk("jwatchstream"), bulk(prefix+"*"),
+		&resp.Resp{Type: resp.IntegerResp, Integer: int64(seq)})}
+	for i := 0; i < cl.count; i++ {
+		e := cl.entries[(cl.head+i)%cl.retention]
+		if e.seq >= seq && w.match(e.key) {
+			if b := w.message(&e); b != nil {
+				msgs = append(msgs, b)
+			}
+		}
+	}
+	cl.watchers[w] = true
+	cl.lock.Unlock()
+
+	cl.replay(w, msgs)
+	return w, nil
+}
+
+// checkSeq tells why a watcher can't start from seq, must hold lock
+func (cl *changelog) checkSeq(seq uint64) error {
+	switch {
+	case seq > cl.nextSeq:
+		return fmt.Errorf("sequence %d is ahead of the log, next is %d", seq, cl.nextSeq)
+	case seq < cl.epoch:
+		return fmt.Errorf("sequence %d is from an earlier run of the log, first is %d", seq, cl.epoch)
+	case seq < cl.oldest():
+		return fmt.Errorf("sequence %d is no longer retained, oldest is %d", seq, cl.oldest())
+	}
+	return nil
+}
+
+// replay writes msgs then the changes pending meanwhile as fast as the
+// client reads them, which may be more than its push queue holds, until w
+// caught up with the log and gets the changes as they happen
+func (cl *changelog) replay(w *changeWatcher, msgs [][]byte) {
+	for {
+		for _, b := range msgs {
+			if !w.client.sendPushWait(b) {
+				return
+			}
+		}
+
+		cl.lock.Lock()
+		msgs = w.pending
+		w.pending = nil
+		if len(msgs) == 0 || w.dropped {
+			w.replaying = false
+			cl.lock.Unlock()
+			return
+		}
+		cl.lock.Unlock()
+	}
+}
+
+func (cl *changelog) unwatch(w *changeWatcher) {
+	cl.lock.Lock()
+	delete(cl.watchers, w)
+	cl.lock.Unlock()
+}
+
+func (cl *changelog) Retention() int {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	return cl.retention
+}
+
+// SetRetention resizes the log, dropping the oldest entries if it shrinks
+func (cl *changelog) SetRetention(retention int) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	entries := make([]changeEntry, retention)
+	skip := 0
+	if cl.count > retention {
+		skip = cl.count - retention
+	}
+	n := 0
+	for i := skip; i < cl.count; i++ {
+		entries[n] = cl.entries[(cl.head+i)%cl.retention]
+		n++
+	}
+	cl.entries = entries
+	cl.head = 0
+	cl.count = n
+	cl.retention = retention
+}
+
+// jwatchstream <prefix> [FROM seq]
+func cmdJWatchStream(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 2 && len(r.Multi) != 4 {
+		return RespInvalidParam
+	}
+	var seq uint64
+	if len(r.Multi) == 4 {
+		if strings.ToLower(string(r.Multi[2].Bulk)) != "from" {
+			return RespInvalidParam
+		}
+		var err error
+		if seq, err = strconv.ParseUint(string(r.Multi[3].Bulk), 10, 64); err != nil || seq == 0 {
+			return RespInvalidParam
+		}
+	}
+
+	w, err := client.srv.changelog.watch(client, parseKeyPrefix(r.Multi[1].Bulk), seq)
+	if err != nil {
+		return RespErr(err)
+	}
+	client.watchers = append(client.watchers, w)
+	return nil
+}
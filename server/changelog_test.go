@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func TestChangelog(t *testing.T) {
+	s := NewServer("")
+	c := newTestClient(t, s)
+	defer c.close()
+
+	c.do("config", "set", "changelog-retention", "3")
+	c.do("jdocset", "doc:1", `{"a":[1]}`)
+	c.do("jdocset", "other", `{}`)
+	c.do("jpush", "doc:1", "a", "2")
+	c.do("jset", "doc:1", "b", `"x"`)
+
+	// the sequences start at the epoch of the log, seq+0 has been dropped
+	// and only seq+1..seq+3 are retained
+	seq := int64(s.changelog.epoch)
+	from := func(n int64) string { return strconv.FormatInt(seq+n, 10) }
+	if r := c.do("jwatchstream", "doc:*", "FROM", from(0)); !strings.Contains(r.Error, "no longer retained") {
+		t.Fatal("should error", r)
+	}
+	// those of an earlier run are refused
+	if r := c.do("jwatchstream", "doc:*", "FROM", "2"); !strings.Contains(r.Error, "earlier run") {
+		t.Fatal("stale", r)
+	}
+
+	w := newTestClient(t, s)
+	defer w.close()
+	if r := w.do("jwatchstream", "doc:*", "FROM", from(1)); r.Multi[2].Integer != seq+1 {
+		t.Fatal("watch", r)
+	}
+	r := w.read()
+	if r.Multi[1].Integer != seq+2 || string(r.Multi[4].Bulk) != "jpush" || string(r.Multi[5].Bulk) != "[1,2]" {
+		t.Error("backlog", r)
+	}
+	if r := w.read(); r.Multi[1].Integer != seq+3 || string(r.Multi[3].Bulk) != "b" {
+		t.Error("backlog", r)
+	}
+
+	c.do("jincr", "doc:1", "a[0]", "10")
+	if r := w.read(); r.Multi[1].Integer != seq+4 || string(r.Multi[5].Bulk) != "11" {
+		t.Error("live", r)
+	}
+	if r := w.do("jget", "doc:1", "a"); !strings.Contains(r.Error, "subscribe mode") {
+		t.Error("streaming session", r)
+	}
+}
+
+// a replay longer than the push queue reaches a client reading it slowly
+func TestChangelogLongReplay(t *testing.T) {
+	s := NewServer("")
+	l := listen(t, s)
+	defer l.Close()
+	c := newTestClient(t, s)
+	defer c.close()
+	n := 3 * pushQueueSize
+	for i := 0; i < n; i++ {
+		c.do("jdocset", "doc:"+strconv.Itoa(i), "1")
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w := &testClient{t: t, c: conn, r: bufio.NewReader(conn)}
+	w.send("jwatchstream", "doc:*", "FROM", strconv.FormatUint(s.changelog.epoch, 10))
+	if r := w.read(); r.Type != resp.MultiResp || string(r.Multi[0].Bulk) != "jwatchstream" {
+		t.Fatal(r)
+	}
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		if r := w.read(); string(r.Multi[2].Bulk) != "doc:"+strconv.Itoa(i) {
+			t.Fatal("replay", i, r)
+		}
+	}
+	c.do("jdocset", "doc:live", "1")
+	if r := w.read(); string(r.Multi[2].Bulk) != "doc:live" {
+		t.Error("live", r)
+	}
+}
+
+func TestChangelogReplayDisconnect(t *testing.T) {
+	s := NewServer("")
+	l := listen(t, s)
+	defer l.Close()
+	c := newTestClient(t, s)
+	defer c.close()
+	for i := 0; i < 3*pushQueueSize; i++ {
+		c.do("jdocset", "doc:"+strconv.Itoa(i), `{"pad": "`+strings.Repeat("x", 4096)+`"}`)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &testClient{t: t, c: conn, r: bufio.NewReader(conn)}
+	w.send("jwatchstream", "doc:*", "FROM", strconv.FormatUint(s.changelog.epoch, 10))
+	w.read()
+	conn.Close()
+
+	// the session stops replaying to the client gone away, and ends
+	waitFor(t, "session end", func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.sessions) == 1
+	})
+	waitFor(t, "unwatch", func() bool {
+		s.changelog.lock.Lock()
+		defer s.changelog.lock.Unlock()
+		return len(s.changelog.watchers) == 0
+	})
+}
@@ -0,0 +1,769 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var (
+	ErrClusterDisabled = errors.New("cluster support disabled")
+	ErrCrossSlot       = errors.New("CROSSSLOT keys in request don't hash to the same slot")
+	ErrClusterDown     = errors.New("CLUSTERDOWN hash slot not served")
+	ErrUnknownNode     = errors.New("unknown node")
+	ErrInvalidSlot     = errors.New("invalid or out of range slot")
+	ErrTryAgain        = errors.New("TRYAGAIN multiple keys request during rehashing of slot")
+	ErrBusyKey         = errors.New("BUSYKEY target key name already exists")
+)
+
+const nodeCallTimeout = time.Second
+
+// clusterGossipPeriod is how often a node pulls the view of the others
+var clusterGossipPeriod = time.Second
+
+type clusterNode struct {
+	id     string
+	addr   string
+	epoch  uint64 // epoch of the node's slot claims
+	linkOk bool
+}
+
+// cluster assigns the hash slots of GetSlotIdFromKey to nodes. Every node
+// pulls CLUSTER NODES from the others; a slot belongs to the node that
+// claims it with the highest epoch, and a node claiming slots takes a new
+// epoch, so the last assignment wins everywhere.
+type cluster struct {
+	lock         sync.RWMutex
+	enabled      bool
+	announceIP   string
+	myself       *clusterNode
+	nodes        map[string]*clusterNode
+	slots        [MaxSlotSize]*clusterNode
+	migrating    map[int]*clusterNode // slots moving from myself to a node
+	importing    map[int]*clusterNode // slots moving from a node to myself
+	currentEpoch uint64
+	gossipOnce   sync.Once
+}
+
+func newCluster() *cluster {
+	b := make([]byte, 20)
+	rand.Read(b)
+	myself := &clusterNode{id: hex.EncodeToString(b), linkOk: true}
+	return &cluster{
+		announceIP: "127.0.0.1",
+		myself:     myself,
+		nodes:      map[string]*clusterNode{myself.id: myself},
+		migrating:  make(map[int]*clusterNode),
+		importing:  make(map[int]*clusterNode),
+	}
+}
+
+func (c *cluster) Enabled() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.enabled
+}
+
+func (c *cluster) setEnabled(s *Server, enabled bool) {
+	c.lock.Lock()
+	c.enabled = enabled
+	c.setAddr(s)
+	c.lock.Unlock()
+	if enabled {
+		c.gossipOnce.Do(func() {
+			go c.gossip(s)
+		})
+	}
+}
+
+// setAddr must be called with the lock held
+func (c *cluster) setAddr(s *Server) {
+	_, port, _ := net.SplitHostPort(s.addr)
+	c.myself.addr = net.JoinHostPort(c.announceIP, port)
+}
+
+// callNode sends one command to another node and reads the reply, after
+// the AUTH command auth if there is one
+func callNode(auth []string, addr string, args ...string) (*resp.Resp, error) {
+	conn, err := net.DialTimeout("tcp", addr, nodeCallTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(nodeCallTimeout))
+	r := bufio.NewReader(conn)
+
+	if auth != nil {
+		if _, err := nodeCall(conn, r, auth...); err != nil {
+			return nil, err
+		}
+	}
+	return nodeCall(conn, r, args...)
+}
+
+func nodeCall(conn net.Conn, r *bufio.Reader, args ...string) (*resp.Resp, error) {
+	items := make([]*resp.Resp, len(args))
+	for i, a := range args {
+		items[i] = bulk(a)
+	}
+	if _, err := conn.Write(pushMessage(items...)); err != nil {
+		return nil, err
+	}
+	ret, err := resp.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Type == resp.ErrorResp {
+		return nil, errors.New(ret.Error)
+	}
+	return ret, nil
+}
+
+// redirect returns the redirection for a command on keys this node doesn't
+// serve, nil if the command can run here. While a slot migrates, keys that
+// already left are asked to the target, which serves them to clients that
+// sent ASKING. The Db refuses to create keys in a migrating slot, which
+// covers the keys that leave between this check and the write.
+func (c *cluster) redirect(r *resp.Resp, cmd *command, client *session) *resp.Resp {
+	if cmd.flags&(flagRead|flagWrite) == 0 || !c.Enabled() {
+		return nil
+	}
+	keys, _ := r.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := GetSlotIdFromKey(string(keys[0]))
+	for _, k := range keys[1:] {
+		if GetSlotIdFromKey(string(k)) != slot {
+			return RespErr(ErrCrossSlot)
+		}
+	}
+
+	c.lock.RLock()
+	owner := c.slots[slot]
+	isOwner := owner == c.myself
+	migratingTo := c.migrating[slot]
+	_, importing := c.importing[slot]
+	c.lock.RUnlock()
+
+	if isOwner {
+		if migratingTo == nil {
+			return nil
+		}
+		found := 0
+		for _, k := range keys {
+			if doc, _ := client.srv.db.GetDoc(string(k)); doc != nil {
+				found++
+			}
+		}
+		switch found {
+		case len(keys):
+			return nil
+		case 0:
+			return RespErr(fmt.Errorf("ASK %d %s", slot, migratingTo.addr))
+		}
+		return RespErr(ErrTryAgain)
+	}
+	if importing && client.asking {
+		return nil
+	}
+	if owner == nil {
+		return RespErr(ErrClusterDown)
+	}
+	return RespErr(fmt.Errorf("MOVED %d %s", slot, owner.addr))
+}
+
+// bumpEpoch gives myself a new epoch, so that its claims win over the older
+// ones. It must be called with the lock held.
+func (c *cluster) bumpEpoch() {
+	c.currentEpoch++
+	c.myself.epoch = c.currentEpoch
+}
+
+// slotRanges returns the [start, end] ranges of the slots owned by n
+func (c *cluster) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < MaxSlotSize; i++ {
+		if c.slots[i] != n {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == i-1 {
+			ranges[len(ranges)-1][1] = i
+		} else {
+			ranges = append(ranges, [2]int{i, i})
+		}
+	}
+	return ranges
+}
+
+// nodesLines formats the view of this node like redis CLUSTER NODES:
+// <id> <addr> <flags> <master> <ping-sent> <pong-recv> <epoch> <link> <slot>...
+func (c *cluster) nodesLines() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ids := make([]string, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var b strings.Builder
+	for _, id := range ids {
+		n := c.nodes[id]
+		flags := "master"
+		if n == c.myself {
+			flags = "myself,master"
+		}
+		link := "connected"
+		if !n.linkOk {
+			link = "disconnected"
+		}
+		fmt.Fprintf(&b, "%s %s %s - 0 0 %d %s", n.id, n.addr, flags, n.epoch, link)
+		for _, r := range c.slotRanges(n) {
+			if r[0] == r[1] {
+				fmt.Fprintf(&b, " %d", r[0])
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+			}
+		}
+		if n == c.myself {
+			for _, slot := range sortedSlots(c.migrating) {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, c.migrating[slot].id)
+			}
+			for _, slot := range sortedSlots(c.importing) {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, c.importing[slot].id)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func sortedSlots(m map[int]*clusterNode) []int {
+	slots := make([]int, 0, len(m))
+	for slot := range m {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+type nodesLine struct {
+	id     string
+	addr   string
+	myself bool
+	epoch  uint64
+	slots  []int
+}
+
+func parseNodesLines(s string) []nodesLine {
+	var lines []nodesLine
+	for _, text := range strings.Split(s, "\n") {
+		fields := strings.Fields(text)
+		if len(fields) < 8 {
+			continue
+		}
+		epoch, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			continue
+		}
+		l := nodesLine{
+			id:     fields[0],
+			addr:   fields[1],
+			myself: strings.Contains(fields[2], "myself"),
+			epoch:  epoch,
+		}
+		for _, r := range fields[8:] {
+			start, end, err := parseSlotRange(r)
+			if err != nil {
+				continue
+			}
+			for i := start; i <= end; i++ {
+				l.slots = append(l.slots, i)
+			}
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func parseSlot(s string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= MaxSlotSize {
+		return 0, ErrInvalidSlot
+	}
+	return i, nil
+}
+
+func parseSlotRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := parseSlot(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end := start
+	if len(parts) == 2 {
+		if end, err = parseSlot(parts[1]); err != nil || end < start {
+			return 0, 0, ErrInvalidSlot
+		}
+	}
+	return start, end, nil
+}
+
+// merge takes in the view of another node. It must be called with the
+// lock held.
+func (c *cluster) merge(lines []nodesLine) {
+	for _, l := range lines {
+		if l.id == c.myself.id {
+			continue
+		}
+		n, ok := c.nodes[l.id]
+		if !ok {
+			n = &clusterNode{id: l.id, addr: l.addr}
+			c.nodes[l.id] = n
+		}
+		if l.epoch > c.currentEpoch {
+			c.currentEpoch = l.epoch
+		}
+		if l.epoch > n.epoch {
+			n.epoch = l.epoch
+		}
+
+		claimed := make(map[int]bool, len(l.slots))
+		for _, i := range l.slots {
+			claimed[i] = true
+			owner := c.slots[i]
+			// equal epochs are settled by the node id, the same way everywhere
+			if owner == nil || owner.epoch < n.epoch || (owner.epoch == n.epoch && n.id < owner.id) {
+				c.slots[i] = n
+			}
+		}
+		// only the node itself knows what it no longer owns
+		if l.myself {
+			n.addr = l.addr
+			for i, owner := range c.slots {
+				if owner == n && !claimed[i] {
+					c.slots[i] = nil
+				}
+			}
+		}
+	}
+}
+
+func (c *cluster) gossip(s *Server) {
+	for {
+		select {
+		case <-time.After(clusterGossipPeriod):
+		case <-s.quit:
+			return
+		}
+
+		c.lock.RLock()
+		var peers []*clusterNode
+		if c.enabled {
+			for _, n := range c.nodes {
+				if n != c.myself {
+					peers = append(peers, n)
+				}
+			}
+		}
+		c.lock.RUnlock()
+
+		for _, n := range peers {
+			r, err := callNode(s.acl.nodeAuth(), n.addr, "cluster", "nodes")
+			c.lock.Lock()
+			n.linkOk = err == nil
+			if err == nil {
+				c.merge(parseNodesLines(string(r.Bulk)))
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+// meet adds the node at addr, and has it add this node too
+func (c *cluster) meet(s *Server, addr string) error {
+	r, err := callNode(s.acl.nodeAuth(), addr, "cluster", "myid")
+	if err != nil {
+		return err
+	}
+	id := string(r.Bulk)
+
+	c.lock.Lock()
+	_, known := c.nodes[id]
+	if !known && id != c.myself.id {
+		c.nodes[id] = &clusterNode{id: id, addr: addr, linkOk: true}
+	}
+	host, port, _ := net.SplitHostPort(c.myself.addr)
+	c.lock.Unlock()
+
+	if known {
+		return nil
+	}
+	_, err = callNode(s.acl.nodeAuth(), addr, "cluster", "meet", host, port)
+	return err
+}
+
+func (c *cluster) info() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	assigned, ok := 0, 0
+	owners := make(map[*clusterNode]bool)
+	for _, n := range c.slots {
+		if n != nil {
+			assigned++
+			owners[n] = true
+			if n.linkOk {
+				ok++
+			}
+		}
+	}
+	state := "ok"
+	if ok < MaxSlotSize {
+		state = "fail"
+	}
+	return fmt.Sprintf("cluster_state:%s\r\n"+
+		"cluster_slots_assigned:%d\r\n"+
+		"cluster_slots_ok:%d\r\n"+
+		"cluster_known_nodes:%d\r\n"+
+		"cluster_size:%d\r\n"+
+		"cluster_current_epoch:%d\r\n"+
+		"cluster_my_epoch:%d\r\n",
+		state, assigned, ok, len(c.nodes), len(owners), c.currentEpoch, c.myself.epoch)
+}
+
+func (c *cluster) slotsResp() *resp.Resp {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ret := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{}}
+	for start := 0; start < MaxSlotSize; {
+		n := c.slots[start]
+		end := start
+		for end+1 < MaxSlotSize && c.slots[end+1] == n {
+			end++
+		}
+		if n != nil {
+			host, port, _ := net.SplitHostPort(n.addr)
+			p, _ := strconv.Atoi(port)
+			ret.Multi = append(ret.Multi, &resp.Resp{
+				Type: resp.MultiResp,
+				Multi: []*resp.Resp{
+					{Type: resp.IntegerResp, Integer: int64(start)},
+					{Type: resp.IntegerResp, Integer: int64(end)},
+					{Type: resp.MultiResp, Multi: []*resp.Resp{
+						bulk(host),
+						{Type: resp.IntegerResp, Integer: int64(p)},
+						bulk(n.id),
+					}},
+				},
+			})
+		}
+		start = end + 1
+	}
+	return ret
+}
+
+// addSlots assigns slots to myself, del removes them instead
+func (c *cluster) addSlots(slots []int, del bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, i := range slots {
+		if del && c.slots[i] == nil {
+			return fmt.Errorf("slot %d is already unassigned", i)
+		}
+		if !del && c.slots[i] != nil {
+			return fmt.Errorf("slot %d is already busy", i)
+		}
+	}
+	for _, i := range slots {
+		if del {
+			c.slots[i] = nil
+		} else {
+			c.slots[i] = c.myself
+		}
+	}
+	if !del {
+		c.bumpEpoch()
+	}
+	return nil
+}
+
+// setSlot handles cluster setslot: state is node, migrating, importing or
+// stable. Assigning a node ends a migration of the slot. db is told which
+// slots are migrating, so that it refuses to create keys in them.
+func (c *cluster) setSlot(db Db, slot int, state string, id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if state == "stable" {
+		db.SetMigrating(slot, false)
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+		return nil
+	}
+	n, ok := c.nodes[id]
+	if !ok {
+		return ErrUnknownNode
+	}
+	switch state {
+	case "node":
+		db.SetMigrating(slot, false)
+		delete(c.migrating, slot)
+		delete(c.importing, slot)
+		c.slots[slot] = n
+		if n == c.myself {
+			c.bumpEpoch()
+		}
+	case "migrating":
+		if c.slots[slot] != c.myself {
+			return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+		}
+		c.migrating[slot] = n
+		db.SetMigrating(slot, true)
+	case "importing":
+		if c.slots[slot] == c.myself {
+			return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+		}
+		c.importing[slot] = n
+	default:
+		return ErrInvalidParam
+	}
+	return nil
+}
+
+func parseSlots(args []*resp.Resp, ranges bool) ([]int, error) {
+	var slots []int
+	if ranges {
+		if len(args)%2 != 0 {
+			return nil, ErrInvalidParam
+		}
+		for i := 0; i < len(args); i += 2 {
+			start, end, err := parseSlotRange(string(args[i].Bulk) + "-" + string(args[i+1].Bulk))
+			if err != nil {
+				return nil, err
+			}
+			for j := start; j <= end; j++ {
+				slots = append(slots, j)
+			}
+		}
+		return slots, nil
+	}
+	for _, a := range args {
+		i, err := parseSlot(string(a.Bulk))
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, i)
+	}
+	return slots, nil
+}
+
+// cluster myid|nodes|slots|info
+// cluster meet <host> <port>
+// cluster addslots|delslots <slot> [slot ...]
+// cluster addslotsrange|delslotsrange <start> <end> [start end ...]
+// cluster setslot <slot> node|migrating|importing <id>
+// cluster setslot <slot> stable
+// cluster keyslot <key>
+// cluster countkeysinslot <slot>
+// cluster getkeysinslot <slot> <count>
+func cmdCluster(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+	c := client.srv.cluster
+	if !c.Enabled() {
+		return RespErr(ErrClusterDisabled)
+	}
+	args := r.Multi[2:]
+
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "myid":
+		c.lock.RLock()
+		defer c.lock.RUnlock()
+		return bulk(c.myself.id)
+	case "nodes":
+		return bulk(c.nodesLines())
+	case "slots":
+		return c.slotsResp()
+	case "info":
+		return bulk(c.info())
+	case "meet":
+		if len(args) != 2 {
+			return RespInvalidParam
+		}
+		if err := c.meet(client.srv, net.JoinHostPort(string(args[0].Bulk), string(args[1].Bulk))); err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		return RespOk
+	case "addslots", "delslots", "addslotsrange", "delslotsrange":
+		sub := strings.ToLower(string(r.Multi[1].Bulk))
+		if len(args) == 0 {
+			return RespInvalidParam
+		}
+		slots, err := parseSlots(args, strings.HasSuffix(sub, "range"))
+		if err != nil {
+			return RespErr(err)
+		}
+		if err := c.addSlots(slots, strings.HasPrefix(sub, "del")); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	case "setslot":
+		if len(args) < 2 {
+			return RespInvalidParam
+		}
+		state := strings.ToLower(string(args[1].Bulk))
+		id := ""
+		if state == "stable" && len(args) != 2 || state != "stable" && len(args) != 3 {
+			return RespInvalidParam
+		}
+		if len(args) == 3 {
+			id = string(args[2].Bulk)
+		}
+		slot, err := parseSlot(string(args[0].Bulk))
+		if err != nil {
+			return RespErr(err)
+		}
+		if err := c.setSlot(client.srv.db, slot, state, id); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	case "keyslot":
+		if len(args) != 1 {
+			return RespInvalidParam
+		}
+		return &resp.Resp{Type: resp.IntegerResp, Integer: int64(GetSlotIdFromKey(string(args[0].Bulk)))}
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return RespInvalidParam
+		}
+		slot, err := parseSlot(string(args[0].Bulk))
+		if err != nil {
+			return RespErr(err)
+		}
+		return &resp.Resp{Type: resp.IntegerResp, Integer: int64(len(client.srv.db.SlotKeys(slot, -1)))}
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return RespInvalidParam
+		}
+		slot, err := parseSlot(string(args[0].Bulk))
+		if err != nil {
+			return RespErr(err)
+		}
+		count, err := strconv.Atoi(string(args[1].Bulk))
+		if err != nil || count < 0 {
+			return RespInvalidParam
+		}
+		return bulkStrings(client.srv.db.SlotKeys(slot, count))
+	}
+	return RespInvalidParam
+}
+
+// asking
+func cmdAsking(r *resp.Resp, client *session) *resp.Resp {
+	client.asking = true
+	return RespOk
+}
+
+// jmigrate <host> <port> <timeout ms> <key> [key ...]
+//
+// Each key is sent to the target with jrestore and removed once the target
+// stored it. The slot of the key is locked meanwhile, so no change is lost.
+func cmdJMigrate(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 5 {
+		return RespInvalidParam
+	}
+	addr := net.JoinHostPort(string(r.Multi[1].Bulk), string(r.Multi[2].Bulk))
+	ms, err := strconv.Atoi(string(r.Multi[3].Bulk))
+	if err != nil || ms <= 0 {
+		return RespInvalidParam
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return RespErr(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	if auth := client.srv.acl.nodeAuth(); auth != nil {
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := nodeCall(conn, br, auth...); err != nil {
+			return RespErr(err)
+		}
+	}
+
+	moved := 0
+	for _, k := range r.Multi[4:] {
+		key := string(k.Bulk)
+		err := client.srv.db.Migrate(key, func(doc interface{}) error {
+			b, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			conn.SetDeadline(time.Now().Add(timeout))
+			if _, err := conn.Write(pushMessage(bulk("jrestore"), bulk(key), &resp.Resp{Type: resp.BulkResp, Bulk: b}, bulk("replace"))); err != nil {
+				return err
+			}
+			ret, err := resp.Parse(br)
+			if err != nil {
+				return err
+			}
+			if ret.Type == resp.ErrorResp {
+				return errors.New(ret.Error)
+			}
+			return nil
+		})
+		if err == ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		moved++
+	}
+	if moved == 0 {
+		return &resp.Resp{Type: resp.SimpleString, Status: "NOKEY"}
+	}
+	return RespOk
+}
+
+// jrestore <key> <doc> [REPLACE]
+func cmdJRestore(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 3 && len(r.Multi) != 4 {
+		return RespInvalidParam
+	}
+	if len(r.Multi) == 4 && strings.ToLower(string(r.Multi[3].Bulk)) != "replace" {
+		return RespInvalidParam
+	}
+	key := string(r.Multi[1].Bulk)
+	var doc interface{}
+	if err := json.Unmarshal(r.Multi[2].Bulk, &doc); err != nil {
+		return RespErr(err)
+	}
+	if len(r.Multi) == 3 {
+		if old, _ := client.srv.db.GetDoc(key); old != nil {
+			return RespErr(ErrBusyKey)
+		}
+	}
+	if err := client.srv.db.Replay(key, "", OpDocSet, doc); err != nil {
+		return RespErr(err)
+	}
+	return RespOk
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func init() {
+	// set once, the gossip goroutines of earlier tests keep reading it
+	clusterGossipPeriod = 10 * time.Millisecond
+}
+
+func TestHashTag(t *testing.T) {
+	if GetSlotIdFromKey("{user1}.profile") != GetSlotIdFromKey("{user1}.settings") {
+		t.Error("keys with the same tag should share a slot")
+	}
+	if GetSlotIdFromKey("{user1}.profile") != GetSlotIdFromKey("user1") {
+		t.Error("a tagged key hashes like its tag")
+	}
+	for _, key := range []string{"{}.a", "a{", "a}{"} {
+		if hashTag(key) != key {
+			t.Error("no tag in", key)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	a, b := NewServer(""), NewServer("")
+	defer listen(t, a).Close()
+	defer listen(t, b).Close()
+	ca := newTestClient(t, a)
+	defer ca.close()
+	cb := newTestClient(t, b)
+	defer cb.close()
+
+	if r := ca.do("cluster", "info"); r.Type != resp.ErrorResp {
+		t.Error("cluster is disabled by default", r)
+	}
+	ca.do("config", "set", "cluster-enabled", "yes")
+	cb.do("config", "set", "cluster-enabled", "yes")
+	ca.do("cluster", "addslotsrange", "0", "511")
+	cb.do("cluster", "addslotsrange", "512", "1023")
+	_, port, _ := net.SplitHostPort(b.addr)
+	if r := ca.do("cluster", "meet", "127.0.0.1", port); r.Status != "OK" {
+		t.Fatal("meet", r)
+	}
+	for _, c := range []*testClient{ca, cb} {
+		waitFor(t, "gossip", func() bool {
+			return strings.Contains(string(c.do("cluster", "info").Bulk), "cluster_state:ok")
+		})
+	}
+
+	if r := ca.do("cluster", "slots"); len(r.Multi) != 2 || r.Multi[1].Multi[0].Integer != 512 {
+		t.Error("slots", r)
+	}
+
+	key := "{user1}.profile"
+	slot := GetSlotIdFromKey(key)
+	own, other := ca, cb
+	if slot >= 512 {
+		own, other = cb, ca
+	}
+	if r := own.do("jdocset", key, `{"name":"x"}`); r.Status != "OK" {
+		t.Error("owner", r)
+	}
+	if r := other.do("jdocget", key); !strings.HasPrefix(r.Error, fmt.Sprintf("MOVED %d ", slot)) {
+		t.Error("moved", r)
+	}
+	own.do("jdocset", "{user1}.settings", `{"theme":"dark"}`)
+	if r := own.do("jmget", "", key, "{user1}.settings"); len(r.Multi) != 2 || string(r.Multi[1].Bulk) != `{"theme":"dark"}` {
+		t.Error("jmget", r)
+	}
+	if r := own.do("jmget", "", "{user1}.profile", "{user2}.profile"); !strings.HasPrefix(r.Error, "CROSSSLOT") {
+		t.Error("crossslot", r)
+	}
+	if r := own.do("cluster", "countkeysinslot", fmt.Sprint(slot)); r.Integer != 2 {
+		t.Error("countkeysinslot", r)
+	}
+
+	// the last claim wins
+	bid := string(cb.do("cluster", "myid").Bulk)
+	cb.do("cluster", "setslot", "0", "node", bid)
+	waitFor(t, "handover", func() bool {
+		r := ca.do("jdocget", "{"+keyInSlot(0)+"}")
+		return strings.HasPrefix(r.Error, "MOVED 0 ")
+	})
+}
+
+// keyInSlot finds a key that hashes to slot
+func keyInSlot(slot int) string {
+	for i := 0; ; i++ {
+		if k := fmt.Sprint("k", i); GetSlotIdFromKey(k) == slot {
+			return k
+		}
+	}
+}
+
+func TestSlotMigration(t *testing.T) {
+	a, b := NewServer(""), NewServer("")
+	defer listen(t, a).Close()
+	defer listen(t, b).Close()
+	ca := newTestClient(t, a)
+	defer ca.close()
+	cb := newTestClient(t, b)
+	defer cb.close()
+
+	ca.do("config", "set", "cluster-enabled", "yes")
+	cb.do("config", "set", "cluster-enabled", "yes")
+	ca.do("cluster", "addslotsrange", "0", "1023")
+	host, port, _ := net.SplitHostPort(b.addr)
+	ca.do("cluster", "meet", host, port)
+	waitFor(t, "gossip", func() bool {
+		return strings.Contains(string(cb.do("cluster", "info").Bulk), "cluster_state:ok")
+	})
+
+	tag := keyInSlot(7)
+	k1, k2 := "{"+tag+"}.1", "{"+tag+"}.2"
+	ca.do("jdocset", k1, `{"n":1}`)
+	ca.do("jdocset", k2, `{"n":2}`)
+	aid := string(ca.do("cluster", "myid").Bulk)
+	bid := string(cb.do("cluster", "myid").Bulk)
+
+	if r := cb.do("cluster", "setslot", "7", "importing", aid); r.Status != "OK" {
+		t.Fatal("importing", r)
+	}
+	if r := ca.do("cluster", "setslot", "7", "migrating", bid); r.Status != "OK" {
+		t.Fatal("migrating", r)
+	}
+	if r := ca.do("jmigrate", host, port, "1000", k1); r.Status != "OK" {
+		t.Fatal("jmigrate", r)
+	}
+
+	// k1 left, k2 is still served by a
+	if r := ca.do("jget", k1, "n"); r.Error != "ASK 7 "+b.addr {
+		t.Error("ask", r)
+	}
+	if r := ca.do("jget", k2, "n"); string(r.Bulk) != "2" {
+		t.Error("not migrated yet", r)
+	}
+	if r := ca.do("jmget", "n", k1, k2); !strings.HasPrefix(r.Error, "TRYAGAIN") {
+		t.Error("tryagain", r)
+	}
+	// a write redirected before k1 left can't create it again on a
+	if err := a.db.PutDoc(k1, 3.0); err != ErrTryAgain {
+		t.Error("created in a migrating slot", err)
+	}
+	if _, err := a.db.Update(k1, func(doc interface{}, version uint64) (interface{}, error) { return 3.0, nil }); err != ErrTryAgain {
+		t.Error("created by update in a migrating slot", err)
+	}
+	if err := a.db.PutDoc(k2, map[string]interface{}{"n": 2.0}); err != nil {
+		t.Error("existing key", err)
+	}
+	if r := cb.do("jget", k1, "n"); !strings.HasPrefix(r.Error, "MOVED 7 ") {
+		t.Error("moved without asking", r)
+	}
+	cb.do("asking")
+	if r := cb.do("jget", k1, "n"); string(r.Bulk) != "1" {
+		t.Error("asking", r)
+	}
+
+	ca.do("jmigrate", host, port, "1000", k2)
+	cb.do("cluster", "setslot", "7", "node", bid)
+	ca.do("cluster", "setslot", "7", "node", bid)
+	if r := cb.do("jget", k2, "n"); string(r.Bulk) != "2" {
+		t.Error("owner", r)
+	}
+	if r := ca.do("jget", k2, "n"); r.Error != "MOVED 7 "+b.addr {
+		t.Error("moved", r)
+	}
+	if r := ca.do("cluster", "countkeysinslot", "7"); r.Integer != 0 {
+		t.Error("keys left", r)
+	}
+}
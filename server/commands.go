@@ -2,11 +2,18 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
 	"jj/resp"
+	"jj/utils"
 
 	log "github.com/ngaut/logging"
 )
 
+var ErrInvalidParam = errors.New("invalid parameter")
+
 var (
 	RespNoSuchCmd = &resp.Resp{
 		Type:  resp.ErrorResp,
@@ -87,7 +94,7 @@ func generalGetPathVal(r *resp.Resp, client *session, fn func(string, string) (i
 	path := string(r.Multi[2].Bulk)
 	ret, err := fn(string(k), path)
 	if err != nil {
-		if err == ErrNoSuchKey {
+		if err == ErrNoSuchKey || err == ErrEmptyArray {
 			return RespNil
 		}
 		log.Warning(err)
@@ -97,17 +104,7 @@ func generalGetPathVal(r *resp.Resp, client *session, fn func(string, string) (i
 		return RespNil
 	}
 
-	b, err := json.Marshal(ret)
-	if err != nil {
-		log.Warning(err)
-		return RespErr(err)
-	}
-
-	return &resp.Resp{
-		Type: resp.BulkResp,
-		Bulk: b,
-	}
-
+	return client.jsonReply(ret)
 }
 
 func cmdJdocSet(r *resp.Resp, client *session) *resp.Resp {
@@ -128,7 +125,7 @@ func cmdJdocSet(r *resp.Resp, client *session) *resp.Resp {
 		return RespErr(err)
 	}
 
-	err = client.srv.db.PutDoc(string(k), val)
+	err = client.db().PutDoc(string(k), val)
 	if err != nil {
 		log.Warning(err)
 		return RespErr(err)
@@ -144,46 +141,145 @@ func cmdJdocGet(r *resp.Resp, client *session) *resp.Resp {
 		return RespErr(err)
 	}
 
-	val, _ := client.srv.db.GetDoc(string(k))
+	val, _ := client.db().GetDoc(string(k))
 	if val == nil {
 		return RespNil
 	}
-	b, err := json.Marshal(val)
+	return client.jsonReply(val)
+}
+
+func cmdJdocDel(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 2 {
+		return RespInvalidParam
+	}
+
+	k, err := r.Key()
 	if err != nil {
 		log.Warning(err)
 		return RespErr(err)
 	}
 
-	return &resp.Resp{
-		Type: resp.BulkResp,
-		Bulk: b,
+	if err := client.db().RemoveDoc(string(k)); err != nil {
+		log.Warning(err)
+		return RespErr(err)
 	}
+
+	return RespOk
 }
 
 func cmdJSet(r *resp.Resp, client *session) *resp.Resp {
-	return generalSetPathVal(r, client, client.srv.db.PutPath)
+	return generalSetPathVal(r, client, client.db().PutPath)
 }
 
 func cmdJGet(r *resp.Resp, client *session) *resp.Resp {
-	return generalGetPathVal(r, client, client.srv.db.GetPath)
+	return generalGetPathVal(r, client, client.db().GetPath)
+}
+
+// jmget <path> <key> [key ...]
+func cmdJMGet(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 3 {
+		return RespInvalidParam
+	}
+
+	path := string(r.Multi[1].Bulk)
+	db := client.db()
+	ret := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{}}
+	for _, k := range r.Multi[2:] {
+		val, err := db.GetPath(string(k.Bulk), path)
+		if err != nil || val == nil {
+			ret.Multi = append(ret.Multi, RespNil)
+			continue
+		}
+		v := client.jsonReply(val)
+		if v.Type == resp.ErrorResp {
+			return v
+		}
+		ret.Multi = append(ret.Multi, v)
+	}
+	return ret
+}
+
+// scan <cursor> [MATCH pattern] [COUNT count]
+//
+// The cursor is the next slot to walk, a call returns whole slots until it
+// has count keys.
+func cmdScan(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 || len(r.Multi)%2 != 0 {
+		return RespInvalidParam
+	}
+	cursor, err := strconv.Atoi(string(r.Multi[1].Bulk))
+	if err != nil || cursor < 0 || cursor >= MaxSlotSize {
+		return RespErr(errors.New("invalid cursor"))
+	}
+	pattern, count := "*", 10
+	for i := 2; i < len(r.Multi); i += 2 {
+		switch strings.ToLower(string(r.Multi[i].Bulk)) {
+		case "match":
+			pattern = string(r.Multi[i+1].Bulk)
+		case "count":
+			count, err = strconv.Atoi(string(r.Multi[i+1].Bulk))
+			if err != nil || count <= 0 {
+				return RespInvalidParam
+			}
+		default:
+			return RespInvalidParam
+		}
+	}
+
+	keep := client.srv.acl.keyFilter(client.user)
+	var keys []string
+	for cursor < MaxSlotSize && len(keys) < count {
+		for _, k := range client.srv.db.SlotKeys(cursor, -1) {
+			if utils.GlobMatch(pattern, k) && (keep == nil || keep(k)) {
+				keys = append(keys, k)
+			}
+		}
+		cursor++
+	}
+	if cursor == MaxSlotSize {
+		cursor = 0
+	}
+	return &resp.Resp{
+		Type: resp.MultiResp,
+		Multi: []*resp.Resp{
+			bulk(strconv.Itoa(cursor)),
+			bulkStrings(keys),
+		},
+	}
 }
 
 func cmdJPush(r *resp.Resp, client *session) *resp.Resp {
-	return generalSetPathVal(r, client, client.srv.db.PushPath)
+	return generalSetPathVal(r, client, client.db().PushPath)
 }
 
 func cmdJPop(r *resp.Resp, client *session) *resp.Resp {
-	return generalGetPathVal(r, client, client.srv.db.PopPath)
+	return generalGetPathVal(r, client, client.db().PopPath)
 }
 
 func cmdJIncr(r *resp.Resp, client *session) *resp.Resp {
-	return generalSetPathVal(r, client, client.srv.db.IncrPath)
-}
-
-func cmdSave(r *resp.Resp, client *session) *resp.Resp {
-	return RespNoImplement
+	return generalSetPathVal(r, client, client.db().IncrPath)
 }
 
-func cmdBgSave(r *resp.Resp, client *session) *resp.Resp {
-	return RespNoImplement
+// ping [message]
+func cmdPing(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) > 2 {
+		return RespInvalidParam
+	}
+	msg := []byte{}
+	if len(r.Multi) == 2 {
+		msg = r.Multi[1].Bulk
+	}
+	if client.subscribed() > 0 {
+		return &resp.Resp{
+			Type: resp.MultiResp,
+			Multi: []*resp.Resp{
+				{Type: resp.BulkResp, Bulk: []byte("pong")},
+				{Type: resp.BulkResp, Bulk: msg},
+			},
+		}
+	}
+	if len(r.Multi) == 2 {
+		return &resp.Resp{Type: resp.BulkResp, Bulk: msg}
+	}
+	return &resp.Resp{Type: resp.SimpleString, Status: "PONG"}
 }
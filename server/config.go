@@ -0,0 +1,620 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"jj/resp"
+	"jj/utils"
+
+	log "github.com/ngaut/logging"
+)
+
+var (
+	ErrUnsupportedParam = errors.New("unsupported CONFIG parameter")
+	ErrNoConfigFile     = errors.New("The server is running without a config file")
+)
+
+// configParam is a setting of the config file, the command line and CONFIG.
+// startup ones are only read by Run, or too sensitive to change at runtime:
+// CONFIG SET refuses them.
+type configParam struct {
+	usage   string
+	startup bool
+	get     func(s *Server) string
+	set     func(s *Server, val string) error
+}
+
+var configParams = map[string]*configParam{
+	"addr": stringParam("address of the RESP listener, none if empty and TLS is on", func(s *Server) *string { return &s.addr }),
+	"http": stringParam("address of the HTTP listener, none if empty", func(s *Server) *string { return &s.httpAddr }),
+	"https": stringParam("address of the HTTPS listener, none if empty, needs tls-addr",
+		func(s *Server) *string { return &s.httpsAddr }),
+	"ws-origins": stringParam("space separated origins whose pages may open /ws, besides the server's own",
+		func(s *Server) *string { return &s.wsOrigins }),
+	"tls-addr": stringParam("address of the TLS RESP listener, none if empty", func(s *Server) *string { return &s.tlsAddr }),
+	"tls-cert": stringParam("certificate of the TLS listeners", func(s *Server) *string { return &s.tlsOpts.CertFile }),
+	"tls-key":  stringParam("private key of the TLS listeners", func(s *Server) *string { return &s.tlsOpts.KeyFile }),
+	"tls-ca": stringParam("CA certificate verifying the clients, the system roots if empty",
+		func(s *Server) *string { return &s.tlsOpts.CAFile }),
+	"tls-auth-clients": {
+		usage:   "whether TLS clients present a certificate: no, optional or yes",
+		startup: true,
+		get: func(s *Server) string {
+			if s.tlsOpts.AuthClients == "" {
+				return "no"
+			}
+			return s.tlsOpts.AuthClients
+		},
+		set: func(s *Server, val string) error {
+			switch val {
+			case "no", "optional", "yes":
+				s.tlsOpts.AuthClients = val
+				return nil
+			}
+			return errors.New("tls-auth-clients must be no, optional or yes")
+		},
+	},
+	"tls-cert-user": {
+		usage:   "authenticate TLS clients as the ACL user named by their certificate common name, needs tls-ca",
+		startup: true,
+		get: func(s *Server) string {
+			return formatBool(s.tlsOpts.CertUser)
+		},
+		set: func(s *Server, val string) error {
+			b, err := parseBool(val)
+			if err != nil {
+				return err
+			}
+			s.tlsOpts.CertUser = b
+			return nil
+		},
+	},
+	"aclfile": {
+		usage:   "file holding the ACL users, none if empty",
+		startup: true,
+		get: func(s *Server) string {
+			return s.acl.fileName()
+		},
+		set: func(s *Server, val string) error {
+			s.acl.lock.Lock()
+			s.acl.file = val
+			s.acl.lock.Unlock()
+			return nil
+		},
+	},
+	"logfile": {
+		usage:   "file the log is written to, stderr if empty",
+		startup: true,
+		get: func(s *Server) string {
+			return s.logFile
+		},
+		set: func(s *Server, val string) error {
+			if val != "" {
+				if err := log.SetOutputByName(val); err != nil {
+					return err
+				}
+			}
+			s.logFile = val
+			return nil
+		},
+	},
+	"loglevel": {
+		usage: "debug, info, warn, error or fatal",
+		get: func(s *Server) string {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			return s.logLevel
+		},
+		set: func(s *Server, val string) error {
+			switch val {
+			case "debug", "info", "warn", "error", "fatal":
+			default:
+				return errors.New("loglevel must be debug, info, warn, error or fatal")
+			}
+			log.SetLevelByString(val)
+			s.lock.Lock()
+			s.logLevel = val
+			s.lock.Unlock()
+			return nil
+		},
+	},
+	"timeout": {
+		usage: "seconds after which an idle client is closed, 0 for never",
+		get: func(s *Server) string {
+			return strconv.Itoa(int(s.timeout() / time.Second))
+		},
+		set: func(s *Server, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return errors.New("timeout must be a non-negative integer")
+			}
+			s.lock.Lock()
+			s.idleTimeout = time.Duration(n) * time.Second
+			s.lock.Unlock()
+			return nil
+		},
+	},
+	"maxmemory": {
+		usage: "heap size above which writes are refused, like 512mb, 0 for no limit",
+		get: func(s *Server) string {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			return strconv.FormatInt(s.maxMemory, 10)
+		},
+		set: func(s *Server, val string) error {
+			n, err := parseMemory(val)
+			if err != nil {
+				return err
+			}
+			s.lock.Lock()
+			s.maxMemory = n
+			s.lock.Unlock()
+			s.sampleMemory()
+			return nil
+		},
+	},
+	"dir": {
+		usage: "directory of the snapshot",
+		// a client able to move it could write snapshots anywhere
+		startup: true,
+		get: func(s *Server) string {
+			s.persist.lock.Lock()
+			defer s.persist.lock.Unlock()
+			return s.persist.dir
+		},
+		set: func(s *Server, val string) error {
+			if fi, err := os.Stat(val); err != nil || !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", val)
+			}
+			s.persist.lock.Lock()
+			s.persist.dir = val
+			s.persist.lock.Unlock()
+			return nil
+		},
+	},
+	"dbfilename": {
+		usage: "file name of the snapshot in dir",
+		get: func(s *Server) string {
+			s.persist.lock.Lock()
+			defer s.persist.lock.Unlock()
+			return s.persist.dbFilename
+		},
+		set: func(s *Server, val string) error {
+			if val == "" || filepath.Base(val) != val {
+				return errors.New("dbfilename can't be a path, only a file name")
+			}
+			s.persist.lock.Lock()
+			s.persist.dbFilename = val
+			s.persist.lock.Unlock()
+			return nil
+		},
+	},
+	"save": {
+		usage: `save points, "seconds changes ...": snapshot once both are reached, none if empty`,
+		get: func(s *Server) string {
+			s.persist.lock.Lock()
+			defer s.persist.lock.Unlock()
+			return formatSavePoints(s.persist.savePoints)
+		},
+		set: func(s *Server, val string) error {
+			points, err := parseSavePoints(val)
+			if err != nil {
+				return err
+			}
+			s.persist.lock.Lock()
+			s.persist.savePoints = points
+			s.persist.lock.Unlock()
+			return nil
+		},
+	},
+	"changelog-retention": {
+		usage: "changes kept for jwatchstream to resume from",
+		get: func(s *Server) string {
+			return strconv.Itoa(s.changelog.Retention())
+		},
+		set: func(s *Server, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return errors.New("changelog-retention must be a non-negative integer")
+			}
+			s.changelog.SetRetention(n)
+			return nil
+		},
+	},
+	"repl-backlog-size": {
+		usage: "bytes of replication stream kept for partial resyncs",
+		get: func(s *Server) string {
+			s.repl.lock.Lock()
+			defer s.repl.lock.Unlock()
+			return strconv.Itoa(s.repl.backlogSize)
+		},
+		set: func(s *Server, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return errors.New("repl-backlog-size must be a positive integer")
+			}
+			s.repl.lock.Lock()
+			s.repl.backlogSize = n
+			s.repl.lock.Unlock()
+			return nil
+		},
+	},
+	"replica-read-only": {
+		usage: "whether replicas refuse writes",
+		get: func(s *Server) string {
+			s.repl.lock.Lock()
+			defer s.repl.lock.Unlock()
+			return formatBool(s.repl.replicaReadOnly)
+		},
+		set: func(s *Server, val string) error {
+			b, err := parseBool(val)
+			if err != nil {
+				return err
+			}
+			s.repl.lock.Lock()
+			s.repl.replicaReadOnly = b
+			s.repl.lock.Unlock()
+			return nil
+		},
+	},
+	"cluster-enabled": {
+		usage: "whether the node runs in cluster mode",
+		get: func(s *Server) string {
+			return formatBool(s.cluster.Enabled())
+		},
+		set: func(s *Server, val string) error {
+			b, err := parseBool(val)
+			if err != nil {
+				return err
+			}
+			s.cluster.setEnabled(s, b)
+			return nil
+		},
+	},
+	"cluster-announce-ip": {
+		usage: "address the node gives to the other cluster nodes",
+		get: func(s *Server) string {
+			s.cluster.lock.RLock()
+			defer s.cluster.lock.RUnlock()
+			return s.cluster.announceIP
+		},
+		set: func(s *Server, val string) error {
+			if net.ParseIP(val) == nil {
+				return errors.New("cluster-announce-ip must be an ip address")
+			}
+			s.cluster.lock.Lock()
+			s.cluster.announceIP = val
+			s.cluster.setAddr(s)
+			s.cluster.lock.Unlock()
+			return nil
+		},
+	},
+	"masteruser": aclParam("user this node authenticates as to the other nodes",
+		func(a *acl) *string { return &a.masterUser }),
+	"masterauth": aclParam("password this node authenticates with to the other nodes",
+		func(a *acl) *string { return &a.masterAuth }),
+	"proto-max-bulk-len": limitParam("bytes of a bulk string",
+		func(l *resp.Limits) *int { return &l.MaxBulkLen }),
+	"proto-max-multibulk-len": limitParam("items of an array",
+		func(l *resp.Limits) *int { return &l.MaxMultiLen }),
+	"proto-max-nesting": limitParam("depth of nested arrays and maps",
+		func(l *resp.Limits) *int { return &l.MaxDepth }),
+	"proto-max-inline-len": limitParam("bytes of an inline command",
+		func(l *resp.Limits) *int { return &l.MaxInlineLen }),
+	"notify-keyspace-events": {
+		usage: "classes of keyspace notifications published",
+		get: func(s *Server) string {
+			return formatNotifyFlags(s.pubsub.NotifyFlags())
+		},
+		set: func(s *Server, val string) error {
+			flags, ok := parseNotifyFlags(val)
+			if !ok {
+				return errors.New("invalid notify-keyspace-events flags")
+			}
+			s.pubsub.SetNotifyFlags(flags)
+			return nil
+		},
+	},
+}
+
+// requirepass is added here as it sets rules, which look the commands up
+func init() {
+	configParams["requirepass"] = &configParam{
+		usage: "password of the default user, none if empty",
+		get: func(s *Server) string {
+			s.acl.lock.RLock()
+			defer s.acl.lock.RUnlock()
+			return s.acl.requirePass
+		},
+		set: func(s *Server, val string) error {
+			rules := []string{"resetpass", ">" + val}
+			if val == "" {
+				rules = []string{"nopass"}
+			}
+			if err := s.acl.setUser(defaultUser, rules); err != nil {
+				return err
+			}
+			s.acl.lock.Lock()
+			s.acl.requirePass = val
+			s.acl.lock.Unlock()
+			return nil
+		},
+	}
+}
+
+// stringParam is a setting read at start
+func stringParam(usage string, field func(s *Server) *string) *configParam {
+	return &configParam{
+		usage:   usage,
+		startup: true,
+		get: func(s *Server) string {
+			return *field(s)
+		},
+		set: func(s *Server, val string) error {
+			*field(s) = val
+			return nil
+		},
+	}
+}
+
+// limitParam is a protocol limit of the requests, 0 for none
+func limitParam(usage string, field func(l *resp.Limits) *int) *configParam {
+	return &configParam{
+		usage: usage + ", 0 for no limit",
+		get: func(s *Server) string {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+			return strconv.Itoa(*field(&s.limits))
+		},
+		set: func(s *Server, val string) error {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return errors.New("protocol limits must be non-negative integers")
+			}
+			s.lock.Lock()
+			*field(&s.limits) = n
+			s.lock.Unlock()
+			return nil
+		},
+	}
+}
+
+// aclParam is a credential this node sends to the others
+func aclParam(usage string, field func(a *acl) *string) *configParam {
+	return &configParam{
+		usage: usage,
+		get: func(s *Server) string {
+			s.acl.lock.RLock()
+			defer s.acl.lock.RUnlock()
+			return *field(s.acl)
+		},
+		set: func(s *Server, val string) error {
+			s.acl.lock.Lock()
+			*field(s.acl) = val
+			s.acl.lock.Unlock()
+			return nil
+		},
+	}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+// parseMemory reads bytes with an optional kb, mb or gb unit
+func parseMemory(val string) (int64, error) {
+	v := strings.ToLower(val)
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		n      int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"b", 1}} {
+		if strings.HasSuffix(v, u.suffix) {
+			v, unit = v[:len(v)-len(u.suffix)], u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid memory size '%s'", val)
+	}
+	return n * unit, nil
+}
+
+// ConfigUsage describes the parameters, which jj-server takes as flags
+func ConfigUsage() map[string]string {
+	usage := make(map[string]string, len(configParams))
+	for name, p := range configParams {
+		usage[name] = p.usage
+	}
+	return usage
+}
+
+// GetConfig returns the value of a parameter
+func (s *Server) GetConfig(name string) (string, error) {
+	p, ok := configParams[name]
+	if !ok {
+		return "", fmt.Errorf("%v '%s'", ErrUnsupportedParam, name)
+	}
+	return p.get(s), nil
+}
+
+// SetConfig sets a parameter, the startup ones included, before Run
+func (s *Server) SetConfig(name string, val string) error {
+	p, ok := configParams[name]
+	if !ok {
+		return fmt.Errorf("%v '%s'", ErrUnsupportedParam, name)
+	}
+	if err := p.set(s, val); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// configLine splits a line of the config file into a parameter and its
+// value, quoted like an inline command if it has spaces; ok is false for
+// blank and comment lines
+func configLine(line string) (name string, val string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", false, nil
+	}
+	args, err := resp.SplitArgs([]byte(line))
+	if err != nil {
+		return "", "", false, err
+	}
+	if len(args) != 2 {
+		return "", "", false, errors.New("expected a parameter and its value")
+	}
+	return strings.ToLower(string(args[0])), string(args[1]), true, nil
+}
+
+func quoteConfigValue(val string) string {
+	if val != "" && !strings.ContainsAny(val, " \t\r\n\"'\\{[#") {
+		return val
+	}
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+	return "\"" + r.Replace(val) + "\""
+}
+
+// LoadConfig applies a config file of "parameter value" lines, which
+// CONFIG REWRITE writes back
+func (s *Server) LoadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		name, val, ok, err := configLine(scanner.Text())
+		if err == nil && ok {
+			err = s.SetConfig(name, val)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.configFile = path
+	s.configBase = make(map[string]string, len(configParams))
+	for name, p := range configParams {
+		s.configBase[name] = p.get(s)
+	}
+	return nil
+}
+
+// rewriteConfig writes the current values to the config file: the lines
+// of the parameters it has are updated in place, comments kept, and the
+// parameters changed since it was loaded are appended
+func (s *Server) rewriteConfig() error {
+	if s.configFile == "" {
+		return ErrNoConfigFile
+	}
+	b, err := os.ReadFile(s.configFile)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	done := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		name, _, ok, err := configLine(line)
+		if err != nil || !ok || configParams[name] == nil {
+			lines = append(lines, line)
+			continue
+		}
+		if !done[name] {
+			lines = append(lines, name+" "+quoteConfigValue(configParams[name].get(s)))
+			done[name] = true
+		}
+	}
+	var names []string
+	for name, p := range configParams {
+		if !done[name] && p.get(s) != s.configBase[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		lines = append(lines, name+" "+quoteConfigValue(configParams[name].get(s)))
+	}
+
+	tmp := s.configFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.configFile)
+}
+
+// config get <pattern>
+// config set <param> <value>
+// config rewrite
+func cmdConfig(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "get":
+		if len(r.Multi) != 3 {
+			return RespInvalidParam
+		}
+		pattern := strings.ToLower(string(r.Multi[2].Bulk))
+		var ret []string
+		for name, p := range configParams {
+			if utils.GlobMatch(pattern, name) {
+				ret = append(ret, name, p.get(client.srv))
+			}
+		}
+		return bulkStrings(ret)
+	case "set":
+		if len(r.Multi) != 4 {
+			return RespInvalidParam
+		}
+		p, ok := configParams[strings.ToLower(string(r.Multi[2].Bulk))]
+		if !ok {
+			return RespErr(ErrUnsupportedParam)
+		}
+		if p.startup {
+			return RespErr(fmt.Errorf("can't set '%s' at runtime, only at start", r.Multi[2].Bulk))
+		}
+		if err := p.set(client.srv, string(r.Multi[3].Bulk)); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	case "rewrite":
+		if len(r.Multi) != 2 {
+			return RespInvalidParam
+		}
+		if err := client.srv.rewriteConfig(); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	}
+	return RespInvalidParam
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jj.conf")
+	os.WriteFile(path, []byte(`# jj settings
+addr :7000
+dir `+dir+`
+save "60 10"
+
+maxmemory 1mb
+`), 0600)
+
+	s := NewServer(":9999")
+	if err := s.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if s.addr != ":7000" {
+		t.Error("addr", s.addr)
+	}
+	c := newTestClient(t, s)
+	defer c.close()
+	for name, want := range map[string]string{"save": "60 10", "maxmemory": "1048576", "dir": dir} {
+		if r := c.do("config", "get", name); len(r.Multi) != 2 || string(r.Multi[1].Bulk) != want {
+			t.Error(name, r)
+		}
+	}
+	for _, args := range [][]string{
+		{"config", "set", "addr", ":7001"},
+		{"config", "set", "dir", t.TempDir()},
+	} {
+		if r := c.do(args...); r.Type != resp.ErrorResp {
+			t.Error("startup parameter set at runtime", args, r)
+		}
+	}
+	if r := c.do("config", "set", "save", "1 2 3"); r.Type != resp.ErrorResp {
+		t.Error("invalid save points", r)
+	}
+	if r := c.do("config", "set", "maxmemory", "9000000000gb"); r.Type != resp.ErrorResp {
+		t.Error("overflowing memory size", r)
+	}
+	for _, args := range [][]string{
+		{"config", "set", "save", ""},
+		{"config", "set", "timeout", "30"},
+		{"config", "rewrite"},
+	} {
+		if r := c.do(args...); r.Type != resp.SimpleString {
+			t.Error(args, r)
+		}
+	}
+	b, _ := os.ReadFile(path)
+	want := "# jj settings\naddr :7000\ndir " + dir + "\nsave \"\"\n\nmaxmemory 1048576\ntimeout 30\n"
+	if string(b) != want {
+		t.Errorf("rewritten %q", b)
+	}
+	if err := NewServer("").LoadConfig(path); err != nil {
+		t.Error("reload", err)
+	}
+
+	os.WriteFile(path, []byte("timeout 1\nnope 1\n"), 0600)
+	if err := NewServer("").LoadConfig(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Error("unknown parameter", err)
+	}
+	if r := newTestClient(t, NewServer("")).do("config", "rewrite"); r.Error != ErrNoConfigFile.Error() {
+		t.Error("no config file", r)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	s := NewServer("")
+	c := newTestClient(t, s)
+	defer c.close()
+	c.do("config", "set", "maxmemory", "1kb")
+	if r := c.do("jdocset", "a", "1"); r.Error != ErrOOM.Error() {
+		t.Error("write over maxmemory", r)
+	}
+	if r := c.do("jdocget", "a"); r.Type == resp.ErrorResp {
+		t.Error("read over maxmemory", r)
+	}
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	hc := &httpClient{t: t, url: ts.URL}
+	if res, _ := hc.do("PUT", "/docs/a", "1"); res.StatusCode != http.StatusInsufficientStorage {
+		t.Error("http write over maxmemory", res.Status)
+	}
+	c.do("config", "set", "maxmemory", "0")
+	if r := c.do("jdocset", "a", "1"); r.Type != resp.SimpleString {
+		t.Error("no limit", r)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer("")
+	s.SetConfig("timeout", "1")
+	c := newTestClient(t, s)
+	defer c.close()
+	w := newTestClient(t, s)
+	defer w.close()
+	w.do("jwatchstream", "a")
+
+	time.Sleep(1500 * time.Millisecond)
+	c.c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("idle client not closed")
+	}
+	other := newTestClient(t, s)
+	defer other.close()
+	other.do("jdocset", "a", "1")
+	if r := w.read(); len(r.Multi) != 6 || string(r.Multi[2].Bulk) != "a" {
+		t.Error("watcher closed", r)
+	}
+}
@@ -1,13 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-var ErrNoSuchKey = errors.New("no such key")
+var (
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrEmptyArray      = errors.New("empty array")
+	ErrVersionMismatch = errors.New("document version mismatch")
+)
 
 const (
 	MaxSlotSize = 1024
@@ -16,6 +25,9 @@ const (
 type Db interface {
 	PutDoc(key string, val interface{}) error
 	GetDoc(key string) (interface{}, error)
+	GetDocVersion(key string) (interface{}, uint64)
+	Read(key string, fn func(doc interface{}))
+	Update(key string, fn func(doc interface{}, version uint64) (interface{}, error)) (uint64, error)
 	RemoveDoc(key string) error
 	PutPath(key string, path string, val interface{}) error
 	GetPath(key string, path string) (interface{}, error)
@@ -25,6 +37,45 @@ type Db interface {
 	RemovePath(key string, path string) error
 	Scan(keyPrefix string) (KVIter, error)
 	Save(fileName string, context interface{}) error
+	Walk(keyPrefix string, fn func(key string, doc interface{}))
+	SlotKeys(slot int, count int) []string
+	Migrate(key string, fn func(doc interface{}) error) error
+	SetMigrating(slot int, migrating bool)
+	Snapshot(fn func()) map[string]interface{}
+	Restore(docs map[string]interface{})
+	Replay(key string, path string, op string, val interface{}) error
+	Observe(fn MutationFunc)
+	SetValidator(v Validator)
+	View(f DocFilter) Db
+}
+
+// operation names passed to a MutationFunc
+const (
+	OpDocSet = "jdocset"
+	OpDocDel = "jdocdel"
+	OpSet    = "jset"
+	OpIncr   = "jincr"
+	OpPush   = "jpush"
+	OpPop    = "jpop"
+)
+
+// MutationFunc is called after a document was changed, with the slot lock
+// still held. doc is the whole document after the change, nil if removed.
+type MutationFunc func(key string, path string, op string, doc interface{})
+
+// Validator checks a document before a change to it is committed
+type Validator interface {
+	Match(key string) bool
+	Validate(key string, doc interface{}) error
+}
+
+// DocFilter narrows a view of the db to what a user may read and change
+type DocFilter interface {
+	// Filter returns doc as it may be read, a copy if anything is hidden
+	Filter(doc interface{}) interface{}
+	// Check refuses a change at path turning old into doc, nil if removed.
+	// It runs with the slot lock held.
+	Check(path string, old interface{}, doc interface{}) error
 }
 
 type KVIter interface {
@@ -35,20 +86,34 @@ type KVIter interface {
 }
 
 type Slot struct {
-	m    map[string]interface{}
-	lock sync.RWMutex
+	m         map[string]interface{}
+	versions  map[string]uint64
+	migrating bool // keys are leaving, no new one may be created
+	lock      sync.RWMutex
 }
 
 func NewSlot() *Slot {
 	return &Slot{
-		m:    make(map[string]interface{}),
-		lock: sync.RWMutex{},
+		m:        make(map[string]interface{}),
+		versions: make(map[string]uint64),
+		lock:     sync.RWMutex{},
 	}
 }
 
+// MapDb is a view of the documents, filtered if filter is set
 type MapDb struct {
+	*mapStore
+	filter DocFilter
+}
+
+type mapStore struct {
 	slots    []*Slot
 	keyCount int
+	version  uint64 // last version given to a document
+
+	observers []MutationFunc
+	validator Validator
+	hookLock  sync.RWMutex
 }
 
 func NewMapDb() *MapDb {
@@ -57,38 +122,202 @@ func NewMapDb() *MapDb {
 	for i := 0; i < MaxSlotSize; i++ {
 		slots = append(slots, NewSlot())
 	}
-	return &MapDb{
+	return &MapDb{mapStore: &mapStore{
 		slots:    slots,
 		keyCount: 0,
+	}}
+}
+
+// View returns the same documents seen through f: reads are filtered and
+// changes checked by it
+func (db *MapDb) View(f DocFilter) Db {
+	return &MapDb{mapStore: db.mapStore, filter: f}
+}
+
+// check runs the filter of the view on a change, with the slot lock held
+func (db *MapDb) check(path string, old interface{}, doc interface{}) error {
+	if db.filter == nil {
+		return nil
+	}
+	return db.filter.Check(path, old, doc)
+}
+
+// visible returns doc as the view shows it
+func (db *MapDb) visible(doc interface{}) interface{} {
+	if db.filter == nil || doc == nil {
+		return doc
+	}
+	return db.filter.Filter(doc)
+}
+
+// deepCopy copies the maps and arrays of a decoded json document
+func deepCopy(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, item := range vv {
+			m[k] = deepCopy(item)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(vv))
+		for i, item := range vv {
+			a[i] = deepCopy(item)
+		}
+		return a
+	}
+	return v
+}
+
+// hashTag returns the part of key between the first { and the following },
+// if not empty, so that keys sharing a tag land in the same slot
+func hashTag(key string) string {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			return key[i+1 : i+1+j]
+		}
 	}
+	return key
 }
 
 func GetSlotIdFromKey(key string) int {
-	h := crc32.Checksum([]byte(key), crc32.IEEETable)
+	h := crc32.Checksum([]byte(hashTag(key)), crc32.IEEETable)
 	return int(h) % MaxSlotSize
 }
 
+func (db *MapDb) Observe(fn MutationFunc) {
+	db.hookLock.Lock()
+	db.observers = append(db.observers, fn)
+	db.hookLock.Unlock()
+}
+
+// notify must be called with the slot lock of key held. Every change goes
+// through it, so it also gives the document a new version, unique across
+// all keys.
+func (db *MapDb) notify(key string, path string, op string, doc interface{}) {
+	slot := db.slots[GetSlotIdFromKey(key)]
+	if op == OpDocDel {
+		delete(slot.versions, key)
+	} else {
+		slot.versions[key] = atomic.AddUint64(&db.version, 1)
+	}
+
+	db.hookLock.RLock()
+	defer db.hookLock.RUnlock()
+	for _, fn := range db.observers {
+		fn(key, path, op, doc)
+	}
+}
+
+func (db *MapDb) SetValidator(v Validator) {
+	db.hookLock.Lock()
+	db.validator = v
+	db.hookLock.Unlock()
+}
+
+func (db *MapDb) getValidator() Validator {
+	db.hookLock.RLock()
+	defer db.hookLock.RUnlock()
+	return db.validator
+}
+
 func (db *MapDb) PutDoc(key string, val interface{}) error {
+	if v := db.getValidator(); v != nil && v.Match(key) {
+		if err := v.Validate(key, val); err != nil {
+			return err
+		}
+	}
+
 	id := GetSlotIdFromKey(key)
 	db.slots[id].lock.Lock()
+	defer db.slots[id].lock.Unlock()
+	old, exists := db.slots[id].m[key]
+	if !exists && db.slots[id].migrating {
+		return ErrTryAgain
+	}
+	if err := db.check("", old, val); err != nil {
+		return err
+	}
 	db.slots[id].m[key] = val
-	db.slots[id].lock.Unlock()
+	db.notify(key, "", OpDocSet, val)
 	return nil
 }
 
 func (db *MapDb) GetDoc(key string) (interface{}, error) {
 	id := GetSlotIdFromKey(key)
 	db.slots[id].lock.RLock()
-	val := db.slots[id].m[key]
+	val := db.visible(db.slots[id].m[key])
 	db.slots[id].lock.RUnlock()
 	return val, nil
 }
 
+// GetDocVersion returns a copy of the document at key and its version, 0 if
+// there is no document
+func (db *MapDb) GetDocVersion(key string) (interface{}, uint64) {
+	id := GetSlotIdFromKey(key)
+	db.slots[id].lock.RLock()
+	defer db.slots[id].lock.RUnlock()
+	return db.visible(deepCopy(db.slots[id].m[key])), db.slots[id].versions[key]
+}
+
+// Read calls fn with the document at key, nil if there is none, while its
+// slot is locked. fn must not keep doc nor call back into db.
+func (db *MapDb) Read(key string, fn func(doc interface{})) {
+	id := GetSlotIdFromKey(key)
+	db.slots[id].lock.RLock()
+	defer db.slots[id].lock.RUnlock()
+	fn(db.visible(db.slots[id].m[key]))
+}
+
+// Update replaces the document at key with the one fn returns. fn gets a
+// copy of the document and its version, 0 if there is none, and may refuse
+// the change; a nil result removes the document. It returns the new version.
+// Like PutDoc, it doesn't create a document in a migrating slot.
+func (db *MapDb) Update(key string, fn func(doc interface{}, version uint64) (interface{}, error)) (uint64, error) {
+	id := GetSlotIdFromKey(key)
+	slot := db.slots[id]
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+
+	old, exists := slot.m[key]
+	doc, err := fn(db.visible(deepCopy(old)), slot.versions[key])
+	if err != nil {
+		return 0, err
+	}
+	if err := db.check("", old, doc); err != nil {
+		return 0, err
+	}
+	if doc == nil {
+		if exists {
+			delete(slot.m, key)
+			db.notify(key, "", OpDocDel, nil)
+		}
+		return 0, nil
+	}
+	if !exists && slot.migrating {
+		return 0, ErrTryAgain
+	}
+	if v := db.getValidator(); v != nil && v.Match(key) {
+		if err := v.Validate(key, doc); err != nil {
+			return 0, err
+		}
+	}
+	slot.m[key] = doc
+	db.notify(key, "", OpDocSet, doc)
+	return slot.versions[key], nil
+}
+
 func (db *MapDb) RemoveDoc(key string) error {
 	id := GetSlotIdFromKey(key)
 	db.slots[id].lock.Lock()
-	delete(db.slots[id].m, key)
-	db.slots[id].lock.Unlock()
+	defer db.slots[id].lock.Unlock()
+	if old, ok := db.slots[id].m[key]; ok {
+		if err := db.check("", old, nil); err != nil {
+			return err
+		}
+		delete(db.slots[id].m, key)
+		db.notify(key, "", OpDocDel, nil)
+	}
 	return nil
 }
 
@@ -96,6 +325,7 @@ func (db *MapDb) GetPath(key string, path string) (interface{}, error) {
 	id := GetSlotIdFromKey(key)
 	db.slots[id].lock.RLock()
 	val, ok := db.slots[id].m[key]
+	val = db.visible(val)
 	db.slots[id].lock.RUnlock()
 
 	if ok {
@@ -109,53 +339,77 @@ func (db *MapDb) GetPath(key string, path string) (interface{}, error) {
 	return nil, ErrNoSuchKey
 }
 
-func (db *MapDb) PutPath(key string, path string, val interface{}) error {
+// mutate runs fn on the document at key. If a validator matches the key, fn
+// works on a copy that only replaces the document once it passed validation,
+// so a rejected change leaves the document untouched. The same goes for the
+// filter of a view.
+func (db *MapDb) mutate(key string, path string, op string, fn func(doc interface{}) error) error {
+	return db.doMutate(key, path, op, db.getValidator(), fn)
+}
+
+func (db *MapDb) doMutate(key string, path string, op string, validator Validator, fn func(doc interface{}) error) error {
 	id := GetSlotIdFromKey(key)
 	db.slots[id].lock.Lock()
 	defer db.slots[id].lock.Unlock()
-	if v, ok := db.slots[id].m[key]; ok {
-		return jsonPathSet(v, path, val)
+	v, ok := db.slots[id].m[key]
+	if !ok {
+		return ErrNoSuchKey
 	}
-	return ErrNoSuchKey
+
+	old := v
+	validate := validator != nil && validator.Match(key)
+	if validate || db.filter != nil {
+		v = deepCopy(v)
+	}
+	if err := fn(v); err != nil {
+		return err
+	}
+	if err := db.check(path, old, v); err != nil {
+		return err
+	}
+	if validate {
+		if err := validator.Validate(key, v); err != nil {
+			return err
+		}
+	}
+	if validate || db.filter != nil {
+		db.slots[id].m[key] = v
+	}
+	db.notify(key, path, op, v)
+	return nil
+}
+
+func (db *MapDb) PutPath(key string, path string, val interface{}) error {
+	return db.mutate(key, path, OpSet, func(doc interface{}) error {
+		return jsonPathSet(doc, path, val)
+	})
 }
 
 func (db *MapDb) IncrPath(key string, path string, val interface{}) error {
-	id := GetSlotIdFromKey(key)
-	db.slots[id].lock.Lock()
-	defer db.slots[id].lock.Unlock()
-	if v, ok := db.slots[id].m[key]; ok {
-		if delta, ok := val.(float64); ok {
-			return jsonPathIncr(v, path, int(delta))
-		} else {
-			fmt.Errorf("type error %v", val)
-		}
+	delta, ok := val.(float64)
+	if !ok {
+		return fmt.Errorf("type error %v", val)
 	}
-	return ErrNoSuchKey
+	return db.mutate(key, path, OpIncr, func(doc interface{}) error {
+		return jsonPathIncr(doc, path, int(delta))
+	})
 }
 
 func (db *MapDb) PushPath(key string, path string, val interface{}) error {
-	id := GetSlotIdFromKey(key)
-	db.slots[id].lock.Lock()
-	defer db.slots[id].lock.Unlock()
-	if v, ok := db.slots[id].m[key]; ok {
-		return jsonPathPush(v, path, val)
-	}
-	return ErrNoSuchKey
+	return db.mutate(key, path, OpPush, func(doc interface{}) error {
+		return jsonPathPush(doc, path, val)
+	})
 }
 
 func (db *MapDb) PopPath(key string, path string) (interface{}, error) {
-	id := GetSlotIdFromKey(key)
-	db.slots[id].lock.Lock()
-	defer db.slots[id].lock.Unlock()
-	if v, ok := db.slots[id].m[key]; ok {
-		var ret interface{}
-		err := jsonPathPop(v, path, &ret)
-		if err != nil {
-			return nil, err
-		}
-		return ret, nil
+	var ret interface{}
+	err := db.mutate(key, path, OpPop, func(doc interface{}) error {
+		return jsonPathPop(doc, path, &ret)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, ErrNoSuchKey
+	return ret, nil
 }
 
 func (db *MapDb) RemovePath(key string, path string) error {
@@ -168,7 +422,150 @@ func (db *MapDb) Scan(keyPrefix string) (KVIter, error) {
 	return nil, fmt.Errorf("not implement yet")
 }
 
+// Walk calls fn for every document whose key starts with keyPrefix. fn runs
+// with the slot lock held, so it must not call back into db.
+func (db *MapDb) Walk(keyPrefix string, fn func(key string, doc interface{})) {
+	for _, slot := range db.slots {
+		slot.lock.RLock()
+		for k, v := range slot.m {
+			if strings.HasPrefix(k, keyPrefix) {
+				fn(k, db.visible(v))
+			}
+		}
+		slot.lock.RUnlock()
+	}
+}
+
+// SlotKeys returns up to count keys of a slot, all of them if count < 0
+func (db *MapDb) SlotKeys(slot int, count int) []string {
+	db.slots[slot].lock.RLock()
+	defer db.slots[slot].lock.RUnlock()
+	keys := []string{}
+	for k := range db.slots[slot].m {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Migrate hands the document at key to fn and removes it if fn succeeds.
+// The slot stays locked meanwhile.
+func (db *MapDb) Migrate(key string, fn func(doc interface{}) error) error {
+	id := GetSlotIdFromKey(key)
+	db.slots[id].lock.Lock()
+	defer db.slots[id].lock.Unlock()
+	doc, ok := db.slots[id].m[key]
+	if !ok {
+		return ErrNoSuchKey
+	}
+	if err := fn(doc); err != nil {
+		return err
+	}
+	delete(db.slots[id].m, key)
+	db.notify(key, "", OpDocDel, nil)
+	return nil
+}
+
+// SetMigrating marks a slot whose keys are moving to another node. PutDoc
+// and Update refuse to create keys there with ErrTryAgain, since the key
+// may already live on the target: checked under the slot lock, this closes
+// the gap between the redirection of a command and its write.
+func (db *MapDb) SetMigrating(slot int, migrating bool) {
+	db.slots[slot].lock.Lock()
+	db.slots[slot].migrating = migrating
+	db.slots[slot].lock.Unlock()
+}
+
+// Snapshot returns a copy of all documents. fn is called while no document
+// can change, so that state kept next to db is captured at the same point.
+func (db *MapDb) Snapshot(fn func()) map[string]interface{} {
+	for _, slot := range db.slots {
+		slot.lock.RLock()
+	}
+	docs := make(map[string]interface{})
+	for _, slot := range db.slots {
+		for k, v := range slot.m {
+			docs[k] = deepCopy(v)
+		}
+	}
+	if fn != nil {
+		fn()
+	}
+	for _, slot := range db.slots {
+		slot.lock.RUnlock()
+	}
+	return docs
+}
+
+// Restore replaces all documents with docs. Documents are not validated.
+func (db *MapDb) Restore(docs map[string]interface{}) {
+	for _, slot := range db.slots {
+		slot.lock.Lock()
+		for k := range slot.m {
+			if _, ok := docs[k]; !ok {
+				delete(slot.m, k)
+				db.notify(k, "", OpDocDel, nil)
+			}
+		}
+		slot.lock.Unlock()
+	}
+	for k, v := range docs {
+		id := GetSlotIdFromKey(k)
+		db.slots[id].lock.Lock()
+		db.slots[id].m[k] = v
+		db.notify(k, "", OpDocSet, v)
+		db.slots[id].lock.Unlock()
+	}
+}
+
+// Replay applies a change that was already validated elsewhere, op is one of
+// OpDocSet, OpDocDel or OpSet
+func (db *MapDb) Replay(key string, path string, op string, val interface{}) error {
+	switch op {
+	case OpDocSet:
+		id := GetSlotIdFromKey(key)
+		db.slots[id].lock.Lock()
+		db.slots[id].m[key] = val
+		db.notify(key, "", OpDocSet, val)
+		db.slots[id].lock.Unlock()
+		return nil
+	case OpDocDel:
+		return db.RemoveDoc(key)
+	case OpSet:
+		return db.doMutate(key, path, OpSet, nil, func(doc interface{}) error {
+			return jsonPathSet(doc, path, val)
+		})
+	}
+	return fmt.Errorf("can't replay %s", op)
+}
+
+// Save writes all documents to fileName as one JSON object. It goes through
+// a temporary file, so a failure leaves the previous snapshot in place.
 func (db *MapDb) Save(fileName string, context interface{}) error {
-	// TODO
-	return fmt.Errorf("not implement yet")
+	docs := db.Snapshot(nil)
+	tmp := fmt.Sprintf("%s.tmp-%d", fileName, os.Getpid())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(docs)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
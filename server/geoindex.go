@@ -0,0 +1,468 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"jj/resp"
+)
+
+const (
+	geoStep        = 26 // bits per coordinate, the hash fits a float64 exactly
+	geoMaxCells    = 16
+	geoEarthRadius = 6372797.560856 // meters, same as redis
+)
+
+var (
+	ErrInvalidUnit   = errors.New("unsupported unit provided. please use m, km, ft, mi")
+	ErrInvalidLatLon = errors.New("invalid latitude or longitude")
+)
+
+var geoUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.34,
+	"ft": 0.3048,
+}
+
+type geoPoint struct {
+	lat, lon float64
+	hash     float64
+}
+
+// geoIndex keeps the documents whose lat/lon paths hold a valid position.
+// Positions are stored in a skiplist by their interleaved geohash, so every
+// geohash cell is a contiguous score range.
+type geoIndex struct {
+	name    string
+	prefix  string
+	latPath string
+	lonPath string
+
+	lock   sync.RWMutex
+	sl     *skiplist
+	points map[string]geoPoint
+}
+
+func newGeoIndex(name string, prefix string, latPath string, lonPath string) *geoIndex {
+	return &geoIndex{
+		name:    name,
+		prefix:  prefix,
+		latPath: latPath,
+		lonPath: lonPath,
+		sl:      newSkiplist(),
+		points:  make(map[string]geoPoint),
+	}
+}
+
+// args: <lat path> <lon path>
+func newGeoIndexFromArgs(name string, prefix string, args [][]byte) (index, error) {
+	if len(args) != 2 {
+		return nil, errors.New("usage: jindex create <name> geo <prefix> <lat path> <lon path>")
+	}
+	return newGeoIndex(name, prefix, string(args[0]), string(args[1])), nil
+}
+
+func (idx *geoIndex) Name() string {
+	return idx.name
+}
+
+func (idx *geoIndex) Prefix() string {
+	return idx.prefix
+}
+
+func (idx *geoIndex) Info() []string {
+	return []string{idx.name, "geo", idx.prefix + "*", idx.latPath, idx.lonPath}
+}
+
+func validLatLon(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+func (idx *geoIndex) update(key string, doc interface{}) {
+	lat, ok1 := pathNumber(doc, idx.latPath)
+	lon, ok2 := pathNumber(doc, idx.lonPath)
+	ok := ok1 && ok2 && validLatLon(lat, lon)
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, exists := idx.points[key]; exists {
+		if ok && old.lat == lat && old.lon == lon {
+			return
+		}
+		idx.sl.delete(old.hash, key)
+		delete(idx.points, key)
+	}
+	if ok {
+		p := geoPoint{lat: lat, lon: lon, hash: geoHash(lat, lon)}
+		idx.sl.insert(p.hash, key)
+		idx.points[key] = p
+	}
+}
+
+// geoCell returns the cell of v in [min, max] at the given step
+func geoCell(v, min, max float64, step uint) uint64 {
+	n := uint64(1) << step
+	c := uint64((v - min) / (max - min) * float64(n))
+	if c >= n {
+		c = n - 1
+	}
+	return c
+}
+
+func interleave(lat, lon uint64, step uint) uint64 {
+	var h uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		h = h<<1 | (lat>>uint(i))&1
+		h = h<<1 | (lon>>uint(i))&1
+	}
+	return h
+}
+
+func geoHash(lat, lon float64) float64 {
+	return float64(interleave(geoCell(lat, -90, 90, geoStep), geoCell(lon, -180, 180, geoStep), geoStep))
+}
+
+func degRad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func radDeg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// geoDistance is the haversine distance in meters
+func geoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	u := math.Sin(degRad(lat2-lat1) / 2)
+	v := math.Sin(degRad(lon2-lon1) / 2)
+	a := u*u + math.Cos(degRad(lat1))*math.Cos(degRad(lat2))*v*v
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// geoBoundingBox returns the box around (lat, lon) reaching dLat meters
+// north and south and dLon meters east and west
+func geoBoundingBox(lat, lon, dLat, dLon float64) (minLat, maxLat, minLon, maxLon float64) {
+	latSpan := radDeg(dLat / geoEarthRadius)
+	minLat = math.Max(lat-latSpan, -90)
+	maxLat = math.Min(lat+latSpan, 90)
+
+	cos := math.Cos(degRad(lat))
+	if maxLat == 90 || minLat == -90 || cos < 1e-9 {
+		return minLat, maxLat, -180, 180
+	}
+	lonSpan := radDeg(dLon / (geoEarthRadius * cos))
+	if lonSpan >= 180 {
+		return minLat, maxLat, -180, 180
+	}
+	return minLat, maxLat, lon - lonSpan, lon + lonSpan
+}
+
+// scanBox calls fn for every point inside the geohash cells covering the
+// box. Longitudes outside [-180, 180] wrap around. Points near the box may
+// be reported too, callers filter on the exact shape.
+func (idx *geoIndex) scanBox(minLat, maxLat, minLon, maxLon float64, fn func(key string, p geoPoint)) {
+	if minLon < -180 {
+		idx.scanBox(minLat, maxLat, minLon+360, 180, fn)
+		minLon = -180
+	}
+	if maxLon > 180 {
+		idx.scanBox(minLat, maxLat, -180, maxLon-360, fn)
+		maxLon = 180
+	}
+
+	step := uint(geoStep)
+	var latLo, latHi, lonLo, lonHi uint64
+	for ; step > 0; step-- {
+		latLo, latHi = geoCell(minLat, -90, 90, step), geoCell(maxLat, -90, 90, step)
+		lonLo, lonHi = geoCell(minLon, -180, 180, step), geoCell(maxLon, -180, 180, step)
+		if (latHi-latLo+1)*(lonHi-lonLo+1) <= geoMaxCells {
+			break
+		}
+	}
+
+	shift := 2 * (geoStep - step)
+	for la := latLo; la <= latHi; la++ {
+		for lo := lonLo; lo <= lonHi; lo++ {
+			h := interleave(la, lo, step)
+			r := &scoreRange{
+				min:   float64(h << shift),
+				max:   float64((h + 1) << shift),
+				maxex: true,
+			}
+			for x := idx.sl.first(r); x != nil && r.lteMax(x.score); x = x.level[0].forward {
+				fn(x.key, idx.points[x.key])
+			}
+		}
+	}
+}
+
+type geoResult struct {
+	key  string
+	dist float64
+	p    geoPoint
+}
+
+type geoResults []geoResult
+
+func (s geoResults) Len() int           { return len(s) }
+func (s geoResults) Less(i, j int) bool { return s[i].dist < s[j].dist }
+func (s geoResults) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Radius returns the points within radius meters of (lat, lon), nearest first
+func (idx *geoIndex) Radius(lat, lon, radius float64) []geoResult {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	var ret geoResults
+	minLat, maxLat, minLon, maxLon := geoBoundingBox(lat, lon, radius, radius)
+	idx.scanBox(minLat, maxLat, minLon, maxLon, func(key string, p geoPoint) {
+		if d := geoDistance(lat, lon, p.lat, p.lon); d <= radius {
+			ret = append(ret, geoResult{key, d, p})
+		}
+	})
+	sort.Sort(ret)
+	return ret
+}
+
+// Box returns the points in the box of width x height meters centered on
+// (lat, lon), nearest to the center first
+func (idx *geoIndex) Box(lat, lon, width, height float64) []geoResult {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	var ret geoResults
+	minLat, maxLat, minLon, maxLon := geoBoundingBox(lat, lon, height/2, width/2)
+	lonSpan := (maxLon - minLon) / 2
+	idx.scanBox(minLat, maxLat, minLon, maxLon, func(key string, p geoPoint) {
+		if p.lat < minLat || p.lat > maxLat {
+			return
+		}
+		dLon := math.Mod(p.lon-lon+540, 360) - 180
+		if lonSpan < 180 && math.Abs(dLon) > lonSpan {
+			return
+		}
+		ret = append(ret, geoResult{key, geoDistance(lat, lon, p.lat, p.lon), p})
+	})
+	sort.Sort(ret)
+	return ret
+}
+
+// Pos returns the position of key
+func (idx *geoIndex) Pos(key string) (geoPoint, bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	p, ok := idx.points[key]
+	return p, ok
+}
+
+func getGeoIndex(client *session, name []byte) (*geoIndex, error) {
+	idx, err := client.srv.indexes.get(string(name))
+	if err != nil {
+		return nil, err
+	}
+	gidx, ok := idx.(*geoIndex)
+	if !ok {
+		return nil, ErrWrongIndexType
+	}
+	if err := client.checkIndex(gidx.latPath, gidx.lonPath); err != nil {
+		return nil, err
+	}
+	return gidx, nil
+}
+
+func parseFloatArgs(args []*resp.Resp) ([]float64, error) {
+	var ret []float64
+	for _, a := range args {
+		f, err := strconv.ParseFloat(string(a.Bulk), 64)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+type geoQueryOpts struct {
+	withDist  bool
+	withCoord bool
+	desc      bool
+	count     int
+}
+
+func parseGeoQueryOpts(args []*resp.Resp) (*geoQueryOpts, error) {
+	opts := &geoQueryOpts{count: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i].Bulk)) {
+		case "withdist":
+			opts.withDist = true
+		case "withcoord":
+			opts.withCoord = true
+		case "asc":
+			opts.desc = false
+		case "desc":
+			opts.desc = true
+		case "count":
+			if i+1 >= len(args) {
+				return nil, ErrInvalidParam
+			}
+			n, err := resp.Btoi(args[i+1].Bulk)
+			if err != nil || n <= 0 {
+				return nil, ErrInvalidParam
+			}
+			opts.count = n
+			i++
+		default:
+			return nil, ErrInvalidParam
+		}
+	}
+	return opts, nil
+}
+
+// filterGeo drops the results whose key keep refuses
+func filterGeo(results []geoResult, keep func(string) bool) []geoResult {
+	if keep == nil {
+		return results
+	}
+	ret := results[:0]
+	for _, res := range results {
+		if keep(res.key) {
+			ret = append(ret, res)
+		}
+	}
+	return ret
+}
+
+func geoResultsResp(results []geoResult, unit float64, opts *geoQueryOpts) *resp.Resp {
+	if opts.desc {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	if opts.count >= 0 && len(results) > opts.count {
+		results = results[:opts.count]
+	}
+
+	ret := &resp.Resp{
+		Type:  resp.MultiResp,
+		Multi: []*resp.Resp{},
+	}
+	for _, res := range results {
+		key := &resp.Resp{Type: resp.BulkResp, Bulk: []byte(res.key)}
+		if !opts.withDist && !opts.withCoord {
+			ret.Multi = append(ret.Multi, key)
+			continue
+		}
+		item := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{key}}
+		if opts.withDist {
+			d := strconv.FormatFloat(res.dist/unit, 'f', 4, 64)
+			item.Multi = append(item.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(d)})
+		}
+		if opts.withCoord {
+			item.Multi = append(item.Multi, &resp.Resp{
+				Type: resp.MultiResp,
+				Multi: []*resp.Resp{
+					{Type: resp.BulkResp, Bulk: formatScore(res.p.lat)},
+					{Type: resp.BulkResp, Bulk: formatScore(res.p.lon)},
+				},
+			})
+		}
+		ret.Multi = append(ret.Multi, item)
+	}
+	return ret
+}
+
+// jgeoradius <index> <lat> <lon> <radius> <m|km|ft|mi> [WITHDIST] [WITHCOORD] [COUNT n] [ASC|DESC]
+func cmdJGeoRadius(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 6 {
+		return RespInvalidParam
+	}
+	idx, err := getGeoIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	args, err := parseFloatArgs(r.Multi[2:5])
+	if err != nil {
+		return RespInvalidParam
+	}
+	lat, lon, radius := args[0], args[1], args[2]
+	if !validLatLon(lat, lon) || radius < 0 {
+		return RespErr(ErrInvalidLatLon)
+	}
+	unit, ok := geoUnits[strings.ToLower(string(r.Multi[5].Bulk))]
+	if !ok {
+		return RespErr(ErrInvalidUnit)
+	}
+	opts, err := parseGeoQueryOpts(r.Multi[6:])
+	if err != nil {
+		return RespErr(err)
+	}
+
+	keep := client.srv.acl.keyFilter(client.user)
+	return geoResultsResp(filterGeo(idx.Radius(lat, lon, radius*unit), keep), unit, opts)
+}
+
+// jgeobox <index> <lat> <lon> <width> <height> <m|km|ft|mi> [WITHDIST] [WITHCOORD] [COUNT n] [ASC|DESC]
+func cmdJGeoBox(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 7 {
+		return RespInvalidParam
+	}
+	idx, err := getGeoIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	args, err := parseFloatArgs(r.Multi[2:6])
+	if err != nil {
+		return RespInvalidParam
+	}
+	lat, lon, width, height := args[0], args[1], args[2], args[3]
+	if !validLatLon(lat, lon) || width < 0 || height < 0 {
+		return RespErr(ErrInvalidLatLon)
+	}
+	unit, ok := geoUnits[strings.ToLower(string(r.Multi[6].Bulk))]
+	if !ok {
+		return RespErr(ErrInvalidUnit)
+	}
+	opts, err := parseGeoQueryOpts(r.Multi[7:])
+	if err != nil {
+		return RespErr(err)
+	}
+
+	keep := client.srv.acl.keyFilter(client.user)
+	return geoResultsResp(filterGeo(idx.Box(lat, lon, width*unit, height*unit), keep), unit, opts)
+}
+
+// jgeodist <index> <key1> <key2> [m|km|ft|mi]
+func cmdJGeoDist(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 4 && len(r.Multi) != 5 {
+		return RespInvalidParam
+	}
+	idx, err := getGeoIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	unit := 1.0
+	if len(r.Multi) == 5 {
+		var ok bool
+		if unit, ok = geoUnits[strings.ToLower(string(r.Multi[4].Bulk))]; !ok {
+			return RespErr(ErrInvalidUnit)
+		}
+	}
+	key1, key2 := string(r.Multi[2].Bulk), string(r.Multi[3].Bulk)
+	if err := client.srv.acl.checkKeys(client.user, key1, key2); err != nil {
+		return RespErr(err)
+	}
+	p1, ok1 := idx.Pos(key1)
+	p2, ok2 := idx.Pos(key2)
+	if !ok1 || !ok2 {
+		return RespNil
+	}
+	d := geoDistance(p1.lat, p1.lon, p2.lat, p2.lon) / unit
+	return &resp.Resp{
+		Type: resp.BulkResp,
+		Bulk: []byte(strconv.FormatFloat(d, 'f', 4, 64)),
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestGeoIndex(t *testing.T) {
+	db := NewMapDb()
+	indexes := newIndexManager()
+	db.Observe(indexes.onMutation)
+
+	stores := map[string][2]float64{
+		"store:berlin":  {52.5200, 13.4050},
+		"store:potsdam": {52.3906, 13.0645},
+		"store:hamburg": {53.5511, 9.9937},
+		"store:fiji":    {-17.7134, 178.0650},
+		"store:samoa":   {-13.7590, -172.1046},
+	}
+	for k, p := range stores {
+		db.PutDoc(k, map[string]interface{}{
+			"location": map[string]interface{}{"lat": p[0], "lon": p[1]},
+		})
+	}
+
+	idx := newGeoIndex("stores", "store:", "location.lat", "location.lon")
+	if err := indexes.create(db, idx); err != nil {
+		t.Fatal(err)
+	}
+
+	res := idx.Radius(52.5200, 13.4050, 50000)
+	if len(res) != 2 || res[0].key != "store:berlin" || res[1].key != "store:potsdam" {
+		t.Error("radius", res)
+	}
+
+	// across the antimeridian
+	res = idx.Radius(-15, 179.9, 1200000)
+	if len(res) != 2 || res[0].key != "store:fiji" {
+		t.Error("radius", res)
+	}
+
+	res = idx.Box(53.5, 11, 400000, 100000)
+	if len(res) != 1 || res[0].key != "store:hamburg" {
+		t.Error("box", res)
+	}
+
+	db.PutPath("store:potsdam", "location.lat", float64(48.1351))
+	res = idx.Radius(52.5200, 13.4050, 50000)
+	if len(res) != 1 {
+		t.Error("radius after move", res)
+	}
+}
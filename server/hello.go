@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const serverVersion = "1.0.0"
+
+var (
+	ErrNoProto   = errors.New("NOPROTO unsupported protocol version")
+	ErrNeedResp3 = errors.New("native json replies need RESP3, send HELLO 3 first")
+)
+
+// hello [protover [AUTH username password] [SETNAME clientname]]
+func cmdHello(r *resp.Resp, client *session) *resp.Resp {
+	proto := client.protocol()
+	if len(r.Multi) > 1 {
+		v, err := strconv.Atoi(string(r.Multi[1].Bulk))
+		if err != nil {
+			return RespInvalidParam
+		}
+		if v != 2 && v != 3 {
+			return RespErr(ErrNoProto)
+		}
+		proto = v
+	}
+	name, setName := "", false
+	user := client.user
+	for i := 2; i < len(r.Multi); i++ {
+		switch strings.ToLower(string(r.Multi[i].Bulk)) {
+		case "auth":
+			if i+2 >= len(r.Multi) {
+				return RespInvalidParam
+			}
+			u, err := client.srv.acl.authenticate(string(r.Multi[i+1].Bulk), string(r.Multi[i+2].Bulk))
+			if err != nil {
+				log.Warningf("failed authentication of %s from %v", r.Multi[i+1].Bulk, client.RemoteAddr())
+				return RespErr(err)
+			}
+			user = u
+			i += 2
+		case "setname":
+			if i+1 >= len(r.Multi) {
+				return RespInvalidParam
+			}
+			name, setName = string(r.Multi[i+1].Bulk), true
+			i++
+		default:
+			return RespInvalidParam
+		}
+	}
+
+	if !client.srv.acl.authenticated(user) {
+		return RespErr(ErrHelloNoAuth)
+	}
+	client.user = user
+
+	if setName {
+		if strings.ContainsAny(name, " \n") {
+			return RespErr(ErrInvalidParam)
+		}
+		client.name = name
+	}
+	atomic.StoreInt32(&client.proto, int32(proto))
+	if proto == 2 {
+		client.nativeJSON = false
+	}
+
+	mode, role := "standalone", "master"
+	srv := client.srv
+	srv.cluster.lock.RLock()
+	if srv.cluster.enabled {
+		mode = "cluster"
+	}
+	srv.cluster.lock.RUnlock()
+	srv.repl.lock.Lock()
+	if srv.repl.master != nil {
+		role = "replica"
+	}
+	srv.repl.lock.Unlock()
+
+	return &resp.Resp{
+		Type: resp.MapResp,
+		Multi: []*resp.Resp{
+			bulk("server"), bulk("jj"),
+			bulk("version"), bulk(serverVersion),
+			bulk("proto"), {Type: resp.IntegerResp, Integer: int64(proto)},
+			bulk("id"), {Type: resp.IntegerResp, Integer: client.id},
+			bulk("mode"), bulk(mode),
+			bulk("role"), bulk(role),
+			bulk("modules"), {Type: resp.MultiResp, Multi: []*resp.Resp{}},
+		},
+	}
+}
+
+// client id
+// client setname [name]
+// client getname
+// client json [native|string]
+func cmdClient(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+	sub := strings.ToLower(string(r.Multi[1].Bulk))
+	switch {
+	case sub == "id" && len(r.Multi) == 2:
+		return &resp.Resp{Type: resp.IntegerResp, Integer: client.id}
+	case sub == "getname" && len(r.Multi) == 2:
+		if client.name == "" {
+			return RespNil
+		}
+		return bulk(client.name)
+	case sub == "setname" && len(r.Multi) == 3:
+		name := string(r.Multi[2].Bulk)
+		if strings.ContainsAny(name, " \n") {
+			return RespErr(ErrInvalidParam)
+		}
+		client.name = name
+		return RespOk
+	case sub == "json" && len(r.Multi) == 2:
+		if client.nativeJSON {
+			return bulk("native")
+		}
+		return bulk("string")
+	case sub == "json" && len(r.Multi) == 3:
+		switch strings.ToLower(string(r.Multi[2].Bulk)) {
+		case "native":
+			if client.protocol() != 3 {
+				return RespErr(ErrNeedResp3)
+			}
+			client.nativeJSON = true
+		case "string":
+			client.nativeJSON = false
+		default:
+			return RespInvalidParam
+		}
+		return RespOk
+	}
+	return RespInvalidParam
+}
+
+// jsonReply is the reply for a JSON value: its serialized text, or RESP3
+// values if the session asked for native JSON
+func (s *session) jsonReply(v interface{}) *resp.Resp {
+	if s.nativeJSON {
+		return jsonResp(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Warning(err)
+		return RespErr(err)
+	}
+	return &resp.Resp{Type: resp.BulkResp, Bulk: b}
+}
+
+// jsonResp maps a decoded JSON value on RESP3 types: objects are maps with
+// sorted keys, whole numbers integers and strings bulk strings
+func jsonResp(v interface{}) *resp.Resp {
+	switch v := v.(type) {
+	case nil:
+		return &resp.Resp{Type: resp.NullResp}
+	case bool:
+		return &resp.Resp{Type: resp.BooleanResp, Bool: v}
+	case string:
+		return bulk(v)
+	case int:
+		return &resp.Resp{Type: resp.IntegerResp, Integer: int64(v)}
+	case int64:
+		return &resp.Resp{Type: resp.IntegerResp, Integer: v}
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return &resp.Resp{Type: resp.IntegerResp, Integer: int64(v)}
+		}
+		return &resp.Resp{Type: resp.DoubleResp, Double: v}
+	case []interface{}:
+		ret := &resp.Resp{Type: resp.MultiResp, Multi: make([]*resp.Resp, len(v))}
+		for i, item := range v {
+			ret.Multi[i] = jsonResp(item)
+		}
+		return ret
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		ret := &resp.Resp{Type: resp.MapResp, Multi: make([]*resp.Resp, 0, 2*len(v))}
+		for _, k := range keys {
+			ret.Multi = append(ret.Multi, bulk(k), jsonResp(v[k]))
+		}
+		return ret
+	}
+	b, _ := json.Marshal(v)
+	return &resp.Resp{Type: resp.BulkResp, Bulk: b}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+
+	"jj/resp"
+)
+
+func TestHello(t *testing.T) {
+	s := NewServer("")
+	c := newTestClient(t, s)
+	defer c.close()
+
+	// RESP2 until HELLO 3
+	if r := c.do("hello"); r.Type != resp.MultiResp || len(r.Multi) != 14 || r.Multi[5].Integer != 2 {
+		t.Fatal("hello", r)
+	}
+	if r := c.do("jget", "missing", "a"); r.Type != resp.BulkResp || r.Bulk != nil {
+		t.Error("resp2 nil", r)
+	}
+	if r := c.do("client", "json", "native"); r.Type != resp.ErrorResp {
+		t.Error("native json on resp2", r)
+	}
+	if r := c.do("hello", "4"); r.Type != resp.ErrorResp || r.Error != ErrNoProto.Error() {
+		t.Error("hello 4", r)
+	}
+
+	r := c.do("hello", "3", "setname", "dash")
+	if r.Type != resp.MapResp || string(r.Multi[4].Bulk) != "proto" || r.Multi[5].Integer != 3 {
+		t.Fatal("hello 3", r)
+	}
+	if r := c.do("client", "getname"); string(r.Bulk) != "dash" {
+		t.Error("name", r)
+	}
+	if r := c.do("jget", "missing", "a"); r.Type != resp.NullResp {
+		t.Error("resp3 nil", r)
+	}
+
+	c.do("jdocset", "d", `{"s": "x", "n": 2, "f": 1.5, "b": true, "z": null, "l": [1, {"k": "v"}]}`)
+	if r := c.do("jget", "d", "s"); string(r.Bulk) != `"x"` {
+		t.Error("string json", r)
+	}
+	if r := c.do("client", "json", "native"); r.Type != resp.SimpleString {
+		t.Fatal(r)
+	}
+	r = c.do("jdocget", "d")
+	b, _ := r.Bytes()
+	want := "%6\r\n$1\r\nb\r\n#t\r\n$1\r\nf\r\n,1.5\r\n$1\r\nl\r\n*2\r\n:1\r\n%1\r\n$1\r\nk\r\n$1\r\nv\r\n" +
+		"$1\r\nn\r\n:2\r\n$1\r\ns\r\n$1\r\nx\r\n$1\r\nz\r\n_\r\n"
+	if string(b) != want {
+		t.Errorf("native doc %q", b)
+	}
+	if r := c.do("jmget", "s", "d", "missing"); len(r.Multi) != 2 || string(r.Multi[0].Bulk) != "x" || r.Multi[1].Type != resp.NullResp {
+		t.Error("jmget", r)
+	}
+
+	// pushed messages use the push type
+	sub := newTestClient(t, s)
+	defer sub.close()
+	sub.do("hello", "3")
+	sub.send("subscribe", "news")
+	if r := sub.read(); r.Type != resp.PushResp || string(r.Multi[0].Bulk) != "subscribe" {
+		t.Error("subscribe", r)
+	}
+	c.do("publish", "news", "hi")
+	if r := sub.read(); r.Type != resp.PushResp || string(r.Multi[2].Bulk) != "hi" {
+		t.Error("message", r)
+	}
+
+	// back to RESP2 drops native json
+	c.do("hello", "2")
+	if r := c.do("jget", "d", "n"); r.Type != resp.BulkResp || string(r.Bulk) != "2" {
+		t.Error("resp2 again", r)
+	}
+}
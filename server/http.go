@@ -0,0 +1,377 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const maxHTTPBody = 64 << 20
+
+var (
+	ErrNullDoc          = errors.New("a document can't be null")
+	ErrBodyTooLarge     = errors.New("request body too large")
+	ErrUnsupportedPatch = errors.New("unsupported patch type, use application/json-patch+json or application/merge-patch+json")
+)
+
+// HTTPHandler serves the documents over HTTP:
+//
+//	GET|PUT|PATCH|DELETE /docs/{key}
+//	GET|PUT|PATCH|DELETE /docs/{key}/{json pointer}
+//
+// Every response carries the version of the document as ETag, and writes
+// honor If-Match and If-None-Match. /ws streams document changes over a
+// WebSocket. Requests are authenticated with Basic auth against the ACL
+// users, reads needing the rights of jdocget and writes those of jdocset.
+func (s *Server) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docs/", s.serveDoc)
+	mux.HandleFunc("/ws", s.serveWS)
+	return mux
+}
+
+// RunHTTP serves the HTTP API until Shutdown
+func (s *Server) RunHTTP(addr string) {
+	srv := &http.Server{Addr: addr, Handler: s.HTTPHandler()}
+	if !s.addHTTPServer(srv) {
+		return
+	}
+	log.Info("http listening on", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// httpStatus maps the errors of the data operations to status codes
+func httpStatus(err error) int {
+	var schemaErr *SchemaError
+	switch {
+	case err == ErrNoSuchKey || err == ErrPathNotFound:
+		return http.StatusNotFound
+	case err == ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case err == ErrTestFailed:
+		return http.StatusConflict
+	case err == ErrUnsupportedPatch:
+		return http.StatusUnsupportedMediaType
+	case err == ErrNoAuth || err == ErrWrongPass:
+		return http.StatusUnauthorized
+	case err == ErrReadOnly || strings.HasPrefix(err.Error(), "NOPERM"):
+		return http.StatusForbidden
+	case errors.As(err, &schemaErr) || err == ErrNullDoc:
+		return http.StatusUnprocessableEntity
+	case err == ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == ErrOOM:
+		return http.StatusInsufficientStorage
+	case strings.HasPrefix(err.Error(), "MOVED ") || strings.HasPrefix(err.Error(), "ASK "):
+		return http.StatusMisdirectedRequest
+	case err == ErrClusterDown || err == ErrTryAgain ||
+		strings.HasPrefix(err.Error(), "CLUSTERDOWN") || strings.HasPrefix(err.Error(), "TRYAGAIN"):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	if httpStatus(err) == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jj"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(err))
+	w.Write(b)
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// etagMatch tells if an If-Match or If-None-Match list names version
+func etagMatch(header string, version uint64) bool {
+	if strings.TrimSpace(header) == "*" {
+		return version != 0
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if version != 0 && t == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions refuses a write if the document is not at the version
+// the request expects
+func checkPreconditions(r *http.Request, version uint64) error {
+	if h := r.Header.Get("If-Match"); h != "" && !etagMatch(h, version) {
+		return ErrVersionMismatch
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatch(h, version) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// splitDocPath splits /docs/{key}/{pointer}, the key being escaped if it
+// holds a /
+func splitDocPath(u *url.URL) (string, string, error) {
+	p := strings.TrimPrefix(u.EscapedPath(), "/docs/")
+	rawKey, rawPtr := p, ""
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		rawKey, rawPtr = p[:i], p[i:]
+	}
+	key, err := url.PathUnescape(rawKey)
+	if err != nil || key == "" {
+		return "", "", ErrInvalidParam
+	}
+	ptr, err := url.PathUnescape(rawPtr)
+	if err != nil {
+		return "", "", ErrInvalidPointer
+	}
+	return key, ptr, nil
+}
+
+// httpUser authenticates a request with Basic auth or its client
+// certificate, a request without credentials is the default user's
+func (s *Server) httpUser(r *http.Request) (*aclUser, error) {
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		if r.TLS != nil {
+			if u := s.tlsUser(*r.TLS); u != nil {
+				return u, nil
+			}
+		}
+		if u := s.acl.sessionUser(); u != nil {
+			return u, nil
+		}
+		return nil, ErrNoAuth
+	}
+	if name == "" {
+		name = defaultUser
+	}
+	return s.acl.authenticate(name, pass)
+}
+
+// checkKey applies the ACL, cluster, replica and maxmemory rules of the RESP
+// commands
+func (s *Server) checkKey(user *aclUser, key string, write bool) error {
+	op := "jdocget"
+	if write {
+		op = "jdocset"
+	}
+	if err := s.acl.checkKey(user, op, &key); err != nil {
+		return err
+	}
+	r := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{bulk(op), bulk(key)}}
+	if ret := s.cluster.redirect(r, commands[op], &session{srv: s}); ret != nil {
+		return errors.New(ret.Error)
+	}
+	if write && s.repl.readOnly() {
+		return ErrReadOnly
+	}
+	if write && s.overMaxMemory() {
+		return ErrOOM
+	}
+	return nil
+}
+
+func readJSONBody(w http.ResponseWriter, r *http.Request) (interface{}, []byte, error) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, nil, err
+	}
+	return v, b, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, version uint64, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (s *Server) serveDoc(w http.ResponseWriter, r *http.Request) {
+	key, ptr, err := splitDocPath(r.URL)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	toks, err := parsePointer(ptr)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	user, err := s.httpUser(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	write := r.Method != http.MethodGet && r.Method != http.MethodHead
+	if err := s.checkKey(user, key, write); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	db := s.userDb(user)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		httpGet(w, r, db, key, toks)
+	case http.MethodPut:
+		httpPut(w, r, db, key, toks)
+	case http.MethodPatch:
+		httpPatch(w, r, db, key, toks)
+	case http.MethodDelete:
+		httpDelete(w, r, db, key, toks)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func httpGet(w http.ResponseWriter, r *http.Request, db Db, key string, toks []string) {
+	doc, version := db.GetDocVersion(key)
+	if version == 0 {
+		httpError(w, ErrNoSuchKey)
+		return
+	}
+	val, err := pointerGet(doc, toks)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatch(h, version) {
+		w.Header().Set("ETag", etag(version))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, version, val)
+}
+
+// httpPut stores the document, or the value at the pointer, replacing it
+// or adding it to its parent; "-" appends to an array
+func httpPut(w http.ResponseWriter, r *http.Request, db Db, key string, toks []string) {
+	val, _, err := readJSONBody(w, r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	created := false
+	version, err := db.Update(key, func(doc interface{}, version uint64) (interface{}, error) {
+		if err := checkPreconditions(r, version); err != nil {
+			return nil, err
+		}
+		if len(toks) == 0 {
+			if val == nil {
+				return nil, ErrNullDoc
+			}
+			created = version == 0
+			return val, nil
+		}
+		if version == 0 {
+			return nil, ErrNoSuchKey
+		}
+		newDoc, err := pointerReplace(doc, toks, val)
+		if err == ErrPathNotFound {
+			newDoc, err = pointerAdd(doc, toks, val)
+		}
+		return newDoc, err
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// httpPatch applies a JSON Patch or a JSON Merge Patch to the document, or
+// to the value at the pointer, and returns the patched value. A patch
+// leaving no document is refused, DELETE removes one.
+func httpPatch(w http.ResponseWriter, r *http.Request, db Db, key string, toks []string) {
+	ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if ct != "application/json-patch+json" && ct != "application/merge-patch+json" {
+		httpError(w, ErrUnsupportedPatch)
+		return
+	}
+	patch, raw, err := readJSONBody(w, r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	var patched interface{}
+	version, err := db.Update(key, func(doc interface{}, version uint64) (interface{}, error) {
+		if err := checkPreconditions(r, version); err != nil {
+			return nil, err
+		}
+		// a merge patch may create the document
+		if version == 0 && (len(toks) > 0 || ct != "application/merge-patch+json") {
+			return nil, ErrNoSuchKey
+		}
+		target, err := pointerGet(doc, toks)
+		if err != nil {
+			return nil, err
+		}
+		if ct == "application/merge-patch+json" {
+			patched = mergePatch(target, patch)
+		} else if patched, err = applyJSONPatch(target, raw); err != nil {
+			return nil, err
+		}
+		newDoc, err := pointerReplace(doc, toks, patched)
+		if err == nil && newDoc == nil {
+			return nil, ErrNullDoc
+		}
+		return newDoc, err
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, version, patched)
+}
+
+func httpDelete(w http.ResponseWriter, r *http.Request, db Db, key string, toks []string) {
+	version, err := db.Update(key, func(doc interface{}, version uint64) (interface{}, error) {
+		if err := checkPreconditions(r, version); err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			return nil, ErrNoSuchKey
+		}
+		return pointerRemove(doc, toks)
+	})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if version != 0 {
+		w.Header().Set("ETag", etag(version))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
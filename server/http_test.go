@@ -0,0 +1,144 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type httpClient struct {
+	t   *testing.T
+	url string
+}
+
+func (c *httpClient) do(method string, path string, body string, headers ...string) (*http.Response, string) {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.url+path, r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func TestHTTPDocs(t *testing.T) {
+	s := NewServer("")
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	c := &httpClient{t: t, url: ts.URL}
+
+	res, _ := c.do("PUT", "/docs/user:1", `{"name": "ann", "tags": ["a"]}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatal("create", res.Status)
+	}
+	v1 := res.Header.Get("ETag")
+
+	res, body := c.do("GET", "/docs/user:1/tags/0", "")
+	if res.StatusCode != http.StatusOK || body != `"a"` || res.Header.Get("ETag") != v1 {
+		t.Error("get pointer", res.Status, body)
+	}
+	if res, _ := c.do("GET", "/docs/user:1", "", "If-None-Match", v1); res.StatusCode != http.StatusNotModified {
+		t.Error("not modified", res.Status)
+	}
+	if res, _ := c.do("GET", "/docs/user:1/nope", ""); res.StatusCode != http.StatusNotFound {
+		t.Error("missing path", res.Status)
+	}
+	if res, _ := c.do("GET", "/docs/user:2", ""); res.StatusCode != http.StatusNotFound {
+		t.Error("missing doc", res.Status)
+	}
+
+	// the RESP commands see the same documents
+	tc := newTestClient(t, s)
+	defer tc.close()
+	if r := tc.do("jget", "user:1", "name"); string(r.Bulk) != `"ann"` {
+		t.Error("jget", r)
+	}
+
+	res, _ = c.do("PUT", "/docs/user:1/tags/-", `"b"`, "If-Match", v1)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatal("append", res.Status)
+	}
+	v2 := res.Header.Get("ETag")
+	if res, body := c.do("PUT", "/docs/user:1/name", `"bob"`, "If-Match", v1); res.StatusCode != http.StatusPreconditionFailed {
+		t.Error("stale etag", res.Status, body)
+	}
+	if res, _ := c.do("PUT", "/docs/user:1", `{}`, "If-None-Match", "*"); res.StatusCode != http.StatusPreconditionFailed {
+		t.Error("create only", res.Status)
+	}
+
+	res, body = c.do("PATCH", "/docs/user:1", `[{"op": "replace", "path": "/name", "value": "bob"}, {"op": "remove", "path": "/tags/0"}]`,
+		"Content-Type", "application/json-patch+json", "If-Match", v2)
+	if res.StatusCode != http.StatusOK || body != `{"name":"bob","tags":["b"]}` {
+		t.Error("json patch", res.Status, body)
+	}
+	res, body = c.do("PATCH", "/docs/user:1", `{"age": 30, "tags": null}`, "Content-Type", "application/merge-patch+json")
+	if res.StatusCode != http.StatusOK || body != `{"age":30,"name":"bob"}` {
+		t.Error("merge patch", res.Status, body)
+	}
+	if res, _ := c.do("PATCH", "/docs/user:1", `[{"op": "test", "path": "/age", "value": 1}]`,
+		"Content-Type", "application/json-patch+json"); res.StatusCode != http.StatusConflict {
+		t.Error("test op", res.Status)
+	}
+	if res, _ := c.do("PATCH", "/docs/user:1", `{}`, "Content-Type", "application/json"); res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("patch type", res.Status)
+	}
+	if res, _ := c.do("PUT", "/docs/user:1", `{bad`); res.StatusCode != http.StatusBadRequest {
+		t.Error("bad body", res.Status)
+	}
+	big := `"` + strings.Repeat("x", maxHTTPBody) + `"`
+	if res, _ := c.do("PUT", "/docs/user:1", big); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("large body", res.Status)
+	}
+
+	// a patch can't leave the document null, DELETE removes it
+	for _, patch := range [][]string{
+		{`null`, "application/merge-patch+json"},
+		{`[{"op": "remove", "path": ""}]`, "application/json-patch+json"},
+	} {
+		if res, _ := c.do("PATCH", "/docs/user:1", patch[0], "Content-Type", patch[1]); res.StatusCode != http.StatusUnprocessableEntity {
+			t.Error("null patch", patch[0], res.Status)
+		}
+	}
+	if r := tc.do("jdocget", "user:1"); r.Bulk == nil {
+		t.Error("removed by a patch")
+	}
+
+	tc.do("jschema", "set", "strict:", `{"type": "object", "required": ["id"]}`)
+	if res, _ := c.do("PUT", "/docs/strict:1", `{}`); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Error("schema", res.Status)
+	}
+
+	if res, _ := c.do("DELETE", "/docs/user:1/age", ""); res.StatusCode != http.StatusNoContent {
+		t.Error("delete path", res.Status)
+	}
+	if res, _ := c.do("DELETE", "/docs/user:1", ""); res.StatusCode != http.StatusNoContent {
+		t.Error("delete", res.Status)
+	}
+	if r := tc.do("jdocget", "user:1"); r.Bulk != nil {
+		t.Error("deleted", r)
+	}
+
+	// a key holding a slash is escaped
+	c.do("PUT", "/docs/a%2Fb", `{"x": 1}`)
+	if res, body := c.do("GET", "/docs/a%2Fb/x", ""); res.StatusCode != http.StatusOK || body != "1" {
+		t.Error("escaped key", res.Status, body)
+	}
+
+	tc.do("config", "set", "cluster-enabled", "yes")
+	if res, _ := c.do("GET", "/docs/a%2Fb", ""); res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("cluster down", res.Status)
+	}
+}
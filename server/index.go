@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var (
+	ErrNoSuchIndex    = errors.New("no such index")
+	ErrIndexExists    = errors.New("index already exists")
+	ErrWrongIndexType = errors.New("wrong index type")
+)
+
+// index is a secondary structure over the documents whose keys start with
+// prefix. update is called on every change of such a document, doc is nil
+// when the document was removed.
+type index interface {
+	Name() string
+	Prefix() string
+	Info() []string
+	update(key string, doc interface{})
+}
+
+type indexBuilder func(name string, prefix string, args [][]byte) (index, error)
+
+var indexBuilders = map[string]indexBuilder{
+	"sorted": newSortedIndexFromArgs,
+	"geo":    newGeoIndexFromArgs,
+	"vector": newVectorIndexFromArgs,
+}
+
+type indexManager struct {
+	lock    sync.RWMutex
+	indexes map[string]index
+}
+
+func newIndexManager() *indexManager {
+	return &indexManager{
+		indexes: make(map[string]index),
+	}
+}
+
+func (m *indexManager) onMutation(key string, path string, op string, doc interface{}) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, idx := range m.indexes {
+		if strings.HasPrefix(key, idx.Prefix()) {
+			idx.update(key, doc)
+		}
+	}
+}
+
+// create registers idx and fills it with the documents already in db. The
+// index is registered first so no concurrent mutation is missed.
+func (m *indexManager) create(db Db, idx index) error {
+	m.lock.Lock()
+	if _, ok := m.indexes[idx.Name()]; ok {
+		m.lock.Unlock()
+		return ErrIndexExists
+	}
+	m.indexes[idx.Name()] = idx
+	m.lock.Unlock()
+
+	db.Walk(idx.Prefix(), idx.update)
+	return nil
+}
+
+func (m *indexManager) drop(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.indexes[name]; !ok {
+		return ErrNoSuchIndex
+	}
+	delete(m.indexes, name)
+	return nil
+}
+
+func (m *indexManager) get(name string) (index, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	idx, ok := m.indexes[name]
+	if !ok {
+		return nil, ErrNoSuchIndex
+	}
+	return idx, nil
+}
+
+func (m *indexManager) list() []index {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var ret []index
+	for _, idx := range m.indexes {
+		ret = append(ret, idx)
+	}
+	sort.Sort(indexByName(ret))
+	return ret
+}
+
+type indexByName []index
+
+func (s indexByName) Len() int           { return len(s) }
+func (s indexByName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s indexByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// parseKeyPrefix accepts both "user:" and "user:*", and "*" for all keys
+func parseKeyPrefix(b []byte) string {
+	return strings.TrimSuffix(string(b), "*")
+}
+
+// pathNumber returns the number found at path in doc
+func pathNumber(doc interface{}, path string) (float64, bool) {
+	if doc == nil {
+		return 0, false
+	}
+	var v interface{}
+	if err := jsonPathQuery(doc, path, &v); err != nil {
+		return 0, false
+	}
+	return toFloat(v)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func bulkStrings(ss []string) *resp.Resp {
+	ret := &resp.Resp{
+		Type:  resp.MultiResp,
+		Multi: []*resp.Resp{},
+	}
+	for _, s := range ss {
+		ret.Multi = append(ret.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(s)})
+	}
+	return ret
+}
+
+// jindex create <name> <type> <prefix> [args...]
+// jindex drop <name>
+// jindex list
+func cmdJIndex(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+
+	indexes := client.srv.indexes
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "create":
+		if len(r.Multi) < 5 {
+			return RespInvalidParam
+		}
+		name := string(r.Multi[2].Bulk)
+		typ := strings.ToLower(string(r.Multi[3].Bulk))
+		builder, ok := indexBuilders[typ]
+		if !ok {
+			return RespErr(fmt.Errorf("unknown index type %s", typ))
+		}
+		var args [][]byte
+		for _, v := range r.Multi[5:] {
+			args = append(args, v.Bulk)
+		}
+		idx, err := builder(name, parseKeyPrefix(r.Multi[4].Bulk), args)
+		if err != nil {
+			return RespErr(err)
+		}
+		if err := indexes.create(client.srv.db, idx); err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		return RespOk
+	case "drop":
+		if len(r.Multi) != 3 {
+			return RespInvalidParam
+		}
+		if err := indexes.drop(string(r.Multi[2].Bulk)); err != nil {
+			return RespErr(err)
+		}
+		return RespOk
+	case "list":
+		ret := &resp.Resp{
+			Type:  resp.MultiResp,
+			Multi: []*resp.Resp{},
+		}
+		for _, idx := range indexes.list() {
+			ret.Multi = append(ret.Multi, bulkStrings(idx.Info()))
+		}
+		return ret
+	}
+	return RespInvalidParam
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPointer = errors.New("invalid json pointer")
+	ErrPathNotFound   = errors.New("path not found")
+	ErrInvalidPatch   = errors.New("invalid json patch")
+	ErrTestFailed     = errors.New("json patch test failed")
+)
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped tokens,
+// "" being the whole document
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, ErrInvalidPointer
+	}
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return toks, nil
+}
+
+// arrayIndex parses an array token, "-" being the element past the end
+func arrayIndex(tok string, n int, insert bool) (int, error) {
+	if tok == "-" {
+		if insert {
+			return n, nil
+		}
+		return 0, ErrPathNotFound
+	}
+	if tok == "" || (len(tok) > 1 && tok[0] == '0') || strings.TrimLeft(tok, "0123456789") != "" {
+		return 0, ErrInvalidPointer
+	}
+	i, err := strconv.Atoi(tok)
+	if err != nil {
+		return 0, ErrInvalidPointer
+	}
+	if i > n || (i == n && !insert) {
+		return 0, ErrPathNotFound
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, toks []string) (interface{}, error) {
+	for _, tok := range toks {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[tok]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// pointerApply runs fn on the parent of the last token and returns the new
+// root, arrays may be reallocated on the way
+func pointerApply(doc interface{}, toks []string, fn func(parent interface{}, tok string) (interface{}, error)) (interface{}, error) {
+	if len(toks) == 1 {
+		return fn(doc, toks[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[toks[0]]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		v, err := pointerApply(child, toks[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[toks[0]] = v
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(toks[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := pointerApply(node[i], toks[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = v
+		return node, nil
+	}
+	return nil, ErrPathNotFound
+}
+
+// pointerAdd sets val at toks, inserting into arrays
+func pointerAdd(doc interface{}, toks []string, val interface{}) (interface{}, error) {
+	if len(toks) == 0 {
+		return val, nil
+	}
+	return pointerApply(doc, toks, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[tok] = val
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = val
+			return node, nil
+		}
+		return nil, ErrPathNotFound
+	})
+}
+
+// pointerReplace sets val at toks, which must exist
+func pointerReplace(doc interface{}, toks []string, val interface{}) (interface{}, error) {
+	if len(toks) == 0 {
+		return val, nil
+	}
+	return pointerApply(doc, toks, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[tok]; !ok {
+				return nil, ErrPathNotFound
+			}
+			node[tok] = val
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = val
+			return node, nil
+		}
+		return nil, ErrPathNotFound
+	})
+}
+
+func pointerRemove(doc interface{}, toks []string) (interface{}, error) {
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	return pointerApply(doc, toks, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[tok]; !ok {
+				return nil, ErrPathNotFound
+			}
+			delete(node, tok)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(tok, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, ErrPathNotFound
+	})
+}
+
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"` // "null" for a null value, empty if missing
+}
+
+// applyJSONPatch applies a JSON Patch (RFC 6902), all operations or none
+// since doc is expected to be a copy
+func applyJSONPatch(doc interface{}, patch []byte) (interface{}, error) {
+	var ops []patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, ErrInvalidPatch
+	}
+	for _, op := range ops {
+		if op.Path == nil {
+			return nil, fmt.Errorf("%v: missing path", ErrInvalidPatch)
+		}
+		path, err := parsePointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var val interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, fmt.Errorf("%v: missing value", ErrInvalidPatch)
+			}
+			if err := json.Unmarshal(op.Value, &val); err != nil {
+				return nil, ErrInvalidPatch
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("%v: missing from", ErrInvalidPatch)
+			}
+			from, err := parsePointer(*op.From)
+			if err != nil {
+				return nil, err
+			}
+			if val, err = pointerGet(doc, from); err != nil {
+				return nil, err
+			}
+			if op.Op == "copy" {
+				val = deepCopy(val)
+			} else {
+				if strings.HasPrefix(*op.Path+"/", *op.From+"/") && *op.Path != *op.From {
+					return nil, fmt.Errorf("%v: can't move into itself", ErrInvalidPatch)
+				}
+				if doc, err = pointerRemove(doc, from); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = pointerAdd(doc, path, val)
+		case "replace":
+			doc, err = pointerReplace(doc, path, val)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "test":
+			var cur interface{}
+			if cur, err = pointerGet(doc, path); err == nil && !jsonEqual(cur, val) {
+				err = ErrTestFailed
+			}
+		default:
+			err = fmt.Errorf("%v: unknown op %q", ErrInvalidPatch, op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7396)
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+func patchOperation(op string, path string, val interface{}) map[string]interface{} {
+	m := map[string]interface{}{"op": op, "path": path}
+	if op != "remove" {
+		m["value"] = val
+	}
+	return m
+}
+
+// jsonDiff returns a JSON Patch turning a into b. Objects and arrays are
+// compared member by member, arrays growing or shrinking at their end.
+func jsonDiff(a interface{}, b interface{}) []map[string]interface{} {
+	return appendDiff(nil, "", a, b)
+}
+
+func appendDiff(ops []map[string]interface{}, ptr string, a interface{}, b interface{}) []map[string]interface{} {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := ptr + "/" + escapePointer(k)
+			va, inA := av[k]
+			vb, inB := bv[k]
+			switch {
+			case !inB:
+				ops = append(ops, patchOperation("remove", p, nil))
+			case !inA:
+				ops = append(ops, patchOperation("add", p, vb))
+			default:
+				ops = appendDiff(ops, p, va, vb)
+			}
+		}
+		return ops
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := len(av)
+		if len(bv) < n {
+			n = len(bv)
+		}
+		for i := 0; i < n; i++ {
+			ops = appendDiff(ops, ptr+"/"+strconv.Itoa(i), av[i], bv[i])
+		}
+		for i := len(av) - 1; i >= len(bv); i-- {
+			ops = append(ops, patchOperation("remove", ptr+"/"+strconv.Itoa(i), nil))
+		}
+		for i := len(av); i < len(bv); i++ {
+			ops = append(ops, patchOperation("add", ptr+"/"+strconv.Itoa(i), bv[i]))
+		}
+		return ops
+	}
+	if !jsonEqual(a, b) {
+		ops = append(ops, patchOperation("replace", ptr, b))
+	}
+	return ops
+}
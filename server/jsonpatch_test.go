@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func mustJSON(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestJSONPointer(t *testing.T) {
+	doc := mustJSON(`{"a/b": {"~c": [1, 2]}, "": 3}`)
+	for ptr, want := range map[string]string{
+		"":            `{"":3,"a/b":{"~c":[1,2]}}`,
+		"/a~1b/~0c/1": `2`,
+		"/":           `3`,
+	} {
+		toks, err := parsePointer(ptr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := pointerGet(doc, toks)
+		if b, _ := json.Marshal(v); err != nil || string(b) != want {
+			t.Error(ptr, string(b), err)
+		}
+	}
+	for ptr, want := range map[string]error{
+		"a":            ErrInvalidPointer,
+		"/a~1b/~0c/01": ErrInvalidPointer,
+		"/a~1b/~0c/2":  ErrPathNotFound,
+		"/x":           ErrPathNotFound,
+	} {
+		toks, err := parsePointer(ptr)
+		if err == nil {
+			_, err = pointerGet(doc, toks)
+		}
+		if err != want {
+			t.Error(ptr, err)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	doc := mustJSON(`{"a": [1, 2], "b": {"c": "x"}}`)
+	patch := `[
+		{"op": "add", "path": "/a/1", "value": 9},
+		{"op": "add", "path": "/a/-", "value": 3},
+		{"op": "remove", "path": "/a/0"},
+		{"op": "replace", "path": "/b/c", "value": "y"},
+		{"op": "copy", "from": "/b", "path": "/d"},
+		{"op": "move", "from": "/b/c", "path": "/e"},
+		{"op": "test", "path": "/a", "value": [9, 2, 3]}
+	]`
+	v, err := applyJSONPatch(doc, []byte(patch))
+	if b, _ := json.Marshal(v); err != nil || string(b) != `{"a":[9,2,3],"b":{},"d":{"c":"y"},"e":"y"}` {
+		t.Error(string(b), err)
+	}
+
+	for patch, want := range map[string]error{
+		`[{"op": "test", "path": "/a", "value": 1}]`:     ErrTestFailed,
+		`[{"op": "replace", "path": "/zz", "value": 1}]`: ErrPathNotFound,
+		`[{"op": "remove", "path": "/a/5"}]`:             ErrPathNotFound,
+		`{"op": "add"}`:                                  ErrInvalidPatch,
+		`[{"op": "add", "path": "/a/x", "value": 1}]`:    ErrInvalidPointer,
+	} {
+		if _, err := applyJSONPatch(mustJSON(`{"a": []}`), []byte(patch)); err != want {
+			t.Error(patch, err)
+		}
+	}
+	if _, err := applyJSONPatch(doc, []byte(`[{"op": "move", "from": "/d", "path": "/d/x"}]`)); err == nil {
+		t.Error("move into itself")
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	v := mergePatch(mustJSON(`{"a": "b", "c": {"d": "e", "f": "g"}}`), mustJSON(`{"a": "z", "c": {"f": null}, "h": [1]}`))
+	if b, _ := json.Marshal(v); string(b) != `{"a":"z","c":{"d":"e"},"h":[1]}` {
+		t.Error(string(b))
+	}
+	if v := mergePatch(mustJSON(`{"a": 1}`), mustJSON(`[1]`)); !jsonEqual(v, mustJSON(`[1]`)) {
+		t.Error(v)
+	}
+}
+
+func TestJSONDiff(t *testing.T) {
+	cases := [][2]string{
+		{`{"a": 1, "b": [1, 2, 3], "c": {"d": "x"}}`, `{"a": 2, "b": [1, 5], "e/f": null}`},
+		{`[1, {"a": 1}]`, `[1, {"a": 1, "~": 2}, 3, 4]`},
+		{`{"a": [1]}`, `{"a": {"0": 1}}`},
+		{`1`, `"x"`},
+		{`{"a": 1.0}`, `{"a": 1}`},
+	}
+	for _, c := range cases {
+		patch := jsonDiff(mustJSON(c[0]), mustJSON(c[1]))
+		b, _ := json.Marshal(patch)
+		v, err := applyJSONPatch(mustJSON(c[0]), b)
+		if err != nil || !jsonEqual(v, mustJSON(c[1])) {
+			t.Error(c[0], c[1], string(b), err)
+		}
+	}
+	if patch := jsonDiff(mustJSON(`{"a": [1, 2]}`), mustJSON(`{"a": [1, 2, 3]}`)); len(patch) != 1 || patch[0]["path"] != "/a/2" {
+		t.Error("append", patch)
+	}
+}
@@ -192,16 +192,35 @@ func jsonPathPush(v interface{}, jp string, val interface{}) error {
 	})
 }
 
+// jsonPathPop returns ErrEmptyArray if there is nothing to pop, including
+// when the path doesn't exist yet
 func jsonPathPop(v interface{}, jp string, t interface{}) error {
-	return jsonPathDo(v, jp, nil, func(v interface{}) interface{} {
-		if vv, ok := v.([]interface{}); ok {
+	var popErr error
+	err := jsonPathDo(v, jp, nil, func(v interface{}) interface{} {
+		vv, ok := v.([]interface{})
+		if !ok {
+			if v == nil {
+				popErr = ErrEmptyArray
+			} else {
+				popErr = errors.New("invalid type, assume array")
+			}
+			return nil
+		}
+		if len(vv) == 0 {
+			popErr = ErrEmptyArray
+			return nil
+		}
+		if vv[0] != nil {
 			rt := reflect.ValueOf(t).Elem()
 			rv := reflect.ValueOf(vv[0])
 			rt.Set(rv)
-			return vv[1:]
 		}
-		return nil
+		return vv[1:]
 	})
+	if err != nil {
+		return err
+	}
+	return popErr
 }
 
 func jsonPathArrayLen(v interface{}, jp string) (int, error) {
@@ -220,3 +239,35 @@ func jsonPathArrayLen(v interface{}, jp string) (int, error) {
 func jsonPathRemove(v interface{}, jp string) error {
 	return nil
 }
+
+// pathStep is a member name or an array index of a json path, negative
+// indexes counting from the end
+type pathStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// parsePath splits a json path as the data commands take it, a.b[0].c,
+// into its steps; empty parts are skipped as jsonPathDo does
+func parsePath(jp string) ([]pathStep, error) {
+	var steps []pathStep
+	for _, part := range strings.Split(jp, ".") {
+		sl := re.FindAllStringSubmatch(part, -1)
+		if len(sl) == 0 {
+			return nil, errors.New("invalid path")
+		}
+		ss := sl[0]
+		if ss[1] != "" {
+			steps = append(steps, pathStep{name: ss[1]})
+		}
+		if ss[2] != "" {
+			i, err := strconv.Atoi(ss[2][1 : len(ss[2])-1])
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, pathStep{index: i, isIndex: true})
+		}
+	}
+	return steps, nil
+}
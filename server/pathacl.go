@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+const redactedValue = "[redacted]"
+
+var (
+	ErrNoPermPath  = errors.New("NOPERM this user has no permissions to change one of the paths of the document")
+	ErrNoPermIndex = errors.New("NOPERM this user has no permissions to read the path of the index")
+)
+
+// pathRule hides a path of every document from a user, or shows its value
+// redacted. Reads leave it out, writes that would reveal or change it are
+// refused.
+type pathRule struct {
+	path   string
+	steps  []pathStep
+	redact bool
+}
+
+func newPathRule(path string, redact bool) (pathRule, error) {
+	steps, err := parsePath(path)
+	if err != nil || len(steps) == 0 {
+		return pathRule{}, fmt.Errorf("%v: invalid path '%s'", ErrInvalidRule, path)
+	}
+	return pathRule{path: path, steps: steps, redact: redact}, nil
+}
+
+func (r pathRule) String() string {
+	if r.redact {
+		return "redactpath:" + r.path
+	}
+	return "denypath:" + r.path
+}
+
+// present tells if doc has a value at the path of the rule
+func (r pathRule) present(doc interface{}) bool {
+	found := false
+	if doc != nil {
+		jsonPathDo(doc, r.path, func(v interface{}) { found = true }, nil)
+	}
+	return found
+}
+
+// stepMatch tells if two steps may name the same value, a negative index
+// matching any other index
+func stepMatch(a pathStep, b pathStep) bool {
+	if a.isIndex != b.isIndex {
+		return false
+	}
+	if !a.isIndex {
+		return a.name == b.name
+	}
+	return a.index == b.index || a.index < 0 || b.index < 0
+}
+
+// prefixOf tells if the path a is b or one of its parents
+func prefixOf(a []pathStep, b []pathStep) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if !stepMatch(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hidePath removes the value at steps from v, or redacts it. A removed
+// array element becomes null so that the indexes of the others hold.
+func hidePath(v interface{}, steps []pathStep, redact bool) {
+	s := steps[0]
+	var hidden interface{}
+	if redact {
+		hidden = redactedValue
+	}
+	switch node := v.(type) {
+	case map[string]interface{}:
+		child, ok := node[s.name]
+		if s.isIndex || !ok {
+			return
+		}
+		if len(steps) > 1 {
+			hidePath(child, steps[1:], redact)
+		} else if redact {
+			node[s.name] = hidden
+		} else {
+			delete(node, s.name)
+		}
+	case []interface{}:
+		i := s.index
+		if i < 0 {
+			i += len(node)
+		}
+		if !s.isIndex || i < 0 || i >= len(node) {
+			return
+		}
+		if len(steps) > 1 {
+			hidePath(node[i], steps[1:], redact)
+		} else {
+			node[i] = hidden
+		}
+	}
+}
+
+// pathFilter applies the path rules of a user, it is the DocFilter of its
+// view of the db
+type pathFilter struct {
+	rules []pathRule
+}
+
+// filterAt returns v, the value at path, as the user may read it. It is a
+// copy if anything was hidden, ok is false if the whole value is denied.
+func (f *pathFilter) filterAt(path []pathStep, v interface{}) (interface{}, bool) {
+	redacted := false
+	for _, r := range f.rules {
+		if prefixOf(r.steps, path) {
+			if !r.redact {
+				return nil, false
+			}
+			redacted = true
+		}
+	}
+	if redacted {
+		return redactedValue, true
+	}
+	copied := false
+	for _, r := range f.rules {
+		if len(r.steps) > len(path) && prefixOf(path, r.steps) {
+			if !copied {
+				v, copied = deepCopy(v), true
+			}
+			hidePath(v, r.steps[len(path):], r.redact)
+		}
+	}
+	return v, true
+}
+
+func (f *pathFilter) Filter(doc interface{}) interface{} {
+	v, _ := f.filterAt(nil, doc)
+	return v
+}
+
+// Check refuses a change at path if a rule path inside it, or above it,
+// is in the document before or after. Comparing the values instead would
+// tell the user whether it guessed a hidden one.
+func (f *pathFilter) Check(path string, old interface{}, doc interface{}) error {
+	steps, err := parsePath(path)
+	if err != nil {
+		// the command fails on it anyway, check it as the whole document
+		steps = nil
+	}
+	for _, r := range f.rules {
+		if !prefixOf(steps, r.steps) && !prefixOf(r.steps, steps) {
+			continue
+		}
+		if r.present(old) || r.present(doc) {
+			return ErrNoPermPath
+		}
+	}
+	return nil
+}
+
+// checkIndex refuses the paths of an index that a rule hides or redacts,
+// in whole or in part: the scores, ranks and distances the index answers
+// with would reveal the values.
+func (f *pathFilter) checkIndex(paths ...string) error {
+	for _, p := range paths {
+		steps, err := parsePath(p)
+		if err != nil {
+			return ErrNoPermIndex
+		}
+		for _, r := range f.rules {
+			if prefixOf(steps, r.steps) || prefixOf(r.steps, steps) {
+				return ErrNoPermIndex
+			}
+		}
+	}
+	return nil
+}
+
+// userDb is the db as the user sees it through its path rules
+func (s *Server) userDb(u *aclUser) Db {
+	if f := s.acl.pathFilter(u); f != nil {
+		return s.db.View(f)
+	}
+	return s.db
+}
+
+// db is the db as the user of the session sees it
+func (s *session) db() Db {
+	return s.srv.userDb(s.user)
+}
+
+// checkIndex refuses the queries on an index built from paths the user of
+// the session may not read
+func (s *session) checkIndex(paths ...string) error {
+	if f := s.srv.acl.pathFilter(s.user); f != nil {
+		return f.checkIndex(paths...)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var ErrSaveInProgress = errors.New("Background save already in progress")
+
+// savePoint saves the documents once seconds passed since the last save
+// and at least changes were made
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+// persistence writes the documents to dir/dbfilename on SAVE, BGSAVE and
+// the save points, and loads them at start. The snapshot is the JSON object
+// replication sends on a full resync.
+type persistence struct {
+	lock       sync.Mutex
+	dir        string
+	dbFilename string
+	savePoints []savePoint
+	lastSave   time.Time
+	lastErr    error
+	saving     bool
+
+	dirty int64 // changes since the last save
+}
+
+func newPersistence() *persistence {
+	return &persistence{dir: ".", dbFilename: "dump.json", lastSave: time.Now()}
+}
+
+func (p *persistence) onMutation(key string, path string, op string, doc interface{}) {
+	atomic.AddInt64(&p.dirty, 1)
+}
+
+func (p *persistence) path() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return filepath.Join(p.dir, p.dbFilename)
+}
+
+// save writes the snapshot unless one is already being written
+func (p *persistence) save(db Db) error {
+	p.lock.Lock()
+	if p.saving {
+		p.lock.Unlock()
+		return ErrSaveInProgress
+	}
+	p.saving = true
+	path := filepath.Join(p.dir, p.dbFilename)
+	p.lock.Unlock()
+
+	dirty := atomic.LoadInt64(&p.dirty)
+	start := time.Now()
+	err := db.Save(path, nil)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.saving, p.lastErr = false, err
+	if err != nil {
+		log.Warningf("saving %s failed, %v", path, err)
+		return err
+	}
+	atomic.AddInt64(&p.dirty, -dirty)
+	p.lastSave = start
+	log.Infof("saved %s in %v", path, time.Since(start))
+	return nil
+}
+
+func (p *persistence) bgSave(db Db) error {
+	p.lock.Lock()
+	saving := p.saving
+	p.lock.Unlock()
+	if saving {
+		return ErrSaveInProgress
+	}
+	go p.save(db)
+	return nil
+}
+
+// check saves in the background if a save point is reached, a failed save
+// is retried no sooner than a minute later
+func (p *persistence) check(db Db) {
+	p.lock.Lock()
+	elapsed := time.Since(p.lastSave)
+	if p.saving || (p.lastErr != nil && elapsed < time.Minute) {
+		p.lock.Unlock()
+		return
+	}
+	due := false
+	dirty := atomic.LoadInt64(&p.dirty)
+	for _, sp := range p.savePoints {
+		if dirty >= sp.changes && elapsed >= time.Duration(sp.seconds)*time.Second {
+			due = true
+		}
+	}
+	p.lock.Unlock()
+	if due {
+		p.bgSave(db)
+	}
+}
+
+// saveOnShutdown tells if save points are set, which is when a shutdown
+// without SAVE or NOSAVE writes a last snapshot
+func (p *persistence) saveOnShutdown() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.savePoints) > 0
+}
+
+// load restores the snapshot, a missing file is an empty dataset
+func (p *persistence) load(db Db) error {
+	path := p.path()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var docs map[string]interface{}
+	if err := json.NewDecoder(f).Decode(&docs); err != nil {
+		return fmt.Errorf("loading %s: %v", path, err)
+	}
+	db.Restore(docs)
+	atomic.StoreInt64(&p.dirty, 0)
+	log.Infof("loaded %d documents from %s", len(docs), path)
+	return nil
+}
+
+func parseSavePoints(val string) ([]savePoint, error) {
+	fields := strings.Fields(val)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("save takes pairs of seconds and changes")
+	}
+	var points []savePoint
+	for i := 0; i < len(fields); i += 2 {
+		secs, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || secs <= 0 || changes < 0 {
+			return nil, errors.New("save takes pairs of seconds and changes")
+		}
+		points = append(points, savePoint{secs, changes})
+	}
+	return points, nil
+}
+
+func formatSavePoints(points []savePoint) string {
+	fields := make([]string, 0, 2*len(points))
+	for _, sp := range points {
+		fields = append(fields, strconv.Itoa(sp.seconds), strconv.FormatInt(sp.changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+func cmdSave(r *resp.Resp, client *session) *resp.Resp {
+	if err := client.srv.persist.save(client.srv.db); err != nil {
+		return RespErr(err)
+	}
+	return RespOk
+}
+
+func cmdBgSave(r *resp.Resp, client *session) *resp.Resp {
+	if err := client.srv.persist.bgSave(client.srv.db); err != nil {
+		return RespErr(err)
+	}
+	return &resp.Resp{Type: resp.SimpleString, Status: "Background saving started"}
+}
+
+// lastsave is the unix time of the last successful save
+func cmdLastSave(r *resp.Resp, client *session) *resp.Resp {
+	p := client.srv.persist
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return &resp.Resp{Type: resp.IntegerResp, Integer: p.lastSave.Unix()}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer("")
+	s.SetConfig("dir", dir)
+	c := newTestClient(t, s)
+	defer c.close()
+	c.do("jdocset", "a", `{"n": [1, 2]}`)
+	c.do("jdocset", "b", `"x"`)
+	before := c.do("lastsave").Integer
+	if r := c.do("save"); r.Type != resp.SimpleString {
+		t.Fatal(r)
+	}
+	if r := c.do("lastsave"); r.Integer < before {
+		t.Error("lastsave", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dump.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := NewServer("")
+	s2.SetConfig("dir", dir)
+	if err := s2.persist.load(s2.db); err != nil {
+		t.Fatal(err)
+	}
+	c2 := newTestClient(t, s2)
+	defer c2.close()
+	if r := c2.do("jget", "a", "n[1]"); string(r.Bulk) != "2" {
+		t.Error("loaded", r)
+	}
+
+	// a save point is reached once both its time and changes are
+	c2.do("config", "set", "dbfilename", "points.json")
+	c2.do("config", "set", "save", "1 2")
+	c2.do("jdocset", "c", "1")
+	s2.persist.check(s2.db)
+	s2.persist.lock.Lock()
+	s2.persist.lastSave = time.Now().Add(-2 * time.Second)
+	s2.persist.lock.Unlock()
+	s2.persist.check(s2.db)
+	if r := c2.do("bgsave"); r.Type != resp.SimpleString && r.Error != ErrSaveInProgress.Error() {
+		t.Error("bgsave", r)
+	}
+	for i := 0; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, "points.json")); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("no background save")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the last save finish before the directory goes
+	for saving := true; saving; time.Sleep(10 * time.Millisecond) {
+		s2.persist.lock.Lock()
+		saving = s2.persist.saving
+		s2.persist.lock.Unlock()
+	}
+	if r := c2.do("config", "set", "dbfilename", "../x.json"); r.Type != resp.ErrorResp {
+		t.Error("dbfilename path", r)
+	}
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"jj/resp"
+	"jj/utils"
+)
+
+var ErrReservedChannel = errors.New("keyspace notification channels are reserved to the server")
+
+const (
+	keyspacePrefix = "__keyspace__:"
+	keyeventPrefix = "__keyevent__:"
+)
+
+// keyspace event classes, set with config set notify-keyspace-events
+const (
+	NotifyKeyspace = 1 << iota // K: publish on __keyspace__:<key>
+	NotifyKeyevent             // E: publish on __keyevent__:<op>
+	NotifyDoc                  // d: jdocset, jdocdel
+	NotifySet                  // s: jset
+	NotifyNumeric              // n: jincr
+	NotifyArray                // a: jpush, jpop
+
+	NotifyAll = NotifyDoc | NotifySet | NotifyNumeric | NotifyArray // A
+)
+
+var opNotifyClass = map[string]int{
+	OpDocSet: NotifyDoc,
+	OpDocDel: NotifyDoc,
+	OpSet:    NotifySet,
+	OpIncr:   NotifyNumeric,
+	OpPush:   NotifyArray,
+	OpPop:    NotifyArray,
+}
+
+var notifyFlagChars = []struct {
+	c    byte
+	flag int
+}{
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+	{'d', NotifyDoc},
+	{'s', NotifySet},
+	{'n', NotifyNumeric},
+	{'a', NotifyArray},
+}
+
+func parseNotifyFlags(s string) (int, bool) {
+	flags := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		found := false
+		for _, fc := range notifyFlagChars {
+			if fc.c == s[i] {
+				flags |= fc.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+func formatNotifyFlags(flags int) string {
+	var b []byte
+	for _, fc := range notifyFlagChars {
+		if flags&fc.flag != 0 {
+			b = append(b, fc.c)
+		}
+	}
+	return string(b)
+}
+
+type pubsub struct {
+	lock     sync.RWMutex
+	channels map[string]map[*session]bool
+	patterns map[string]map[*session]bool
+
+	notifyFlags int32
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*session]bool),
+		patterns: make(map[string]map[*session]bool),
+	}
+}
+
+func bulk(s string) *resp.Resp {
+	return &resp.Resp{Type: resp.BulkResp, Bulk: []byte(s)}
+}
+
+func pushMessage(items ...*resp.Resp) []byte {
+	b, _ := (&resp.Resp{Type: resp.MultiResp, Multi: items}).Bytes()
+	return b
+}
+
+func subscribeReply(kind string, channel *resp.Resp, count int) []byte {
+	return pushMessage(bulk(kind), channel, &resp.Resp{Type: resp.IntegerResp, Integer: int64(count)})
+}
+
+// subscribe queues the confirmation while holding the lock, so it reaches
+// the client before any message of the channel
+func (ps *pubsub) subscribe(client *session, channel string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if client.subs == nil {
+		client.subs = make(map[string]bool)
+	}
+	client.subs[channel] = true
+	if ps.channels[channel] == nil {
+		ps.channels[channel] = make(map[*session]bool)
+	}
+	ps.channels[channel][client] = true
+	client.sendPush(subscribeReply("subscribe", bulk(channel), client.subscribed()))
+}
+
+func (ps *pubsub) psubscribe(client *session, pattern string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if client.psubs == nil {
+		client.psubs = make(map[string]bool)
+	}
+	client.psubs[pattern] = true
+	if ps.patterns[pattern] == nil {
+		ps.patterns[pattern] = make(map[*session]bool)
+	}
+	ps.patterns[pattern][client] = true
+	client.sendPush(subscribeReply("psubscribe", bulk(pattern), client.subscribed()))
+}
+
+func (ps *pubsub) unsubscribe(client *session, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if !client.subs[channel] {
+		return false
+	}
+	delete(client.subs, channel)
+	delete(ps.channels[channel], client)
+	if len(ps.channels[channel]) == 0 {
+		delete(ps.channels, channel)
+	}
+	return true
+}
+
+func (ps *pubsub) punsubscribe(client *session, pattern string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if !client.psubs[pattern] {
+		return false
+	}
+	delete(client.psubs, pattern)
+	delete(ps.patterns[pattern], client)
+	if len(ps.patterns[pattern]) == 0 {
+		delete(ps.patterns, pattern)
+	}
+	return true
+}
+
+func (ps *pubsub) unsubscribeAll(client *session) {
+	for channel := range client.subs {
+		ps.unsubscribe(client, channel)
+	}
+	for pattern := range client.psubs {
+		ps.punsubscribe(client, pattern)
+	}
+}
+
+// Publish sends message to the subscribers of channel and returns how many
+// clients received it
+func (ps *pubsub) Publish(channel string, message []byte) int {
+	return ps.publish(channel, message, nil)
+}
+
+// publish sends message to the subscribers of channel that may access key,
+// all of them if key is nil
+func (ps *pubsub) publish(channel string, message []byte, key *string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	n := 0
+	if subs, ok := ps.channels[channel]; ok {
+		b := pushMessage(bulk("message"), bulk(channel), &resp.Resp{Type: resp.BulkResp, Bulk: message})
+		for client := range subs {
+			if key != nil && !client.srv.acl.canAccess(client.user, *key) {
+				continue
+			}
+			client.sendPush(b)
+			n++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !utils.GlobMatch(pattern, channel) {
+			continue
+		}
+		b := pushMessage(bulk("pmessage"), bulk(pattern), bulk(channel), &resp.Resp{Type: resp.BulkResp, Bulk: message})
+		for client := range subs {
+			if key != nil && !client.srv.acl.canAccess(client.user, *key) {
+				continue
+			}
+			client.sendPush(b)
+			n++
+		}
+	}
+	return n
+}
+
+func (ps *pubsub) NotifyFlags() int {
+	return int(atomic.LoadInt32(&ps.notifyFlags))
+}
+
+func (ps *pubsub) SetNotifyFlags(flags int) {
+	atomic.StoreInt32(&ps.notifyFlags, int32(flags))
+}
+
+type keyspaceEvent struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	Op   string `json:"op"`
+}
+
+// onMutation publishes keyspace events for the classes enabled in
+// notify-keyspace-events
+func (ps *pubsub) onMutation(key string, path string, op string, doc interface{}) {
+	flags := ps.NotifyFlags()
+	if flags&opNotifyClass[op] == 0 || flags&(NotifyKeyspace|NotifyKeyevent) == 0 {
+		return
+	}
+	msg, _ := json.Marshal(&keyspaceEvent{Key: key, Path: path, Op: op})
+	// the events name the key, only the subscribers allowed to it get them
+	if flags&NotifyKeyspace != 0 {
+		ps.publish(keyspacePrefix+key, msg, &key)
+	}
+	if flags&NotifyKeyevent != 0 {
+		ps.publish(keyeventPrefix+op, msg, &key)
+	}
+}
+
+func generalSubscribe(r *resp.Resp, client *session, fn func(*session, string)) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+	for _, v := range r.Multi[1:] {
+		fn(client, string(v.Bulk))
+	}
+	return nil
+}
+
+func generalUnsubscribe(r *resp.Resp, client *session, kind string, all map[string]bool, fn func(*session, string) bool) *resp.Resp {
+	var names []string
+	for _, v := range r.Multi[1:] {
+		names = append(names, string(v.Bulk))
+	}
+	if len(names) == 0 {
+		for name := range all {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		client.sendPush(subscribeReply(kind, RespNil, client.subscribed()))
+		return nil
+	}
+	for _, name := range names {
+		fn(client, name)
+		client.sendPush(subscribeReply(kind, bulk(name), client.subscribed()))
+	}
+	return nil
+}
+
+// subscribe <channel> [channel ...]
+func cmdSubscribe(r *resp.Resp, client *session) *resp.Resp {
+	return generalSubscribe(r, client, client.srv.pubsub.subscribe)
+}
+
+// psubscribe <pattern> [pattern ...]
+func cmdPSubscribe(r *resp.Resp, client *session) *resp.Resp {
+	return generalSubscribe(r, client, client.srv.pubsub.psubscribe)
+}
+
+// unsubscribe [channel ...]
+func cmdUnsubscribe(r *resp.Resp, client *session) *resp.Resp {
+	return generalUnsubscribe(r, client, "unsubscribe", client.subs, client.srv.pubsub.unsubscribe)
+}
+
+// punsubscribe [pattern ...]
+func cmdPUnsubscribe(r *resp.Resp, client *session) *resp.Resp {
+	return generalUnsubscribe(r, client, "punsubscribe", client.psubs, client.srv.pubsub.punsubscribe)
+}
+
+// publish <channel> <message>
+// The keyspace channels are the server's own, so that their messages can
+// be trusted to tell a change.
+func cmdPublish(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 3 {
+		return RespInvalidParam
+	}
+	channel := string(r.Multi[1].Bulk)
+	if strings.HasPrefix(channel, keyspacePrefix) || strings.HasPrefix(channel, keyeventPrefix) {
+		return RespErr(ErrReservedChannel)
+	}
+	n := client.srv.pubsub.Publish(channel, r.Multi[2].Bulk)
+	return &resp.Resp{
+		Type:    resp.IntegerResp,
+		Integer: int64(n),
+	}
+}
+
+// commands a client may send while it has subscriptions
+var subscribeModeCmds = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"jwatchstream": true,
+}
@@ -0,0 +1,601 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var ErrReadOnly = errors.New("READONLY can't write against a read only replica")
+
+const (
+	defaultReplBacklogSize = 1 << 20
+	replPingPeriod         = 10 * time.Second
+	replAckPeriod          = time.Second
+	replTimeout            = 60 * time.Second
+)
+
+// replRetryDelay is how long a follower waits before reconnecting
+var replRetryDelay = time.Second
+
+// replica is a follower connected to this server
+type replica struct {
+	client    *session
+	addr      string
+	ackOffset int64
+	online    bool   // false while the snapshot is being prepared
+	pending   []byte // stream received before the snapshot was queued
+}
+
+// replicaLink is the connection of a follower to its leader
+type replicaLink struct {
+	host  string
+	port  string
+	state string // connect, sync or connected
+	conn  net.Conn
+	stop  chan struct{}
+}
+
+func (link *replicaLink) close() {
+	close(link.stop)
+	if link.conn != nil {
+		link.conn.Close()
+	}
+}
+
+// replication keeps the stream of changes sent to followers. The stream is
+// identified by replid and offset counts its bytes; the last backlogSize
+// bytes are kept so that a follower that reconnects can continue where it
+// stopped. A follower shares the replid and offsets of its leader and keeps
+// the same backlog, so it can take over the other followers once promoted.
+type replication struct {
+	lock sync.Mutex
+
+	replid       string
+	replid2      string // replid before the last promotion
+	offset       int64
+	secondOffset int64 // replid2 is valid up to this offset
+	backlog      []byte
+	backlogSize  int
+	replicas     map[*session]*replica
+
+	master          *replicaLink
+	replicaReadOnly bool
+
+	syncFull    int
+	syncPartial int
+}
+
+func newReplid() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newReplication() *replication {
+	return &replication{
+		replid:          newReplid(),
+		secondOffset:    -1,
+		backlogSize:     defaultReplBacklogSize,
+		replicas:        make(map[*session]*replica),
+		replicaReadOnly: true,
+	}
+}
+
+// replayablePath tells if jsonPathSet reaches the same value as the other
+// path operations, which also accept negative indexes and empty parts
+func replayablePath(path string) bool {
+	for _, part := range strings.Split(path, ".") {
+		if part == "" || strings.Contains(part, "[-") {
+			return false
+		}
+	}
+	return true
+}
+
+func replMessage(key string, path string, op string, doc interface{}) []byte {
+	if doc == nil {
+		return pushMessage(bulk(OpDocDel), bulk(key))
+	}
+	if path != "" && replayablePath(path) {
+		var v interface{}
+		if err := jsonPathQuery(doc, path, &v); err == nil {
+			if b, err := json.Marshal(v); err == nil {
+				return pushMessage(bulk(OpSet), bulk(key), bulk(path), &resp.Resp{Type: resp.BulkResp, Bulk: b})
+			}
+		}
+	}
+	b, _ := json.Marshal(doc)
+	return pushMessage(bulk(OpDocSet), bulk(key), &resp.Resp{Type: resp.BulkResp, Bulk: b})
+}
+
+// onMutation appends the change to the stream. The new value is sent rather
+// than the command, so replaying a change twice, as may happen around a full
+// resync from a follower, does no harm.
+func (rl *replication) onMutation(key string, path string, op string, doc interface{}) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.master != nil || rl.backlog == nil {
+		return
+	}
+	rl.feed(replMessage(key, path, op, doc))
+}
+
+// feed must be called with the lock held
+func (rl *replication) feed(b []byte) {
+	rl.backlog = append(rl.backlog, b...)
+	if len(rl.backlog) > rl.backlogSize {
+		rl.backlog = rl.backlog[len(rl.backlog)-rl.backlogSize:]
+	}
+	rl.offset += int64(len(b))
+	for _, rp := range rl.replicas {
+		if rp.online {
+			rp.client.push(b)
+		} else {
+			rp.pending = append(rp.pending, b...)
+		}
+	}
+}
+
+// cron pings the followers, so that they notice a leader that went away,
+// until quit is closed
+func (rl *replication) cron(quit <-chan struct{}) {
+	ping := pushMessage(bulk("ping"))
+	ticker := time.NewTicker(replPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+		rl.lock.Lock()
+		if rl.master == nil && len(rl.replicas) > 0 {
+			rl.feed(ping)
+		}
+		rl.lock.Unlock()
+	}
+}
+
+// stopLink closes the link to the leader on shutdown
+func (rl *replication) stopLink() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.master != nil {
+		rl.master.close()
+		rl.master = nil
+	}
+}
+
+func (rl *replication) readOnly() bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.master != nil && rl.replicaReadOnly
+}
+
+// shiftReplid must be called with the lock held
+func (rl *replication) shiftReplid(replid string) {
+	rl.replid2 = rl.replid
+	rl.secondOffset = rl.offset
+	rl.replid = replid
+}
+
+// disconnectReplicas must be called with the lock held
+func (rl *replication) disconnectReplicas() {
+	for c := range rl.replicas {
+		c.Conn.Close()
+	}
+}
+
+func (rl *replication) removeReplica(client *session) {
+	rl.lock.Lock()
+	delete(rl.replicas, client)
+	rl.lock.Unlock()
+}
+
+// canContinue must be called with the lock held
+func (rl *replication) canContinue(replid string, offset int64) bool {
+	if rl.backlog == nil || offset < rl.offset-int64(len(rl.backlog)) {
+		return false
+	}
+	return (replid == rl.replid && offset <= rl.offset) ||
+		(replid == rl.replid2 && offset <= rl.secondOffset)
+}
+
+func replicaAddr(client *session) string {
+	host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+	return net.JoinHostPort(host, client.listeningPort)
+}
+
+// sync starts streaming to client from offset if the backlog still has it,
+// and sends a snapshot of db first otherwise
+func (rl *replication) sync(db Db, client *session, replid string, offset int64) {
+	rl.lock.Lock()
+	if rl.canContinue(replid, offset) {
+		b := []byte("+CONTINUE " + rl.replid + "\r\n")
+		b = append(b, rl.backlog[len(rl.backlog)-int(rl.offset-offset):]...)
+		client.push(b)
+		rl.replicas[client] = &replica{client: client, addr: replicaAddr(client), ackOffset: offset, online: true}
+		rl.syncPartial++
+		rl.lock.Unlock()
+		return
+	}
+	rl.lock.Unlock()
+
+	rp := &replica{client: client, addr: replicaAddr(client)}
+	docs := db.Snapshot(func() {
+		rl.lock.Lock()
+		if rl.backlog == nil {
+			rl.backlog = make([]byte, 0, rl.backlogSize)
+		}
+		replid, offset = rl.replid, rl.offset
+		rp.ackOffset = offset
+		rl.replicas[client] = rp
+		rl.syncFull++
+		rl.lock.Unlock()
+	})
+
+	payload, err := json.Marshal(docs)
+	if err != nil {
+		log.Warning(err)
+		client.Conn.Close()
+		return
+	}
+	b, _ := (&resp.Resp{Type: resp.BulkResp, Bulk: payload}).Bytes()
+	client.push(append([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replid, offset)), b...))
+
+	rl.lock.Lock()
+	if len(rp.pending) > 0 {
+		client.push(rp.pending)
+	}
+	rp.pending = nil
+	rp.online = true
+	rl.lock.Unlock()
+}
+
+// follow makes this server a follower of host:port
+func (rl *replication) follow(s *Server, host string, port string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.master != nil {
+		if rl.master.host == host && rl.master.port == port {
+			return
+		}
+		rl.master.close()
+	}
+	link := &replicaLink{
+		host:  host,
+		port:  port,
+		state: "connect",
+		stop:  make(chan struct{}),
+	}
+	rl.master = link
+	go rl.runLink(s, link)
+}
+
+// promote turns a follower into a leader. Its followers are disconnected so
+// that they learn the new replid when they continue.
+func (rl *replication) promote() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.master == nil {
+		return
+	}
+	rl.master.close()
+	rl.master = nil
+	rl.shiftReplid(newReplid())
+	rl.disconnectReplicas()
+}
+
+// setLink records the state of link, it returns false once link was replaced
+func (rl *replication) setLink(link *replicaLink, state string, conn net.Conn) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.master != link {
+		return false
+	}
+	link.state = state
+	if conn != nil {
+		link.conn = conn
+	}
+	return true
+}
+
+func (rl *replication) runLink(s *Server, link *replicaLink) {
+	for {
+		err := rl.syncWithMaster(s, link)
+		select {
+		case <-link.stop:
+			return
+		default:
+		}
+		log.Warningf("replication from %s:%s broken, %v", link.host, link.port, err)
+		rl.setLink(link, "connect", nil)
+
+		select {
+		case <-link.stop:
+			return
+		case <-time.After(replRetryDelay):
+		}
+	}
+}
+
+// replCall sends a command to the leader and reads its reply
+func replCall(conn net.Conn, r *bufio.Reader, args ...string) (*resp.Resp, error) {
+	items := make([]*resp.Resp, len(args))
+	for i, a := range args {
+		items[i] = bulk(a)
+	}
+	if _, err := conn.Write(pushMessage(items...)); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(replTimeout))
+	ret, err := resp.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Type == resp.ErrorResp {
+		return nil, errors.New(ret.Error)
+	}
+	return ret, nil
+}
+
+func (rl *replication) syncWithMaster(s *Server, link *replicaLink) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(link.host, link.port), replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !rl.setLink(link, "sync", conn) {
+		return nil
+	}
+	r := bufio.NewReader(conn)
+
+	if auth := s.acl.nodeAuth(); auth != nil {
+		if _, err := replCall(conn, r, auth...); err != nil {
+			return err
+		}
+	}
+	if _, port, err := net.SplitHostPort(s.addr); err == nil && port != "" {
+		if _, err := replCall(conn, r, "replconf", "listening-port", port); err != nil {
+			return err
+		}
+	}
+
+	rl.lock.Lock()
+	replid, offset := rl.replid, rl.offset
+	rl.lock.Unlock()
+	reply, err := replCall(conn, r, "psync", replid, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(reply.Status)
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		// no deadline, the snapshot may take a while
+		conn.SetReadDeadline(time.Time{})
+		payload, err := resp.Parse(r)
+		if err != nil {
+			return err
+		}
+		var docs map[string]interface{}
+		if err := json.Unmarshal(payload.Bulk, &docs); err != nil {
+			return err
+		}
+		s.db.Restore(docs)
+
+		rl.lock.Lock()
+		rl.replid = fields[1]
+		rl.offset = offset
+		rl.replid2 = ""
+		rl.secondOffset = -1
+		rl.backlog = make([]byte, 0, rl.backlogSize)
+		// our followers have a dataset that is gone now
+		rl.disconnectReplicas()
+		rl.lock.Unlock()
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		rl.lock.Lock()
+		if fields[1] != rl.replid {
+			rl.shiftReplid(fields[1])
+		}
+		rl.lock.Unlock()
+	default:
+		return fmt.Errorf("unexpected psync reply %+v", reply)
+	}
+
+	if !rl.setLink(link, "connected", nil) {
+		return nil
+	}
+	log.Infof("replicating from %s:%s", link.host, link.port)
+
+	done := make(chan struct{})
+	defer close(done)
+	go rl.sendAcks(conn, done)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(replTimeout))
+		cmd, err := resp.Parse(r)
+		if err != nil {
+			return err
+		}
+		if err := replayCommand(s.db, cmd); err != nil {
+			log.Warning(err)
+		}
+		b, _ := cmd.Bytes()
+
+		rl.lock.Lock()
+		if rl.master != link {
+			rl.lock.Unlock()
+			return nil
+		}
+		rl.feed(b)
+		rl.lock.Unlock()
+	}
+}
+
+// sendAcks tells the leader how far this follower got
+func (rl *replication) sendAcks(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rl.lock.Lock()
+			offset := rl.offset
+			rl.lock.Unlock()
+			msg := pushMessage(bulk("replconf"), bulk("ack"), bulk(strconv.FormatInt(offset, 10)))
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func replayCommand(db Db, r *resp.Resp) error {
+	op, err := r.Op()
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(string(op)) {
+	case "ping":
+		return nil
+	case OpDocDel:
+		if len(r.Multi) == 2 {
+			return db.Replay(string(r.Multi[1].Bulk), "", OpDocDel, nil)
+		}
+	case OpDocSet:
+		if len(r.Multi) == 3 {
+			var val interface{}
+			if err := json.Unmarshal(r.Multi[2].Bulk, &val); err != nil {
+				return err
+			}
+			return db.Replay(string(r.Multi[1].Bulk), "", OpDocSet, val)
+		}
+	case OpSet:
+		if len(r.Multi) == 4 {
+			var val interface{}
+			if err := json.Unmarshal(r.Multi[3].Bulk, &val); err != nil {
+				return err
+			}
+			return db.Replay(string(r.Multi[1].Bulk), string(r.Multi[2].Bulk), OpSet, val)
+		}
+	}
+	return fmt.Errorf("unexpected replication command %q", op)
+}
+
+// replicaof <host> <port>
+// replicaof no one
+func cmdReplicaOf(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 3 {
+		return RespInvalidParam
+	}
+	host, port := string(r.Multi[1].Bulk), string(r.Multi[2].Bulk)
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		client.srv.repl.promote()
+		return RespOk
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return RespInvalidParam
+	}
+	client.srv.repl.follow(client.srv, host, port)
+	return RespOk
+}
+
+// psync <replid> <offset>
+func cmdPSync(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 3 {
+		return RespInvalidParam
+	}
+	offset, err := strconv.ParseInt(string(r.Multi[2].Bulk), 10, 64)
+	if err != nil {
+		return RespInvalidParam
+	}
+	client.srv.repl.sync(client.srv.db, client, string(r.Multi[1].Bulk), offset)
+	return nil
+}
+
+// replconf listening-port <port>
+// replconf ack <offset>
+func cmdReplConf(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 3 {
+		return RespInvalidParam
+	}
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "listening-port":
+		client.listeningPort = string(r.Multi[2].Bulk)
+		return RespOk
+	case "ack":
+		offset, err := strconv.ParseInt(string(r.Multi[2].Bulk), 10, 64)
+		if err != nil {
+			return nil
+		}
+		rl := client.srv.repl
+		rl.lock.Lock()
+		if rp, ok := rl.replicas[client]; ok {
+			rp.ackOffset = offset
+		}
+		rl.lock.Unlock()
+		return nil
+	}
+	return RespInvalidParam
+}
+
+// role
+func cmdRole(r *resp.Resp, client *session) *resp.Resp {
+	rl := client.srv.repl
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if link := rl.master; link != nil {
+		return &resp.Resp{
+			Type: resp.MultiResp,
+			Multi: []*resp.Resp{
+				bulk("slave"),
+				bulk(link.host),
+				bulk(link.port),
+				bulk(link.state),
+				{Type: resp.IntegerResp, Integer: rl.offset},
+			},
+		}
+	}
+
+	replicas := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{}}
+	for _, rp := range rl.replicas {
+		host, port, _ := net.SplitHostPort(rp.addr)
+		replicas.Multi = append(replicas.Multi, &resp.Resp{
+			Type: resp.MultiResp,
+			Multi: []*resp.Resp{
+				bulk(host),
+				bulk(port),
+				{Type: resp.IntegerResp, Integer: rp.ackOffset},
+			},
+		})
+	}
+	return &resp.Resp{
+		Type: resp.MultiResp,
+		Multi: []*resp.Resp{
+			bulk("master"),
+			{Type: resp.IntegerResp, Integer: rl.offset},
+			replicas,
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func listen(t *testing.T, s *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = l.Addr().String()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(c)
+		}
+	}()
+	return l
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+func TestReplication(t *testing.T) {
+	replRetryDelay = 10 * time.Millisecond
+
+	leader := NewServer("")
+	defer listen(t, leader).Close()
+	follower := NewServer("")
+	defer listen(t, follower).Close()
+	l := newTestClient(t, leader)
+	defer l.close()
+	f := newTestClient(t, follower)
+	defer f.close()
+
+	l.do("jdocset", "a", `{"n":1,"list":[1,2]}`)
+	f.do("jdocset", "stale", `{}`)
+
+	host, port, _ := net.SplitHostPort(leader.addr)
+	if r := f.do("replicaof", host, port); r.Status != "OK" {
+		t.Fatal("replicaof", r)
+	}
+	waitFor(t, "full sync", func() bool {
+		return string(f.do("jdocget", "a").Bulk) == `{"list":[1,2],"n":1}`
+	})
+	if r := f.do("jdocget", "stale"); r.Bulk != nil {
+		t.Error("full sync keeps old data", r)
+	}
+
+	l.do("jincr", "a", "n", "1")
+	l.do("jpop", "a", "list")
+	l.do("jset", "a", "s", `"x"`)
+	l.do("jdocset", "b", `[1]`)
+	waitFor(t, "stream", func() bool {
+		return string(f.do("jdocget", "b").Bulk) == `[1]`
+	})
+	if r := f.do("jdocget", "a"); string(r.Bulk) != `{"list":[2],"n":2,"s":"x"}` {
+		t.Error("stream", r)
+	}
+	if r := f.do("jset", "a", "s", `"y"`); !strings.HasPrefix(r.Error, "READONLY") {
+		t.Error("followers are read only", r)
+	}
+	if r := f.do("role"); string(r.Multi[0].Bulk) != "slave" || string(r.Multi[3].Bulk) != "connected" {
+		t.Error("role", r)
+	}
+	waitFor(t, "ack", func() bool {
+		r := l.do("role")
+		return len(r.Multi[2].Multi) == 1 && r.Multi[2].Multi[0].Multi[2].Integer == r.Multi[1].Integer
+	})
+
+	// a dropped connection continues from the backlog
+	follower.repl.lock.Lock()
+	follower.repl.master.conn.Close()
+	follower.repl.lock.Unlock()
+	l.do("jdocdel", "b")
+	waitFor(t, "partial resync", func() bool {
+		return f.do("jdocget", "b").Bulk == nil
+	})
+	leader.repl.lock.Lock()
+	full, partial := leader.repl.syncFull, leader.repl.syncPartial
+	leader.repl.lock.Unlock()
+	if full != 1 || partial != 1 {
+		t.Error("syncs", full, partial)
+	}
+
+	if r := f.do("replicaof", "no", "one"); r.Status != "OK" {
+		t.Fatal("replicaof no one", r)
+	}
+	if r := f.do("jset", "a", "s", `"y"`); r.Type == resp.ErrorResp {
+		t.Error("promoted follower is writable", r)
+	}
+}
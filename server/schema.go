@@ -0,0 +1,874 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+var ErrNoSuchSchema = errors.New("no such schema")
+
+// SchemaError reports the first place where a document breaks its schema.
+// Path uses the same syntax as the data commands, "." is the whole document.
+type SchemaError struct {
+	Prefix string
+	Path   string
+	Msg    string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("schema violation at %s (schema %s*): %s", e.Path, e.Prefix, e.Msg)
+}
+
+func childPath(parent string, name string) string {
+	if parent == "." {
+		return name
+	}
+	return parent + "." + name
+}
+
+func indexPath(parent string, i int) string {
+	if parent == "." {
+		return "[" + strconv.Itoa(i) + "]"
+	}
+	return parent + "[" + strconv.Itoa(i) + "]"
+}
+
+// jsonSchema is a compiled JSON Schema (draft 2020-12). Only the core
+// validation keywords are checked; annotations like format are ignored.
+type jsonSchema struct {
+	root *schemaRoot
+
+	boolean *bool
+
+	ref   string
+	types []string
+
+	enum     []interface{}
+	constVal interface{}
+	hasConst bool
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	minLength, maxLength int
+	hasMaxLength         bool
+	pattern              *regexp.Regexp
+
+	items                    *jsonSchema
+	prefixItems              []*jsonSchema
+	contains                 *jsonSchema
+	minContains, maxContains int
+	hasMinContains           bool
+	hasMaxContains           bool
+	minItems, maxItems       int
+	hasMaxItems              bool
+	uniqueItems              bool
+
+	properties           map[string]*jsonSchema
+	patternProperties    []*patternSchema
+	additionalProperties *jsonSchema
+	propertyNames        *jsonSchema
+	required             []string
+	dependentRequired    map[string][]string
+	dependentSchemas     map[string]*jsonSchema
+	minProperties        int
+	maxProperties        int
+	hasMaxProperties     bool
+
+	allOf, anyOf, oneOf []*jsonSchema
+	not                 *jsonSchema
+	ifS, thenS, elseS   *jsonSchema
+}
+
+type patternSchema struct {
+	re     *regexp.Regexp
+	schema *jsonSchema
+}
+
+// schemaRoot holds every subschema by its JSON pointer, to resolve $ref
+type schemaRoot struct {
+	source   []byte
+	pointers map[string]*jsonSchema
+}
+
+func compileSchema(source []byte) (*jsonSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal(source, &v); err != nil {
+		return nil, err
+	}
+	root := &schemaRoot{
+		source:   source,
+		pointers: make(map[string]*jsonSchema),
+	}
+	s, err := root.compile(v, "#")
+	if err != nil {
+		return nil, err
+	}
+	if err := root.checkCycles(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// inPlace returns the subschemas s applies to the value it validates
+// itself, rather than to its items or properties
+func (s *jsonSchema) inPlace() []*jsonSchema {
+	var ret []*jsonSchema
+	if target, ok := s.root.pointers[s.ref]; ok && s.ref != "" {
+		ret = append(ret, target)
+	}
+	ret = append(ret, s.allOf...)
+	ret = append(ret, s.anyOf...)
+	ret = append(ret, s.oneOf...)
+	for _, sub := range []*jsonSchema{s.not, s.ifS, s.thenS, s.elseS} {
+		if sub != nil {
+			ret = append(ret, sub)
+		}
+	}
+	for _, sub := range s.dependentSchemas {
+		ret = append(ret, sub)
+	}
+	return ret
+}
+
+// checkCycles refuses the $ref loops that come back to a schema without
+// going down into the value, validating with them would never end
+func (root *schemaRoot) checkCycles() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[*jsonSchema]int)
+	var visit func(s *jsonSchema) bool
+	visit = func(s *jsonSchema) bool {
+		switch state[s] {
+		case visiting:
+			return false
+		case visited:
+			return true
+		}
+		state[s] = visiting
+		for _, sub := range s.inPlace() {
+			if !visit(sub) {
+				return false
+			}
+		}
+		state[s] = visited
+		return true
+	}
+
+	ptrs := make([]string, 0, len(root.pointers))
+	for ptr := range root.pointers {
+		ptrs = append(ptrs, ptr)
+	}
+	sort.Strings(ptrs)
+	for _, ptr := range ptrs {
+		if !visit(root.pointers[ptr]) {
+			return fmt.Errorf("$ref cycle reached from %s never goes into the value", ptr)
+		}
+	}
+	return nil
+}
+
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+func schemaNumber(v interface{}, kw string) (*float64, error) {
+	f, ok := toFloat(v)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a number", kw)
+	}
+	return &f, nil
+}
+
+func schemaInt(v interface{}, kw string) (int, error) {
+	f, ok := toFloat(v)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", kw)
+	}
+	return int(f), nil
+}
+
+func schemaStrings(v interface{}, kw string) ([]string, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", kw)
+	}
+	var ret []string
+	for _, item := range a {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", kw)
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func (root *schemaRoot) compileList(v interface{}, ptr string, kw string) ([]*jsonSchema, error) {
+	a, ok := v.([]interface{})
+	if !ok || len(a) == 0 {
+		return nil, fmt.Errorf("%s must be a non-empty array", kw)
+	}
+	var ret []*jsonSchema
+	for i, item := range a {
+		s, err := root.compile(item, ptr+"/"+kw+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func (root *schemaRoot) compileMap(v interface{}, ptr string, kw string) (map[string]*jsonSchema, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an object", kw)
+	}
+	ret := make(map[string]*jsonSchema)
+	for k, item := range m {
+		s, err := root.compile(item, ptr+"/"+kw+"/"+escapePointer(k))
+		if err != nil {
+			return nil, err
+		}
+		ret[k] = s
+	}
+	return ret, nil
+}
+
+func (root *schemaRoot) compile(v interface{}, ptr string) (*jsonSchema, error) {
+	s := &jsonSchema{root: root}
+	root.pointers[ptr] = s
+
+	if b, ok := v.(bool); ok {
+		s.boolean = &b
+		return s, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema at %s must be an object or a boolean", ptr)
+	}
+
+	var err error
+	for kw, val := range m {
+		switch kw {
+		case "$ref":
+			ref, ok := val.(string)
+			if !ok || !strings.HasPrefix(ref, "#") {
+				return nil, errors.New("only local $ref like #/$defs/name are supported")
+			}
+			s.ref = ref
+		case "$defs", "definitions":
+			_, err = root.compileMap(val, ptr, kw)
+		case "type":
+			switch t := val.(type) {
+			case string:
+				s.types = []string{t}
+			default:
+				s.types, err = schemaStrings(val, kw)
+			}
+		case "enum":
+			a, ok := val.([]interface{})
+			if !ok {
+				return nil, errors.New("enum must be an array")
+			}
+			s.enum = a
+		case "const":
+			s.constVal, s.hasConst = val, true
+		case "minimum":
+			s.minimum, err = schemaNumber(val, kw)
+		case "maximum":
+			s.maximum, err = schemaNumber(val, kw)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = schemaNumber(val, kw)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = schemaNumber(val, kw)
+		case "multipleOf":
+			s.multipleOf, err = schemaNumber(val, kw)
+			if err == nil && *s.multipleOf <= 0 {
+				err = errors.New("multipleOf must be greater than 0")
+			}
+		case "minLength":
+			s.minLength, err = schemaInt(val, kw)
+		case "maxLength":
+			s.maxLength, err = schemaInt(val, kw)
+			s.hasMaxLength = true
+		case "pattern":
+			p, ok := val.(string)
+			if !ok {
+				return nil, errors.New("pattern must be a string")
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "items":
+			s.items, err = root.compile(val, ptr+"/items")
+		case "prefixItems":
+			s.prefixItems, err = root.compileList(val, ptr, kw)
+		case "contains":
+			s.contains, err = root.compile(val, ptr+"/contains")
+		case "minContains":
+			s.minContains, err = schemaInt(val, kw)
+			s.hasMinContains = true
+		case "maxContains":
+			s.maxContains, err = schemaInt(val, kw)
+			s.hasMaxContains = true
+		case "minItems":
+			s.minItems, err = schemaInt(val, kw)
+		case "maxItems":
+			s.maxItems, err = schemaInt(val, kw)
+			s.hasMaxItems = true
+		case "uniqueItems":
+			s.uniqueItems, _ = val.(bool)
+		case "properties":
+			s.properties, err = root.compileMap(val, ptr, kw)
+		case "patternProperties":
+			var pm map[string]*jsonSchema
+			if pm, err = root.compileMap(val, ptr, kw); err != nil {
+				break
+			}
+			for p, ps := range pm {
+				re, err := regexp.Compile(p)
+				if err != nil {
+					return nil, err
+				}
+				s.patternProperties = append(s.patternProperties, &patternSchema{re, ps})
+			}
+		case "additionalProperties":
+			s.additionalProperties, err = root.compile(val, ptr+"/additionalProperties")
+		case "propertyNames":
+			s.propertyNames, err = root.compile(val, ptr+"/propertyNames")
+		case "required":
+			s.required, err = schemaStrings(val, kw)
+		case "dependentRequired":
+			dm, ok := val.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("dependentRequired must be an object")
+			}
+			s.dependentRequired = make(map[string][]string)
+			for k, item := range dm {
+				if s.dependentRequired[k], err = schemaStrings(item, kw); err != nil {
+					return nil, err
+				}
+			}
+		case "dependentSchemas":
+			s.dependentSchemas, err = root.compileMap(val, ptr, kw)
+		case "minProperties":
+			s.minProperties, err = schemaInt(val, kw)
+		case "maxProperties":
+			s.maxProperties, err = schemaInt(val, kw)
+			s.hasMaxProperties = true
+		case "allOf":
+			s.allOf, err = root.compileList(val, ptr, kw)
+		case "anyOf":
+			s.anyOf, err = root.compileList(val, ptr, kw)
+		case "oneOf":
+			s.oneOf, err = root.compileList(val, ptr, kw)
+		case "not":
+			s.not, err = root.compile(val, ptr+"/not")
+		case "if":
+			s.ifS, err = root.compile(val, ptr+"/if")
+		case "then":
+			s.thenS, err = root.compile(val, ptr+"/then")
+		case "else":
+			s.elseS, err = root.compile(val, ptr+"/else")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func jsonType(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if vv == math.Trunc(vv) && !math.IsInf(vv, 0) {
+			return "integer"
+		}
+		return "number"
+	case int, int64:
+		return "integer"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares decoded json values, treating 1 and 1.0 as equal
+func jsonEqual(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, item := range av {
+			other, ok := bv[k]
+			if !ok || !jsonEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func briefJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 64 {
+		return string(b[:61]) + "..."
+	}
+	return string(b)
+}
+
+func schemaErrorf(path string, format string, args ...interface{}) *SchemaError {
+	return &SchemaError{Path: path, Msg: fmt.Sprintf(format, args...)}
+}
+
+// validate returns the first violation found in v, path is the location
+// of v in the document
+func (s *jsonSchema) validate(v interface{}, path string) *SchemaError {
+	if s.boolean != nil {
+		if !*s.boolean {
+			return schemaErrorf(path, "value is not allowed")
+		}
+		return nil
+	}
+
+	if s.ref != "" {
+		target, ok := s.root.pointers[s.ref]
+		if !ok {
+			return schemaErrorf(path, "unresolved $ref %s", s.ref)
+		}
+		if err := target.validate(v, path); err != nil {
+			return err
+		}
+	}
+
+	typ := jsonType(v)
+	if len(s.types) > 0 {
+		match := false
+		for _, t := range s.types {
+			if t == typ || (t == "number" && typ == "integer") {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return schemaErrorf(path, "expected %s, got %s", strings.Join(s.types, " or "), typ)
+		}
+	}
+	if s.enum != nil {
+		match := false
+		for _, e := range s.enum {
+			if jsonEqual(v, e) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			return schemaErrorf(path, "%s is not one of %s", briefJSON(v), briefJSON(s.enum))
+		}
+	}
+	if s.hasConst && !jsonEqual(v, s.constVal) {
+		return schemaErrorf(path, "%s does not equal %s", briefJSON(v), briefJSON(s.constVal))
+	}
+
+	var err *SchemaError
+	switch vv := v.(type) {
+	case string:
+		err = s.validateString(vv, path)
+	case map[string]interface{}:
+		err = s.validateObject(vv, path)
+	case []interface{}:
+		err = s.validateArray(vv, path)
+	default:
+		if f, ok := toFloat(v); ok {
+			err = s.validateNumber(f, path)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.validateCombinators(v, path)
+}
+
+func (s *jsonSchema) validateNumber(f float64, path string) *SchemaError {
+	if s.minimum != nil && f < *s.minimum {
+		return schemaErrorf(path, "%v is less than minimum %v", f, *s.minimum)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		return schemaErrorf(path, "%v is greater than maximum %v", f, *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+		return schemaErrorf(path, "%v is not greater than %v", f, *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+		return schemaErrorf(path, "%v is not less than %v", f, *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := f / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			return schemaErrorf(path, "%v is not a multiple of %v", f, *s.multipleOf)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateString(str string, path string) *SchemaError {
+	n := utf8.RuneCountInString(str)
+	if n < s.minLength {
+		return schemaErrorf(path, "string is shorter than %d", s.minLength)
+	}
+	if s.hasMaxLength && n > s.maxLength {
+		return schemaErrorf(path, "string is longer than %d", s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return schemaErrorf(path, "string does not match pattern %s", s.pattern)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(a []interface{}, path string) *SchemaError {
+	if len(a) < s.minItems {
+		return schemaErrorf(path, "array has fewer than %d items", s.minItems)
+	}
+	if s.hasMaxItems && len(a) > s.maxItems {
+		return schemaErrorf(path, "array has more than %d items", s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := range a {
+			for j := i + 1; j < len(a); j++ {
+				if jsonEqual(a[i], a[j]) {
+					return schemaErrorf(indexPath(path, j), "duplicate of item %d", i)
+				}
+			}
+		}
+	}
+	for i, item := range a {
+		var sub *jsonSchema
+		if i < len(s.prefixItems) {
+			sub = s.prefixItems[i]
+		} else {
+			sub = s.items
+		}
+		if sub != nil {
+			if err := sub.validate(item, indexPath(path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if s.contains != nil {
+		count := 0
+		for i, item := range a {
+			if s.contains.validate(item, indexPath(path, i)) == nil {
+				count++
+			}
+		}
+		min := 1
+		if s.hasMinContains {
+			min = s.minContains
+		}
+		if count < min {
+			return schemaErrorf(path, "array contains %d matching items, expected at least %d", count, min)
+		}
+		if s.hasMaxContains && count > s.maxContains {
+			return schemaErrorf(path, "array contains %d matching items, expected at most %d", count, s.maxContains)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(m map[string]interface{}, path string) *SchemaError {
+	if len(m) < s.minProperties {
+		return schemaErrorf(path, "object has fewer than %d properties", s.minProperties)
+	}
+	if s.hasMaxProperties && len(m) > s.maxProperties {
+		return schemaErrorf(path, "object has more than %d properties", s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			return schemaErrorf(childPath(path, name), "required property is missing")
+		}
+	}
+	for name, deps := range s.dependentRequired {
+		if _, ok := m[name]; !ok {
+			continue
+		}
+		for _, dep := range deps {
+			if _, ok := m[dep]; !ok {
+				return schemaErrorf(childPath(path, dep), "property is required when %s is present", name)
+			}
+		}
+	}
+	for name, sub := range s.dependentSchemas {
+		if _, ok := m[name]; ok {
+			if err := sub.validate(m, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// visit properties in a stable order so the reported path is too
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		item := m[name]
+		p := childPath(path, name)
+		if s.propertyNames != nil {
+			if err := s.propertyNames.validate(name, p); err != nil {
+				err.Msg = "invalid property name: " + err.Msg
+				return err
+			}
+		}
+		matched := false
+		if sub, ok := s.properties[name]; ok {
+			matched = true
+			if err := sub.validate(item, p); err != nil {
+				return err
+			}
+		}
+		for _, ps := range s.patternProperties {
+			if ps.re.MatchString(name) {
+				matched = true
+				if err := ps.schema.validate(item, p); err != nil {
+					return err
+				}
+			}
+		}
+		if !matched && s.additionalProperties != nil {
+			if err := s.additionalProperties.validate(item, p); err != nil {
+				if s.additionalProperties.boolean != nil {
+					err.Msg = "additional property is not allowed"
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateCombinators(v interface{}, path string) *SchemaError {
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var first *SchemaError
+		for _, sub := range s.anyOf {
+			err := sub.validate(v, path)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return schemaErrorf(path, "value matches none of anyOf (first failure at %s: %s)", first.Path, first.Msg)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		count := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				count++
+			}
+		}
+		if count != 1 {
+			return schemaErrorf(path, "value matches %d schemas of oneOf, expected exactly 1", count)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return schemaErrorf(path, "value must not match the schema in not")
+	}
+	if s.ifS != nil {
+		if s.ifS.validate(v, path) == nil {
+			if s.thenS != nil {
+				return s.thenS.validate(v, path)
+			}
+		} else if s.elseS != nil {
+			return s.elseS.validate(v, path)
+		}
+	}
+	return nil
+}
+
+// schemaRegistry holds the schemas by key prefix. It is the Validator of
+// the Db, a document must satisfy the schema of every prefix matching its
+// key.
+type schemaRegistry struct {
+	lock    sync.RWMutex
+	schemas map[string]*jsonSchema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{
+		schemas: make(map[string]*jsonSchema),
+	}
+}
+
+func (reg *schemaRegistry) Set(prefix string, source []byte) error {
+	s, err := compileSchema(source)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %v", err)
+	}
+	reg.lock.Lock()
+	reg.schemas[prefix] = s
+	reg.lock.Unlock()
+	return nil
+}
+
+func (reg *schemaRegistry) Get(prefix string) ([]byte, bool) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	s, ok := reg.schemas[prefix]
+	if !ok {
+		return nil, false
+	}
+	return s.root.source, true
+}
+
+func (reg *schemaRegistry) Del(prefix string) bool {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	_, ok := reg.schemas[prefix]
+	delete(reg.schemas, prefix)
+	return ok
+}
+
+func (reg *schemaRegistry) Prefixes() []string {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	var ret []string
+	for prefix := range reg.schemas {
+		ret = append(ret, prefix)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (reg *schemaRegistry) Match(key string) bool {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	for prefix := range reg.schemas {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks doc against the schemas of every prefix of key, the
+// longest prefix first, so that the error reported is always the same
+func (reg *schemaRegistry) Validate(key string, doc interface{}) error {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	var prefixes []string
+	for prefix := range reg.schemas {
+		if strings.HasPrefix(key, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, prefix := range prefixes {
+		if err := reg.schemas[prefix].validate(doc, "."); err != nil {
+			err.Prefix = prefix
+			return err
+		}
+	}
+	return nil
+}
+
+// jschema set <prefix> <schema>
+// jschema get <prefix>
+// jschema del <prefix>
+// jschema list
+func cmdJSchema(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 2 {
+		return RespInvalidParam
+	}
+
+	schemas := client.srv.schemas
+	switch strings.ToLower(string(r.Multi[1].Bulk)) {
+	case "set":
+		if len(r.Multi) != 4 {
+			return RespInvalidParam
+		}
+		if err := schemas.Set(parseKeyPrefix(r.Multi[2].Bulk), r.Multi[3].Bulk); err != nil {
+			log.Warning(err)
+			return RespErr(err)
+		}
+		return RespOk
+	case "get":
+		if len(r.Multi) != 3 {
+			return RespInvalidParam
+		}
+		source, ok := schemas.Get(parseKeyPrefix(r.Multi[2].Bulk))
+		if !ok {
+			return RespNil
+		}
+		return &resp.Resp{
+			Type: resp.BulkResp,
+			Bulk: source,
+		}
+	case "del":
+		if len(r.Multi) != 3 {
+			return RespInvalidParam
+		}
+		if !schemas.Del(parseKeyPrefix(r.Multi[2].Bulk)) {
+			return RespErr(ErrNoSuchSchema)
+		}
+		return RespOk
+	case "list":
+		var prefixes []string
+		for _, p := range schemas.Prefixes() {
+			prefixes = append(prefixes, p+"*")
+		}
+		return bulkStrings(prefixes)
+	}
+	return RespInvalidParam
+}
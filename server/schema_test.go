@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 18},
+		"tags": {"type": "array", "items": {"$ref": "#/$defs/tag"}, "uniqueItems": true}
+	},
+	"additionalProperties": false,
+	"$defs": {
+		"tag": {"type": "string", "pattern": "^[a-z]+$"}
+	}
+}`
+
+func TestSchemaValidation(t *testing.T) {
+	db := NewMapDb()
+	schemas := newSchemaRegistry()
+	db.SetValidator(schemas)
+	if err := schemas.Set("user:", []byte(userSchema)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutDoc("user:1", map[string]interface{}{"name": "bob"}); err == nil ||
+		!strings.Contains(err.Error(), "at age") {
+		t.Error("missing age", err)
+	}
+	doc := map[string]interface{}{"name": "bob", "age": float64(20), "tags": []interface{}{"a"}}
+	if err := db.PutDoc("user:1", doc); err != nil {
+		t.Fatal(err)
+	}
+	// other prefixes are not checked
+	if err := db.PutDoc("post:1", map[string]interface{}{}); err != nil {
+		t.Error(err)
+	}
+
+	if err := db.IncrPath("user:1", "age", float64(-5)); err == nil ||
+		!strings.Contains(err.Error(), "at age") {
+		t.Error("age below minimum", err)
+	}
+	if err := db.PushPath("user:1", "tags", "NOPE"); err == nil ||
+		!strings.Contains(err.Error(), "at tags[1]") {
+		t.Error("bad tag", err)
+	}
+	if err := db.PushPath("user:1", "tags", "a"); err == nil {
+		t.Error("duplicate tag")
+	}
+	if err := db.PutPath("user:1", "extra", true); err == nil ||
+		!strings.Contains(err.Error(), "additional property") {
+		t.Error("additional property", err)
+	}
+
+	// rejected changes leave the document untouched
+	v, _ := db.GetDoc("user:1")
+	if !jsonEqual(v, map[string]interface{}{"name": "bob", "age": 20, "tags": []interface{}{"a"}}) {
+		t.Error("document changed", v)
+	}
+
+	if err := db.IncrPath("user:1", "age", float64(1)); err != nil {
+		t.Error(err)
+	}
+	if age, _ := db.GetPath("user:1", "age"); !jsonEqual(age, 21) {
+		t.Error("age", age)
+	}
+
+	// the longest matching prefix reports the error, every time
+	schemas.Set("user:admin:", []byte(`{"required": ["role"]}`))
+	for i := 0; i < 20; i++ {
+		var schemaErr *SchemaError
+		if err := schemas.Validate("user:admin:1", map[string]interface{}{}); !errors.As(err, &schemaErr) || schemaErr.Prefix != "user:admin:" {
+			t.Fatal("prefix order", err)
+		}
+	}
+}
+
+func TestSchemaCombinators(t *testing.T) {
+	s, err := compileSchema([]byte(`{
+		"oneOf": [{"type": "integer"}, {"type": "string"}],
+		"not": {"const": "forbidden"},
+		"if": {"type": "integer"}, "then": {"multipleOf": 5}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{`10`: true, `"ok"`: true, `7`: false, `"forbidden"`: false, `1.5`: false, `null`: false}
+	for doc, valid := range cases {
+		v, _ := decodeJSON(doc)
+		if err := s.validate(v, "."); (err == nil) != valid {
+			t.Error(doc, err)
+		}
+	}
+}
+
+func TestSchemaRefCycles(t *testing.T) {
+	for _, schema := range []string{
+		`{"$ref": "#"}`,
+		`{"$defs": {"a": {"allOf": [{"$ref": "#/$defs/b"}]}, "b": {"not": {"$ref": "#/$defs/a"}}}, "$ref": "#/$defs/a"}`,
+		`{"if": {"$ref": "#"}}`,
+	} {
+		if _, err := compileSchema([]byte(schema)); err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Error(schema, err)
+		}
+	}
+
+	// a reference going into the value is a recursive schema
+	s, err := compileSchema([]byte(`{"type": "object", "properties": {"child": {"$ref": "#"}}, "required": ["n"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := decodeJSON(`{"n": 1, "child": {"n": 2, "child": {}}}`)
+	if err := s.validate(v, "."); err == nil || !strings.Contains(err.Path, "child.child") {
+		t.Error("recursive", err)
+	}
+}
+
+func decodeJSON(doc string) (interface{}, error) {
+	var v interface{}
+	err := json.Unmarshal([]byte(doc), &v)
+	return v, err
+}
@@ -2,8 +2,13 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/http"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"jj/resp"
@@ -16,44 +21,266 @@ import (
 
 type cmdFunc func(r *resp.Resp, client *session) *resp.Resp
 
+// command flags
+const (
+	flagRead = 1 << iota
+	flagWrite
+	flagAdmin
+	flagNoAuth // runs before authentication, without ACL checks
+)
+
+type command struct {
+	fn    cmdFunc
+	flags int
+}
+
 var (
-	cmdFuncs = map[string]cmdFunc{
-		"jdocset": cmdJdocSet,
-		"jdocget": cmdJdocGet,
-		"jget":    cmdJGet,
-		"jset":    cmdJSet,
-		"jpush":   cmdJPush,
-		"jpop":    cmdJPop,
-		"jincr":   cmdJIncr,
-		"save":    cmdSave,
-		"bgsave":  cmdBgSave,
+	commands = map[string]*command{
+		"jdocset":  {cmdJdocSet, flagWrite},
+		"jdocget":  {cmdJdocGet, flagRead},
+		"jdocdel":  {cmdJdocDel, flagWrite},
+		"jget":     {cmdJGet, flagRead},
+		"jmget":    {cmdJMGet, flagRead},
+		"scan":     {cmdScan, flagRead},
+		"jset":     {cmdJSet, flagWrite},
+		"jpush":    {cmdJPush, flagWrite},
+		"jpop":     {cmdJPop, flagWrite},
+		"jincr":    {cmdJIncr, flagWrite},
+		"save":     {cmdSave, flagAdmin},
+		"bgsave":   {cmdBgSave, flagAdmin},
+		"lastsave": {cmdLastSave, flagAdmin},
+		"shutdown": {cmdShutdown, flagAdmin},
+
+		"jindex":            {cmdJIndex, flagAdmin},
+		"jzrange":           {cmdJZRange, flagRead},
+		"jzrevrange":        {cmdJZRevRange, flagRead},
+		"jzrangebyscore":    {cmdJZRangeByScore, flagRead},
+		"jzrevrangebyscore": {cmdJZRevRangeByScore, flagRead},
+		"jzrank":            {cmdJZRank, flagRead},
+		"jzrevrank":         {cmdJZRevRank, flagRead},
+		"jzcard":            {cmdJZCard, flagRead},
+		"jgeoradius":        {cmdJGeoRadius, flagRead},
+		"jgeobox":           {cmdJGeoBox, flagRead},
+		"jgeodist":          {cmdJGeoDist, flagRead},
+		"jknn":              {cmdJKnn, flagRead},
+		"jschema":           {cmdJSchema, flagAdmin},
+
+		"ping":         {cmdPing, flagRead},
+		"hello":        {cmdHello, flagRead | flagNoAuth},
+		"auth":         {cmdAuth, flagNoAuth},
+		"client":       {cmdClient, flagRead},
+		"config":       {cmdConfig, flagAdmin},
+		"subscribe":    {cmdSubscribe, flagRead},
+		"psubscribe":   {cmdPSubscribe, flagRead},
+		"unsubscribe":  {cmdUnsubscribe, flagRead},
+		"punsubscribe": {cmdPUnsubscribe, flagRead},
+		"publish":      {cmdPublish, flagRead},
+		"jwatchstream": {cmdJWatchStream, flagRead},
+		"bjpop":        {cmdBJPop, flagWrite},
+
+		"replicaof": {cmdReplicaOf, flagAdmin},
+		"psync":     {cmdPSync, flagAdmin},
+		"replconf":  {cmdReplConf, flagAdmin},
+		"role":      {cmdRole, flagRead},
+		"cluster":   {cmdCluster, flagAdmin},
+		"asking":    {cmdAsking, flagRead},
+		"jmigrate":  {cmdJMigrate, flagAdmin},
+		"jrestore":  {cmdJRestore, flagAdmin},
 	}
 )
 
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+const cronPeriod = time.Second
+
 type Server struct {
-	db   Db
-	lock sync.RWMutex
-	addr string
+	db          Db
+	lock        sync.RWMutex
+	addr        string
+	limits      resp.Limits   // guarded by lock
+	maxMemory   int64         // guarded by lock, 0 for no limit
+	idleTimeout time.Duration // guarded by lock, 0 for none
+	logLevel    string        // guarded by lock
+	usedMemory  int64         // heap in use, sampled by cron
+	indexes     *indexManager
+	schemas     *schemaRegistry
+	pubsub      *pubsub
+	changelog   *changelog
+	blocking    *blockingPops
+	repl        *replication
+	cluster     *cluster
+	docWatch    *docWatch
+	acl         *acl
+	persist     *persistence
+
+	// read at start, set by the configuration before Run
+	httpAddr  string
+	httpsAddr string
+	tlsAddr   string
+	tlsOpts   TLSOptions
+	logFile   string
+	wsOrigins string // origins besides the server's own that may open /ws
+
+	// configuration file CONFIG REWRITE writes, and its values when loaded
+	configFile string
+	configBase map[string]string
+
+	// TLS listener served next to the plain one, nil if none
+	tlsConfig   *tls.Config
+	tlsListener net.Listener
+	certUser    bool
+
+	// closed once Shutdown starts, and once it is over
+	quit         chan struct{}
+	done         chan struct{}
+	shutdownOnce sync.Once
+	listeners    []net.Listener    // guarded by lock
+	httpServers  []*http.Server    // guarded by lock
+	sessions     map[*session]bool // guarded by lock
+
+	nextClientID int64
 }
 
 func NewServer(addr string) *Server {
-	return &Server{
-		addr: addr,
-		db:   NewMapDb(),
-		lock: sync.RWMutex{},
+	quit := make(chan struct{})
+	s := &Server{
+		addr:      addr,
+		db:        NewMapDb(),
+		lock:      sync.RWMutex{},
+		limits:    resp.DefaultLimits,
+		indexes:   newIndexManager(),
+		schemas:   newSchemaRegistry(),
+		pubsub:    newPubsub(),
+		changelog: newChangelog(defaultChangelogRetention),
+		blocking:  newBlockingPops(quit),
+		repl:      newReplication(),
+		cluster:   newCluster(),
+		docWatch:  newDocWatch(),
+		acl:       newACL(),
+		persist:   newPersistence(),
+		logLevel:  "info",
+		quit:      quit,
+		done:      make(chan struct{}),
+		sessions:  make(map[*session]bool),
 	}
+	s.db.Observe(s.indexes.onMutation)
+	s.db.Observe(s.pubsub.onMutation)
+	s.db.Observe(s.changelog.onMutation)
+	s.db.Observe(s.blocking.onMutation)
+	s.db.Observe(s.repl.onMutation)
+	s.db.Observe(s.docWatch.onMutation)
+	s.db.Observe(s.persist.onMutation)
+	s.db.SetValidator(s.schemas)
+	return s
+}
+
+func (s *Server) protoLimits() resp.Limits {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.limits
 }
 
+// Run serves the plain listener, and the TLS one if ListenTLS was called or
+// tls-addr is set. An empty address leaves the plain listener out when TLS
+// is on. It returns once Shutdown is over.
 func (s *Server) Run() {
+	if err := s.start(); err != nil {
+		log.Fatal(err)
+	}
+
+	if s.tlsListener != nil {
+		log.Info("listening with TLS on", s.tlsListener.Addr())
+		if s.addr == "" {
+			s.serve(s.tlsListener)
+			<-s.done
+			return
+		}
+		go s.serve(s.tlsListener)
+	}
+
 	log.Info("listening on", s.addr)
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	s.serve(listener)
+	<-s.done
+}
+
+// start loads the ACL file and the snapshot, binds the TLS listener and
+// starts the HTTP ones and the background jobs
+func (s *Server) start() error {
+	if f := s.acl.fileName(); f != "" {
+		if err := s.LoadACL(f); err != nil {
+			return err
+		}
+	}
+	if err := s.persist.load(s.db); err != nil {
+		return err
+	}
+	if s.tlsListener == nil && s.tlsAddr != "" {
+		if err := s.ListenTLS(s.tlsAddr, s.tlsOpts); err != nil {
+			return err
+		}
+	}
+	if s.httpAddr != "" {
+		go s.RunHTTP(s.httpAddr)
+	}
+	if s.httpsAddr != "" {
+		go s.RunHTTPS(s.httpsAddr)
+	}
+	go s.repl.cron(s.quit)
+	go s.cron()
+	return nil
+}
+
+// cron saves at the save points and samples the memory in use
+func (s *Server) cron() {
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+		s.sampleMemory()
+		s.persist.check(s.db)
+	}
+}
+
+func (s *Server) sampleMemory() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	atomic.StoreInt64(&s.usedMemory, int64(ms.HeapAlloc))
+}
+
+// overMaxMemory tells if writes are refused, there is no eviction
+func (s *Server) overMaxMemory() bool {
+	s.lock.RLock()
+	max := s.maxMemory
+	s.lock.RUnlock()
+	return max > 0 && atomic.LoadInt64(&s.usedMemory) > max
+}
+
+func (s *Server) timeout() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.idleTimeout
+}
 
+// serve accepts connections until Shutdown closes listener
+func (s *Server) serve(listener net.Listener) {
+	if !s.addListener(listener) {
+		listener.Close()
+		return
+	}
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return
+			}
 			log.Warning(errors.ErrorStack(err))
 			continue
 		}
@@ -67,8 +294,28 @@ func (s *Server) handleConn(c net.Conn) {
 	client := &session{
 		Conn:     c,
 		srv:      s,
-		r:        bufio.NewReader(c),
+		w:        bufio.NewWriter(c),
 		CreateAt: time.Now(),
+		closed:   make(chan struct{}),
+		id:       atomic.AddInt64(&s.nextClientID, 1),
+		user:     s.acl.sessionUser(),
+	}
+	client.r = bufio.NewReader(connReader{client})
+	if tc, ok := c.(*tls.Conn); ok {
+		u, err := s.tlsHandshake(tc)
+		if err != nil {
+			log.Warningf("TLS handshake with %v failed, %v", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		if u != nil {
+			client.user = u
+		}
+	}
+
+	if !s.addSession(client) {
+		c.Close()
+		return
 	}
 
 	var err error
@@ -77,13 +324,44 @@ func (s *Server) handleConn(c net.Conn) {
 		if err != nil {
 			log.Infof("close connection %v, %+v", c.RemoteAddr(), client)
 		}
+		s.removeSession(client)
+		s.repl.removeReplica(client)
+		s.pubsub.unsubscribeAll(client)
+		for _, w := range client.watchers {
+			s.changelog.unwatch(w)
+		}
+		close(client.closed)
 		c.Close()
 	}()
 
 	for {
-		r, err := resp.Parse(client.r)
+		// once the commands already read are done, send what is queued
+		// and leave
+		if s.shuttingDown() && client.r.Buffered() == 0 {
+			client.drain()
+			return
+		}
+		// sessions getting pushed messages are idle on purpose
+		timeout := s.timeout()
+		if timeout > 0 && client.pushCh == nil {
+			c.SetReadDeadline(time.Now().Add(timeout))
+		}
+		r, err := resp.ParseWithLimits(client.r, s.protoLimits())
+		if timeout > 0 && client.pushCh == nil {
+			c.SetReadDeadline(time.Time{})
+		}
 		if err != nil {
+			if s.shuttingDown() {
+				client.drain()
+				return
+			}
 			log.Warning(err)
+			// the rest of the stream can't be parsed, tell why and close
+			if pe := resp.AsProtocolError(err); pe != nil {
+				b, _ := RespErr(pe).Bytes()
+				client.Write(b)
+				client.Flush()
+			}
 			return
 		}
 
@@ -95,15 +373,28 @@ func (s *Server) handleConn(c net.Conn) {
 		strOp := strings.ToLower(string(op))
 
 		var ret *resp.Resp
-		f, ok := cmdFuncs[strOp]
+		cmd, ok := commands[strOp]
 		if !ok {
 			ret = RespNoSuchCmd
+		} else if err := s.acl.check(client.user, strOp, cmd, r); err != nil {
+			ret = RespErr(err)
+		} else if client.subscribed() > 0 && !subscribeModeCmds[strOp] {
+			ret = RespErr(fmt.Errorf("can't execute '%s' in subscribe mode", strOp))
+		} else if moved := s.cluster.redirect(r, cmd, client); moved != nil {
+			ret = moved
+		} else if cmd.flags&flagWrite != 0 && s.repl.readOnly() {
+			ret = RespErr(ErrReadOnly)
+		} else if cmd.flags&flagWrite != 0 && s.overMaxMemory() {
+			ret = RespErr(ErrOOM)
 		} else {
-			ret = f(r, client)
+			ret = cmd.fn(r, client)
+		}
+		if strOp != "asking" {
+			client.asking = false
 		}
 		if ret != nil {
-			b, _ := ret.Bytes()
-			client.Write(b)
+			b, _ := client.encode(ret)
+			client.reply(b)
 		}
 	}
 }
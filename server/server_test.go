@@ -1,6 +1,219 @@
 package server
 
-import "testing"
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
 
 func TestServer(t *testing.T) {
 }
+
+type testClient struct {
+	t *testing.T
+	c net.Conn
+	r *bufio.Reader
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	c1, c2 := net.Pipe()
+	go s.handleConn(c2)
+	return &testClient{t: t, c: c1, r: bufio.NewReader(c1)}
+}
+
+func (tc *testClient) send(args ...string) {
+	r := &resp.Resp{Type: resp.MultiResp}
+	for _, a := range args {
+		r.Multi = append(r.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(a)})
+	}
+	b, _ := r.Bytes()
+	if _, err := tc.c.Write(b); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+func (tc *testClient) read() *resp.Resp {
+	r, err := resp.Parse(tc.r)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return r
+}
+
+func (tc *testClient) do(args ...string) *resp.Resp {
+	tc.send(args...)
+	return tc.read()
+}
+
+func (tc *testClient) close() {
+	tc.c.Close()
+}
+
+func TestPubsub(t *testing.T) {
+	s := NewServer("")
+	sub := newTestClient(t, s)
+	defer sub.close()
+	pub := newTestClient(t, s)
+	defer pub.close()
+
+	if r := pub.do("config", "set", "notify-keyspace-events", "Kd"); r.Type == resp.ErrorResp {
+		t.Fatal(r.Error)
+	}
+
+	if r := sub.do("subscribe", "news"); len(r.Multi) != 3 || r.Multi[2].Integer != 1 {
+		t.Fatal("subscribe", r)
+	}
+	if r := sub.do("psubscribe", "__keyspace__:doc*"); len(r.Multi) != 3 || r.Multi[2].Integer != 2 {
+		t.Fatal("psubscribe", r)
+	}
+	if r := sub.do("jget", "a", "b"); r.Type != resp.ErrorResp {
+		t.Error("commands are limited in subscribe mode", r)
+	}
+
+	if r := pub.do("publish", "news", "hello"); r.Integer != 1 {
+		t.Error("publish", r)
+	}
+	if r := sub.read(); string(r.Multi[0].Bulk) != "message" || string(r.Multi[2].Bulk) != "hello" {
+		t.Error("message", r)
+	}
+	// keyspace notifications can't be forged
+	if r := pub.do("publish", "__keyspace__:doc1", "{}"); r.Error != ErrReservedChannel.Error() {
+		t.Error("forged notification", r)
+	}
+
+	pub.do("jdocset", "doc1", `{"a":1}`)
+	// jset events are not enabled
+	pub.do("jset", "doc1", "a", "2")
+	pub.do("jdocset", "other", `{}`)
+	pub.do("jdocset", "doc2", `{}`)
+
+	r := sub.read()
+	if string(r.Multi[0].Bulk) != "pmessage" || string(r.Multi[2].Bulk) != "__keyspace__:doc1" ||
+		string(r.Multi[3].Bulk) != `{"key":"doc1","path":"","op":"jdocset"}` {
+		t.Error("keyspace event", r)
+	}
+	if r := sub.read(); string(r.Multi[2].Bulk) != "__keyspace__:doc2" {
+		t.Error("keyspace event", r)
+	}
+
+	if r := sub.do("unsubscribe"); string(r.Multi[1].Bulk) != "news" || r.Multi[2].Integer != 1 {
+		t.Error("unsubscribe", r)
+	}
+	if r := sub.do("punsubscribe"); r.Multi[2].Integer != 0 {
+		t.Error("punsubscribe", r)
+	}
+	if r := sub.do("ping"); r.Status != "PONG" {
+		t.Error("ping", r)
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := NewServer("")
+	c := newTestClient(t, s)
+	defer c.close()
+
+	for i := 0; i < 30; i++ {
+		c.do("jdocset", fmt.Sprint("user:", i), "{}")
+	}
+	c.do("jdocset", "other", "{}")
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for {
+		r := c.do("scan", cursor, "MATCH", "user:*", "COUNT", "4")
+		for _, k := range r.Multi[1].Multi {
+			seen[string(k.Bulk)] = true
+		}
+		if cursor = string(r.Multi[0].Bulk); cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 30 || seen["other"] {
+		t.Error("scan", seen)
+	}
+	if r := c.do("scan", "1024"); r.Type != resp.ErrorResp {
+		t.Error("invalid cursor", r)
+	}
+}
+
+// writeCounter counts the writes to the connection of a session
+type writeCounter struct {
+	net.Conn
+	writes int32
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	atomic.AddInt32(&wc.writes, 1)
+	return wc.Conn.Write(p)
+}
+
+func TestPipeline(t *testing.T) {
+	s := NewServer("")
+	c1, c2 := net.Pipe()
+	wc := &writeCounter{Conn: c2}
+	go s.handleConn(wc)
+	tc := &testClient{t: t, c: c1, r: bufio.NewReader(c1)}
+	defer tc.close()
+
+	var batch []byte
+	for i := 0; i < 50; i++ {
+		r := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{
+			{Type: resp.BulkResp, Bulk: []byte("jdocset")},
+			{Type: resp.BulkResp, Bulk: []byte(fmt.Sprintf("p:%d", i))},
+			{Type: resp.BulkResp, Bulk: []byte(fmt.Sprintf(`{"i": %d}`, i))},
+		}}
+		b, _ := r.Bytes()
+		batch = append(batch, b...)
+	}
+	go c1.Write(batch)
+	for i := 0; i < 50; i++ {
+		if r := tc.read(); r.Status != "OK" {
+			t.Fatal(i, r)
+		}
+	}
+	if n := atomic.LoadInt32(&wc.writes); n > 2 {
+		t.Error("replies of a pipeline written in", n, "writes")
+	}
+
+	// a blocking command sends the replies before it, even with more
+	// commands in the pipeline
+	go c1.Write([]byte("*2\r\n$4\r\nping\r\n$1\r\na\r\n" +
+		"*4\r\n$5\r\nbjpop\r\n$1\r\nq\r\n$1\r\nl\r\n$1\r\n0\r\n" +
+		"*1\r\n$4\r\nping\r\n"))
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if r := tc.read(); string(r.Bulk) != "a" {
+		t.Error("ping", r)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	s := NewServer("")
+	tc := newTestClient(t, s)
+	defer tc.close()
+
+	if r := tc.do("config", "set", "proto-max-bulk-len", "8"); r.Type == resp.ErrorResp {
+		t.Fatal(r)
+	}
+	if _, err := tc.c.Write([]byte("jset a b {\"x\": 1}\r\nping\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if r := tc.read(); r.Type != resp.BulkResp || r.Bulk != nil {
+		t.Error("inline json", r)
+	}
+	if r := tc.read(); r.Status != "PONG" {
+		t.Error("ping", r)
+	}
+
+	go tc.c.Write([]byte("*2\r\n$4\r\nping\r\n$9\r\n"))
+	if r := tc.read(); r.Type != resp.ErrorResp || r.Error != "Protocol error: invalid bulk length" {
+		t.Error("bulk length", r)
+	}
+	if _, err := resp.Parse(tc.r); err == nil {
+		t.Error("connection still open")
+	}
+}
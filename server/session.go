@@ -3,7 +3,18 @@ package server
 import (
 	"bufio"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const (
+	pushQueueSize = 1024
+	drainTimeout  = time.Second
 )
 
 type session struct {
@@ -14,6 +25,34 @@ type session struct {
 	CreateAt time.Time
 	Ops      int64
 	srv      *Server
+
+	id   int64
+	name string
+	// protocol version set by HELLO, read by the goroutines pushing messages
+	proto int32
+	// authenticated user, nil until AUTH if the default user has a password
+	user *aclUser
+	// reply JSON values as RESP3 types rather than serialized strings
+	nativeJSON bool
+
+	// replies and pushed messages may be written by different goroutines
+	wlock sync.Mutex
+
+	pushOnce     sync.Once
+	pushCh       chan []byte
+	pushDone     chan struct{} // closed once the push goroutine stopped writing
+	overflowOnce sync.Once
+	closed       chan struct{}
+
+	subs     map[string]bool
+	psubs    map[string]bool
+	watchers []*changeWatcher
+
+	// port a follower listens on, as told by replconf
+	listeningPort string
+
+	// the next command may use a slot being imported
+	asking bool
 }
 
 //make sure all read using bufio.Reader
@@ -21,7 +60,170 @@ func (s *session) Read(p []byte) (int, error) {
 	return s.r.Read(p)
 }
 
-//write without bufio
+// Write buffers p until the next Flush
 func (s *session) Write(p []byte) (int, error) {
-	return s.Conn.Write(p)
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *session) Flush() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+	return s.w.Flush()
+}
+
+// connReader is what the bufio.Reader of a session reads from. The reader
+// only goes to the connection once it has no whole command left, so the
+// replies of a pipeline are flushed together, before waiting for more.
+type connReader struct {
+	s *session
+}
+
+func (cr connReader) Read(p []byte) (int, error) {
+	if err := cr.s.Flush(); err != nil {
+		return 0, err
+	}
+	return cr.s.Conn.Read(p)
+}
+
+func (s *session) startPush() {
+	s.pushOnce.Do(func() {
+		s.pushCh = make(chan []byte, pushQueueSize)
+		s.pushDone = make(chan struct{})
+		go s.pushLoop()
+	})
+}
+
+// push queues b to be written by the push goroutine, so that publishers never
+// block on a slow client. A client that can't keep up is disconnected.
+func (s *session) push(b []byte) {
+	s.startPush()
+	select {
+	case s.pushCh <- b:
+	case <-s.closed:
+	default:
+		s.overflowOnce.Do(func() {
+			log.Warningf("push queue of %v is full, closing connection", s.RemoteAddr())
+			s.Conn.Close()
+		})
+	}
+}
+
+// pushWait queues b like push but waits for room in the queue, it returns
+// false once nothing drains the queue anymore. Only the session goroutine
+// may wait, to send what the client asked for at the pace it reads; it
+// closes s.closed itself, so a client gone away is told by pushDone.
+func (s *session) pushWait(b []byte) bool {
+	s.startPush()
+	select {
+	case s.pushCh <- b:
+		return true
+	case <-s.pushDone:
+		return false
+	case <-s.closed:
+		return false
+	}
+}
+
+func (s *session) pushLoop() {
+	defer close(s.pushDone)
+	for {
+		select {
+		case b := <-s.pushCh:
+			if _, err := s.Write(b); err != nil {
+				return
+			}
+			if len(s.pushCh) == 0 {
+				if err := s.Flush(); err != nil {
+					return
+				}
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// drain gives the push goroutine a moment to write what is queued and
+// flushes the replies of the commands already run, before a shutdown
+// closes the connection
+func (s *session) drain() {
+	if s.pushCh != nil {
+		deadline := time.Now().Add(drainTimeout)
+		for len(s.pushCh) > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.Flush()
+}
+
+// watchDisconnect lets a blocking command notice that the client went away.
+// The returned channel is closed on disconnect; stop must be called before
+// the session reads from the connection again. The replies of the commands
+// before are sent first.
+func (s *session) watchDisconnect() (<-chan struct{}, func()) {
+	s.Flush()
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.r.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				close(closed)
+			}
+		}
+	}()
+	return closed, func() {
+		s.Conn.SetReadDeadline(time.Now())
+		<-done
+		s.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// reply writes b in order with the pushed messages once the session has
+// subscribed to something, and directly otherwise
+func (s *session) reply(b []byte) {
+	if s.pushCh != nil {
+		s.push(b)
+		return
+	}
+	s.Write(b)
+}
+
+func (s *session) protocol() int {
+	if p := atomic.LoadInt32(&s.proto); p != 0 {
+		return int(p)
+	}
+	return 2
+}
+
+// encode serializes a reply in the protocol of the session
+func (s *session) encode(r *resp.Resp) ([]byte, error) {
+	if s.protocol() == 3 {
+		return r.Resp3().Bytes()
+	}
+	return r.Resp2().Bytes()
+}
+
+// sendPush queues a message built by pushMessage, turned into the RESP3 push
+// type for the sessions that switched to it
+func (s *session) sendPush(b []byte) {
+	s.push(s.pushFrame(b))
+}
+
+// sendPushWait is sendPush waiting for room in the queue, see pushWait
+func (s *session) sendPushWait(b []byte) bool {
+	return s.pushWait(s.pushFrame(b))
+}
+
+func (s *session) pushFrame(b []byte) []byte {
+	if s.protocol() == 3 && len(b) > 0 && b[0] == '*' {
+		b = append([]byte{'>'}, b[1:]...)
+	}
+	return b
+}
+
+func (s *session) subscribed() int {
+	return len(s.subs) + len(s.psubs) + len(s.watchers)
 }
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"jj/resp"
+
+	log "github.com/ngaut/logging"
+)
+
+const (
+	// shutdownTimeout bounds the draining started by SHUTDOWN
+	shutdownTimeout = 10 * time.Second
+	// shutdownPollPeriod is how often idle sessions are woken up to leave
+	shutdownPollPeriod = 20 * time.Millisecond
+)
+
+type shutdownMode int
+
+const (
+	shutdownDefault shutdownMode = iota // save if save points are set
+	shutdownSave
+	shutdownNoSave
+)
+
+// Shutdown stops accepting connections, lets the commands in flight finish,
+// closes the sessions and writes a last snapshot when save points are set.
+// Sessions still busy when ctx is done are closed. Run returns once it is
+// over; the error is the one of the snapshot or ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.shutdown(ctx, shutdownDefault)
+}
+
+func (s *Server) shutdown(ctx context.Context, mode shutdownMode) error {
+	var err error
+	ran := false
+	s.shutdownOnce.Do(func() {
+		ran = true
+		err = s.stop(ctx, mode)
+	})
+	if !ran {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *Server) stop(ctx context.Context, mode shutdownMode) error {
+	defer close(s.done)
+	log.Info("shutting down")
+	close(s.quit)
+
+	s.lock.Lock()
+	listeners, httpServers := s.listeners, s.httpServers
+	s.lock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warning("http shutdown,", err)
+			srv.Close()
+		}
+	}
+	s.docWatch.closeConns()
+	s.repl.stopLink()
+
+	err := s.drainSessions(ctx)
+
+	if mode == shutdownSave || (mode == shutdownDefault && s.persist.saveOnShutdown()) {
+		if serr := s.finalSave(); serr != nil {
+			err = serr
+		}
+	}
+	log.Info("shutdown complete")
+	return err
+}
+
+// drainSessions wakes up the sessions waiting for a command until they all
+// left, a session finishes the command it runs and sends its replies first
+func (s *Server) drainSessions(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollPeriod)
+	defer ticker.Stop()
+	for {
+		s.lock.RLock()
+		sessions := make([]*session, 0, len(s.sessions))
+		for c := range s.sessions {
+			sessions = append(sessions, c)
+		}
+		s.lock.RUnlock()
+		if len(sessions) == 0 {
+			return nil
+		}
+		for _, c := range sessions {
+			c.Conn.SetReadDeadline(time.Now())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warningf("closing %d sessions still busy", len(sessions))
+			for _, c := range sessions {
+				c.Conn.Close()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// finalSave writes the snapshot, after a background save in progress
+func (s *Server) finalSave() error {
+	for {
+		err := s.persist.save(s.db)
+		if err != ErrSaveInProgress {
+			return err
+		}
+		time.Sleep(shutdownPollPeriod)
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// addListener records l for Shutdown to close, it returns false once the
+// server is shutting down
+func (s *Server) addListener(l net.Listener) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.listeners = append(s.listeners, l)
+	return true
+}
+
+func (s *Server) addHTTPServer(srv *http.Server) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.httpServers = append(s.httpServers, srv)
+	return true
+}
+
+func (s *Server) addSession(c *session) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	s.sessions[c] = true
+	return true
+}
+
+func (s *Server) removeSession(c *session) {
+	s.lock.Lock()
+	delete(s.sessions, c)
+	s.lock.Unlock()
+}
+
+// shutdown [save|nosave]
+// There is no reply, the connection is closed with the others.
+func cmdShutdown(r *resp.Resp, client *session) *resp.Resp {
+	mode := shutdownDefault
+	switch len(r.Multi) {
+	case 1:
+	case 2:
+		switch strings.ToLower(string(r.Multi[1].Bulk)) {
+		case "save":
+			mode = shutdownSave
+		case "nosave":
+			mode = shutdownNoSave
+		default:
+			return RespInvalidParam
+		}
+	default:
+		return RespInvalidParam
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		client.srv.shutdown(ctx, mode)
+	}()
+	return nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/resp"
+)
+
+func expectClosed(t *testing.T, name string, c *testClient) {
+	if r, err := resp.Parse(c.r); err == nil || !strings.Contains(err.Error(), io.EOF.Error()) {
+		t.Error(name, "not closed", r, err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer("")
+	s.SetConfig("dir", dir)
+	s.SetConfig("save", "3600 1")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		s.serve(l)
+		close(served)
+	}()
+
+	idle := newTestClient(t, s)
+	defer idle.close()
+	blocked := newTestClient(t, s)
+	defer blocked.close()
+	blocked.send("bjpop", "q", "items", "0")
+	waitFor(t, "bjpop", func() bool {
+		s.blocking.lock.Lock()
+		defer s.blocking.lock.Unlock()
+		return len(s.blocking.waiting) > 0
+	})
+
+	// a pipeline read before the shutdown runs to the end
+	busy := newTestClient(t, s)
+	defer busy.close()
+	var pipeline []byte
+	for _, key := range []string{"a", "b", "c"} {
+		r := &resp.Resp{Type: resp.MultiResp, Multi: []*resp.Resp{bulk("jdocset"), bulk(key), bulk(`{"n": 1}`)}}
+		b, _ := r.Bytes()
+		pipeline = append(pipeline, b...)
+	}
+	if _, err := busy.c.Write(pipeline); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(ctx) }()
+
+	for i := 0; i < 3; i++ {
+		if r := busy.read(); r.Status != "OK" {
+			t.Error("pipelined write", i, r)
+		}
+	}
+	for name, c := range map[string]*testClient{"busy": busy, "idle": idle} {
+		expectClosed(t, name, c)
+	}
+	if r := blocked.read(); r.Type != resp.MultiResp || len(r.Multi) != 0 {
+		t.Error("blocked pop", r)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+	<-served
+
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("still accepting")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "dump.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"c"`) {
+		t.Error("snapshot", string(b))
+	}
+
+	// the server is gone for the connections arriving late
+	late := newTestClient(t, s)
+	defer late.close()
+	expectClosed(t, "late connection", late)
+	if err := s.Shutdown(ctx); err != nil {
+		t.Error("second shutdown", err)
+	}
+}
+
+func TestShutdownCommand(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer("")
+	s.SetConfig("dir", dir)
+	c := newTestClient(t, s)
+	defer c.close()
+	c.do("jdocset", "a", "1")
+	if r := c.do("shutdown", "later"); r.Type != resp.ErrorResp {
+		t.Error("bad mode", r)
+	}
+	c.send("shutdown", "save")
+	expectClosed(t, "shutdown", c)
+	<-s.done
+	if _, err := os.Stat(filepath.Join(dir, "dump.json")); err != nil {
+		t.Error("no snapshot", err)
+	}
+
+	// NOSAVE skips the snapshot even with save points
+	dir2 := t.TempDir()
+	s2 := NewServer("")
+	s2.SetConfig("dir", dir2)
+	s2.SetConfig("save", "3600 1")
+	c2 := newTestClient(t, s2)
+	defer c2.close()
+	c2.do("jdocset", "a", "1")
+	c2.send("shutdown", "nosave")
+	<-s2.done
+	if _, err := os.Stat(filepath.Join(dir2, "dump.json")); !os.IsNotExist(err) {
+		t.Error("saved with nosave", err)
+	}
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"jj/resp"
+)
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+var ErrInvalidScore = errors.New("min or max is not a float")
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplistNode struct {
+	key      string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+// less reports whether n sorts before (score, key)
+func (n *skiplistNode) less(score float64, key string) bool {
+	return n.score < score || (n.score == score && n.key < key)
+}
+
+// skiplist keeps (score, key) pairs ordered by score, then key. Every level
+// records the number of nodes it skips, so rank lookups are O(log n).
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+func (sl *skiplist) insert(score float64, key string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i != sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(score, key) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skiplistNode{
+		key:   key,
+		score: score,
+		level: make([]skiplistLevel, level),
+	}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+}
+
+func (sl *skiplist) delete(score float64, key string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(score, key) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.key != key {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		sl.tail = x.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// rank returns the 0-based position of (score, key), or -1
+func (sl *skiplist) rank(score float64, key string) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.less(score, key) ||
+				(x.level[i].forward.score == score && x.level[i].forward.key == key)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != sl.header && x.key == key {
+			return rank - 1
+		}
+	}
+	return -1
+}
+
+// byRank returns the node at the 0-based position rank
+func (sl *skiplist) byRank(rank int) *skiplistNode {
+	rank++
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+type scoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+func (r *scoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r *scoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// first returns the lowest node inside r
+func (sl *skiplist) first(r *scoreRange) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+// last returns the highest node inside r
+func (sl *skiplist) last(r *scoreRange) *skiplistNode {
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if x == sl.header || !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+type scoredKey struct {
+	key   string
+	score float64
+}
+
+// sortedIndex orders documents by the number found at path
+type sortedIndex struct {
+	name   string
+	prefix string
+	path   string
+
+	lock   sync.RWMutex
+	sl     *skiplist
+	scores map[string]float64
+}
+
+func newSortedIndex(name string, prefix string, path string) *sortedIndex {
+	return &sortedIndex{
+		name:   name,
+		prefix: prefix,
+		path:   path,
+		sl:     newSkiplist(),
+		scores: make(map[string]float64),
+	}
+}
+
+// args: <path>
+func newSortedIndexFromArgs(name string, prefix string, args [][]byte) (index, error) {
+	if len(args) != 1 {
+		return nil, errors.New("usage: jindex create <name> sorted <prefix> <path>")
+	}
+	return newSortedIndex(name, prefix, string(args[0])), nil
+}
+
+func (idx *sortedIndex) Name() string {
+	return idx.name
+}
+
+func (idx *sortedIndex) Prefix() string {
+	return idx.prefix
+}
+
+func (idx *sortedIndex) Info() []string {
+	return []string{idx.name, "sorted", idx.prefix + "*", idx.path}
+}
+
+func (idx *sortedIndex) update(key string, doc interface{}) {
+	score, ok := pathNumber(doc, idx.path)
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, exists := idx.scores[key]; exists {
+		if ok && old == score {
+			return
+		}
+		idx.sl.delete(old, key)
+		delete(idx.scores, key)
+	}
+	if ok {
+		idx.sl.insert(score, key)
+		idx.scores[key] = score
+	}
+}
+
+// Len returns the number of entries whose key keep accepts, all of them if
+// keep is nil
+func (idx *sortedIndex) Len(keep func(string) bool) int {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	if keep == nil {
+		return idx.sl.length
+	}
+	return len(idx.kept(keep, false))
+}
+
+// Rank returns the position of key in ascending (or descending) order,
+// among the keys keep accepts if it is set
+func (idx *sortedIndex) Rank(key string, reverse bool, keep func(string) bool) (int, bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	score, ok := idx.scores[key]
+	if !ok {
+		return 0, false
+	}
+	if keep != nil {
+		for i, e := range idx.kept(keep, reverse) {
+			if e.key == key {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	rank := idx.sl.rank(score, key)
+	if reverse {
+		rank = idx.sl.length - 1 - rank
+	}
+	return rank, true
+}
+
+// RangeByRank returns the entries between start and stop inclusive.
+// Negative positions count from the end, like ZRANGE. If keep is set, the
+// positions only count the keys it accepts.
+func (idx *sortedIndex) RangeByRank(start, stop int, reverse bool, keep func(string) bool) []scoredKey {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	var entries []scoredKey
+	length := idx.sl.length
+	if keep != nil {
+		entries = idx.kept(keep, reverse)
+		length = len(entries)
+	}
+	if start < 0 {
+		start = length + start
+	}
+	if stop < 0 {
+		stop = length + stop
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= length {
+		return nil
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if keep != nil {
+		return entries[start : stop+1]
+	}
+
+	var x *skiplistNode
+	if reverse {
+		x = idx.sl.byRank(length - 1 - start)
+	} else {
+		x = idx.sl.byRank(start)
+	}
+	ret := make([]scoredKey, 0, stop-start+1)
+	for i := start; i <= stop && x != nil; i++ {
+		ret = append(ret, scoredKey{x.key, x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return ret
+}
+
+// kept returns the entries whose key keep accepts, in order. Positions among
+// them can't use the spans of the skiplist, so it walks all entries; it
+// must be called with the lock held.
+func (idx *sortedIndex) kept(keep func(string) bool, reverse bool) []scoredKey {
+	var ret []scoredKey
+	x := idx.sl.header.level[0].forward
+	if reverse {
+		x = idx.sl.tail
+	}
+	for x != nil {
+		if keep(x.key) {
+			ret = append(ret, scoredKey{x.key, x.score})
+		}
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return ret
+}
+
+// RangeByScore returns the entries inside r, skipping offset entries and
+// returning at most count entries (count < 0 means no limit). Only the keys
+// keep accepts are counted, all of them if keep is nil.
+func (idx *sortedIndex) RangeByScore(r *scoreRange, offset, count int, reverse bool, keep func(string) bool) []scoredKey {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	var x *skiplistNode
+	if reverse {
+		x = idx.sl.last(r)
+	} else {
+		x = idx.sl.first(r)
+	}
+
+	var ret []scoredKey
+	for x != nil && count != 0 {
+		if (reverse && !r.gteMin(x.score)) || (!reverse && !r.lteMax(x.score)) {
+			break
+		}
+		if keep == nil || keep(x.key) {
+			if offset > 0 {
+				offset--
+			} else {
+				ret = append(ret, scoredKey{x.key, x.score})
+				count--
+			}
+		}
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.level[0].forward
+		}
+	}
+	return ret
+}
+
+// parseScore accepts a float, "-inf", "+inf" and the exclusive form "(1.5"
+func parseScore(b []byte) (float64, bool, error) {
+	s := string(b)
+	exclusive := false
+	if strings.HasPrefix(s, "(") {
+		exclusive = true
+		s = s[1:]
+	}
+	switch strings.ToLower(s) {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, ErrInvalidScore
+	}
+	return f, exclusive, nil
+}
+
+func formatScore(f float64) []byte {
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func scoredKeysResp(entries []scoredKey, withScores bool) *resp.Resp {
+	ret := &resp.Resp{
+		Type:  resp.MultiResp,
+		Multi: []*resp.Resp{},
+	}
+	for _, e := range entries {
+		ret.Multi = append(ret.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: []byte(e.key)})
+		if withScores {
+			ret.Multi = append(ret.Multi, &resp.Resp{Type: resp.BulkResp, Bulk: formatScore(e.score)})
+		}
+	}
+	return ret
+}
+
+func getSortedIndex(client *session, name []byte) (*sortedIndex, error) {
+	idx, err := client.srv.indexes.get(string(name))
+	if err != nil {
+		return nil, err
+	}
+	sidx, ok := idx.(*sortedIndex)
+	if !ok {
+		return nil, ErrWrongIndexType
+	}
+	if err := client.checkIndex(sidx.path); err != nil {
+		return nil, err
+	}
+	return sidx, nil
+}
+
+func generalRangeByRank(r *resp.Resp, client *session, reverse bool) *resp.Resp {
+	if len(r.Multi) != 4 && len(r.Multi) != 5 {
+		return RespInvalidParam
+	}
+	withScores := false
+	if len(r.Multi) == 5 {
+		if strings.ToLower(string(r.Multi[4].Bulk)) != "withscores" {
+			return RespInvalidParam
+		}
+		withScores = true
+	}
+
+	idx, err := getSortedIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	start, err := resp.Btoi(r.Multi[2].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	stop, err := resp.Btoi(r.Multi[3].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+
+	keep := client.srv.acl.keyFilter(client.user)
+	return scoredKeysResp(idx.RangeByRank(start, stop, reverse, keep), withScores)
+}
+
+func generalRangeByScore(r *resp.Resp, client *session, reverse bool) *resp.Resp {
+	if len(r.Multi) < 4 {
+		return RespInvalidParam
+	}
+
+	idx, err := getSortedIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+
+	// the reverse commands take max before min, like ZREVRANGEBYSCORE
+	minArg, maxArg := r.Multi[2].Bulk, r.Multi[3].Bulk
+	if reverse {
+		minArg, maxArg = maxArg, minArg
+	}
+	sr := &scoreRange{}
+	if sr.min, sr.minex, err = parseScore(minArg); err != nil {
+		return RespErr(err)
+	}
+	if sr.max, sr.maxex, err = parseScore(maxArg); err != nil {
+		return RespErr(err)
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	for i := 4; i < len(r.Multi); i++ {
+		switch strings.ToLower(string(r.Multi[i].Bulk)) {
+		case "withscores":
+			withScores = true
+		case "limit":
+			if i+2 >= len(r.Multi) {
+				return RespInvalidParam
+			}
+			if offset, err = resp.Btoi(r.Multi[i+1].Bulk); err != nil {
+				return RespErr(err)
+			}
+			if count, err = resp.Btoi(r.Multi[i+2].Bulk); err != nil {
+				return RespErr(err)
+			}
+			if offset < 0 {
+				return RespInvalidParam
+			}
+			i += 2
+		default:
+			return RespInvalidParam
+		}
+	}
+
+	keep := client.srv.acl.keyFilter(client.user)
+	return scoredKeysResp(idx.RangeByScore(sr, offset, count, reverse, keep), withScores)
+}
+
+func generalRank(r *resp.Resp, client *session, reverse bool) *resp.Resp {
+	if len(r.Multi) != 3 {
+		return RespInvalidParam
+	}
+	idx, err := getSortedIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	key := string(r.Multi[2].Bulk)
+	if err := client.srv.acl.checkKeys(client.user, key); err != nil {
+		return RespErr(err)
+	}
+	rank, ok := idx.Rank(key, reverse, client.srv.acl.keyFilter(client.user))
+	if !ok {
+		return RespNil
+	}
+	return &resp.Resp{
+		Type:    resp.IntegerResp,
+		Integer: int64(rank),
+	}
+}
+
+// jzrange <index> <start> <stop> [WITHSCORES]
+func cmdJZRange(r *resp.Resp, client *session) *resp.Resp {
+	return generalRangeByRank(r, client, false)
+}
+
+func cmdJZRevRange(r *resp.Resp, client *session) *resp.Resp {
+	return generalRangeByRank(r, client, true)
+}
+
+// jzrangebyscore <index> <min> <max> [WITHSCORES] [LIMIT offset count]
+func cmdJZRangeByScore(r *resp.Resp, client *session) *resp.Resp {
+	return generalRangeByScore(r, client, false)
+}
+
+func cmdJZRevRangeByScore(r *resp.Resp, client *session) *resp.Resp {
+	return generalRangeByScore(r, client, true)
+}
+
+// jzrank <index> <key>
+func cmdJZRank(r *resp.Resp, client *session) *resp.Resp {
+	return generalRank(r, client, false)
+}
+
+func cmdJZRevRank(r *resp.Resp, client *session) *resp.Resp {
+	return generalRank(r, client, true)
+}
+
+// jzcard <index>
+func cmdJZCard(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) != 2 {
+		return RespInvalidParam
+	}
+	idx, err := getSortedIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	return &resp.Resp{
+		Type:    resp.IntegerResp,
+		Integer: int64(idx.Len(client.srv.acl.keyFilter(client.user))),
+	}
+}
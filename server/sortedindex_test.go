@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	sl := newSkiplist()
+	for i := 0; i < 100; i++ {
+		sl.insert(float64(i%10), fmt.Sprintf("k%03d", i))
+	}
+	if sl.length != 100 {
+		t.Error("length", sl.length)
+	}
+
+	// score 0 holds k000, k010 ... k090, score 1 starts at rank 10
+	if r := sl.rank(1, "k001"); r != 10 {
+		t.Error("rank", r)
+	}
+	if n := sl.byRank(10); n == nil || n.key != "k001" {
+		t.Error("byRank", n)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		if !sl.delete(float64(i%10), fmt.Sprintf("k%03d", i)) {
+			t.Error("delete", i)
+		}
+	}
+	if sl.delete(0, "k000") {
+		t.Error("should not delete twice")
+	}
+	if sl.length != 50 {
+		t.Error("length", sl.length)
+	}
+	if n := sl.first(&scoreRange{min: 2, max: 4}); n == nil || n.key != "k003" {
+		t.Error("first", n)
+	}
+	if n := sl.last(&scoreRange{min: 2, max: 4, maxex: true}); n == nil || n.key != "k093" {
+		t.Error("last", n)
+	}
+}
+
+func TestSortedIndex(t *testing.T) {
+	db := NewMapDb()
+	indexes := newIndexManager()
+	db.Observe(indexes.onMutation)
+
+	for i := 0; i < 5; i++ {
+		db.PutDoc(fmt.Sprintf("player:%d", i), map[string]interface{}{"score": float64(i * 10)})
+	}
+	db.PutDoc("other", map[string]interface{}{"score": float64(1000)})
+
+	idx := newSortedIndex("lb", "player:", "score")
+	if err := indexes.create(db, idx); err != nil {
+		t.Fatal(err)
+	}
+	if idx.Len(nil) != 5 {
+		t.Error("len", idx.Len(nil))
+	}
+
+	if err := db.IncrPath("player:0", "score", float64(100)); err != nil {
+		t.Fatal(err)
+	}
+	top := idx.RangeByRank(0, 0, true, nil)
+	if len(top) != 1 || top[0].key != "player:0" || top[0].score != 100 {
+		t.Error("top", top)
+	}
+	if r, _ := idx.Rank("player:1", false, nil); r != 0 {
+		t.Error("rank", r)
+	}
+
+	page := idx.RangeByScore(&scoreRange{min: math.Inf(-1), max: math.Inf(1)}, 1, 2, false, nil)
+	if len(page) != 2 || page[0].key != "player:2" || page[1].key != "player:3" {
+		t.Error("page", page)
+	}
+
+	db.PutDoc("player:1", map[string]interface{}{"name": "no score"})
+	if idx.Len(nil) != 4 {
+		t.Error("len", idx.Len(nil))
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/ngaut/logging"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+var ErrNoTLS = errors.New("TLS is not configured, call ListenTLS first")
+
+// TLSOptions configure the TLS listener
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// CAFile holds the certificates that sign the client certificates, the
+	// system roots if empty
+	CAFile string
+	// AuthClients is "no", "optional" or "yes": whether clients present a
+	// certificate, which is verified if they do. "no" by default.
+	AuthClients string
+	// CertUser authenticates the clients with a certificate as the ACL
+	// user named by its subject common name. It needs CAFile: any public CA
+	// would otherwise vouch for the name.
+	CertUser bool
+}
+
+func (o *TLSOptions) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch o.AuthClients {
+	case "", "no":
+		if o.CertUser {
+			return nil, fmt.Errorf("%v: certificate users need client certificates", ErrInvalidParam)
+		}
+	case "optional":
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	case "yes":
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("%v: tls auth clients is no, optional or yes", ErrInvalidParam)
+	}
+	if o.CertUser && o.CAFile == "" {
+		return nil, fmt.Errorf("%v: certificate users need a tls ca", ErrInvalidParam)
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", o.CAFile)
+		}
+	}
+	return conf, nil
+}
+
+// ListenTLS binds the TLS listener, which Run serves next to the plain one
+func (s *Server) ListenTLS(addr string, opts TLSOptions) error {
+	conf, err := opts.config()
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", addr, conf)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig, s.tlsListener, s.certUser = conf, l, opts.CertUser
+	return nil
+}
+
+// TLSAddr is the address of the TLS listener, nil if there is none
+func (s *Server) TLSAddr() net.Addr {
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+// tlsHandshake runs the handshake of a TLS connection and returns the user
+// its certificate names, nil if none
+func (s *Server) tlsHandshake(c *tls.Conn) (*aclUser, error) {
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return s.tlsUser(c.ConnectionState()), nil
+}
+
+// tlsUser maps the verified client certificate on an ACL user
+func (s *Server) tlsUser(state tls.ConnectionState) *aclUser {
+	if !s.certUser || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	name := state.VerifiedChains[0][0].Subject.CommonName
+	u := s.acl.certUser(name)
+	if u == nil {
+		log.Warningf("client certificate of %q names no enabled user", name)
+	}
+	return u
+}
+
+// RunHTTPS serves the HTTP API with the certificate and client rules of
+// the TLS listener
+func (s *Server) RunHTTPS(addr string) {
+	if s.tlsConfig == nil {
+		log.Fatal(ErrNoTLS)
+	}
+	srv := &http.Server{Addr: addr, Handler: s.HTTPHandler(), TLSConfig: s.tlsConfig.Clone()}
+	if !s.addHTTPServer(srv) {
+		return
+	}
+	log.Info("https listening on", addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
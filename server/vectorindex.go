@@ -0,0 +1,641 @@
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"jj/resp"
+)
+
+const (
+	MetricCosine = "cosine"
+	MetricDot    = "dot"
+	MetricL2     = "l2"
+
+	defaultHnswM              = 16
+	defaultHnswEfConstruction = 200
+	defaultHnswEfSearch       = 50
+)
+
+var ErrDimensionMismatch = errors.New("vector dimension mismatch")
+
+// distance functions return smaller values for closer vectors
+var vectorDistances = map[string]func(a, b []float32) float64{
+	MetricCosine: func(a, b []float32) float64 {
+		var dot, na, nb float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+			na += float64(a[i]) * float64(a[i])
+			nb += float64(b[i]) * float64(b[i])
+		}
+		if na == 0 || nb == 0 {
+			return 1
+		}
+		return 1 - dot/math.Sqrt(na*nb)
+	},
+	MetricDot: func(a, b []float32) float64 {
+		var dot float64
+		for i := range a {
+			dot += float64(a[i]) * float64(b[i])
+		}
+		return -dot
+	},
+	MetricL2: func(a, b []float32) float64 {
+		var sum float64
+		for i := range a {
+			d := float64(a[i]) - float64(b[i])
+			sum += d * d
+		}
+		return sum
+	},
+}
+
+// vectorScore turns a distance back into the value users expect: the
+// cosine similarity, the dot product or the euclidean distance
+func vectorScore(metric string, dist float64) float64 {
+	switch metric {
+	case MetricCosine:
+		return 1 - dist
+	case MetricDot:
+		return -dist
+	}
+	return math.Sqrt(dist)
+}
+
+type vectorResult struct {
+	key  string
+	dist float64
+}
+
+type vectorResults []vectorResult
+
+func (s vectorResults) Len() int { return len(s) }
+func (s vectorResults) Less(i, j int) bool {
+	return s[i].dist < s[j].dist || (s[i].dist == s[j].dist && s[i].key < s[j].key)
+}
+func (s vectorResults) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// vectorIndex keeps the fixed size number arrays found at path. Queries
+// compare against every vector, unless the index was created with HNSW.
+type vectorIndex struct {
+	name   string
+	prefix string
+	path   string
+	dim    int
+	metric string
+	dist   func(a, b []float32) float64
+
+	lock    sync.RWMutex
+	vectors map[string][]float32
+	hnsw    *hnswGraph
+	// keys changed while a new graph is built in the background, nil if
+	// none is
+	rebuildChanged map[string]bool
+}
+
+func newVectorIndex(name string, prefix string, path string, dim int, metric string) (*vectorIndex, error) {
+	dist, ok := vectorDistances[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %s", metric)
+	}
+	if dim <= 0 {
+		return nil, ErrInvalidParam
+	}
+	return &vectorIndex{
+		name:    name,
+		prefix:  prefix,
+		path:    path,
+		dim:     dim,
+		metric:  metric,
+		dist:    dist,
+		vectors: make(map[string][]float32),
+	}, nil
+}
+
+// args: <path> <dim> <cosine|dot|l2> [HNSW [M m] [EF_CONSTRUCTION n] [EF_SEARCH n]]
+func newVectorIndexFromArgs(name string, prefix string, args [][]byte) (index, error) {
+	if len(args) < 3 {
+		return nil, errors.New("usage: jindex create <name> vector <prefix> <path> <dim> <cosine|dot|l2> [HNSW [M m] [EF_CONSTRUCTION n] [EF_SEARCH n]]")
+	}
+	dim, err := resp.Btoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+	idx, err := newVectorIndex(name, prefix, string(args[0]), dim, strings.ToLower(string(args[2])))
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 3 {
+		return idx, nil
+	}
+
+	if strings.ToLower(string(args[3])) != "hnsw" {
+		return nil, ErrInvalidParam
+	}
+	m, efc, efs := defaultHnswM, defaultHnswEfConstruction, defaultHnswEfSearch
+	for i := 4; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrInvalidParam
+		}
+		n, err := resp.Btoi(args[i+1])
+		if err != nil || n <= 0 {
+			return nil, ErrInvalidParam
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "m":
+			m = n
+		case "ef_construction":
+			efc = n
+		case "ef_search":
+			efs = n
+		default:
+			return nil, ErrInvalidParam
+		}
+	}
+	if m < 2 {
+		return nil, ErrInvalidParam
+	}
+	idx.hnsw = newHnswGraph(m, efc, efs, idx.dist)
+	return idx, nil
+}
+
+func (idx *vectorIndex) Name() string {
+	return idx.name
+}
+
+func (idx *vectorIndex) Prefix() string {
+	return idx.prefix
+}
+
+func (idx *vectorIndex) Info() []string {
+	info := []string{idx.name, "vector", idx.prefix + "*", idx.path, strconv.Itoa(idx.dim), idx.metric}
+	if idx.hnsw != nil {
+		info = append(info, "hnsw",
+			"m", strconv.Itoa(idx.hnsw.m),
+			"ef_construction", strconv.Itoa(idx.hnsw.efConstruction),
+			"ef_search", strconv.Itoa(idx.hnsw.efSearch))
+	}
+	return info
+}
+
+// toVector converts a decoded json array of dim numbers
+func toVector(v interface{}, dim int) ([]float32, bool) {
+	a, ok := v.([]interface{})
+	if !ok || len(a) != dim {
+		return nil, false
+	}
+	vec := make([]float32, dim)
+	for i, item := range a {
+		f, ok := toFloat(item)
+		if !ok {
+			return nil, false
+		}
+		vec[i] = float32(f)
+	}
+	return vec, true
+}
+
+func (idx *vectorIndex) update(key string, doc interface{}) {
+	var vec []float32
+	ok := false
+	if doc != nil {
+		var v interface{}
+		if err := jsonPathQuery(doc, idx.path, &v); err == nil {
+			vec, ok = toVector(v, idx.dim)
+		}
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, exists := idx.vectors[key]; exists {
+		if ok && equalVectors(old, vec) {
+			return
+		}
+		delete(idx.vectors, key)
+		if idx.hnsw != nil {
+			idx.hnsw.remove(key)
+		}
+	}
+	if ok {
+		idx.vectors[key] = vec
+		if idx.hnsw != nil {
+			idx.hnsw.insert(key, vec)
+		}
+	}
+	if idx.hnsw == nil {
+		return
+	}
+	if idx.rebuildChanged != nil {
+		idx.rebuildChanged[key] = true
+	} else if idx.hnsw.needRebuild() {
+		idx.rebuildChanged = make(map[string]bool)
+		go idx.rebuild()
+	}
+}
+
+// rebuild builds a graph without tombstones in the background, as it takes
+// long: update runs with the slot lock of a document held. The current
+// graph serves meanwhile, and the keys changed since are applied to the
+// new one before it replaces it.
+func (idx *vectorIndex) rebuild() {
+	idx.lock.RLock()
+	g := idx.hnsw
+	vectors := make(map[string][]float32, len(idx.vectors))
+	for key, vec := range idx.vectors {
+		vectors[key] = vec
+	}
+	idx.lock.RUnlock()
+
+	ng := newHnswGraph(g.m, g.efConstruction, g.efSearch, g.dist)
+	for key, vec := range vectors {
+		ng.insert(key, vec)
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	for key := range idx.rebuildChanged {
+		ng.remove(key)
+		if vec, ok := idx.vectors[key]; ok {
+			ng.insert(key, vec)
+		}
+	}
+	idx.hnsw = ng
+	idx.rebuildChanged = nil
+}
+
+func equalVectors(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Knn returns the k vectors closest to q among the keys keep accepts, all
+// of them if keep is nil. ef only applies to HNSW indexes, 0 means the
+// ef_search the index was created with.
+func (idx *vectorIndex) Knn(q []float32, k int, ef int, keep func(string) bool) ([]vectorResult, error) {
+	if len(q) != idx.dim {
+		return nil, ErrDimensionMismatch
+	}
+
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	if idx.hnsw != nil {
+		return idx.hnsw.search(q, k, ef, keep), nil
+	}
+
+	results := make(vectorResults, 0, len(idx.vectors))
+	for key, vec := range idx.vectors {
+		if keep == nil || keep(key) {
+			results = append(results, vectorResult{key, idx.dist(q, vec)})
+		}
+	}
+	sort.Sort(results)
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+type hnswNode struct {
+	key     string
+	vec     []float32
+	deleted bool
+	friends [][]int // neighbor ids per layer
+}
+
+// hnswGraph is a hierarchical navigable small world graph. Removed nodes
+// stay in the graph as tombstones to keep it connected and are skipped in
+// results; the graph is rebuilt once they make up half of it.
+type hnswGraph struct {
+	m              int
+	efConstruction int
+	efSearch       int
+	levelMult      float64
+	dist           func(a, b []float32) float64
+
+	nodes    []*hnswNode
+	ids      map[string]int
+	entry    int
+	maxLevel int
+	deleted  int
+}
+
+func newHnswGraph(m, efConstruction, efSearch int, dist func(a, b []float32) float64) *hnswGraph {
+	return &hnswGraph{
+		m:              m,
+		efConstruction: efConstruction,
+		efSearch:       efSearch,
+		levelMult:      1 / math.Log(float64(m)),
+		dist:           dist,
+		ids:            make(map[string]int),
+		entry:          -1,
+	}
+}
+
+func (g *hnswGraph) maxFriends(level int) int {
+	if level == 0 {
+		return 2 * g.m
+	}
+	return g.m
+}
+
+func (g *hnswGraph) randomLevel() int {
+	return int(math.Floor(-math.Log(1-rand.Float64()) * g.levelMult))
+}
+
+func (g *hnswGraph) needRebuild() bool {
+	return g.deleted > 64 && g.deleted*2 > len(g.nodes)
+}
+
+func (g *hnswGraph) remove(key string) {
+	if id, ok := g.ids[key]; ok {
+		g.nodes[id].deleted = true
+		delete(g.ids, key)
+		g.deleted++
+	}
+}
+
+func (g *hnswGraph) insert(key string, vec []float32) {
+	level := g.randomLevel()
+	id := len(g.nodes)
+	node := &hnswNode{
+		key:     key,
+		vec:     vec,
+		friends: make([][]int, level+1),
+	}
+	g.nodes = append(g.nodes, node)
+	g.ids[key] = id
+
+	if g.entry < 0 {
+		g.entry = id
+		g.maxLevel = level
+		return
+	}
+
+	ep := g.entry
+	for l := g.maxLevel; l > level; l-- {
+		ep = g.greedy(vec, ep, l)
+	}
+	eps := []int{ep}
+	for l := minInt(level, g.maxLevel); l >= 0; l-- {
+		candidates := g.searchLayer(vec, eps, g.efConstruction, l, nil)
+		friends := g.selectFriends(candidates, g.m)
+		node.friends[l] = friends
+		for _, f := range friends {
+			g.link(f, id, l)
+		}
+		eps = eps[:0]
+		for _, c := range candidates {
+			eps = append(eps, c.id)
+		}
+	}
+
+	if level > g.maxLevel {
+		g.entry = id
+		g.maxLevel = level
+	}
+}
+
+// link adds id to the friends of f on level l, dropping the farthest
+// friend if f has too many
+func (g *hnswGraph) link(f int, id int, l int) {
+	fn := g.nodes[f]
+	fn.friends[l] = append(fn.friends[l], id)
+	if len(fn.friends[l]) <= g.maxFriends(l) {
+		return
+	}
+	candidates := make([]hnswCandidate, 0, len(fn.friends[l]))
+	for _, x := range fn.friends[l] {
+		candidates = append(candidates, hnswCandidate{x, g.dist(fn.vec, g.nodes[x].vec)})
+	}
+	sort.Sort(hnswCandidates(candidates))
+	fn.friends[l] = g.selectFriends(candidates, g.maxFriends(l))
+}
+
+// selectFriends keeps the n closest candidates, which must be sorted
+func (g *hnswGraph) selectFriends(candidates []hnswCandidate, n int) []int {
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	ret := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		ret = append(ret, c.id)
+	}
+	return ret
+}
+
+func (g *hnswGraph) greedy(q []float32, ep int, l int) int {
+	cur := ep
+	curDist := g.dist(q, g.nodes[cur].vec)
+	for changed := true; changed; {
+		changed = false
+		for _, f := range g.nodes[cur].friends[l] {
+			if d := g.dist(q, g.nodes[f].vec); d < curDist {
+				cur, curDist = f, d
+				changed = true
+			}
+		}
+	}
+	return cur
+}
+
+// searchLayer returns up to ef nodes close to q on level l, closest first.
+// If accept is set, the nodes it refuses are only walked through, so that
+// ef accepted ones are found however many are refused.
+func (g *hnswGraph) searchLayer(q []float32, eps []int, ef int, l int, accept func(id int) bool) []hnswCandidate {
+	visited := make(map[int]bool)
+	candidates := &hnswHeap{}
+	results := &hnswHeap{max: true}
+	for _, ep := range eps {
+		visited[ep] = true
+		c := hnswCandidate{ep, g.dist(q, g.nodes[ep].vec)}
+		heap.Push(candidates, c)
+		if accept == nil || accept(ep) {
+			heap.Push(results, c)
+		}
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.dist > results.items[0].dist {
+			break
+		}
+		for _, f := range g.nodes[c.id].friends[l] {
+			if visited[f] {
+				continue
+			}
+			visited[f] = true
+			d := g.dist(q, g.nodes[f].vec)
+			if results.Len() < ef || d < results.items[0].dist {
+				heap.Push(candidates, hnswCandidate{f, d})
+				if accept != nil && !accept(f) {
+					continue
+				}
+				heap.Push(results, hnswCandidate{f, d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	ret := hnswCandidates(results.items)
+	sort.Sort(ret)
+	return ret
+}
+
+// search returns the k nodes closest to q, leaving out the tombstones and
+// the keys keep refuses while searching rather than after, so that they
+// don't take the place of the others
+func (g *hnswGraph) search(q []float32, k int, ef int, keep func(string) bool) []vectorResult {
+	if g.entry < 0 {
+		return nil
+	}
+	if ef <= 0 {
+		ef = g.efSearch
+	}
+	if ef < k {
+		ef = k
+	}
+
+	ep := g.entry
+	for l := g.maxLevel; l > 0; l-- {
+		ep = g.greedy(q, ep, l)
+	}
+
+	accept := func(id int) bool {
+		n := g.nodes[id]
+		return !n.deleted && (keep == nil || keep(n.key))
+	}
+	var ret []vectorResult
+	for _, c := range g.searchLayer(q, []int{ep}, ef, 0, accept) {
+		ret = append(ret, vectorResult{g.nodes[c.id].key, c.dist})
+		if len(ret) == k {
+			break
+		}
+	}
+	return ret
+}
+
+type hnswCandidate struct {
+	id   int
+	dist float64
+}
+
+type hnswCandidates []hnswCandidate
+
+func (s hnswCandidates) Len() int           { return len(s) }
+func (s hnswCandidates) Less(i, j int) bool { return s[i].dist < s[j].dist }
+func (s hnswCandidates) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// hnswHeap is a min heap on distance, or a max heap if max is set
+type hnswHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (h *hnswHeap) Len() int { return len(h.items) }
+func (h *hnswHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h *hnswHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *hnswHeap) Push(x interface{}) { h.items = append(h.items, x.(hnswCandidate)) }
+func (h *hnswHeap) Pop() interface{} {
+	n := len(h.items)
+	x := h.items[n-1]
+	h.items = h.items[:n-1]
+	return x
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func getVectorIndex(client *session, name []byte) (*vectorIndex, error) {
+	idx, err := client.srv.indexes.get(string(name))
+	if err != nil {
+		return nil, err
+	}
+	vidx, ok := idx.(*vectorIndex)
+	if !ok {
+		return nil, ErrWrongIndexType
+	}
+	if err := client.checkIndex(vidx.path); err != nil {
+		return nil, err
+	}
+	return vidx, nil
+}
+
+// jknn <index> <k> <vector as json array> [EF n] [WITHSCORES]
+func cmdJKnn(r *resp.Resp, client *session) *resp.Resp {
+	if len(r.Multi) < 4 {
+		return RespInvalidParam
+	}
+	idx, err := getVectorIndex(client, r.Multi[1].Bulk)
+	if err != nil {
+		return RespErr(err)
+	}
+	k, err := resp.Btoi(r.Multi[2].Bulk)
+	if err != nil || k <= 0 {
+		return RespInvalidParam
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(r.Multi[3].Bulk, &v); err != nil {
+		return RespErr(err)
+	}
+	q, ok := toVector(v, idx.dim)
+	if !ok {
+		return RespErr(ErrDimensionMismatch)
+	}
+
+	ef := 0
+	withScores := false
+	for i := 4; i < len(r.Multi); i++ {
+		switch strings.ToLower(string(r.Multi[i].Bulk)) {
+		case "withscores":
+			withScores = true
+		case "ef":
+			if i+1 >= len(r.Multi) {
+				return RespInvalidParam
+			}
+			if ef, err = resp.Btoi(r.Multi[i+1].Bulk); err != nil || ef <= 0 {
+				return RespInvalidParam
+			}
+			i++
+		default:
+			return RespInvalidParam
+		}
+	}
+
+	results, err := idx.Knn(q, k, ef, client.srv.acl.keyFilter(client.user))
+	if err != nil {
+		return RespErr(err)
+	}
+	entries := make([]scoredKey, 0, len(results))
+	for _, res := range results {
+		entries = append(entries, scoredKey{res.key, vectorScore(idx.metric, res.dist)})
+	}
+	return scoredKeysResp(entries, withScores)
+}
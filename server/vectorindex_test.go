@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func randomVectorDoc(dim int) map[string]interface{} {
+	v := make([]interface{}, dim)
+	for i := range v {
+		v[i] = rand.Float64()*2 - 1
+	}
+	return map[string]interface{}{"embedding": v}
+}
+
+func TestVectorIndexBruteForce(t *testing.T) {
+	db := NewMapDb()
+	indexes := newIndexManager()
+	db.Observe(indexes.onMutation)
+
+	db.PutDoc("p:x", map[string]interface{}{"embedding": []interface{}{1.0, 0.0}})
+	db.PutDoc("p:y", map[string]interface{}{"embedding": []interface{}{0.0, 1.0}})
+	db.PutDoc("p:xy", map[string]interface{}{"embedding": []interface{}{1.0, 1.0}})
+	db.PutDoc("p:bad", map[string]interface{}{"embedding": []interface{}{1.0, 1.0, 1.0}})
+
+	for _, metric := range []string{MetricCosine, MetricDot, MetricL2} {
+		idx, err := newVectorIndex("v"+metric, "p:", "embedding", 2, metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes.create(db, idx)
+		res, err := idx.Knn([]float32{1, 0.1}, 3, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 3 {
+			t.Fatal(metric, res)
+		}
+		// dot product prefers the longer vector
+		want := "p:x"
+		if metric == MetricDot {
+			want = "p:xy"
+		}
+		if res[0].key != want {
+			t.Error(metric, res)
+		}
+	}
+}
+
+func TestVectorIndexHnsw(t *testing.T) {
+	const dim = 16
+	db := NewMapDb()
+	indexes := newIndexManager()
+	db.Observe(indexes.onMutation)
+
+	for i := 0; i < 1000; i++ {
+		db.PutDoc(fmt.Sprintf("p:%d", i), randomVectorDoc(dim))
+	}
+
+	brute, _ := newVectorIndex("brute", "p:", "embedding", dim, MetricL2)
+	indexes.create(db, brute)
+	hidx, err := newVectorIndexFromArgs("hnsw", "p:", [][]byte{
+		[]byte("embedding"), []byte("16"), []byte("l2"), []byte("HNSW"), []byte("M"), []byte("8"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexes.create(db, hidx)
+
+	// replace half of the vectors so the graph has tombstones
+	for i := 0; i < 500; i++ {
+		db.PutDoc(fmt.Sprintf("p:%d", i), randomVectorDoc(dim))
+	}
+
+	hits, total := 0, 0
+	for n := 0; n < 20; n++ {
+		q, _ := toVector(randomVectorDoc(dim)["embedding"], dim)
+		want, _ := brute.Knn(q, 10, 0, nil)
+		got, _ := hidx.(*vectorIndex).Knn(q, 10, 100, nil)
+		found := make(map[string]bool)
+		for _, r := range got {
+			found[r.key] = true
+		}
+		for _, r := range want {
+			if found[r.key] {
+				hits++
+			}
+			total++
+		}
+	}
+	if recall := float64(hits) / float64(total); recall < 0.9 {
+		t.Error("recall", recall)
+	}
+}
+
+func TestVectorIndexHnswRebuild(t *testing.T) {
+	const dim = 4
+	db := NewMapDb()
+	indexes := newIndexManager()
+	db.Observe(indexes.onMutation)
+	hidx, _ := newVectorIndexFromArgs("hnsw", "p:", [][]byte{
+		[]byte("embedding"), []byte("4"), []byte("l2"), []byte("HNSW"),
+	})
+	indexes.create(db, hidx)
+	idx := hidx.(*vectorIndex)
+
+	for i := 0; i < 200; i++ {
+		db.PutDoc(fmt.Sprintf("p:%d", i), randomVectorDoc(dim))
+	}
+	// replacing the vectors twice leaves more tombstones than live nodes
+	for i := 0; i < 400; i++ {
+		db.PutDoc(fmt.Sprintf("p:%d", i%200), randomVectorDoc(dim))
+	}
+	db.RemoveDoc("p:199")
+	waitFor(t, "rebuild", func() bool {
+		idx.lock.RLock()
+		defer idx.lock.RUnlock()
+		return idx.rebuildChanged == nil && idx.hnsw.deleted < 64
+	})
+
+	idx.lock.RLock()
+	live := len(idx.hnsw.ids)
+	idx.lock.RUnlock()
+	if live != 199 {
+		t.Error("live nodes", live)
+	}
+	q, _ := toVector(randomVectorDoc(dim)["embedding"], dim)
+	res, _ := idx.Knn(q, 5, 0, nil)
+	if len(res) != 5 {
+		t.Error("results", res)
+	}
+
+	// the keys a user may not access don't count toward k
+	tens := func(key string) bool { return strings.HasSuffix(key, "0") }
+	res, _ = idx.Knn(q, 5, 0, tens)
+	if len(res) != 5 {
+		t.Error("filtered results", res)
+	}
+	for _, r := range res {
+		if !tens(r.key) {
+			t.Error("refused key", r.key)
+		}
+	}
+}
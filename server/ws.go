@@ -0,0 +1,403 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/ngaut/logging"
+)
+
+const (
+	wsQueueSize    = 1 << 16 // events queued for a client before it is dropped
+	wsWriteTimeout = 10 * time.Second
+	wsPingPeriod   = 30 * time.Second
+)
+
+// checkOrigin lets browsers open /ws only from the pages of the server
+// itself or of ws-origins, as they send the credentials of their user with
+// the request of any page. Clients sending no Origin are not browsers.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range strings.Fields(s.wsOrigins) {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsRequest is a message from the client:
+//
+//	{"op": "subscribe", "key": "user:1", "path": "/stats"}
+//	{"op": "subscribe", "prefix": "user:"}
+//	{"op": "unsubscribe", "id": 1}
+type wsRequest struct {
+	Op     string  `json:"op"`
+	ID     int64   `json:"id"`
+	Key    *string `json:"key"`
+	Prefix *string `json:"prefix"`
+	Path   string  `json:"path"`
+}
+
+// wsSub is a subscription to a key or to every key with a prefix, narrowed
+// to the value at a JSON pointer
+type wsSub struct {
+	id       int64
+	conn     *wsConn
+	key      string
+	isPrefix bool
+	path     []string
+	active   int32
+}
+
+func (sub *wsSub) match(key string) bool {
+	if sub.isPrefix && !strings.HasPrefix(key, sub.key) || !sub.isPrefix && key != sub.key {
+		return false
+	}
+	// the rights of the user may have changed since it subscribed
+	return sub.conn.acl.canAccess(sub.conn.user, key)
+}
+
+// event copies the value sub watches in doc, without the paths hidden from
+// the user. It must run under the slot lock of key.
+func (sub *wsSub) event(key string, doc interface{}, initial bool) wsEvent {
+	e := wsEvent{sub: sub, key: key, initial: initial}
+	if f := sub.conn.acl.pathFilter(sub.conn.user); f != nil && doc != nil {
+		doc = f.Filter(doc)
+	}
+	if doc != nil {
+		if v, err := pointerGet(doc, sub.path); err == nil {
+			e.val, e.found = deepCopy(v), true
+		}
+	}
+	return e
+}
+
+// wsEvent is either a new value for a key of a subscription, or a reply
+type wsEvent struct {
+	sub     *wsSub
+	key     string
+	val     interface{}
+	found   bool
+	initial bool
+	reply   map[string]interface{}
+}
+
+// docWatch sends document changes to the WebSocket subscribers
+type docWatch struct {
+	lock  sync.RWMutex
+	subs  map[*wsSub]bool
+	conns map[*wsConn]bool
+}
+
+func newDocWatch() *docWatch {
+	return &docWatch{subs: make(map[*wsSub]bool), conns: make(map[*wsConn]bool)}
+}
+
+func (dw *docWatch) addConn(c *wsConn) {
+	dw.lock.Lock()
+	dw.conns[c] = true
+	dw.lock.Unlock()
+}
+
+func (dw *docWatch) removeConn(c *wsConn) {
+	dw.lock.Lock()
+	delete(dw.conns, c)
+	dw.lock.Unlock()
+}
+
+// closeConns closes the WebSocket connections on shutdown, the HTTP server
+// no longer knows them once upgraded
+func (dw *docWatch) closeConns() {
+	dw.lock.RLock()
+	conns := make([]*wsConn, 0, len(dw.conns))
+	for c := range dw.conns {
+		conns = append(conns, c)
+	}
+	dw.lock.RUnlock()
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+func (dw *docWatch) add(sub *wsSub) {
+	dw.lock.Lock()
+	dw.subs[sub] = true
+	dw.lock.Unlock()
+}
+
+func (dw *docWatch) remove(sub *wsSub) {
+	atomic.StoreInt32(&sub.active, 0)
+	dw.lock.Lock()
+	delete(dw.subs, sub)
+	dw.lock.Unlock()
+}
+
+// onMutation queues the new value for every matching subscription, the
+// patches are computed by the writer of each connection
+func (dw *docWatch) onMutation(key string, path string, op string, doc interface{}) {
+	dw.lock.RLock()
+	defer dw.lock.RUnlock()
+	for sub := range dw.subs {
+		if sub.match(key) {
+			sub.conn.enqueue(sub.event(key, doc, false))
+		}
+	}
+}
+
+// wsConn is one WebSocket client. Events are queued by the mutations and
+// written by one goroutine, which keeps the last value sent for each key to
+// send patches against it.
+type wsConn struct {
+	ws        *websocket.Conn
+	acl       *acl
+	user      *aclUser
+	lock      sync.Mutex
+	queue     []wsEvent
+	ready     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.ws.Close()
+	})
+}
+
+func (c *wsConn) enqueue(e wsEvent) {
+	c.lock.Lock()
+	if len(c.queue) >= wsQueueSize {
+		c.lock.Unlock()
+		log.Warningf("websocket queue of %v is full, closing connection", c.ws.RemoteAddr())
+		c.close()
+		return
+	}
+	c.queue = append(c.queue, e)
+	c.lock.Unlock()
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) reply(msg map[string]interface{}) {
+	c.enqueue(wsEvent{reply: msg})
+}
+
+func (c *wsConn) write(msg map[string]interface{}) error {
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.ws.WriteJSON(msg)
+}
+
+// writeLoop turns the events into messages:
+//
+//	{"type": "value", "id": 1, "key": "user:1", "value": {...}}
+//	{"type": "patch", "id": 1, "key": "user:1", "patch": [...]}
+//	{"type": "removed", "id": 1, "key": "user:1"}
+//
+// A key gets its value first, then patches against the previous value.
+func (c *wsConn) writeLoop() {
+	defer c.close()
+	sent := make(map[*wsSub]map[string]interface{})
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.ready:
+		case <-ping.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+			continue
+		case <-c.closed:
+			return
+		}
+		c.lock.Lock()
+		events := c.queue
+		c.queue = nil
+		c.lock.Unlock()
+
+		for _, e := range events {
+			msg := e.reply
+			if msg == nil {
+				msg = c.change(sent, e)
+			}
+			if msg == nil {
+				continue
+			}
+			if err := c.write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// change returns the message for an event, nil if the client is up to date
+func (c *wsConn) change(sent map[*wsSub]map[string]interface{}, e wsEvent) map[string]interface{} {
+	if atomic.LoadInt32(&e.sub.active) == 0 {
+		delete(sent, e.sub)
+		return nil
+	}
+	vals := sent[e.sub]
+	if vals == nil {
+		vals = make(map[string]interface{})
+		sent[e.sub] = vals
+	}
+	prev, had := vals[e.key]
+	msg := map[string]interface{}{"id": e.sub.id, "key": e.key}
+	switch {
+	case !e.found && e.initial:
+		// a missing key is told once, unless it was created meanwhile
+		if had {
+			return nil
+		}
+		msg["type"] = "removed"
+		return msg
+	case !e.found:
+		if !had {
+			return nil
+		}
+		delete(vals, e.key)
+		msg["type"] = "removed"
+		return msg
+	case !had:
+		msg["type"] = "value"
+		msg["value"] = e.val
+	case e.initial && jsonEqual(prev, e.val):
+		return nil
+	default:
+		patch := jsonDiff(prev, e.val)
+		if len(patch) == 0 {
+			return nil
+		}
+		msg["type"] = "patch"
+		msg["patch"] = patch
+	}
+	vals[e.key] = e.val
+	return msg
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	user, err := s.httpUser(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{
+		ws:     ws,
+		acl:    s.acl,
+		user:   user,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	s.docWatch.addConn(c)
+	go c.writeLoop()
+
+	subs := make(map[int64]*wsSub)
+	defer func() {
+		for _, sub := range subs {
+			s.docWatch.remove(sub)
+		}
+		s.docWatch.removeConn(c)
+		c.close()
+	}()
+
+	var nextID int64
+	for {
+		_, b, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req wsRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			c.reply(map[string]interface{}{"type": "error", "error": err.Error()})
+			continue
+		}
+		switch req.Op {
+		case "subscribe":
+			nextID++
+			sub, err := s.wsSubscribe(c, &req, nextID)
+			if err != nil {
+				c.reply(map[string]interface{}{"type": "error", "error": err.Error()})
+				continue
+			}
+			subs[sub.id] = sub
+		case "unsubscribe":
+			sub, ok := subs[req.ID]
+			if !ok {
+				c.reply(map[string]interface{}{"type": "error", "error": fmt.Sprintf("no subscription %d", req.ID)})
+				continue
+			}
+			s.docWatch.remove(sub)
+			delete(subs, req.ID)
+			c.reply(map[string]interface{}{"type": "unsubscribed", "id": req.ID})
+		default:
+			c.reply(map[string]interface{}{"type": "error", "error": fmt.Sprintf("unknown op %q", req.Op)})
+		}
+	}
+}
+
+// wsSubscribe registers the subscription, then queues the current values.
+// Both go through the slot locks, so a change is never missed: at worst a
+// value is queued twice and the second is dropped by the writer. A prefix
+// only covers the keys the user may read.
+func (s *Server) wsSubscribe(c *wsConn, req *wsRequest, id int64) (*wsSub, error) {
+	if (req.Key == nil) == (req.Prefix == nil) {
+		return nil, fmt.Errorf("%v: subscribe to a key or a prefix", ErrInvalidParam)
+	}
+	path, err := parsePointer(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	sub := &wsSub{id: id, conn: c, path: path, active: 1}
+	if req.Key != nil {
+		sub.key = *req.Key
+		if err := s.checkKey(c.user, sub.key, false); err != nil {
+			return nil, err
+		}
+	} else {
+		sub.key, sub.isPrefix = *req.Prefix, true
+		if err := s.acl.checkKey(c.user, "jdocget", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	c.reply(map[string]interface{}{"type": "subscribed", "id": id, "key": sub.key, "prefix": sub.isPrefix, "path": req.Path})
+	s.docWatch.add(sub)
+	if !sub.isPrefix {
+		s.db.Read(sub.key, func(doc interface{}) {
+			c.enqueue(sub.event(sub.key, doc, true))
+		})
+		return sub, nil
+	}
+	s.db.Walk(sub.key, func(key string, doc interface{}) {
+		if sub.match(key) {
+			c.enqueue(sub.event(key, doc, true))
+		}
+	})
+	return sub, nil
+}
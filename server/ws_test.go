@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func (c *wsClient) send(msg string) {
+	if err := c.ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *wsClient) read() map[string]interface{} {
+	c.ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msg map[string]interface{}
+	if err := c.ws.ReadJSON(&msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+func (c *wsClient) expect(typ string, key string) map[string]interface{} {
+	msg := c.read()
+	if msg["type"] != typ || (key != "" && msg["key"] != key) {
+		c.t.Fatalf("expected %s of %s, got %v", typ, key, msg)
+	}
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	s := NewServer("")
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	c := &wsClient{t: t, ws: ws}
+	tc := newTestClient(t, s)
+	defer tc.close()
+
+	tc.do("jdocset", "user:1", `{"name": "ann", "tags": ["a"], "stats": {"n": 1}}`)
+	c.send(`{"op": "subscribe", "key": "user:1"}`)
+	if msg := c.expect("subscribed", "user:1"); msg["id"] != 1.0 {
+		t.Error(msg)
+	}
+	val := c.expect("value", "user:1")["value"]
+
+	// the patches rebuild the document
+	tc.do("jset", "user:1", "name", `"bob"`)
+	tc.do("jpush", "user:1", "tags", `"b"`)
+	tc.do("jincr", "user:1", "stats.n", "2")
+	for i := 0; i < 3; i++ {
+		patch, _ := json.Marshal(c.expect("patch", "user:1")["patch"])
+		if val, err = applyJSONPatch(val, patch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	doc, _ := s.db.GetDoc("user:1")
+	if !jsonEqual(val, doc) {
+		t.Error(val, doc)
+	}
+
+	// a prefix narrowed to a path, and a missing key
+	c.send(`{"op": "subscribe", "prefix": "user:", "path": "/stats"}`)
+	c.expect("subscribed", "user:")
+	if msg := c.expect("value", "user:1"); msg["id"] != 2.0 || !jsonEqual(msg["value"], mustJSON(`{"n": 3}`)) {
+		t.Error(msg)
+	}
+	c.send(`{"op": "subscribe", "key": "user:2"}`)
+	c.expect("subscribed", "user:2")
+	c.expect("removed", "user:2")
+
+	tc.do("jdocset", "user:2", `{"stats": {"n": 0}}`)
+	got := map[float64]string{}
+	for i := 0; i < 2; i++ {
+		msg := c.expect("value", "user:2")
+		got[msg["id"].(float64)] = msg["type"].(string)
+	}
+	if len(got) != 2 || got[2] == "" || got[3] == "" {
+		t.Error(got)
+	}
+	// a change outside the path is not sent to the prefix subscription
+	tc.do("jset", "user:2", "name", `"cy"`)
+	if msg := c.expect("patch", "user:2"); msg["id"] != 3.0 {
+		t.Error(msg)
+	}
+
+	c.send(`{"op": "unsubscribe", "id": 1}`)
+	c.expect("unsubscribed", "")
+	tc.do("jdocdel", "user:1")
+	if msg := c.expect("removed", "user:1"); msg["id"] != 2.0 {
+		t.Error(msg)
+	}
+
+	c.send(`{"op": "subscribe", "key": "x", "prefix": "y"}`)
+	c.expect("error", "")
+	c.send(`{"op": "subscribe", "key": "x", "path": "y"}`)
+	c.expect("error", "")
+	c.send(`not json`)
+	c.expect("error", "")
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	s := NewServer("")
+	s.SetConfig("ws-origins", "https://dash.example.com")
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	for origin, ok := range map[string]bool{
+		"":                         true,
+		ts.URL:                     true,
+		"https://dash.example.com": true,
+		"https://evil.example.com": false,
+	} {
+		h := http.Header{}
+		if origin != "" {
+			h.Set("Origin", origin)
+		}
+		ws, _, err := websocket.DefaultDialer.Dial(url, h)
+		if (err == nil) != ok {
+			t.Error(origin, err)
+		}
+		if ws != nil {
+			ws.Close()
+		}
+	}
+}
+
+func TestWebSocketACL(t *testing.T) {
+	s := NewServer("")
+	s.acl.setUser("reader", []string{"on", ">pw", "~a:*", "+@read"})
+	ts := httptest.NewServer(s.HTTPHandler())
+	defer ts.Close()
+	header := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("reader:pw"))}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	c := &wsClient{t: t, ws: ws}
+	tc := newTestClient(t, s)
+	defer tc.close()
+
+	tc.do("jdocset", "a:1", `{"n": 1}`)
+	c.send(`{"op": "subscribe", "key": "a:1"}`)
+	c.expect("subscribed", "a:1")
+	c.expect("value", "a:1")
+
+	// revoking the key stops the updates of the subscription
+	tc.do("acl", "setuser", "reader", "resetkeys", "~b:*")
+	tc.do("jset", "a:1", "n", "2")
+	c.send(`{"op": "subscribe", "key": "b:1"}`)
+	c.expect("subscribed", "b:1")
+}
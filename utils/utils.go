@@ -0,0 +1,86 @@
+package utils
+
+// GlobMatch reports whether s matches the redis style glob pattern, which
+// supports *, ?, [abc], [^abc], [a-z] and \ to escape. On a mismatch the
+// last star takes one more byte of s, earlier ones never have to, so a
+// pattern full of stars costs len(pattern)*len(s) at worst.
+func GlobMatch(pattern string, s string) bool {
+	p, i := 0, 0
+	star, starS := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starS = p, i
+				p++
+				continue
+			case '?':
+				p, i = p+1, i+1
+				continue
+			case '[':
+				if end, ok := matchClass(pattern[p:], s[i]); ok {
+					p, i = p+end, i+1
+					continue
+				}
+			case '\\':
+				c := p
+				if c+1 < len(pattern) {
+					c++
+				}
+				if pattern[c] == s[i] {
+					p, i = c+1, i+1
+					continue
+				}
+			default:
+				if pattern[p] == s[i] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		starS++
+		p, i = star+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the class at the start of pattern and
+// returns the length of the class
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	not := false
+	if i < len(pattern) && pattern[i] == '^' {
+		not = true
+		i++
+	}
+	match := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+			if pattern[i] == c {
+				match = true
+			}
+		} else if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				match = true
+			}
+			i += 2
+		} else if pattern[i] == c {
+			match = true
+		}
+	}
+	if i < len(pattern) {
+		i++ // skip ]
+	}
+	return i, match != not
+}
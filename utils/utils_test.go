@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "post:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"__keyspace__:*:x", "__keyspace__:a:b:x", true},
+		{"*a*b", "xaxbxab", true},
+		{"*a*b", "xaxbxa", false},
+		{"a*", "", false},
+		{"[ab]*", "", false},
+		{"*\\", "x\\", true},
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 60), false},
+	}
+	for _, c := range cases {
+		if GlobMatch(c.pattern, c.s) != c.match {
+			t.Error(c.pattern, c.s, !c.match)
+		}
+	}
+}